@@ -26,19 +26,66 @@ type AllocFileInfo struct {
 	FileMode    string
 	ModTime     time.Time
 	ContentType string
+	UID         *int `json:",omitempty"`
+	GID         *int `json:",omitempty"`
 }
 
 // StreamFrame is used to frame data of a file when streaming
 type StreamFrame struct {
-	Offset    int64  `json:",omitempty"`
-	Data      []byte `json:",omitempty"`
-	File      string `json:",omitempty"`
-	FileEvent string `json:",omitempty"`
+	Offset       int64               `json:",omitempty"`
+	Data         []byte              `json:",omitempty"`
+	File         string              `json:",omitempty"`
+	FileEvent    string              `json:",omitempty"`
+	TotalBytes   int64               `json:",omitempty"`
+	ResumeToken  string              `json:",omitempty"`
+	DroppedLines int64               `json:",omitempty"`
+	Path         string              `json:",omitempty"`
+	Level        string              `json:",omitempty"`
+	Seq          int64               `json:",omitempty"`
+	Checksum     string              `json:",omitempty"`
+	ExitInfo     *TaskExitInfo       `json:",omitempty"`
+	FirstLine    int64               `json:",omitempty"`
+	LastLine     int64               `json:",omitempty"`
+	Compressed   bool                `json:",omitempty"`
+	LogStat      *LogFileStat        `json:",omitempty"`
+	Manifest     []*LogManifestEntry `json:",omitempty"`
+}
+
+// TaskExitInfo is the exit status of a stopped task, sent in the final frame
+// of a log stream requested with the exit info.
+type TaskExitInfo struct {
+	ExitCode   int
+	Signal     int
+	OOMKilled  bool
+	FinishedAt time.Time
+}
+
+// LogFileStat is a snapshot of the newest file of a followed log, sent
+// periodically in log streams that request it.
+type LogFileStat struct {
+	File  string
+	Index int64
+	Size  int64
+}
+
+// LogManifestEntry describes a log file streamed by a logs stream that is not
+// followed, and the range of the stream's combined data read from it, sent in
+// the initial frame of log streams that request a manifest.
+type LogManifestEntry struct {
+	File       string
+	Index      int64
+	Size       int64
+	FileOffset int64
+	Start      int64
+	End        int64
 }
 
 // IsHeartbeat returns if the frame is a heartbeat frame
 func (s *StreamFrame) IsHeartbeat() bool {
-	return len(s.Data) == 0 && s.FileEvent == "" && s.File == "" && s.Offset == 0
+	return len(s.Data) == 0 && s.FileEvent == "" && s.File == "" && s.Offset == 0 &&
+		s.TotalBytes == 0 && s.ResumeToken == "" && s.DroppedLines == 0 && s.Path == "" &&
+		s.Level == "" && s.Seq == 0 && s.Checksum == "" && s.ExitInfo == nil && s.FirstLine == 0 && s.LastLine == 0 && !s.Compressed &&
+		s.LogStat == nil && len(s.Manifest) == 0
 }
 
 // AllocFS is used to introspect an allocation directory on a Nomad client
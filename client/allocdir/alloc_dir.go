@@ -100,6 +100,10 @@ type AllocDir struct {
 type AllocDirFS interface {
 	List(path string) ([]*cstructs.AllocFileInfo, error)
 	Stat(path string) (*cstructs.AllocFileInfo, error)
+	QuickStat(path string) (*cstructs.AllocFileInfo, error)
+	Exists(path string) (bool, bool, error)
+	Walk(path string, fn filepath.WalkFunc) error
+	CanonicalPath(path string) (string, error)
 	ReadAt(path string, offset int64) (io.ReadCloser, error)
 	Snapshot(w io.Writer) error
 	BlockUntilExists(ctx context.Context, path string) (chan error, error)
@@ -363,19 +367,39 @@ func (d *AllocDir) List(path string) ([]*cstructs.AllocFileInfo, error) {
 	}
 	files := make([]*cstructs.AllocFileInfo, len(finfos))
 	for idx, info := range finfos {
-		files[idx] = &cstructs.AllocFileInfo{
-			Name:     info.Name(),
-			IsDir:    info.IsDir(),
-			Size:     info.Size(),
-			FileMode: info.Mode().String(),
-			ModTime:  info.ModTime(),
-		}
+		files[idx] = NewAllocFileInfo(info.Name(), info)
 	}
 	return files, err
 }
 
+// NewAllocFileInfo returns the listing entry with the passed name for the file
+// info.
+func NewAllocFileInfo(name string, info os.FileInfo) *cstructs.AllocFileInfo {
+	file := &cstructs.AllocFileInfo{
+		Name:     name,
+		IsDir:    info.IsDir(),
+		Size:     info.Size(),
+		FileMode: info.Mode().String(),
+		ModTime:  info.ModTime(),
+	}
+	setFileOwner(file, info)
+	return file
+}
+
 // Stat returns information about the file at a path relative to the alloc dir
 func (d *AllocDir) Stat(path string) (*cstructs.AllocFileInfo, error) {
+	return d.stat(path, true)
+}
+
+// QuickStat returns the same information as Stat except for the content type,
+// so the contents of the file are not read.
+func (d *AllocDir) QuickStat(path string) (*cstructs.AllocFileInfo, error) {
+	return d.stat(path, false)
+}
+
+// stat returns information about the file at a path relative to the alloc
+// dir, detecting its content type if requested.
+func (d *AllocDir) stat(path string, detectContent bool) (*cstructs.AllocFileInfo, error) {
 	if escapes, err := structs.PathEscapesAllocDir("", path); err != nil {
 		return nil, fmt.Errorf("Failed to check if path escapes alloc directory: %v", err)
 	} else if escapes {
@@ -388,16 +412,112 @@ func (d *AllocDir) Stat(path string) (*cstructs.AllocFileInfo, error) {
 		return nil, err
 	}
 
-	contentType := detectContentType(info, p)
+	var contentType string
+	if detectContent {
+		contentType = detectContentType(info, p)
+	}
 
-	return &cstructs.AllocFileInfo{
+	file := &cstructs.AllocFileInfo{
 		Size:        info.Size(),
 		Name:        info.Name(),
 		IsDir:       info.IsDir(),
 		FileMode:    info.Mode().String(),
 		ModTime:     info.ModTime(),
 		ContentType: contentType,
-	}, nil
+	}
+	setFileOwner(file, info)
+	setFileIdentity(file, info)
+	return file, nil
+}
+
+// Exists returns whether the path relative to the alloc dir exists and whether
+// it is a directory. Unlike Stat the contents of the file are not read.
+func (d *AllocDir) Exists(path string) (exists bool, isDir bool, err error) {
+	if escapes, err := structs.PathEscapesAllocDir("", path); err != nil {
+		return false, false, fmt.Errorf("Failed to check if path escapes alloc directory: %v", err)
+	} else if escapes {
+		return false, false, fmt.Errorf("Path escapes the alloc directory")
+	}
+
+	info, err := os.Stat(filepath.Join(d.AllocDir, path))
+	if os.IsNotExist(err) {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	return true, info.IsDir(), nil
+}
+
+// Walk calls fn for the path relative to the alloc dir and every file and
+// directory below it in lexical order, like filepath.Walk. The paths passed to
+// fn are relative to the alloc dir. Symlinks are not followed.
+func (d *AllocDir) Walk(path string, fn filepath.WalkFunc) error {
+	if escapes, err := structs.PathEscapesAllocDir("", path); err != nil {
+		return fmt.Errorf("Failed to check if path escapes alloc directory: %v", err)
+	} else if escapes {
+		return fmt.Errorf("Path escapes the alloc directory")
+	}
+
+	return filepath.Walk(filepath.Join(d.AllocDir, path), func(p string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(d.AllocDir, p)
+		if relErr != nil {
+			return relErr
+		}
+		return fn(rel, info, err)
+	})
+}
+
+// CanonicalPath returns the cleaned form of a path relative to the alloc dir,
+// rooted at "/", with any symlinks resolved. Symlinks pointing outside of the
+// alloc dir are not resolved so that host paths are not revealed.
+func (d *AllocDir) CanonicalPath(path string) (string, error) {
+	if escapes, err := structs.PathEscapesAllocDir("", path); err != nil {
+		return "", fmt.Errorf("Failed to check if path escapes alloc directory: %v", err)
+	} else if escapes {
+		return "", fmt.Errorf("Path escapes the alloc directory")
+	}
+
+	cleaned := filepath.ToSlash(filepath.Join("/", path))
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(d.AllocDir, path))
+	if err != nil {
+		return "", err
+	}
+
+	// The alloc dir itself may be beneath a symlink
+	root, err := filepath.EvalSymlinks(d.AllocDir)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return cleaned, nil
+	}
+	return filepath.ToSlash(filepath.Join("/", rel)), nil
+}
+
+// setFileOwner sets the owner and group of the file info where the platform
+// supports them. They are taken from the already retrieved os.FileInfo so this
+// does not require another syscall.
+func setFileOwner(file *cstructs.AllocFileInfo, info os.FileInfo) {
+	uid, gid := getOwner(info)
+	if uid == idUnsupported || gid == idUnsupported {
+		return
+	}
+	file.UID = &uid
+	file.GID = &gid
+}
+
+// setFileIdentity sets the inode and device of the file info where the
+// platform supports them.
+func setFileIdentity(file *cstructs.AllocFileInfo, info os.FileInfo) {
+	inode, device, ok := getIdentity(info)
+	if !ok {
+		return
+	}
+	file.Inode = &inode
+	file.Device = &device
 }
 
 // detectContentType tries to infer the file type by reading the first
@@ -15,6 +15,7 @@ import (
 	"syscall"
 	"testing"
 
+	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper/testlog"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/stretchr/testify/require"
@@ -314,6 +315,11 @@ func TestAllocDir_EscapeChecking(t *testing.T) {
 		t.Fatalf("Stat of escaping path didn't error: %v", err)
 	}
 
+	// QuickStat
+	if _, err := d.QuickStat("../foo"); err == nil || !strings.Contains(err.Error(), "escapes") {
+		t.Fatalf("QuickStat of escaping path didn't error: %v", err)
+	}
+
 	// ReadAt
 	if _, err := d.ReadAt("../foo", 0); err == nil || !strings.Contains(err.Error(), "escapes") {
 		t.Fatalf("ReadAt of escaping path didn't error: %v", err)
@@ -485,6 +491,136 @@ func TestAllocDir_DetectContentType(t *testing.T) {
 	}
 }
 
+func TestAllocDir_ListStat_FileInfo(t *testing.T) {
+	require := require.New(t)
+
+	tmp := t.TempDir()
+	d := NewAllocDir(testlog.HCLogger(t), tmp, "test")
+	require.NoError(d.Build())
+	defer d.Destroy()
+
+	path := filepath.Join(SharedAllocName, "file")
+	require.NoError(ioutil.WriteFile(filepath.Join(d.AllocDir, path), []byte("hello"), 0600))
+	require.NoError(os.Chmod(filepath.Join(d.AllocDir, path), 0640))
+
+	info, err := d.Stat(path)
+	require.NoError(err)
+
+	files, err := d.List(SharedAllocName)
+	require.NoError(err)
+
+	var listed *cstructs.AllocFileInfo
+	for _, file := range files {
+		if file.Name == "file" {
+			listed = file
+		}
+	}
+	require.NotNil(listed)
+
+	for _, file := range []*cstructs.AllocFileInfo{info, listed} {
+		require.Equal("-rw-r-----", file.FileMode)
+
+		if runtime.GOOS == "windows" {
+			require.Nil(file.UID)
+			require.Nil(file.GID)
+			continue
+		}
+
+		require.NotNil(file.UID)
+		require.NotNil(file.GID)
+		require.Equal(os.Getuid(), *file.UID)
+		require.Equal(os.Getgid(), *file.GID)
+	}
+
+	// QuickStat returns the same information except for the content type
+	quick, err := d.QuickStat(path)
+	require.NoError(err)
+	require.Empty(quick.ContentType)
+	quick.ContentType = info.ContentType
+	require.Equal(info, quick)
+
+	// Only Stat and QuickStat return the identity of the file
+	require.Nil(listed.Inode)
+	require.Nil(listed.Device)
+	if runtime.GOOS == "windows" {
+		require.Nil(info.Inode)
+		require.Nil(info.Device)
+		return
+	}
+	require.NotNil(info.Inode)
+	require.NotNil(info.Device)
+}
+
+func TestAllocDir_CanonicalPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on windows")
+	}
+	require := require.New(t)
+
+	tmp := t.TempDir()
+	d := NewAllocDir(testlog.HCLogger(t), tmp, "test")
+	require.NoError(d.Build())
+	defer d.Destroy()
+
+	file := filepath.Join(d.SharedDir, "file")
+	require.NoError(ioutil.WriteFile(file, []byte("hello"), 0600))
+
+	// A link within the alloc dir is resolved
+	require.NoError(os.Symlink(file, filepath.Join(d.SharedDir, "inner")))
+
+	// A link leaving the alloc dir is not
+	outside := filepath.Join(tmp, "outside")
+	require.NoError(ioutil.WriteFile(outside, []byte("hello"), 0600))
+	require.NoError(os.Symlink(outside, filepath.Join(d.SharedDir, "outer")))
+
+	cases := map[string]string{
+		"/":                  "/",
+		"":                   "/",
+		"alloc/file":         "/alloc/file",
+		"./alloc//file":      "/alloc/file",
+		"alloc/data/../file": "/alloc/file",
+		"alloc/inner":        "/alloc/file",
+		"/alloc/./outer":     "/alloc/outer",
+	}
+	for path, expected := range cases {
+		canonical, err := d.CanonicalPath(path)
+		require.NoError(err, path)
+		require.Equal(expected, canonical, path)
+	}
+
+	_, err := d.CanonicalPath("../outside")
+	require.Error(err)
+
+	_, err = d.CanonicalPath("alloc/missing")
+	require.True(os.IsNotExist(err))
+}
+
+func TestAllocDir_Walk(t *testing.T) {
+	require := require.New(t)
+
+	tmp := t.TempDir()
+	d := NewAllocDir(testlog.HCLogger(t), tmp, "test")
+	require.NoError(d.Build())
+	defer d.Destroy()
+
+	dir := filepath.Join(d.SharedDir, SharedDataDir)
+	require.NoError(os.MkdirAll(filepath.Join(dir, "a", "b"), 0700))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "a", "1"), []byte("1"), 0600))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "a", "b", "2"), []byte("22"), 0600))
+
+	var paths []string
+	err := d.Walk("alloc/data", func(path string, info os.FileInfo, err error) error {
+		require.NoError(err)
+		paths = append(paths, filepath.ToSlash(path))
+		return nil
+	})
+	require.NoError(err)
+	require.Equal([]string{"alloc/data", "alloc/data/a", "alloc/data/a/1", "alloc/data/a/b", "alloc/data/a/b/2"}, paths)
+
+	err = d.Walk("../", func(string, os.FileInfo, error) error { return nil })
+	require.Error(err)
+}
+
 // TestAllocDir_SkipAllocDir asserts that building a chroot which contains
 // itself will *not* infinitely recurse. AllocDirs should always skip embedding
 // themselves into chroots.
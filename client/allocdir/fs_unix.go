@@ -106,3 +106,11 @@ func getOwner(fi os.FileInfo) (int, int) {
 	}
 	return int(stat.Uid), int(stat.Gid)
 }
+
+func getIdentity(fi os.FileInfo) (uint64, uint64, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Ino), uint64(stat.Dev), true
+}
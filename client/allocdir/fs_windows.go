@@ -59,3 +59,9 @@ func MountSpecialDirs(taskDir string) error {
 func getOwner(os.FileInfo) (int, int) {
 	return idUnsupported, idUnsupported
 }
+
+// getIdentity doesn't work on Windows as the file index isn't available from
+// os.FileInfo
+func getIdentity(os.FileInfo) (uint64, uint64, bool) {
+	return 0, 0, false
+}
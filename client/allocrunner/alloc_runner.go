@@ -1242,6 +1242,17 @@ func (ar *allocRunner) GetTaskExecHandler(taskName string) drivermanager.TaskExe
 	return tr.TaskExecHandler()
 }
 
+// GetTaskLogsDriver returns the driver of the task if it keeps the task's logs
+// outside of the log files in the alloc dir, or nil otherwise.
+func (ar *allocRunner) GetTaskLogsDriver(taskName string) drivers.TaskLogsDriver {
+	tr, ok := ar.tasks[taskName]
+	if !ok {
+		return nil
+	}
+
+	return tr.TaskLogsDriver()
+}
+
 func (ar *allocRunner) GetTaskDriverCapabilities(taskName string) (*drivers.Capabilities, error) {
 	tr, ok := ar.tasks[taskName]
 	if !ok {
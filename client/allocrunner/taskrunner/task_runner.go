@@ -1487,6 +1487,16 @@ func (tr *TaskRunner) TaskExecHandler() drivermanager.TaskExecHandler {
 	return handle.ExecStreaming
 }
 
+// TaskLogsDriver returns the task's driver if it keeps the task's logs outside
+// of the log files in the alloc dir, or nil otherwise. Only drivers running in
+// the client's process can implement drivers.TaskLogsDriver.
+func (tr *TaskRunner) TaskLogsDriver() drivers.TaskLogsDriver {
+	if impl, ok := tr.driver.(drivers.TaskLogsDriver); ok {
+		return impl
+	}
+	return nil
+}
+
 func (tr *TaskRunner) DriverCapabilities() (*drivers.Capabilities, error) {
 	return tr.driver.Capabilities()
 }
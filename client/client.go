@@ -159,6 +159,7 @@ type AllocRunner interface {
 
 	GetTaskExecHandler(taskName string) drivermanager.TaskExecHandler
 	GetTaskDriverCapabilities(taskName string) (*drivers.Capabilities, error)
+	GetTaskLogsDriver(taskName string) drivers.TaskLogsDriver
 }
 
 // Client is used to implement the client interaction with Nomad. Clients
@@ -997,6 +998,56 @@ func (c *Client) GetAllocFS(allocID string) (allocdir.AllocDirFS, error) {
 	return ar.GetAllocDir(), nil
 }
 
+// prunedAlloc is an allocation placed on this client that it no longer tracks,
+// but whose alloc dir is still on disk.
+type prunedAlloc struct {
+	alloc    *structs.Allocation
+	allocDir *allocdir.AllocDir
+}
+
+// getPrunedAlloc returns an allocation that was placed on this client but is no
+// longer tracked by it, if its alloc dir is still on disk. The allocation is
+// looked up on the servers so it is unknown once they garbage collect it.
+func (c *Client) getPrunedAlloc(allocID string) (*prunedAlloc, error) {
+	if !helper.IsUUID(allocID) {
+		return nil, structs.NewErrUnknownAllocation(allocID)
+	}
+	if info, err := os.Stat(filepath.Join(c.config.AllocDir, allocID)); err != nil || !info.IsDir() {
+		return nil, structs.NewErrUnknownAllocation(allocID)
+	}
+
+	req := structs.AllocSpecificRequest{
+		AllocID: allocID,
+		QueryOptions: structs.QueryOptions{
+			Region:     c.Region(),
+			AllowStale: true,
+			AuthToken:  c.secretNodeID(),
+		},
+	}
+	var resp structs.SingleAllocResponse
+	if err := c.RPC("Alloc.GetAlloc", &req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Alloc == nil || resp.Alloc.NodeID != c.NodeID() {
+		return nil, structs.NewErrUnknownAllocation(allocID)
+	}
+
+	return &prunedAlloc{
+		alloc:    resp.Alloc,
+		allocDir: allocdir.NewAllocDir(c.logger, c.config.AllocDir, allocID),
+	}, nil
+}
+
+// getTaskLogsDriver returns the driver of a task of an allocation if it keeps
+// the task's logs outside of the log files in the alloc dir, or nil otherwise.
+func (c *Client) getTaskLogsDriver(allocID, task string) (drivers.TaskLogsDriver, error) {
+	ar, err := c.getAllocRunner(allocID)
+	if err != nil {
+		return nil, err
+	}
+	return ar.GetTaskLogsDriver(task), nil
+}
+
 // GetAllocState returns a copy of an allocation's state on this client. It
 // returns either an AllocState or an unknown allocation error.
 func (c *Client) GetAllocState(allocID string) (*arstate.State, error) {
@@ -210,6 +210,33 @@ type Config struct {
 	// DisableRemoteExec disables remote exec targeting tasks on this client
 	DisableRemoteExec bool
 
+	// FSSensitivePaths are glob patterns of paths within allocation
+	// directories that can only be accessed through the filesystem API by
+	// tokens that are also allowed to exec into the allocation.
+	FSSensitivePaths []string
+
+	// FSReadAheadBuffers is the number of frame sized buffers read ahead of
+	// the stream when streaming files. Zero disables reading ahead.
+	FSReadAheadBuffers int
+
+	// FSLogTailCacheBytes is the number of bytes from the end of recently
+	// streamed log files held in memory to serve streams attaching to the
+	// end of the logs. Zero disables caching.
+	FSLogTailCacheBytes int
+
+	// FSStreamCacheBytes is the total size of the copies of streamed files
+	// cached on disk for streams requesting caching. Zero disables caching.
+	FSStreamCacheBytes int
+
+	// FSStreamCacheTTL is how long a cached copy of a streamed file is
+	// served for. Zero uses a default of 10 minutes.
+	FSStreamCacheTTL time.Duration
+
+	// FSStreamACLCheckInterval is how often the token of a file or log
+	// stream is checked again while streaming, so that streams of revoked
+	// tokens are ended. Zero uses a default of 1 minute.
+	FSStreamACLCheckInterval time.Duration
+
 	// TemplateConfig includes configuration for template rendering
 	TemplateConfig *ClientTemplateConfig
 
@@ -297,6 +324,7 @@ func (c *Config) Copy() *Config {
 	*nc = *c
 	nc.Node = nc.Node.Copy()
 	nc.Servers = helper.CopySliceString(nc.Servers)
+	nc.FSSensitivePaths = helper.CopySliceString(nc.FSSensitivePaths)
 	nc.Options = helper.CopyMapStringString(nc.Options)
 	nc.HostVolumes = structs.CopyMapStringClientHostVolumeConfig(nc.HostVolumes)
 	nc.ConsulConfig = c.ConsulConfig.Copy()
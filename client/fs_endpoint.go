@@ -1,14 +1,23 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -21,18 +30,64 @@ import (
 
 	"github.com/hashicorp/nomad/acl"
 	"github.com/hashicorp/nomad/client/allocdir"
+	arstate "github.com/hashicorp/nomad/client/allocrunner/state"
 	sframer "github.com/hashicorp/nomad/client/lib/streamframer"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper"
 	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
 )
 
 var (
 	allocIDNotPresentErr = fmt.Errorf("must provide a valid alloc id")
 	pathNotPresentErr    = fmt.Errorf("must provide a file path")
 	taskNotPresentErr    = fmt.Errorf("must provide task name")
-	logTypeNotPresentErr = fmt.Errorf("must provide log type (stdout/stderr)")
+	allocLogTaskErr      = fmt.Errorf("task name cannot be provided for allocation logs")
+	logTypeNotPresentErr = fmt.Errorf("must provide log type (stdout/stderr or a type returned by LogTypes)")
 	invalidOrigin        = fmt.Errorf("origin must be start or end")
+	invalidStreamOrigin  = fmt.Errorf("origin must be start, end, current or percent")
+	invalidPercentOrigin = fmt.Errorf("percent origin requires an offset between 0 and 100")
+	invalidCurrentOrigin = fmt.Errorf("current origin cannot be combined with a resume token or checksum")
+	invalidResumeToken   = fmt.Errorf("invalid resume token")
+	invalidChangedToken  = fmt.Errorf("invalid changed token")
+	invalidEncoding      = fmt.Errorf("frame encoding must be json or msgpack")
+	invalidResumeSHA256  = fmt.Errorf("resume SHA-256 must be a hex encoded checksum of a non-negative resume length and cannot be combined with a resume token")
+	invalidSinceDuration = fmt.Errorf("since duration must be positive and cannot be combined with an offset or end origin")
+	invalidLogsTail      = fmt.Errorf("tail lines must not be negative and cannot be combined with an offset, a since duration, a max backlog or an index range")
+	invalidGrepLimits    = fmt.Errorf("max matches and context lines must not be negative")
+	invalidLineIndex     = fmt.Errorf("stride must be positive and max entries must be between 0 and %d", maxLineIndexEntries)
+	invalidReadSet       = fmt.Errorf("must provide between 1 and %d paths to read", maxReadSetFiles)
+	invalidWindowBytes   = fmt.Errorf("window bytes must be between 1 and %d and the offset must not be negative", maxPeekBytes)
+	invalidPeekBytes     = fmt.Errorf("head and tail bytes must not be negative, must not both be zero and must not exceed %d bytes in total", maxPeekBytes)
+	invalidMaxBacklog    = fmt.Errorf("max backlog must not be negative, requires the start origin and cannot be combined with a since duration or index range")
+	invalidMaxLineBytes  = fmt.Errorf("max line bytes must not be negative")
+	invalidSkipRanges    = fmt.Errorf("skip ranges must be ordered and non-overlapping, with each start not negative and before its end")
+	invalidListEntries   = fmt.Errorf("max entries must not be negative and requires a recursive listing")
+	invalidFindPattern   = fmt.Errorf("name pattern must be a valid glob or, if regex is set, regular expression")
+	invalidFindResults   = fmt.Errorf("max results must be between 0 and %d", maxFindResults)
+	invalidTailLines     = fmt.Errorf("lines must be between 1 and %d", maxTailLines)
+	invalidMaxFrames     = fmt.Errorf("max frames per second must not be negative")
+	invalidLogsMaxFrames = fmt.Errorf("max frames per second must not be negative and cannot be combined with level detection or max lines per second")
+	invalidExitInfo      = fmt.Errorf("exit info requires the logs of a task and cannot be combined with follow or plain text")
+	invalidEventMarker   = fmt.Errorf("event marker requires plain text")
+	invalidCompressMin   = fmt.Errorf("compression threshold must not be negative and cannot be combined with plain text")
+	invalidWholeLines    = fmt.Errorf("whole lines only requires follow")
+	invalidMaxFiles      = fmt.Errorf("max files spanned must not be negative")
+	invalidEmitStat      = fmt.Errorf("stat interval must not be negative and requires follow without plain text")
+	invalidManifest      = fmt.Errorf("manifest cannot be combined with follow or plain text")
+	invalidSourceEnc     = fmt.Errorf("source encoding must be the IANA name of a supported character encoding")
+	invalidMaxIdle       = fmt.Errorf("max idle must not be negative")
+	invalidSnapshot      = fmt.Errorf("snapshot cannot be combined with follow")
+	invalidExitTail      = fmt.Errorf("tail of the other log type on exit must not be negative and requires following the stdout or stderr logs of a task")
+	invalidStopOnExit    = fmt.Errorf("stop on task exit requires following the logs of a task and cannot be combined with tail of the other log type on exit")
+	invalidLevelOptions  = fmt.Errorf("level patterns require level detection or jumping to the first error and minimum level requires level detection")
+	invalidJumpToError   = fmt.Errorf("jump to first error cannot be combined with starting after a match")
+	invalidIndexRange    = fmt.Errorf("start and end index must be set together, with the start not after the end, and cannot be combined with follow, an offset, an end origin or a since duration")
+	invalidUseCache      = fmt.Errorf("use cache cannot be combined with follow or the current origin")
+	invalidChecksum      = fmt.Errorf("checksum algorithm must be md5, sha1 or sha256")
+	invalidStreamSum     = fmt.Errorf("checksum algorithm must be md5, sha1 or sha256 and cannot be combined with follow or plain text")
+	invalidLineRanges    = fmt.Errorf("line ranges cannot be combined with plain text, level detection, max lines per second, starting after a match or jumping to the first error")
+	invalidLineNumbers   = fmt.Errorf("line numbers and ranges require streaming from the start of the logs and cannot be combined with an offset, a since duration, a max backlog, tail lines, an index range, dedup or collapsing blank lines")
 )
 
 const (
@@ -57,31 +112,374 @@ const (
 	// directory listing.
 	nextLogCheckRate = 100 * time.Millisecond
 
+	// maxNextLogCheckRate is the longest interval the check for a log entry
+	// greater than the one being watched backs off to while the logs are
+	// idle. The common case is detected by watching for the next log entry.
+	maxNextLogCheckRate = 2 * time.Second
+
+	// emptyFileCheckRate is the rate at which an empty file being followed is
+	// re-read. The file watcher only detects growth of a non-empty file by its
+	// size and otherwise relies on the modification time, which may not
+	// change on filesystems with coarse timestamps.
+	emptyFileCheckRate = 250 * time.Millisecond
+
+	// rotatedLogRetryBackoff is the initial wait before listing the log files
+	// again after the log file being opened was rotated out. The wait doubles
+	// for each consecutive retry up to maxRotatedLogRetryBackoff.
+	rotatedLogRetryBackoff    = 50 * time.Millisecond
+	maxRotatedLogRetryBackoff = 1 * time.Second
+
+	// rotatedLogRetryLimit is the number of consecutive times the log file
+	// being opened may be rotated out before streaming the logs fails.
+	rotatedLogRetryLimit = 10
+
+	// allocFSRetryBackoff is the initial wait before getting the directory
+	// of an allocation again when waiting for it to start. The wait doubles
+	// for each retry as for rotated logs, up to allocFSRetryLimit retries.
+	allocFSRetryBackoff = 100 * time.Millisecond
+	allocFSRetryLimit   = 5
+
+	// maxFollowedLogIndexes is the number of the most recent log indexes
+	// considered when picking the next log file to stream, so that tasks with
+	// huge numbers of rotated log files don't make every step expensive.
+	maxFollowedLogIndexes = 10000
+
+	// maxLogFilesSpanned is the number of log files streamed by a request
+	// for logs that are not followed, so that tasks with huge numbers of
+	// rotated log files don't make single requests unbounded. Requests may
+	// only lower it.
+	maxLogFilesSpanned = 1000
+
+	// streamResumeTokenRate is the minimum interval between resume tokens
+	// being attached to the frames of a resumable stream.
+	streamResumeTokenRate = 1 * time.Second
+
+	// resumeTokenWindow is the number of bytes preceding a resume token's
+	// offset that are checksummed to verify the file is unchanged on resume.
+	resumeTokenWindow = 1024
+
 	// deleteEvent and truncateEvent are the file events that can be sent in a
 	// StreamFrame
 	deleteEvent   = "file deleted"
 	truncateEvent = "file truncated"
 
+	// rotatedEvent is sent in place of deleteEvent when a followed log file
+	// is removed after the logs have rotated to a later log file.
+	rotatedEvent = "file rotated"
+
+	// skippedEvent is sent at the end of each byte range skipped when
+	// streaming a file, in place of the range's data.
+	skippedEvent = "range skipped"
+
+	// createEvent is sent when a watched directory has a new entry created.
+	createEvent = "file created"
+
+	// watchDirCheckRate is the rate at which a watched directory is listed
+	// to detect newly created entries.
+	watchDirCheckRate = 250 * time.Millisecond
+
+	// taskLogsCheckRate is the rate at which the logs of a task kept by its
+	// driver are read again once their end is reached while following them.
+	taskLogsCheckRate = 250 * time.Millisecond
+
+	// streamACLCheckRate is the default rate at which the token of a file
+	// or log stream is checked again while streaming.
+	streamACLCheckRate = 1 * time.Minute
+
+	// idleTimeoutEvent is sent in the final frame of a followed stream that
+	// is closed for not having streamed data within its max idle duration.
+	idleTimeoutEvent = "idle timeout"
+
+	// resumeRestartEvent is sent when a resumed stream no longer matches its
+	// resume token and restarts from the beginning of the file.
+	resumeRestartEvent = "resume restarted"
+
+	// taskExitedEvent is sent in the final frame of a log stream that ends
+	// with the tail of the other log type once the task has stopped.
+	taskExitedEvent = "task exited"
+
+	// taskExitInfoEvent is sent in the final frame of a log stream that is
+	// not followed, along with the exit status of the stopped task, when the
+	// exit info is requested.
+	taskExitInfoEvent = "task exit info"
+
+	// validatedEvent is sent in the only frame of a stream request that is
+	// validated rather than streamed.
+	validatedEvent = "request validated"
+
+	// filesLimitEvent is sent in the final frame of a log stream that stops
+	// after streaming its maximum number of log files, in place of the data
+	// of the next log file.
+	filesLimitEvent = "file limit reached"
+
+	// streamCompletedEvent is sent in the final frame of a stream that is
+	// not followed, along with the checksum of the data streamed, when a
+	// checksum is requested.
+	streamCompletedEvent = "stream completed"
+
+	// taskExitDrainWait is how long the logs of a stopped task continue to be
+	// streamed before the tail of the other log type is sent, so that output
+	// written just before the task stopped is not lost.
+	taskExitDrainWait = 1 * time.Second
+
+	// maxExitTailBytes is the maximum number of bytes read from the end of
+	// a log file for the tail sent when a task stops, or for the tail of
+	// each task of an allocation.
+	maxExitTailBytes = streamFrameSize
+
+	// tailLinesChunk is the number of bytes read at a time when reading
+	// log files backwards to find the start of their last lines.
+	tailLinesChunk = 32 * 1024
+
+	// maxTailLines is the maximum number of lines read from the end of the
+	// logs of each task of an allocation.
+	maxTailLines = 1000
+
+	// listCompressThreshold is the size of the encoded files of a listing
+	// above which they are compressed, when requested.
+	listCompressThreshold = 16 * 1024
+
+	// maxDiskUsageEntries is the maximum number of files and directories
+	// walked when summarizing disk usage.
+	maxDiskUsageEntries = 100000
+
+	// maxListEntries is the maximum number of files returned by a recursive
+	// listing, regardless of the maximum requested.
+	maxListEntries = 10000
+
+	// maxFindResults is the maximum number of paths returned by a find, and
+	// maxFindEntries the maximum number of files and directories it walks.
+	maxFindResults = 1000
+	maxFindEntries = 100000
+
+	// listChecksumMaxFileBytes is the size of the largest file checksummed
+	// when listing a directory, and listChecksumMaxBytes is the maximum
+	// number of bytes checksummed by a single listing.
+	listChecksumMaxFileBytes = 64 * 1024 * 1024
+	listChecksumMaxBytes     = 256 * 1024 * 1024
+
+	// maxPeekBytes is the maximum number of bytes that may be read from the
+	// start and end of a file by a single peek.
+	maxPeekBytes = 1024 * 1024
+
+	// maxLineIndexEntries is the maximum number of entries of a line index,
+	// and lineIndexBatchSize the number of entries streamed per batch.
+	maxLineIndexEntries = 1000000
+	lineIndexBatchSize  = 1024
+
+	// maxReadSetFiles and maxReadSetBytes are the maximum number of files
+	// and the maximum number of bytes returned by a single read of a set of
+	// files.
+	maxReadSetFiles = 16
+	maxReadSetBytes = 4 * 1024 * 1024
+
 	// OriginStart and OriginEnd are the available parameters for the origin
 	// argument when streaming a file. They respectively offset from the start
-	// and end of a file.
-	OriginStart = "start"
-	OriginEnd   = "end"
+	// and end of a file. OriginCurrent offsets from the end of the file at the
+	// time it starts being read and OriginPercent starts at the first line
+	// after a percentage of the size of the file. Both are only available
+	// when streaming files.
+	OriginStart   = "start"
+	OriginEnd     = "end"
+	OriginCurrent = "current"
+	OriginPercent = "percent"
 )
 
+// checksumAlgorithms are the hashes that may be used to checksum the files of
+// a listing or the data of a stream, keyed by name.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
 // FileSystem endpoint is used for accessing the logs and filesystem of
 // allocations.
 type FileSystem struct {
 	c *Client
+
+	// rotatedRetryBackoff and rotatedRetryLimit control retrying when a log
+	// file is rotated out before it can be opened.
+	rotatedRetryBackoff time.Duration
+	rotatedRetryLimit   int
+
+	// allocFS gets the directory of an allocation, and allocFSRetryBackoff
+	// and allocFSRetryLimit control retrying it when waiting for the
+	// allocation to start.
+	allocFS             func(allocID string) (allocdir.AllocDirFS, error)
+	allocFSRetryBackoff time.Duration
+	allocFSRetryLimit   int
+
+	// taskLogs gets the driver of a task if it keeps the task's logs outside
+	// of the log files in the alloc dir, or nil otherwise.
+	taskLogs func(allocID, task string) (drivers.TaskLogsDriver, error)
+
+	// maxLogIndexes is the number of the most recent log indexes considered
+	// when following logs. All are considered if it is zero.
+	maxLogIndexes int
+
+	// maxFilesSpanned is the number of log files streamed by a request for
+	// logs that are not followed.
+	maxFilesSpanned int
+
+	// tailCache holds the ends of recently streamed log files, if enabled
+	tailCache *logTailCache
+
+	// streamCache holds copies of streamed files, if enabled
+	streamCache *fileStreamCache
+
+	// sharedStreams shares the readers of identical followed file streams
+	sharedStreams *sharedStreams
+
+	// aclCheckInterval is how often the token of a stream is checked again
+	// while streaming if ACLs are enabled
+	aclCheckInterval time.Duration
+
+	// allocBaseDir is the directory holding the allocation directories,
+	// checked by health checks
+	allocBaseDir string
 }
 
 func NewFileSystemEndpoint(c *Client) *FileSystem {
-	f := &FileSystem{c}
+	f := &FileSystem{
+		c:                   c,
+		rotatedRetryBackoff: rotatedLogRetryBackoff,
+		rotatedRetryLimit:   rotatedLogRetryLimit,
+		allocFS:             c.GetAllocFS,
+		allocFSRetryBackoff: allocFSRetryBackoff,
+		allocFSRetryLimit:   allocFSRetryLimit,
+		taskLogs:            c.getTaskLogsDriver,
+		maxLogIndexes:       maxFollowedLogIndexes,
+		maxFilesSpanned:     maxLogFilesSpanned,
+		allocBaseDir:        c.config.AllocDir,
+		sharedStreams:       newSharedStreams(),
+		aclCheckInterval:    c.config.FSStreamACLCheckInterval,
+	}
+	if f.aclCheckInterval == 0 {
+		f.aclCheckInterval = streamACLCheckRate
+	}
+	if size := c.config.FSLogTailCacheBytes; size > 0 {
+		f.tailCache = newLogTailCache(int64(size))
+	}
+	if size := c.config.FSStreamCacheBytes; size > 0 {
+		dir := filepath.Join(c.config.StateDir, fileStreamCacheDir)
+		f.streamCache = newFileStreamCache(dir, int64(size), c.config.FSStreamCacheTTL)
+	}
 	f.c.streamingRpcs.Register("FileSystem.Logs", f.logs)
 	f.c.streamingRpcs.Register("FileSystem.Stream", f.stream)
+	f.c.streamingRpcs.Register("FileSystem.WatchDir", f.watchDir)
+	f.c.streamingRpcs.Register("FileSystem.Grep", f.grep)
+	f.c.streamingRpcs.Register("FileSystem.LineIndex", f.lineIndex)
 	return f
 }
 
+// getAllocFS returns the directory of the allocation. If wait is set, errors
+// other than the allocation being unknown are retried a bounded number of
+// times since the directory may not be available while the allocation starts.
+// Retrying stops early once the context is cancelled.
+func (f *FileSystem) getAllocFS(ctx context.Context, allocID string, wait bool) (allocdir.AllocDirFS, error) {
+	allocFS := f.allocFS
+	if allocFS == nil {
+		allocFS = f.c.GetAllocFS
+	}
+
+	for retry := 1; ; retry++ {
+		fs, err := allocFS(allocID)
+		if err == nil || !wait || structs.IsErrUnknownAllocation(err) || retry > f.allocFSRetryLimit {
+			return fs, err
+		}
+
+		select {
+		case <-time.After(rotatedRetryWait(f.allocFSRetryBackoff, retry)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// listRecursive lists the directory tree below the path, up to the maximum
+// number of entries. The files are named by their path relative to the listed
+// path. It returns whether more files were found than the maximum.
+func (f *FileSystem) listRecursive(fs allocdir.AllocDirFS, path string, maxEntries int,
+	allowSensitive bool) ([]*cstructs.AllocFileInfo, bool, error) {
+
+	root := filepath.Join(".", path)
+	files := []*cstructs.AllocFileInfo{}
+
+	errTruncated := errors.New("truncated")
+	err := fs.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+
+		// Sensitive paths are not included for tokens that may not access
+		// them
+		if !allowSensitive && f.isSensitivePath(fs, p) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if len(files) == maxEntries {
+			return errTruncated
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, allocdir.NewAllocFileInfo(filepath.ToSlash(rel), info))
+		return nil
+	})
+	if err == errTruncated {
+		return files, true, nil
+	}
+	return files, false, err
+}
+
+// getStreamAlloc returns the allocation whose files are streamed. Allocations
+// pruned from the client are returned along with their alloc dir if it is still
+// on disk, so that the logs of replaced allocations may still be read.
+func (f *FileSystem) getStreamAlloc(allocID string) (*structs.Allocation, *prunedAlloc, error) {
+	alloc, err := f.c.GetAlloc(allocID)
+	if err == nil {
+		return alloc, nil, nil
+	}
+
+	pruned, err := f.c.getPrunedAlloc(allocID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pruned.alloc, pruned, nil
+}
+
+// getStreamAllocFS returns the directory of the allocation whose files are
+// streamed, which is on disk if the allocation was pruned from the client.
+func (f *FileSystem) getStreamAllocFS(ctx context.Context, allocID string, pruned *prunedAlloc, wait bool) (allocdir.AllocDirFS, error) {
+	if pruned != nil {
+		return pruned.allocDir, nil
+	}
+	return f.getAllocFS(ctx, allocID, wait)
+}
+
+// getStreamAllocState returns the state of the allocation whose files are
+// streamed, which is the state last reported to the servers if the allocation
+// was pruned from the client.
+func (f *FileSystem) getStreamAllocState(allocID string, pruned *prunedAlloc) (*arstate.State, error) {
+	if pruned != nil {
+		return &arstate.State{
+			ClientStatus:      pruned.alloc.ClientStatus,
+			ClientDescription: pruned.alloc.ClientDescription,
+			TaskStates:        pruned.alloc.TaskStates,
+		}, nil
+	}
+	return f.c.GetAllocState(allocID)
+}
+
 // handleStreamResultError is a helper for sending an error with a potential
 // error code. The transmission of the error is ignored if the error has been
 // generated by the closing of the underlying transport.
@@ -96,32 +494,191 @@ func handleStreamResultError(err error, code *int64, encoder *codec.Encoder) {
 	})
 }
 
+// authorizeAlloc returns the token's ACL if it has any of the namespace
+// capabilities for the allocation.
+func (f *FileSystem) authorizeAlloc(alloc *structs.Allocation, token string, capabilities ...string) (*acl.ACL, error) {
+	aclObj, err := f.c.ResolveToken(token)
+	if err != nil {
+		return nil, err
+	} else if !acl.NamespaceValidator(capabilities...)(aclObj, alloc.Namespace) {
+		return nil, structs.ErrPermissionDenied
+	}
+
+	return aclObj, nil
+}
+
+// checkSensitivePaths returns whether the token may access sensitive paths
+// within the allocation. If it may not, an error is returned for the first of
+// the given paths that is sensitive.
+func (f *FileSystem) checkSensitivePaths(aclObj *acl.ACL, alloc *structs.Allocation,
+	fs allocdir.AllocDirFS, paths ...string) (bool, error) {
+
+	if allowSensitivePaths(aclObj, alloc.Namespace) {
+		return true, nil
+	}
+	for _, path := range paths {
+		if f.isSensitivePath(fs, path) {
+			return false, sensitivePathErr(path)
+		}
+	}
+	return false, nil
+}
+
+// authorizeAllocFS returns the directory of the allocation if the token may
+// read its files, along with whether the token may access sensitive paths
+// within it. Any of the given paths that are sensitive are rejected for tokens
+// that may not access them.
+func (f *FileSystem) authorizeAllocFS(allocID, token string, paths ...string) (allocdir.AllocDirFS, bool, error) {
+	alloc, err := f.c.GetAlloc(allocID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	aclObj, err := f.authorizeAlloc(alloc, token, acl.NamespaceCapabilityReadFS)
+	if err != nil {
+		return nil, false, err
+	}
+
+	fs, err := f.c.GetAllocFS(allocID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	allowSensitive, err := f.checkSensitivePaths(aclObj, alloc, fs, paths...)
+	if err != nil {
+		return nil, false, err
+	}
+	return fs, allowSensitive, nil
+}
+
+// authorizeErrCode returns the HTTP status code streamed with an error
+// authorizing access to the files of an allocation.
+func authorizeErrCode(err error) *int64 {
+	if code, _, ok := structs.CodeFromRPCCodedErr(err); ok {
+		return helper.Int64ToPtr(int64(code))
+	}
+
+	switch {
+	case structs.IsErrUnknownAllocation(err):
+		return helper.Int64ToPtr(404)
+	case structs.IsErrPermissionDenied(err), structs.IsErrTokenNotFound(err):
+		return helper.Int64ToPtr(403)
+	default:
+		return helper.Int64ToPtr(500)
+	}
+}
+
 // List is used to list the contents of an allocation's directory.
 func (f *FileSystem) List(args *cstructs.FsListRequest, reply *cstructs.FsListResponse) error {
 	defer metrics.MeasureSince([]string{"client", "file_system", "list"}, time.Now())
 
-	alloc, err := f.c.GetAlloc(args.AllocID)
-	if err != nil {
-		return err
+	var newHash func() hash.Hash
+	if args.Checksum != "" {
+		var ok bool
+		if newHash, ok = checksumAlgorithms[args.Checksum]; !ok {
+			return invalidChecksum
+		}
 	}
-
-	// Check namespace read-fs permission.
-	if aclObj, err := f.c.ResolveToken(args.QueryOptions.AuthToken); err != nil {
-		return err
-	} else if aclObj != nil && !aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadFS) {
-		return structs.ErrPermissionDenied
+	if args.MaxEntries < 0 || (args.MaxEntries > 0 && !args.Recursive) {
+		return invalidListEntries
 	}
 
-	fs, err := f.c.GetAllocFS(args.AllocID)
+	fs, allowSensitive, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken, args.Path)
 	if err != nil {
 		return err
 	}
-	files, err := fs.List(args.Path)
+
+	var files []*cstructs.AllocFileInfo
+	if args.Recursive {
+		maxEntries := args.MaxEntries
+		if maxEntries == 0 || maxEntries > maxListEntries {
+			maxEntries = maxListEntries
+		}
+
+		files, reply.Truncated, err = f.listRecursive(fs, args.Path, maxEntries, allowSensitive)
+	} else {
+		files, err = fs.List(args.Path)
+	}
 	if err != nil {
 		return err
 	}
 
+	if !allowSensitive && !args.Recursive {
+		filtered := files[:0]
+		for _, file := range files {
+			if !f.isSensitivePath(fs, filepath.Join(args.Path, file.Name)) {
+				filtered = append(filtered, file)
+			}
+		}
+		files = filtered
+	}
+
+	if newHash != nil {
+		if err := checksumFiles(fs, args.Path, files, newHash); err != nil {
+			return err
+		}
+	}
+
+	// The file owners are only returned to callers that ask for them
+	if !args.Owner {
+		hideFileOwner(files...)
+	}
+
 	reply.Files = files
+	if args.Compress {
+		return reply.CompressFiles(listCompressThreshold)
+	}
+	return nil
+}
+
+// hideFileOwner removes the owner and group of the files, which are only
+// returned when requested.
+func hideFileOwner(files ...*cstructs.AllocFileInfo) {
+	for _, file := range files {
+		file.UID = nil
+		file.GID = nil
+	}
+}
+
+// checksumFiles sets the checksums of the regular files listed in dir, skipping
+// those that exceed the per file or total checksum limits.
+func checksumFiles(fs allocdir.AllocDirFS, dir string, files []*cstructs.AllocFileInfo,
+	newHash func() hash.Hash) error {
+
+	var total int64
+	for _, file := range files {
+		if file.IsDir {
+			continue
+		}
+		if !strings.HasPrefix(file.FileMode, "-") || file.Size > listChecksumMaxFileBytes ||
+			total+file.Size > listChecksumMaxBytes {
+			file.ChecksumSkipped = true
+			continue
+		}
+
+		// Files removed or truncated since being listed are skipped, and
+		// only the listed size is read in case the file is being written
+		r, err := fs.ReadAt(filepath.Join(dir, file.Name), 0)
+		if os.IsNotExist(err) {
+			file.ChecksumSkipped = true
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		h := newHash()
+		_, err = io.CopyN(h, r, file.Size)
+		r.Close()
+		if err == io.EOF {
+			file.ChecksumSkipped = true
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		total += file.Size
+		file.Checksum = hex.EncodeToString(h.Sum(nil))
+	}
 	return nil
 }
 
@@ -129,413 +686,3093 @@ func (f *FileSystem) List(args *cstructs.FsListRequest, reply *cstructs.FsListRe
 func (f *FileSystem) Stat(args *cstructs.FsStatRequest, reply *cstructs.FsStatResponse) error {
 	defer metrics.MeasureSince([]string{"client", "file_system", "stat"}, time.Now())
 
-	alloc, err := f.c.GetAlloc(args.AllocID)
+	fs, _, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken, args.Path)
 	if err != nil {
 		return err
 	}
 
-	// Check namespace read-fs permission.
-	if aclObj, err := f.c.ResolveToken(args.QueryOptions.AuthToken); err != nil {
-		return err
-	} else if aclObj != nil && !aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadFS) {
-		return structs.ErrPermissionDenied
-	}
-
-	fs, err := f.c.GetAllocFS(args.AllocID)
+	info, err := fs.Stat(args.Path)
 	if err != nil {
 		return err
 	}
-	info, err := fs.Stat(args.Path)
+	canonical, err := fs.CanonicalPath(args.Path)
 	if err != nil {
 		return err
 	}
 
+	// The file identity is only returned to callers that ask for it
+	if !args.Identity {
+		info.Inode = nil
+		info.Device = nil
+	}
+	if !args.Owner {
+		hideFileOwner(info)
+	}
+
 	reply.Info = info
+	reply.Path = canonical
 	return nil
 }
 
-// stream is is used to stream the contents of file in an allocation's
-// directory.
-func (f *FileSystem) stream(conn io.ReadWriteCloser) {
-	defer metrics.MeasureSince([]string{"client", "file_system", "stream"}, time.Now())
-	defer conn.Close()
+// Exists is used to check whether a path exists in an allocation's directory
+// without the cost of a Stat. Missing paths are not an error.
+func (f *FileSystem) Exists(args *cstructs.FsExistsRequest, reply *cstructs.FsExistsResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "exists"}, time.Now())
 
-	// Decode the arguments
-	var req cstructs.FsStreamRequest
-	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
-	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+	fs, allowSensitive, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken)
+	if err != nil {
+		return err
+	}
 
-	if err := decoder.Decode(&req); err != nil {
-		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
-		return
+	// Sensitive paths are reported as missing to tokens that may not access
+	// them
+	if !allowSensitive && f.isSensitivePath(fs, args.Path) {
+		return nil
 	}
 
-	if req.AllocID == "" {
-		handleStreamResultError(allocIDNotPresentErr, helper.Int64ToPtr(400), encoder)
-		return
+	reply.Exists, reply.IsDir, err = fs.Exists(args.Path)
+	return err
+}
+
+// Changed is used to cheaply check whether a file in an allocation's directory
+// changed since a previous check, without reading its contents.
+func (f *FileSystem) Changed(args *cstructs.FsChangedRequest, reply *cstructs.FsChangedResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "changed"}, time.Now())
+
+	if args.Path == "" {
+		return pathNotPresentErr
 	}
-	alloc, err := f.c.GetAlloc(req.AllocID)
+	var prev *changedToken
+	if args.Token != "" {
+		var err error
+		if prev, err = parseChangedToken(args.Token); err != nil {
+			return err
+		}
+	}
+
+	fs, _, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken, args.Path)
 	if err != nil {
-		handleStreamResultError(structs.NewErrUnknownAllocation(req.AllocID), helper.Int64ToPtr(404), encoder)
-		return
+		return err
 	}
 
-	// Check read permissions
-	if aclObj, err := f.c.ResolveToken(req.QueryOptions.AuthToken); err != nil {
-		handleStreamResultError(err, helper.Int64ToPtr(403), encoder)
-		return
-	} else if aclObj != nil && !aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadFS) {
-		handleStreamResultError(structs.ErrPermissionDenied, helper.Int64ToPtr(403), encoder)
-		return
+	info, err := fs.QuickStat(args.Path)
+	if err != nil {
+		return err
 	}
 
-	// Validate the arguments
-	if req.Path == "" {
-		handleStreamResultError(pathNotPresentErr, helper.Int64ToPtr(400), encoder)
-		return
+	cur := newChangedToken(info)
+	reply.Token = cur.String()
+	if prev == nil {
+		reply.Changed = true
+		reply.SizeDelta = info.Size
+	} else {
+		reply.Recreated = !cur.sameFile(prev)
+		reply.Changed = reply.Recreated || cur.Size != prev.Size || cur.ModTime != prev.ModTime
+		reply.SizeDelta = cur.Size - prev.Size
 	}
-	switch req.Origin {
-	case "start", "end":
-	case "":
-		req.Origin = "start"
-	default:
-		handleStreamResultError(invalidOrigin, helper.Int64ToPtr(400), encoder)
-		return
+	if reply.Changed {
+		hideFileOwner(info)
+		reply.Info = info
 	}
+	return nil
+}
 
-	fs, err := f.c.GetAllocFS(req.AllocID)
-	if err != nil {
-		code := helper.Int64ToPtr(500)
-		if structs.IsErrUnknownAllocation(err) {
-			code = helper.Int64ToPtr(404)
-		}
+// changedToken identifies the state of a file for detecting changes to it.
+type changedToken struct {
+	// Size and ModTime are the size and modification time of the file, in
+	// nanoseconds since the epoch.
+	Size    int64
+	ModTime int64
+
+	// Inode and Device identify the file. They are nil on platforms that do
+	// not provide them.
+	Inode  *uint64
+	Device *uint64
+}
 
-		handleStreamResultError(err, code, encoder)
-		return
+func newChangedToken(info *cstructs.AllocFileInfo) *changedToken {
+	return &changedToken{
+		Size:    info.Size,
+		ModTime: info.ModTime.UnixNano(),
+		Inode:   info.Inode,
+		Device:  info.Device,
 	}
+}
 
-	// Calculate the offset
-	fileInfo, err := fs.Stat(req.Path)
-	if err != nil {
-		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
-		return
+// String returns the opaque form of the token sent to clients.
+func (c *changedToken) String() string {
+	s := fmt.Sprintf("%d:%d", c.Size, c.ModTime)
+	if c.Inode != nil && c.Device != nil {
+		s += fmt.Sprintf(":%d:%d", *c.Inode, *c.Device)
 	}
-	if fileInfo.IsDir {
-		handleStreamResultError(
-			fmt.Errorf("file %q is a directory", req.Path),
-			helper.Int64ToPtr(400), encoder)
-		return
+	return s
+}
+
+// parseChangedToken parses a token previously returned by String.
+func parseChangedToken(s string) (*changedToken, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 && len(parts) != 4 {
+		return nil, invalidChangedToken
 	}
 
-	// If offsetting from the end subtract from the size
-	if req.Origin == "end" {
-		req.Offset = fileInfo.Size - req.Offset
-		if req.Offset < 0 {
-			req.Offset = 0
+	var token changedToken
+	var err error
+	if token.Size, err = strconv.ParseInt(parts[0], 10, 64); err != nil || token.Size < 0 {
+		return nil, invalidChangedToken
+	}
+	if token.ModTime, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return nil, invalidChangedToken
+	}
+	if len(parts) == 4 {
+		inode, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return nil, invalidChangedToken
+		}
+		device, err := strconv.ParseUint(parts[3], 10, 64)
+		if err != nil {
+			return nil, invalidChangedToken
 		}
+		token.Inode, token.Device = &inode, &device
 	}
 
-	frames := make(chan *sframer.StreamFrame, streamFramesBuffer)
-	errCh := make(chan error)
-	var buf bytes.Buffer
-	frameCodec := codec.NewEncoder(&buf, structs.JsonHandle)
+	return &token, nil
+}
 
-	// Create the framer
-	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
-	framer.Run()
-	defer framer.Destroy()
+// sameFile returns whether the tokens were issued for the same file. Files
+// are assumed to be the same if either token lacks their identity.
+func (c *changedToken) sameFile(o *changedToken) bool {
+	if c.Inode == nil || o.Inode == nil {
+		return true
+	}
+	return *c.Inode == *o.Inode && *c.Device == *o.Device
+}
 
-	// If we aren't following end as soon as we hit EOF
-	cancelAfterFirstEof := !req.Follow
+// DiskUsage is used to summarize the disk usage of a directory in the
+// allocation's directory, optionally broken down by its entries.
+func (f *FileSystem) DiskUsage(args *cstructs.FsDiskUsageRequest, reply *cstructs.FsDiskUsageResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "disk_usage"}, time.Now())
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	fs, allowSensitive, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken, args.Path)
+	if err != nil {
+		return err
+	}
 
-	// Start streaming
-	go func() {
-		if err := f.streamFile(ctx, req.Offset, req.Path, req.Limit, fs, framer, nil, cancelAfterFirstEof); err != nil {
-			select {
-			case errCh <- err:
-			case <-ctx.Done():
-			}
-		}
+	root := filepath.Join(".", args.Path)
+	if args.Breakdown {
+		reply.Breakdown = make(map[string]*cstructs.FsDiskUsage)
+	}
 
-		framer.Destroy()
+	var entries int
+	errTruncated := errors.New("truncated")
+	err = fs.Walk(args.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Sensitive paths are not included for tokens that may not access
+		// them
+		if !allowSensitive && f.isSensitivePath(fs, path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entries++
+		if entries > maxDiskUsageEntries {
+			return errTruncated
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		var entry *cstructs.FsDiskUsage
+		if reply.Breakdown != nil {
+			name := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+			entry = reply.Breakdown[name]
+			if entry == nil {
+				entry = new(cstructs.FsDiskUsage)
+				reply.Breakdown[name] = entry
+			}
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		reply.Total.Bytes += info.Size()
+		reply.Total.Files++
+		if entry != nil {
+			entry.Bytes += info.Size()
+			entry.Files++
+		}
+		return nil
+	})
+	if err == errTruncated {
+		reply.Truncated = true
+		return nil
+	}
+	return err
+}
+
+// Find is used to find the files and directories below a directory in the
+// allocation's directory whose base name matches a pattern.
+func (f *FileSystem) Find(args *cstructs.FsFindRequest, reply *cstructs.FsFindResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "find"}, time.Now())
+
+	if args.MaxResults < 0 || args.MaxResults > maxFindResults {
+		return invalidFindResults
+	}
+	match, err := findNameMatcher(args.NamePattern, args.Regex)
+	if err != nil {
+		return err
+	}
+	maxResults := args.MaxResults
+	if maxResults == 0 {
+		maxResults = maxFindResults
+	}
+
+	fs, allowSensitive, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken, args.Root)
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Join(".", args.Root)
+	reply.Paths = []string{}
+
+	var entries int
+	errTruncated := errors.New("truncated")
+	err = fs.Walk(args.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Sensitive paths are not included for tokens that may not access
+		// them
+		if !allowSensitive && f.isSensitivePath(fs, path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entries++
+		if entries > maxFindEntries {
+			return errTruncated
+		}
+
+		if path == root || !match(info.Name()) {
+			return nil
+		}
+		if len(reply.Paths) == maxResults {
+			return errTruncated
+		}
+
+		reply.Paths = append(reply.Paths, filepath.ToSlash(path))
+		return nil
+	})
+	if err == errTruncated {
+		reply.Truncated = true
+		return nil
+	}
+	return err
+}
+
+// findNameMatcher returns the function matching base names against the glob
+// or regular expression of a find.
+func findNameMatcher(pattern string, regex bool) (func(string) bool, error) {
+	if pattern == "" {
+		return nil, invalidFindPattern
+	}
+
+	if regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, invalidFindPattern
+		}
+		return re.MatchString, nil
+	}
+
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, invalidFindPattern
+	}
+	return func(name string) bool {
+		ok, _ := filepath.Match(pattern, name)
+		return ok
+	}, nil
+}
+
+// Health is used to check whether the client can serve file system requests,
+// without targeting an allocation. The client is unhealthy if the directory
+// holding the allocation directories cannot be read.
+func (f *FileSystem) Health(args *structs.NodeSpecificRequest, reply *cstructs.FsHealthResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "health"}, time.Now())
+
+	// Check node read permissions
+	if aclObj, err := f.c.ResolveToken(args.AuthToken); err != nil {
+		return err
+	} else if aclObj != nil && !aclObj.AllowNodeRead() {
+		return structs.ErrPermissionDenied
+	}
+
+	if err := checkDirReadable(f.allocBaseDir); err != nil {
+		reply.Reason = err.Error()
+		return nil
+	}
+
+	reply.Healthy = true
+	return nil
+}
+
+// checkDirReadable returns an error if path is not a directory whose entries
+// can be read.
+func checkDirReadable(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	info, err := d.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+
+	if _, err := d.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Peek is used to read the start and end of a file in the allocation's
+// directory in one request, eliding the middle of large files.
+func (f *FileSystem) Peek(args *cstructs.FsPeekRequest, reply *cstructs.FsPeekResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "peek"}, time.Now())
+
+	if args.Path == "" {
+		return pathNotPresentErr
+	}
+	if args.HeadBytes < 0 || args.TailBytes < 0 || args.HeadBytes+args.TailBytes == 0 ||
+		args.HeadBytes+args.TailBytes > maxPeekBytes {
+		return invalidPeekBytes
+	}
+
+	fs, _, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken, args.Path)
+	if err != nil {
+		return err
+	}
+
+	info, err := fs.Stat(args.Path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return fmt.Errorf("file %q is a directory", args.Path)
+	}
+
+	reply.Size = info.Size
+
+	// Return small files whole rather than as an overlapping head and tail
+	if info.Size <= args.HeadBytes+args.TailBytes {
+		reply.Head, err = peekAt(fs, args.Path, 0, info.Size)
+		return err
+	}
+
+	if reply.Head, err = peekAt(fs, args.Path, 0, args.HeadBytes); err != nil {
+		return err
+	}
+	if reply.Tail, err = peekAt(fs, args.Path, info.Size-args.TailBytes, args.TailBytes); err != nil {
+		return err
+	}
+	reply.ElidedBytes = info.Size - args.HeadBytes - args.TailBytes
+	return nil
+}
+
+// ReadBackward is used to read the window of a file preceding an offset, so
+// that files can be paged through upwards without reading them from the start.
+// The start of the window is moved forward to the next line boundary so that
+// it does not start with a partial line.
+func (f *FileSystem) ReadBackward(args *cstructs.FsReadBackwardRequest, reply *cstructs.FsReadBackwardResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "read_backward"}, time.Now())
+
+	if args.Path == "" {
+		return pathNotPresentErr
+	}
+	if args.WindowBytes <= 0 || args.WindowBytes > maxPeekBytes || args.Offset < 0 {
+		return invalidWindowBytes
+	}
+
+	fs, _, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken, args.Path)
+	if err != nil {
+		return err
+	}
+
+	info, err := fs.Stat(args.Path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return fmt.Errorf("file %q is a directory", args.Path)
+	}
+
+	reply.Size = info.Size
+	end := args.Offset
+	if end > info.Size {
+		end = info.Size
+	}
+
+	// Windows reaching the start of the file start at it
+	start := end - args.WindowBytes
+	if start <= 0 {
+		reply.Data, err = peekAt(fs, args.Path, 0, end)
+		return err
+	}
+
+	// Read the byte preceding the window to tell whether the window already
+	// starts at a line boundary
+	data, err := peekAt(fs, args.Path, start-1, end-start+1)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	skip := 1
+	if data[0] != '\n' {
+		if i := bytes.IndexByte(data[1:], '\n'); i >= 0 {
+			skip += i + 1
+		}
+	}
+	reply.Data = data[skip:]
+	reply.Offset = start - 1 + int64(skip)
+	return nil
+}
+
+// ReadSet is used to read a small set of related files in one request. Each
+// file is stated again once the whole set has been read so that callers can
+// detect files updated during the read and retry.
+func (f *FileSystem) ReadSet(args *cstructs.FsReadSetRequest, reply *cstructs.FsReadSetResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "read_set"}, time.Now())
+
+	if len(args.Paths) == 0 || len(args.Paths) > maxReadSetFiles {
+		return invalidReadSet
+	}
+	for _, path := range args.Paths {
+		if path == "" {
+			return pathNotPresentErr
+		}
+	}
+
+	fs, _, err := f.authorizeAllocFS(args.AllocID, args.QueryOptions.AuthToken, args.Paths...)
+	if err != nil {
+		return err
+	}
+
+	files, err := readSet(fs, args.Paths)
+	if err != nil {
+		return err
+	}
+
+	reply.Files = files
+	reply.Consistent = true
+	for _, file := range files {
+		if file.Changed {
+			reply.Consistent = false
+		}
+	}
+	return nil
+}
+
+// readSet reads the files at the paths, marking those whose contents do not
+// match their size or whose stat differs once all files have been read.
+func readSet(fs allocdir.AllocDirFS, paths []string) ([]*cstructs.FsReadSetFile, error) {
+	files := make([]*cstructs.FsReadSetFile, 0, len(paths))
+	var total int64
+	for _, path := range paths {
+		info, err := fs.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir {
+			return nil, fmt.Errorf("file %q is a directory", path)
+		}
+
+		// Read one byte past the remaining limit to detect files that grew
+		// beyond it since being stated
+		remaining := maxReadSetBytes - total
+		if info.Size > remaining {
+			return nil, fmt.Errorf("files exceed the limit of %d bytes", maxReadSetBytes)
+		}
+		data, err := peekAt(fs, path, 0, remaining+1)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > remaining {
+			return nil, fmt.Errorf("files exceed the limit of %d bytes", maxReadSetBytes)
+		}
+		total += int64(len(data))
+
+		files = append(files, &cstructs.FsReadSetFile{
+			Path:     path,
+			Contents: data,
+			Info:     info,
+			Changed:  int64(len(data)) != info.Size,
+		})
+	}
+
+	// Stat the files again to detect those updated while the set was read
+	for _, file := range files {
+		info, err := fs.Stat(file.Path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			file.Changed = true
+		} else if !sameFileInfo(file.Info, info) {
+			file.Changed = true
+		}
+
+		// The file identity is only used to detect replaced files
+		file.Info.Inode = nil
+		file.Info.Device = nil
+		hideFileOwner(file.Info)
+	}
+
+	return files, nil
+}
+
+// sameFileInfo returns whether the stat results describe the same unmodified
+// file.
+func sameFileInfo(a, b *cstructs.AllocFileInfo) bool {
+	if a.Size != b.Size || !a.ModTime.Equal(b.ModTime) {
+		return false
+	}
+	if a.Inode != nil && b.Inode != nil && *a.Inode != *b.Inode {
+		return false
+	}
+	if a.Device != nil && b.Device != nil && *a.Device != *b.Device {
+		return false
+	}
+	return true
+}
+
+// currentOffset returns the offset of the file that is the passed number of
+// bytes before its current end, statting the file again to get its latest
+// size.
+func currentOffset(fs allocdir.AllocDirFS, path string, offset int64) (int64, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	current := info.Size - offset
+	if current < 0 {
+		current = 0
+	}
+	return current, nil
+}
+
+// percentOffset returns the offset of the first line starting at or after the
+// percentage of the size of the file at path, or the size if no line starts
+// after it.
+func percentOffset(fs allocdir.AllocDirFS, path string, size, percent int64) (int64, error) {
+	offset := size * percent / 100
+	if offset == 0 || offset == size {
+		return offset, nil
+	}
+
+	// Read from the byte before the offset so that an offset already at the
+	// start of a line is kept
+	r, err := fs.ReadAt(path, offset-1)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(io.LimitReader(r, size-offset+1))
+	n := offset - 1
+	for {
+		line, err := br.ReadSlice('\n')
+		n += int64(len(line))
+		switch err {
+		case nil:
+			return n, nil
+		case bufio.ErrBufferFull:
+		case io.EOF:
+			return size, nil
+		default:
+			return 0, err
+		}
+	}
+}
+
+// peekAt reads up to limit bytes of the file at path starting at offset.
+func peekAt(fs allocdir.AllocDirFS, path string, offset, limit int64) ([]byte, error) {
+	if limit == 0 {
+		return nil, nil
+	}
+
+	r, err := fs.ReadAt(path, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(io.LimitReader(r, limit))
+}
+
+// LogStats is used to retrieve per task statistics of the rotated log files
+// kept for an allocation.
+func (f *FileSystem) LogStats(args *cstructs.FsLogStatsRequest, reply *cstructs.FsLogStatsResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "log_stats"}, time.Now())
+
+	alloc, err := f.c.GetAlloc(args.AllocID)
+	if err != nil {
+		return err
+	}
+
+	// Check read permissions
+	if _, err := f.authorizeAlloc(alloc, args.QueryOptions.AuthToken,
+		acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs); err != nil {
+		return err
+	}
+
+	// Determine the tasks to retrieve statistics for
+	var tasks []string
+	if tg := alloc.Job.LookupTaskGroup(alloc.TaskGroup); tg != nil {
+		for _, task := range tg.Tasks {
+			if args.Task == "" || args.Task == task.Name {
+				tasks = append(tasks, task.Name)
+			}
+		}
+	}
+	if args.Task != "" && len(tasks) == 0 {
+		return structs.NewErrRPCCodedf(http.StatusBadRequest, "unknown task name %q", args.Task)
+	}
+
+	fs, err := f.c.GetAllocFS(args.AllocID)
+	if err != nil {
+		return err
+	}
+	entries, err := fs.List(filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName))
+	if err != nil {
+		return err
+	}
+
+	stats := make([]*cstructs.TaskLogStats, 0, len(tasks)*2)
+	for _, task := range tasks {
+		for _, logType := range withStdLogTypes(logTypes(entries, task)) {
+			s, err := logStats(entries, task, logType)
+			if err != nil {
+				return err
+			}
+			stats = append(stats, s)
+		}
+	}
+
+	reply.Stats = stats
+	return nil
+}
+
+// logStats summarizes the rotated log files of the task's log type found in
+// the entries of the log directory.
+func logStats(entries []*cstructs.AllocFileInfo, task, logType string) (*cstructs.TaskLogStats, error) {
+	indexes, err := logIndexes(entries, task, logType)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &cstructs.TaskLogStats{
+		Task:    task,
+		LogType: logType,
+		Files:   len(indexes),
+	}
+	if len(indexes) == 0 {
+		return stats, nil
+	}
+
+	sort.Sort(indexes)
+	stats.MinIndex = indexes[0].idx
+	stats.MaxIndex = indexes[len(indexes)-1].idx
+	for _, index := range indexes {
+		stats.TotalBytes += index.entry.Size
+		if stats.Oldest.IsZero() || index.entry.ModTime.Before(stats.Oldest) {
+			stats.Oldest = index.entry.ModTime
+		}
+		if index.entry.ModTime.After(stats.Newest) {
+			stats.Newest = index.entry.ModTime
+		}
+	}
+
+	return stats, nil
+}
+
+// logFileStat returns a snapshot of the newest log file of the task's log type,
+// or nil if it has not written any.
+func logFileStat(fs allocdir.AllocDirFS, task, logType string) (*sframer.LogFileStat, error) {
+	logPath := filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName)
+	entries, err := fs.List(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes, err := logIndexes(entries, task, logType)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) == 0 {
+		return nil, nil
+	}
+
+	sort.Sort(indexes)
+	newest := indexes[len(indexes)-1]
+	return &sframer.LogFileStat{
+		File:  filepath.Join(logPath, newest.entry.Name),
+		Index: newest.idx,
+		Size:  newest.entry.Size,
+	}, nil
+}
+
+// LogTypes is used to discover the log types a task has written log files
+// for. Besides stdout and stderr, some drivers write additional named streams
+// to the log directory as "<task>.<type>.<index>".
+func (f *FileSystem) LogTypes(args *cstructs.FsLogTypesRequest, reply *cstructs.FsLogTypesResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "log_types"}, time.Now())
+
+	alloc, err := f.c.GetAlloc(args.AllocID)
+	if err != nil {
+		return err
+	}
+
+	// Check read permissions
+	if _, err := f.authorizeAlloc(alloc, args.QueryOptions.AuthToken,
+		acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs); err != nil {
+		return err
+	}
+
+	// Validate the arguments
+	if args.AllocLog && args.Task != "" {
+		return structs.NewErrRPCCoded(http.StatusBadRequest, allocLogTaskErr.Error())
+	} else if !args.AllocLog {
+		if args.Task == "" {
+			return structs.NewErrRPCCoded(http.StatusBadRequest, taskNotPresentErr.Error())
+		}
+		tg := alloc.Job.LookupTaskGroup(alloc.TaskGroup)
+		if tg == nil || tg.LookupTask(args.Task) == nil {
+			return structs.NewErrRPCCodedf(http.StatusBadRequest, "unknown task name %q", args.Task)
+		}
+	}
+
+	fs, err := f.c.GetAllocFS(args.AllocID)
+	if err != nil {
+		return err
+	}
+	types, err := listLogTypes(fs, args.Task)
+	if err != nil {
+		return err
+	}
+
+	reply.LogTypes = types
+	return nil
+}
+
+// AllTasksTail is used to read the last lines of the logs of the given type of
+// every task of an allocation that has started, such as for an overview of
+// the allocation.
+func (f *FileSystem) AllTasksTail(args *cstructs.FsAllTasksTailRequest, reply *cstructs.FsAllTasksTailResponse) error {
+	defer metrics.MeasureSince([]string{"client", "file_system", "all_tasks_tail"}, time.Now())
+
+	alloc, err := f.c.GetAlloc(args.AllocID)
+	if err != nil {
+		return err
+	}
+
+	// Check read permissions
+	if _, err := f.authorizeAlloc(alloc, args.QueryOptions.AuthToken,
+		acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs); err != nil {
+		return err
+	}
+
+	// Validate the arguments
+	if args.LogType == "" || strings.ContainsAny(args.LogType, "./") {
+		return structs.NewErrRPCCoded(http.StatusBadRequest, logTypeNotPresentErr.Error())
+	}
+	if args.Lines <= 0 || args.Lines > maxTailLines {
+		return structs.NewErrRPCCoded(http.StatusBadRequest, invalidTailLines.Error())
+	}
+
+	allocState, err := f.c.GetAllocState(args.AllocID)
+	if err != nil {
+		return err
+	}
+	fs, err := f.c.GetAllocFS(args.AllocID)
+	if err != nil {
+		return err
+	}
+
+	// Tasks that have not started have no logs yet
+	var tasks []string
+	if tg := alloc.Job.LookupTaskGroup(alloc.TaskGroup); tg != nil {
+		for _, task := range tg.Tasks {
+			if ts := allocState.TaskStates[task.Name]; ts != nil && !ts.StartedAt.IsZero() {
+				tasks = append(tasks, task.Name)
+			}
+		}
+	}
+	sort.Strings(tasks)
+
+	tails := make([]*cstructs.TaskLogTail, 0, len(tasks))
+	for _, task := range tasks {
+		tail, err := tailLogLines(fs, task, args.LogType, args.Lines)
+		if err != nil {
+			return err
+		}
+		tails = append(tails, tail)
+	}
+
+	reply.Tails = tails
+	return nil
+}
+
+// listLogTypes returns the log types with log files in the log directory of
+// the allocation for the task, or for the allocation itself if task is empty.
+func listLogTypes(fs allocdir.AllocDirFS, task string) ([]string, error) {
+	entries, err := fs.List(filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName))
+	if err != nil {
+		return nil, err
+	}
+
+	return logTypes(entries, task), nil
+}
+
+// logTypes returns the sorted log types of the task's log files found in the
+// entries of the log directory. Allocation log files are discovered if task is
+// empty. Log types containing a '.' are ignored as they cannot be told apart
+// from the logs of a task whose name shares the prefix.
+func logTypes(entries []*cstructs.AllocFileInfo, task string) []string {
+	prefix := ""
+	if task != "" {
+		prefix = task + "."
+	}
+
+	seen := make(map[string]struct{})
+	var types []string
+	for _, entry := range entries {
+		if entry.IsDir || !strings.HasPrefix(entry.Name, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(entry.Name, prefix)
+		i := strings.LastIndexByte(rest, '.')
+		if i <= 0 {
+			continue
+		}
+		logType, idx := rest[:i], rest[i+1:]
+		if strings.Contains(logType, ".") {
+			continue
+		}
+		if _, err := strconv.Atoi(idx); err != nil {
+			continue
+		}
+
+		if _, ok := seen[logType]; !ok {
+			seen[logType] = struct{}{}
+			types = append(types, logType)
+		}
+	}
+
+	sort.Strings(types)
+	return types
+}
+
+// withStdLogTypes returns stdout and stderr followed by the other discovered
+// log types, so they are reported even before any output is written.
+func withStdLogTypes(types []string) []string {
+	all := []string{"stdout", "stderr"}
+	for _, logType := range types {
+		if logType != "stdout" && logType != "stderr" {
+			all = append(all, logType)
+		}
+	}
+	return all
+}
+
+// allowSensitivePaths returns whether the token may access the client's
+// configured sensitive paths within allocations in the namespace. Tokens that
+// may exec into allocations could read the files that way regardless.
+func allowSensitivePaths(aclObj *acl.ACL, namespace string) bool {
+	return aclObj == nil || aclObj.AllowNsOp(namespace, acl.NamespaceCapabilityAllocExec)
+}
+
+// isSensitivePath returns whether the path within an allocation directory
+// matches, or is within, one of the client's configured sensitive paths. The
+// path the allocation directory resolves it to is matched as well, so that
+// symlinks cannot be used to reach sensitive paths.
+func (f *FileSystem) isSensitivePath(fs allocdir.AllocDirFS, path string) bool {
+	patterns := f.c.GetConfig().FSSensitivePaths
+	if len(patterns) == 0 {
+		return false
+	}
+	if matchSensitivePath(patterns, path) {
+		return true
+	}
+
+	// Paths that cannot be resolved, such as missing files, cannot be read
+	// through a symlink either
+	resolved, err := fs.CanonicalPath(path)
+	if err != nil {
+		return false
+	}
+	return matchSensitivePath(patterns, resolved)
+}
+
+// matchSensitivePath returns whether the path matches, or is within, one of
+// the sensitive path patterns.
+func matchSensitivePath(patterns []string, path string) bool {
+	parts := splitAllocPath(path)
+OUTER:
+	for _, pattern := range patterns {
+		patternParts := splitAllocPath(pattern)
+		if len(patternParts) == 0 || len(parts) < len(patternParts) {
+			continue
+		}
+
+		for i, patternPart := range patternParts {
+			if ok, err := filepath.Match(patternPart, parts[i]); err != nil || !ok {
+				continue OUTER
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// splitAllocPath splits a path within an allocation directory into its cleaned
+// components.
+func splitAllocPath(path string) []string {
+	cleaned := strings.Trim(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+	if cleaned == "" {
+		return nil
+	}
+	return strings.Split(cleaned, "/")
+}
+
+// sensitivePathErr returns the error for a sensitive path the token may not
+// access. It is reported as not existing to avoid confirming its presence.
+func sensitivePathErr(path string) error {
+	return structs.NewErrRPCCodedf(http.StatusNotFound, "stat %s: no such file or directory", path)
+}
+
+// stream is is used to stream the contents of file in an allocation's
+// directory.
+func (f *FileSystem) stream(conn io.ReadWriteCloser) {
+	defer metrics.MeasureSince([]string{"client", "file_system", "stream"}, time.Now())
+	defer conn.Close()
+
+	// Decode the arguments
+	var req cstructs.FsStreamRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&req); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	if req.AllocID == "" {
+		handleStreamResultError(allocIDNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	alloc, pruned, err := f.getStreamAlloc(req.AllocID)
+	if err != nil {
+		handleStreamResultError(structs.NewErrUnknownAllocation(req.AllocID), helper.Int64ToPtr(404), encoder)
+		return
+	}
+
+	// Check read permissions
+	aclObj, err := f.authorizeAlloc(alloc, req.QueryOptions.AuthToken, acl.NamespaceCapabilityReadFS)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(403), encoder)
+		return
+	}
+
+	// Validate the arguments
+	if req.Path == "" {
+		handleStreamResultError(pathNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	switch req.Origin {
+	case OriginStart, OriginEnd, OriginCurrent, OriginPercent:
+	case "":
+		req.Origin = OriginStart
+	default:
+		handleStreamResultError(invalidStreamOrigin, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.Origin == OriginPercent && (req.Offset < 0 || req.Offset > 100) {
+		handleStreamResultError(invalidPercentOrigin, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.Origin == OriginCurrent && (req.ResumeToken != "" || req.ResumeSHA256 != "" || req.ResumeLength != 0) {
+		handleStreamResultError(invalidCurrentOrigin, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.MaxIdle < 0 {
+		handleStreamResultError(invalidMaxIdle, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.UseCache && (req.Follow || req.Origin == OriginCurrent) {
+		handleStreamResultError(invalidUseCache, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	frameHandle, err := frameEncoding(req.Encoding)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	var sum hash.Hash
+	if req.Checksum != "" {
+		newHash, ok := checksumAlgorithms[req.Checksum]
+		if !ok || req.Follow || req.PlainText {
+			handleStreamResultError(invalidStreamSum, helper.Int64ToPtr(400), encoder)
+			return
+		}
+		sum = newHash()
+	}
+	if req.MaxFramesPerSecond < 0 {
+		handleStreamResultError(invalidMaxFrames, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.EventMarker != "" && !req.PlainText {
+		handleStreamResultError(invalidEventMarker, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.CompressMinBytes < 0 || (req.CompressMinBytes > 0 && req.PlainText) {
+		handleStreamResultError(invalidCompressMin, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	transcoder, err := newTranscoder(req.SourceEncoding)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if err := validateSkipRanges(req.SkipRanges); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error)
+	// Create a goroutine to detect the remote side closing
+	go func() {
+		for {
+			if _, err := conn.Read(nil); err != nil {
+				if err == io.EOF || err == io.ErrClosedPipe {
+					// One end of the pipe was explicitly closed, exit cleanly
+					cancel()
+					return
+				}
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	fs, err := f.getStreamAllocFS(ctx, req.AllocID, pruned, req.WaitForStart)
+	if err != nil {
+		code := helper.Int64ToPtr(500)
+		if structs.IsErrUnknownAllocation(err) {
+			code = helper.Int64ToPtr(404)
+		}
+
+		handleStreamResultError(err, code, encoder)
+		return
+	}
+
+	// Hide sensitive paths from tokens that may not access them
+	if _, err := f.checkSensitivePaths(aclObj, alloc, fs, req.Path); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(404), encoder)
+		return
+	}
+
+	// Calculate the offset
+	fileInfo, err := fs.Stat(req.Path)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if fileInfo.IsDir {
+		handleStreamResultError(
+			fmt.Errorf("file %q is a directory", req.Path),
+			helper.Int64ToPtr(400), encoder)
+		return
+	}
+	canonical, err := fs.CanonicalPath(req.Path)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	// Serve the file from its cached copy, copying it into the cache if it
+	// changed since it was cached
+	if req.UseCache && f.streamCache != nil && !req.Validate {
+		key := fileStreamCacheKey(req.AllocID, req.Path, fileInfo)
+		cached, ok := f.streamCache.open(key)
+		if !ok {
+			cached, ok, err = f.streamCache.add(fs, key, req.Path, fileInfo.Size)
+			if err != nil {
+				handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+				return
+			}
+		}
+		if ok {
+			defer cached.Close()
+			fs = &cachedFileFS{AllocDirFS: fs, path: req.Path, file: cached}
+		}
+	}
+
+	// If offsetting from the end subtract from the size
+	if req.Origin == "end" {
+		req.Offset = fileInfo.Size - req.Offset
+		if req.Offset < 0 {
+			req.Offset = 0
+		}
+	}
+
+	// If offsetting by a percentage of the size start at the next line
+	if req.Origin == OriginPercent {
+		req.Offset, err = percentOffset(fs, req.Path, fileInfo.Size, req.Offset)
+		if err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+			return
+		}
+	}
+
+	// A resume token or checksum of the start of the file overrides the
+	// offset if the file still matches it, otherwise the stream restarts
+	// from the beginning of the file.
+	var token *resumeToken
+	if req.ResumeToken != "" {
+		if req.ResumeSHA256 != "" || req.ResumeLength != 0 {
+			handleStreamResultError(invalidResumeSHA256, helper.Int64ToPtr(400), encoder)
+			return
+		}
+
+		token, err = parseResumeToken(req.ResumeToken)
+		if err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+			return
+		}
+	} else if req.ResumeSHA256 != "" || req.ResumeLength != 0 {
+		token, err = prefixResumeToken(req.ResumeLength, req.ResumeSHA256)
+		if err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+			return
+		}
+	}
+
+	resumeRestarted := false
+	if token != nil {
+		ok, err := token.matches(fs, req.Path, fileInfo.Size)
+		if err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+			return
+		}
+
+		if ok {
+			req.Offset = token.Offset
+		} else {
+			req.Offset = 0
+			resumeRestarted = true
+		}
+	}
+
+	if req.Validate {
+		if err := sendValidated(req.Path, req.PlainText, frameHandle, encoder, conn); err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		}
+		return
+	}
+
+	frames := make(chan *sframer.StreamFrame, streamFramesBuffer)
+	var buf bytes.Buffer
+	frameCodec := codec.NewEncoder(&buf, frameHandle)
+
+	// Tell the client the canonical path being streamed before any data
+	if req.IncludePath && !req.PlainText {
+		frames <- &sframer.StreamFrame{File: req.Path, Path: canonical}
+	}
+
+	// Followed streams of the whole file may share the reader of an identical
+	// stream rather than each reading the file
+	shareable := f.sharedStreams != nil && req.Follow && !resumeRestarted &&
+		req.Limit == 0 && len(req.SkipRanges) == 0
+
+	// Create the framer, unless the stream may be shared
+	var framer *sframer.StreamFramer
+	newFramer := func() {
+		framer = sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+		framer.SetLineAligned(req.LineAligned)
+		framer.Run()
+	}
+	defer func() {
+		if framer != nil {
+			framer.Destroy()
+		}
+	}()
+	if !shareable {
+		newFramer()
+	}
+
+	// Let the client know the stream did not resume where it asked to
+	if resumeRestarted {
+		if err := framer.Send(req.Path, resumeRestartEvent, nil, 0); err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+			return
+		}
+	}
+
+	// The current origin is resolved as late as possible so that data written
+	// while the request was being processed is not streamed
+	if req.Origin == OriginCurrent {
+		req.Offset, err = currentOffset(fs, req.Path, req.Offset)
+		if err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+			return
+		}
+	}
+
+	// Track the position and trailing content delivered so resume tokens
+	// can be generated
+	resume := newResumeTracker(req.Offset)
+
+	// If we aren't following end as soon as we hit EOF
+	cancelAfterFirstEof := !req.Follow
+
+	// Coalesce the frames in excess of the frame rate limit
+	var out <-chan *sframer.StreamFrame
+	coalesce := func() {
+		out = frames
+		if req.MaxFramesPerSecond > 0 {
+			out = coalesceFrames(ctx, frames, req.MaxFramesPerSecond)
+		}
+	}
+	coalesce()
+
+	// startReader streams the file from the offset with a reader of its own
+	startReader := func(offset int64) {
+		framer := framer
+		go func() {
+			if err := f.streamFile(ctx, offset, req.Path, req.Limit, req.SkipRanges, fs, framer, nil, cancelAfterFirstEof, nil); err != nil {
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+				}
+			}
+
+			framer.Destroy()
+		}()
+	}
+
+	// Start streaming, joining the shared reader of the file if it is
+	// streaming from the same offset
+	var shared *sharedStreamSub
+	if shareable {
+		key := sharedStreamKey{allocID: req.AllocID, path: req.Path, lineAligned: req.LineAligned}
+		shared = f.sharedStreams.subscribe(key, req.Offset, frames, func(ctx context.Context, framer *sframer.StreamFramer) error {
+			return f.streamFile(ctx, req.Offset, req.Path, 0, nil, fs, framer, nil, false, nil)
+		})
+		if shared == nil {
+			newFramer()
+		} else {
+			defer shared.leave()
+		}
+	}
+	if shared == nil {
+		startReader(req.Offset)
+	}
+
+	// Close followed streams that stop receiving data
+	var idle *idleTimer
+	if req.Follow {
+		idle = newIdleTimer(req.MaxIdle)
+		defer idle.stop()
+	}
+
+	// nextSeq returns the sequence number of the next frame sent, if the
+	// frames are sequenced
+	var seq int64
+	nextSeq := func() int64 {
+		if !req.Sequenced {
+			return 0
+		}
+		seq++
+		return seq
+	}
+
+	// Make the file events visible in plain text streams
+	var marker *eventMarker
+	if req.EventMarker != "" {
+		marker = &eventMarker{format: req.EventMarker}
+	}
+
+	// End the stream if its token no longer allows reading the file
+	aclCheck, stopACLCheck := f.streamACLCheck(aclObj != nil)
+	defer stopACLCheck()
+
+	sentFile := false
+	sendFrame := func(frame *sframer.StreamFrame) error {
+		var resp cstructs.StreamErrWrapper
+		if marker != nil {
+			resp.Payload = marker.mark(frame)
+		} else if req.PlainText {
+			resp.Payload = frame.Data
+		} else {
+			// The streamed file never changes so only send its name once
+			if req.Compact && frame.File != "" {
+				if sentFile {
+					frame.File = ""
+				}
+				sentFile = true
+			}
+
+			if req.Resumable && len(frame.Data) > 0 && time.Since(resume.lastToken) >= streamResumeTokenRate {
+				frame.ResumeToken = resume.token().String()
+				resume.lastToken = time.Now()
+			}
+			if !frame.IsHeartbeat() {
+				frame.Seq = nextSeq()
+			}
+			if req.CompressMinBytes > 0 {
+				if err := frame.CompressData(req.CompressMinBytes); err != nil {
+					return err
+				}
+			}
+
+			if err := frameCodec.Encode(frame); err != nil {
+				return err
+			}
+
+			resp.Payload = buf.Bytes()
+			buf.Reset()
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+		encoder.Reset(conn)
+		return nil
+	}
+
+	// flushTranscoder sends the incomplete character the transcoder held back
+	// once the stream ends
+	flushTranscoder := func() error {
+		if transcoder == nil {
+			return nil
+		}
+		data := transcoder.flush()
+		if len(data) == 0 {
+			return nil
+		}
+		if sum != nil {
+			sum.Write(data)
+		}
+		return sendFrame(&sframer.StreamFrame{File: req.Path, Offset: resume.offset, Data: data})
+	}
+
+	var streamErr error
+	completed := false
+OUTER:
+	for {
+		select {
+		case streamErr = <-errCh:
+			break OUTER
+		case <-aclCheck:
+			aclObj, err := f.authorizeAlloc(alloc, req.QueryOptions.AuthToken, acl.NamespaceCapabilityReadFS)
+			if err == nil {
+				_, err = f.checkSensitivePaths(aclObj, alloc, fs, req.Path)
+			}
+			if err != nil {
+				handleStreamResultError(err, helper.Int64ToPtr(403), encoder)
+				return
+			}
+		case <-idle.C():
+			if streamErr = flushTranscoder(); streamErr != nil {
+				break OUTER
+			}
+			if !req.PlainText {
+				streamErr = sendIdleTimeout(req.Path, nextSeq(), frameHandle, encoder, conn)
+			} else if marker != nil {
+				payload := marker.mark(&sframer.StreamFrame{FileEvent: idleTimeoutEvent})
+				streamErr = encoder.Encode(cstructs.StreamErrWrapper{Payload: payload})
+			}
+			break OUTER
+		case frame, ok := <-out:
+			if !ok {
+				// A stream that fell behind the shared reader continues
+				// reading the file itself from where it got to
+				if shared != nil {
+					lagged, err := shared.result()
+					if lagged {
+						shared = nil
+						frames = make(chan *sframer.StreamFrame, streamFramesBuffer)
+						newFramer()
+						coalesce()
+						startReader(resume.offset)
+						continue
+					}
+					if err != nil {
+						streamErr = err
+						break OUTER
+					}
+				}
+
+				// frame may have been closed when an error
+				// occurred. Check once more for an error.
+				select {
+				case streamErr = <-errCh:
+					// There was a pending error!
+				default:
+					// No error, continue on
+					completed = true
+					streamErr = flushTranscoder()
+				}
+
+				break OUTER
+			}
+
+			resume.update(frame)
+			idle.update(frame)
+			if transcoder != nil && len(frame.Data) > 0 {
+				frame.Data = transcoder.transcode(frame.Data)
+			}
+			if sum != nil {
+				sum.Write(frame.Data)
+			}
+
+			if err := sendFrame(frame); err != nil {
+				streamErr = err
+				break OUTER
+			}
+		case <-ctx.Done():
+			break OUTER
+		}
+	}
+
+	// Finish the stream with the checksum of the data streamed
+	if completed && streamErr == nil && sum != nil && ctx.Err() == nil {
+		streamErr = sendStreamCompleted(req.Path, nextSeq(), hex.EncodeToString(sum.Sum(nil)), frameHandle, encoder, conn)
+	}
+
+	if streamErr != nil {
+		handleStreamResultError(streamErr, helper.Int64ToPtr(500), encoder)
+		return
+	}
+}
+
+// streamACLCheck returns a channel receiving whenever the token of a stream
+// should be checked again, if enabled, along with a function stopping it.
+func (f *FileSystem) streamACLCheck(enabled bool) (<-chan time.Time, func()) {
+	if !enabled {
+		return nil, func() {}
+	}
+
+	ticker := time.NewTicker(f.aclCheckInterval)
+	return ticker.C, ticker.Stop
+}
+
+// validateSkipRanges returns an error if the byte ranges to skip when streaming
+// a file are not ordered and non-overlapping.
+func validateSkipRanges(ranges [][2]int64) error {
+	var prevEnd int64
+	for _, r := range ranges {
+		if r[0] < prevEnd || r[0] >= r[1] {
+			return invalidSkipRanges
+		}
+		prevEnd = r[1]
+	}
+	return nil
+}
+
+// resumeToken identifies a position within a streamed file along with a
+// checksum of the content preceding it, so a resumed stream can verify the file
+// has not been rotated or rewritten since the token was issued.
+type resumeToken struct {
+	// Offset is the position in the file to resume from.
+	Offset int64
+
+	// Length is the number of bytes preceding Offset covered by Sum.
+	Length int64
+
+	// Sum is the SHA-256 checksum of the Length bytes preceding Offset.
+	Sum []byte
+}
+
+// String returns the opaque form of the token sent to clients.
+func (r *resumeToken) String() string {
+	return fmt.Sprintf("%d:%d:%x", r.Offset, r.Length, r.Sum)
+}
+
+// parseResumeToken parses a token previously returned by String.
+func parseResumeToken(s string) (*resumeToken, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return nil, invalidResumeToken
+	}
+
+	offset, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || offset < 0 {
+		return nil, invalidResumeToken
+	}
+
+	length, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || length < 0 || length > offset || length > resumeTokenWindow {
+		return nil, invalidResumeToken
+	}
+
+	sum, err := hex.DecodeString(parts[2])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, invalidResumeToken
+	}
+
+	return &resumeToken{Offset: offset, Length: length, Sum: sum}, nil
+}
+
+// matches returns whether the file at path still contains the content the
+// token was issued for. size is the current size of the file.
+func (r *resumeToken) matches(fs allocdir.AllocDirFS, path string, size int64) (bool, error) {
+	// The file was truncated or replaced by a smaller one
+	if size < r.Offset {
+		return false, nil
+	}
+
+	file, err := fs.ReadAt(path, r.Offset-r.Length)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// The preceding content is hashed as it is read as it may be the whole
+	// start of a large file
+	h := sha256.New()
+	if _, err := io.CopyN(h, file, r.Length); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return bytes.Equal(h.Sum(nil), r.Sum), nil
+}
+
+// prefixResumeToken returns a token resuming after the first length bytes of a
+// file, whose SHA-256 checksum is the hex encoded sum.
+func prefixResumeToken(length int64, sum string) (*resumeToken, error) {
+	decoded, err := hex.DecodeString(sum)
+	if err != nil || len(decoded) != sha256.Size || length < 0 {
+		return nil, invalidResumeSHA256
+	}
+
+	return &resumeToken{
+		Offset: length,
+		Length: length,
+		Sum:    decoded,
+	}, nil
+}
+
+// resumeTracker follows the position and trailing content delivered by a
+// single file stream so resume tokens can be generated for it.
+type resumeTracker struct {
+	offset    int64
+	tail      []byte
+	lastToken time.Time
+}
+
+func newResumeTracker(offset int64) *resumeTracker {
+	return &resumeTracker{offset: offset}
+}
+
+// update records the data delivered by the frame.
+func (r *resumeTracker) update(frame *sframer.StreamFrame) {
+	// Data following a truncation is read from the start of the file, and
+	// data following a skipped range from its end
+	if frame.FileEvent == truncateEvent || frame.FileEvent == resumeRestartEvent {
+		r.offset = 0
+		r.tail = r.tail[:0]
+	} else if frame.FileEvent == skippedEvent {
+		r.offset = frame.Offset
+		r.tail = r.tail[:0]
+	}
+
+	r.offset += int64(len(frame.Data))
+	r.tail = append(r.tail, frame.Data...)
+	if over := len(r.tail) - resumeTokenWindow; over > 0 {
+		r.tail = append(r.tail[:0], r.tail[over:]...)
+	}
+}
+
+// token returns a resume token for the current position.
+func (r *resumeTracker) token() *resumeToken {
+	sum := sha256.Sum256(r.tail)
+	return &resumeToken{
+		Offset: r.offset,
+		Length: int64(len(r.tail)),
+		Sum:    sum[:],
+	}
+}
+
+// watchDir is used to stream a frame for each entry created in a directory
+// of an allocation, optionally followed by the contents of created files.
+func (f *FileSystem) watchDir(conn io.ReadWriteCloser) {
+	defer metrics.MeasureSince([]string{"client", "file_system", "watch_dir"}, time.Now())
+	defer conn.Close()
+
+	// Decode the arguments
+	var req cstructs.FsWatchDirRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&req); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	if req.AllocID == "" {
+		handleStreamResultError(allocIDNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	// Validate the arguments
+	if req.Path == "" {
+		handleStreamResultError(pathNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	fs, allowSensitive, err := f.authorizeAllocFS(req.AllocID, req.QueryOptions.AuthToken, req.Path)
+	if err != nil {
+		handleStreamResultError(err, authorizeErrCode(err), encoder)
+		return
+	}
+
+	fileInfo, err := fs.Stat(req.Path)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if !fileInfo.IsDir {
+		handleStreamResultError(
+			fmt.Errorf("file %q is not a directory", req.Path),
+			helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	frames := make(chan *sframer.StreamFrame, streamFramesBuffer)
+	errCh := make(chan error)
+	var buf bytes.Buffer
+	frameCodec := codec.NewEncoder(&buf, structs.JsonHandle)
+
+	// Create the framer
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start watching
+	go func() {
+		if err := f.watchDirImpl(ctx, req.Path, req.Follow, allowSensitive, fs, framer); err != nil {
+			select {
+			case errCh <- err:
+			case <-ctx.Done():
+			}
+		}
+
+		framer.Destroy()
+	}()
+
+	// Create a goroutine to detect the remote side closing
+	go func() {
+		for {
+			if _, err := conn.Read(nil); err != nil {
+				if err == io.EOF || err == io.ErrClosedPipe {
+					// One end of the pipe was explicitly closed, exit cleanly
+					cancel()
+					return
+				}
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	var streamErr error
+OUTER:
+	for {
+		select {
+		case streamErr = <-errCh:
+			break OUTER
+		case frame, ok := <-frames:
+			if !ok {
+				// frame may have been closed when an error
+				// occurred. Check once more for an error.
+				select {
+				case streamErr = <-errCh:
+					// There was a pending error!
+				default:
+					// No error, continue on
+				}
+
+				break OUTER
+			}
+
+			if err = frameCodec.Encode(frame); err != nil {
+				streamErr = err
+				break OUTER
+			}
+
+			resp := cstructs.StreamErrWrapper{Payload: buf.Bytes()}
+			buf.Reset()
+
+			if err := encoder.Encode(resp); err != nil {
+				streamErr = err
+				break OUTER
+			}
+			encoder.Reset(conn)
+		case <-ctx.Done():
+			break OUTER
+		}
+	}
+
+	if streamErr != nil {
+		handleStreamResultError(streamErr, helper.Int64ToPtr(500), encoder)
+		return
+	}
+}
+
+// watchDirImpl sends a createEvent frame for each entry created in the
+// directory until the context is cancelled or the framer exits. Entries present
+// when the watch starts are not reported. If follow is set the contents of each
+// created file are streamed as well.
+func (f *FileSystem) watchDirImpl(ctx context.Context, dir string, follow, allowSensitive bool,
+	fs allocdir.AllocDirFS, framer *sframer.StreamFramer) error {
+
+	entries, err := fs.List(dir)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		seen[entry.Name] = struct{}{}
+	}
+
+	followErrCh := make(chan error, 1)
+	ticker := time.NewTicker(watchDirCheckRate)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-framer.ExitCh():
+			return nil
+		case err := <-followErrCh:
+			return err
+		case <-ticker.C:
+		}
+
+		entries, err := fs.List(dir)
+		if err != nil {
+			return err
+		}
+
+		current := make(map[string]struct{}, len(entries))
+		for _, entry := range entries {
+			current[entry.Name] = struct{}{}
+			if _, ok := seen[entry.Name]; ok {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name)
+			if !allowSensitive && f.isSensitivePath(fs, path) {
+				continue
+			}
+
+			if err := framer.Send(path, createEvent, nil, 0); err != nil {
+				return parseFramerErr(err)
+			}
+
+			if follow && !entry.IsDir {
+				go func() {
+					if err := f.streamFile(ctx, 0, path, 0, nil, fs, framer, nil, false, nil); err != nil {
+						select {
+						case followErrCh <- err:
+						default:
+						}
+					}
+				}()
+			}
+		}
+
+		// Forget removed entries so they are reported again if recreated
+		seen = current
+	}
+}
+
+// grep is used to stream the lines of a file of an allocation that match a
+// pattern, without streaming the file itself.
+func (f *FileSystem) grep(conn io.ReadWriteCloser) {
+	defer metrics.MeasureSince([]string{"client", "file_system", "grep"}, time.Now())
+	defer conn.Close()
+
+	// Decode the arguments
+	var req cstructs.FsGrepRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&req); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	if req.AllocID == "" {
+		handleStreamResultError(allocIDNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	// Validate the arguments
+	if req.Path == "" {
+		handleStreamResultError(pathNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.MaxMatches < 0 || req.ContextLines < 0 {
+		handleStreamResultError(invalidGrepLimits, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	re, err := regexp.Compile(req.Pattern)
+	if err != nil {
+		handleStreamResultError(fmt.Errorf("invalid pattern: %v", err), helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	fs, _, err := f.authorizeAllocFS(req.AllocID, req.QueryOptions.AuthToken, req.Path)
+	if err != nil {
+		handleStreamResultError(err, authorizeErrCode(err), encoder)
+		return
+	}
+
+	fileInfo, err := fs.Stat(req.Path)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if fileInfo.IsDir {
+		handleStreamResultError(
+			fmt.Errorf("file %q is a directory", req.Path),
+			helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	file, err := fs.ReadAt(req.Path, 0)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create a goroutine to detect the remote side closing
+	go func() {
+		for {
+			if _, err := conn.Read(nil); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	var buf bytes.Buffer
+	matchCodec := codec.NewEncoder(&buf, structs.JsonHandle)
+	err = grepImpl(ctx, file, re, req.MaxMatches, req.ContextLines, func(match *cstructs.FsGrepMatch) error {
+		if err := matchCodec.Encode(match); err != nil {
+			return err
+		}
+
+		resp := cstructs.StreamErrWrapper{Payload: buf.Bytes()}
+		buf.Reset()
+
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+		encoder.Reset(conn)
+		return nil
+	})
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+}
+
+// grepImpl scans the reader for lines matching the pattern, passing each match
+// to emit in the order they occur. At most maxMatches matches are emitted if
+// it is greater than zero, and each match includes up to contextLines lines
+// before and after it. Scanning stops early if the context is cancelled.
+func grepImpl(ctx context.Context, r io.Reader, re *regexp.Regexp, maxMatches, contextLines int,
+	emit func(*cstructs.FsGrepMatch) error) error {
+
+	reader := bufio.NewReader(r)
+
+	// before holds the lines preceding the current line and pending holds
+	// the matches still collecting lines after them
+	var before []string
+	var pending []*cstructs.FsGrepMatch
+	var offset int64
+	matches := 0
+
+	for lineNum := 1; ; lineNum++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		// Stop once the last match has all its context lines
+		done := maxMatches > 0 && matches >= maxMatches
+		if done && len(pending) == 0 {
+			return nil
+		}
+
+		raw, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if raw == "" && readErr == io.EOF {
+			break
+		}
+
+		line := strings.TrimSuffix(strings.TrimSuffix(raw, "\n"), "\r")
+
+		// Complete the context of earlier matches, emitting those that are
+		// done
+		for _, match := range pending {
+			match.After = append(match.After, line)
+		}
+		for len(pending) > 0 && len(pending[0].After) >= contextLines {
+			if err := emit(pending[0]); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+
+		if !done && re.MatchString(line) {
+			matches++
+			match := &cstructs.FsGrepMatch{
+				Offset: offset,
+				Line:   lineNum,
+				Text:   line,
+			}
+			if len(before) > 0 {
+				match.Before = append([]string(nil), before...)
+			}
+
+			if contextLines == 0 {
+				if err := emit(match); err != nil {
+					return err
+				}
+			} else {
+				pending = append(pending, match)
+			}
+		}
+
+		if contextLines > 0 {
+			before = append(before, line)
+			if len(before) > contextLines {
+				before = before[1:]
+			}
+		}
+
+		offset += int64(len(raw))
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	// Matches near the end of the file have fewer lines after them
+	for _, match := range pending {
+		if err := emit(match); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lineIndex is used to stream the byte offsets of every Stride'th line of a
+// file, so that clients can seek close to a line and stream from there.
+func (f *FileSystem) lineIndex(conn io.ReadWriteCloser) {
+	defer metrics.MeasureSince([]string{"client", "file_system", "line_index"}, time.Now())
+	defer conn.Close()
+
+	// Decode the arguments
+	var req cstructs.FsLineIndexRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&req); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	if req.AllocID == "" {
+		handleStreamResultError(allocIDNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	// Validate the arguments
+	if req.Path == "" {
+		handleStreamResultError(pathNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.Stride <= 0 || req.MaxEntries < 0 || req.MaxEntries > maxLineIndexEntries {
+		handleStreamResultError(invalidLineIndex, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	maxEntries := req.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = maxLineIndexEntries
+	}
+
+	fs, _, err := f.authorizeAllocFS(req.AllocID, req.QueryOptions.AuthToken, req.Path)
+	if err != nil {
+		handleStreamResultError(err, authorizeErrCode(err), encoder)
+		return
+	}
+
+	fileInfo, err := fs.Stat(req.Path)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if fileInfo.IsDir {
+		handleStreamResultError(
+			fmt.Errorf("file %q is a directory", req.Path),
+			helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	file, err := fs.ReadAt(req.Path, 0)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create a goroutine to detect the remote side closing
+	go func() {
+		for {
+			if _, err := conn.Read(nil); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	var buf bytes.Buffer
+	batchCodec := codec.NewEncoder(&buf, structs.JsonHandle)
+	err = lineIndexImpl(ctx, file, req.Stride, maxEntries, func(batch *cstructs.FsLineIndexBatch) error {
+		if err := batchCodec.Encode(batch); err != nil {
+			return err
+		}
+
+		resp := cstructs.StreamErrWrapper{Payload: buf.Bytes()}
+		buf.Reset()
+
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+		encoder.Reset(conn)
+		return nil
+	})
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+}
+
+// lineIndexImpl scans the reader for the start of every stride'th line,
+// starting with the first, passing batches of at most lineIndexBatchSize
+// entries to emit. Scanning stops once maxEntries entries have been found if it
+// is greater than zero, and the final batch summarizes what was scanned.
+// Scanning stops early without a final batch if the context is cancelled.
+func lineIndexImpl(ctx context.Context, r io.Reader, stride, maxEntries int,
+	emit func(*cstructs.FsLineIndexBatch) error) error {
+
+	reader := bufio.NewReader(r)
+	batch := new(cstructs.FsLineIndexBatch)
+	entries := 0
+
+	// lineStart is set while the next byte read starts a new line
+	var offset int64
+	lines := 0
+	lineStart := true
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		// Lines are read in chunks so that long lines don't need buffering
+		chunk, err := reader.ReadSlice('\n')
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return err
+		}
+
+		if len(chunk) > 0 && lineStart {
+			lines++
+			if (lines-1)%stride == 0 {
+				if maxEntries > 0 && entries == maxEntries {
+					// The summary covers the lines before the first line
+					// left out of the index
+					lines--
+					batch.Truncated = true
+					break
+				}
+
+				entries++
+				batch.Entries = append(batch.Entries, &cstructs.FsLineIndexEntry{Line: lines, Offset: offset})
+				if len(batch.Entries) == lineIndexBatchSize {
+					if err := emit(batch); err != nil {
+						return err
+					}
+					batch = new(cstructs.FsLineIndexBatch)
+				}
+			}
+		}
+
+		offset += int64(len(chunk))
+		lineStart = len(chunk) > 0 && chunk[len(chunk)-1] == '\n'
+		if err == io.EOF {
+			break
+		}
+	}
+
+	batch.Done = true
+	batch.Lines = lines
+	batch.Bytes = offset
+	return emit(batch)
+}
+
+// validateLogsRequest returns an error if the options of the logs request are
+// invalid or conflict. An unset origin is defaulted to the start of the logs.
+func validateLogsRequest(req *cstructs.FsLogsRequest) error {
+	if req.AllocLog && req.Task != "" {
+		return allocLogTaskErr
+	} else if !req.AllocLog && req.Task == "" {
+		return taskNotPresentErr
+	}
+	if req.LogType == "" || strings.ContainsAny(req.LogType, "./") {
+		return logTypeNotPresentErr
+	}
+	stdLogType := req.LogType == "stdout" || req.LogType == "stderr"
+	switch req.Origin {
+	case "start", "end":
+	case "":
+		req.Origin = "start"
+	default:
+		return invalidOrigin
+	}
+	if req.SinceDuration < 0 || (req.SinceDuration > 0 && (req.Offset != 0 || req.Origin == "end")) {
+		return invalidSinceDuration
+	}
+	if req.MaxBacklog < 0 || (req.MaxBacklog > 0 && (req.Origin == "end" || req.SinceDuration != 0 ||
+		req.StartIndex != nil || req.EndIndex != nil)) {
+		return invalidMaxBacklog
+	}
+	if req.TailLines < 0 || (req.TailLines > 0 && (req.Offset != 0 || req.SinceDuration != 0 || req.MaxBacklog != 0 ||
+		req.StartIndex != nil || req.EndIndex != nil)) {
+		return invalidLogsTail
+	}
+	if req.MaxIdle < 0 {
+		return invalidMaxIdle
+	}
+	if req.Snapshot && req.Follow {
+		return invalidSnapshot
+	}
+	if req.TailOtherOnExit < 0 || (req.TailOtherOnExit > 0 && (!req.Follow || req.AllocLog || !stdLogType)) {
+		return invalidExitTail
+	}
+	if req.StopOnTaskExit && (!req.Follow || req.AllocLog || req.TailOtherOnExit > 0) {
+		return invalidStopOnExit
+	}
+	if req.StartIndex != nil || req.EndIndex != nil {
+		if req.StartIndex == nil || req.EndIndex == nil || *req.StartIndex > *req.EndIndex ||
+			req.Follow || req.Offset != 0 || req.Origin == "end" || req.SinceDuration != 0 {
+			return invalidIndexRange
+		}
+	}
+	if req.LineRanges && (req.PlainText || req.DetectLevel || req.MaxLinesPerSecond > 0 ||
+		req.StartAfterMatch != "" || req.StartAfterRegex != "" || req.JumpToFirstError) {
+		return invalidLineRanges
+	}
+	if (req.LineNumbers || req.LineRanges) && (req.Origin != "start" || req.Offset != 0 || req.SinceDuration != 0 ||
+		req.MaxBacklog != 0 || req.TailLines != 0 || req.StartIndex != nil ||
+		((req.Dedup || req.CollapseBlankLines || req.DropBlankLines) && !req.PlainText)) {
+		return invalidLineNumbers
+	}
+	if req.MaxLineBytes < 0 {
+		return invalidMaxLineBytes
+	}
+	if req.MaxFramesPerSecond < 0 || (req.MaxFramesPerSecond > 0 && (req.DetectLevel || req.MaxLinesPerSecond > 0)) {
+		return invalidLogsMaxFrames
+	}
+	if req.EventMarker != "" && !req.PlainText {
+		return invalidEventMarker
+	}
+	if req.CompressMinBytes < 0 || (req.CompressMinBytes > 0 && req.PlainText) {
+		return invalidCompressMin
+	}
+	if req.WholeLinesOnly && !req.Follow {
+		return invalidWholeLines
+	}
+	if req.MaxFilesSpanned < 0 {
+		return invalidMaxFiles
+	}
+	if req.EmitStatEvery < 0 || (req.EmitStatEvery > 0 && (!req.Follow || req.PlainText)) {
+		return invalidEmitStat
+	}
+	if req.Manifest && (req.Follow || req.PlainText) {
+		return invalidManifest
+	}
+	if req.IncludeExitInfo && (req.AllocLog || req.Follow || req.PlainText) {
+		return invalidExitInfo
+	}
+	return nil
+}
+
+// taskLogsOptions are the options of a logs request that rely on the log
+// files, and so are not supported when streaming the logs from a task's driver
+// that keeps them elsewhere.
+var taskLogsOptions = []struct {
+	name string
+	set  func(req *cstructs.FsLogsRequest) bool
+}{
+	{"since duration", func(req *cstructs.FsLogsRequest) bool { return req.SinceDuration != 0 }},
+	{"max backlog", func(req *cstructs.FsLogsRequest) bool { return req.MaxBacklog != 0 }},
+	{"tail lines", func(req *cstructs.FsLogsRequest) bool { return req.TailLines != 0 }},
+	{"snapshot", func(req *cstructs.FsLogsRequest) bool { return req.Snapshot }},
+	{"index range", func(req *cstructs.FsLogsRequest) bool { return req.StartIndex != nil }},
+	{"tail of the other log type on exit", func(req *cstructs.FsLogsRequest) bool { return req.TailOtherOnExit != 0 }},
+	{"stop on task exit", func(req *cstructs.FsLogsRequest) bool { return req.StopOnTaskExit }},
+	{"stat snapshots", func(req *cstructs.FsLogsRequest) bool { return req.EmitStatEvery != 0 }},
+	{"manifest", func(req *cstructs.FsLogsRequest) bool { return req.Manifest }},
+}
+
+// validateTaskLogsRequest returns an error naming the options of the logs
+// request that are not supported when streaming the logs from a task's driver.
+func validateTaskLogsRequest(req *cstructs.FsLogsRequest) error {
+	var unsupported []string
+	for _, opt := range taskLogsOptions {
+		if opt.set(req) {
+			unsupported = append(unsupported, opt.name)
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s not supported by the task's driver, which keeps its logs outside of the log files",
+		strings.Join(unsupported, ", "))
+}
+
+// logs is is used to stream a task's logs.
+func (f *FileSystem) logs(conn io.ReadWriteCloser) {
+	defer metrics.MeasureSince([]string{"client", "file_system", "logs"}, time.Now())
+	defer conn.Close()
+
+	// Decode the arguments
+	var req cstructs.FsLogsRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&req); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	if req.AllocID == "" {
+		handleStreamResultError(allocIDNotPresentErr, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	alloc, pruned, err := f.getStreamAlloc(req.AllocID)
+	if err != nil {
+		handleStreamResultError(structs.NewErrUnknownAllocation(req.AllocID), helper.Int64ToPtr(404), encoder)
+		return
+	}
+
+	// Check read permissions. Logs are always read from the log directory, so
+	// tokens that may only read logs may stream them.
+	aclObj, err := f.authorizeAlloc(alloc, req.QueryOptions.AuthToken,
+		acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(403), encoder)
+		return
+	}
+
+	// Validate the arguments
+	if err := validateLogsRequest(&req); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	stdLogType := req.LogType == "stdout" || req.LogType == "stderr"
+	transcoder, err := newTranscoder(req.SourceEncoding)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	frameHandle, err := frameEncoding(req.Encoding)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	maxLine := req.MaxLineBytes
+	if maxLine == 0 {
+		maxLine = defaultMaxLineBytes
+	}
+	gate, err := newMarkerGate(req.StartAfterMatch, req.StartAfterRegex)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if req.JumpToFirstError {
+		if gate != nil {
+			handleStreamResultError(invalidJumpToError, helper.Int64ToPtr(400), encoder)
+			return
+		}
+		gate, err = newErrorGate(req.LevelPatterns)
+		if err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+			return
+		}
+	}
+	if gate != nil {
+		gate.maxLine = maxLine
+	}
+	var leveler *levelTagger
+	if req.DetectLevel {
+		leveler, err = newLevelTagger(req.LevelPatterns, req.MinLevel)
+		if err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+			return
+		}
+		leveler.maxLine = maxLine
+	} else if (len(req.LevelPatterns) != 0 && !req.JumpToFirstError) || req.MinLevel != "" {
+		handleStreamResultError(invalidLevelOptions, helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error)
+	// Create a goroutine to detect the remote side closing
+	go func() {
+		for {
+			if _, err := conn.Read(nil); err != nil {
+				if err == io.EOF || err == io.ErrClosedPipe {
+					// One end of the pipe was explicitly closed, exit cleanly
+					cancel()
+					return
+				}
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}()
+
+	fs, err := f.getStreamAllocFS(ctx, req.AllocID, pruned, req.WaitForStart)
+	if err != nil {
+		code := helper.Int64ToPtr(500)
+		if structs.IsErrUnknownAllocation(err) {
+			code = helper.Int64ToPtr(404)
+		}
+
+		handleStreamResultError(err, code, encoder)
+		return
+	}
+
+	// Log types other than stdout and stderr are only accepted once the task
+	// has written log files for them.
+	if !stdLogType {
+		types, err := listLogTypes(fs, req.Task)
+		if err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+			return
+		}
+		i := sort.SearchStrings(types, req.LogType)
+		if i == len(types) || types[i] != req.LogType {
+			handleStreamResultError(
+				fmt.Errorf("unknown log type %q", req.LogType),
+				helper.Int64ToPtr(400),
+				encoder)
+			return
+		}
+	}
+
+	allocState, err := f.getStreamAllocState(req.AllocID, pruned)
+	if err != nil {
+		code := helper.Int64ToPtr(500)
+		if structs.IsErrUnknownAllocation(err) {
+			code = helper.Int64ToPtr(404)
+		}
+
+		handleStreamResultError(err, code, encoder)
+		return
+	}
+
+	// Check that the task is there. Allocation logs are not written by a
+	// single task so their presence is only known once they are opened.
+	if !req.AllocLog {
+		taskState := allocState.TaskStates[req.Task]
+		if taskState == nil {
+			handleStreamResultError(
+				fmt.Errorf("unknown task name %q", req.Task),
+				helper.Int64ToPtr(400),
+				encoder)
+			return
+		}
+
+		if taskState.StartedAt.IsZero() {
+			handleStreamResultError(
+				fmt.Errorf("task %q not started yet. No logs available", req.Task),
+				helper.Int64ToPtr(404),
+				encoder)
+			return
+		}
+	}
+
+	// Stream the logs from the task's driver if it keeps them outside of the
+	// log files
+	var logsDriver drivers.TaskLogsDriver
+	if !req.AllocLog && pruned == nil {
+		logsDriver, err = f.taskLogs(req.AllocID, req.Task)
+		if err != nil {
+			code := helper.Int64ToPtr(500)
+			if structs.IsErrUnknownAllocation(err) {
+				code = helper.Int64ToPtr(404)
+			}
+
+			handleStreamResultError(err, code, encoder)
+			return
+		}
+	}
+	if logsDriver != nil {
+		if err := validateTaskLogsRequest(&req); err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+			return
+		}
+	}
+
+	// Watch for the task stopping to end the stream, either with the other
+	// log type or once the logs written up to then have been streamed
+	var taskExited, stopFollow <-chan struct{}
+	if req.TailOtherOnExit > 0 || req.StopOnTaskExit {
+		var exited <-chan struct{}
+		if pruned != nil {
+			// The tasks of pruned allocations have all stopped
+			closed := make(chan struct{})
+			close(closed)
+			exited = closed
+		} else {
+			ar, err := f.c.getAllocRunner(req.AllocID)
+			if err != nil {
+				handleStreamResultError(err, helper.Int64ToPtr(404), encoder)
+				return
+			}
+
+			listener := ar.Listener()
+			defer listener.Close()
+			exited = watchTaskExited(ctx, listener, ar.AllocState().TaskStates, req.Task)
+		}
+
+		if req.StopOnTaskExit {
+			stopFollow = afterExitDrain(ctx, exited)
+		} else {
+			taskExited = exited
+		}
+	}
+
+	if req.Validate {
+		if err := sendValidated("", req.PlainText, frameHandle, encoder, conn); err != nil {
+			handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		}
+		return
+	}
+
+	frames := make(chan *sframer.StreamFrame, streamFramesBuffer)
+
+	// Coalesce the frames in excess of the frame rate limit
+	var out <-chan *sframer.StreamFrame = frames
+	if req.MaxFramesPerSecond > 0 {
+		out = coalesceFrames(ctx, frames, req.MaxFramesPerSecond)
+	}
+
+	// Start streaming
+	go func() {
+		var err error
+		if logsDriver != nil {
+			err = f.taskLogsImpl(ctx, &req, logsDriver, frames)
+		} else {
+			err = f.logsImpl(ctx, &req, fs, stopFollow, frames)
+		}
+		if err != nil {
+			select {
+			case errCh <- err:
+			case <-ctx.Done():
+			}
+		}
 	}()
 
-	// Create a goroutine to detect the remote side closing
-	go func() {
-		for {
-			if _, err := conn.Read(nil); err != nil {
-				if err == io.EOF || err == io.ErrClosedPipe {
-					// One end of the pipe was explicitly closed, exit cleanly
-					cancel()
-					return
+	var stripper *ansiStripper
+	if req.StripANSI {
+		stripper = new(ansiStripper)
+	}
+
+	var numberer *lineNumberer
+	if req.LineNumbers || req.LineRanges {
+		numberer = new(lineNumberer)
+	}
+
+	var pacer *linePacer
+	if req.MaxLinesPerSecond > 0 {
+		pacer = newLinePacer(req.MaxLinesPerSecond, req.DropExcessLines)
+	}
+
+	// Blank lines and runs of identical lines are held back until they end,
+	// or are flushed on EOF or when the stream is idle
+	var collapser *blankLineCollapser
+	if (req.CollapseBlankLines || req.DropBlankLines) && !req.PlainText {
+		collapser = &blankLineCollapser{drop: req.DropBlankLines, maxLine: maxLine}
+	}
+	var deduper *lineDeduper
+	if req.Dedup && !req.PlainText {
+		deduper = &lineDeduper{maxLine: maxLine}
+	}
+	var heldFile string
+	var heldOffset int64
+
+	buf := new(bytes.Buffer)
+	frameCodec := codec.NewEncoder(buf, frameHandle)
+	var seq int64
+	// Make the file events visible in plain text streams
+	var marker *eventMarker
+	if req.EventMarker != "" {
+		marker = &eventMarker{format: req.EventMarker}
+	}
+	sendFrame := func(frame *sframer.StreamFrame) error {
+		var resp cstructs.StreamErrWrapper
+		if marker != nil {
+			resp.Payload = marker.mark(frame)
+		} else if req.PlainText {
+			resp.Payload = frame.Data
+		} else {
+			if req.Sequenced && !frame.IsHeartbeat() {
+				seq++
+				frame.Seq = seq
+			}
+			if req.CompressMinBytes > 0 {
+				if err := frame.CompressData(req.CompressMinBytes); err != nil {
+					return err
+				}
+			}
+			if err := frameCodec.Encode(frame); err != nil {
+				return err
+			}
+			frameCodec.Reset(buf)
+
+			resp.Payload = buf.Bytes()
+			buf.Reset()
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+		encoder.Reset(conn)
+		return nil
+	}
+	paceFrame := func(frame *sframer.StreamFrame) error {
+		if pacer != nil && len(frame.Data) > 0 {
+			return pacer.pace(ctx, frame, sendFrame)
+		}
+		return sendFrame(frame)
+	}
+	emitFrame := func(frame *sframer.StreamFrame) error {
+		if leveler == nil || len(frame.Data) == 0 {
+			return paceFrame(frame)
+		}
+		for _, f := range leveler.tag(frame) {
+			if err := paceFrame(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// flushHeld emits the data held back by the blank line collapser, deduper
+	// and level tagger
+	flushHeld := func() error {
+		var data []byte
+		if collapser != nil {
+			data = collapser.flush()
+		}
+		if deduper != nil {
+			if len(data) != 0 {
+				data = deduper.dedup(data)
+			}
+			data = append(data, deduper.flush()...)
+		}
+		if len(data) != 0 {
+			err := emitFrame(&sframer.StreamFrame{
+				Offset: heldOffset,
+				File:   heldFile,
+				Data:   data,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if leveler != nil {
+			if frame := leveler.flush(); frame != nil {
+				return paceFrame(frame)
+			}
+		}
+		return nil
+	}
+
+	// filter passes the data of a frame through the enabled filters and
+	// returns false if the gate dropped all of it. The last frame of a stream
+	// carries the data the filters held back instead.
+	filter := func(frame *sframer.StreamFrame, last bool) bool {
+		if transcoder != nil && last {
+			frame.Data = transcoder.flush()
+		} else if transcoder != nil && len(frame.Data) > 0 {
+			frame.Data = transcoder.transcode(frame.Data)
+		}
+		if stripper != nil && len(frame.Data) > 0 {
+			frame.Data = stripper.strip(frame.Data)
+		}
+		if stripper != nil && last {
+			frame.Data = append(frame.Data, stripper.flush()...)
+		}
+		if numberer != nil && len(frame.Data) > 0 {
+			if req.LineRanges {
+				frame.FirstLine, frame.LastLine = numberer.lineRange(frame.Data)
+			}
+			if req.LineNumbers {
+				frame.Data = numberer.number(frame.Data)
+			} else {
+				numberer.advance(frame.Data)
+			}
+		}
+		if gate != nil && len(frame.Data) > 0 {
+			frame.Data = gate.gate(frame.Data)
+			if len(frame.Data) == 0 && frame.FileEvent == "" {
+				return false
+			}
+		}
+		return true
+	}
+
+	// flushEnd emits the data held back by the filters once the stream ends
+	var lastFile string
+	var lastOffset int64
+	flushEnd := func() error {
+		frame := &sframer.StreamFrame{File: lastFile, Offset: lastOffset}
+		if filter(frame, true) && len(frame.Data) != 0 {
+			if collapser != nil || deduper != nil {
+				heldFile, heldOffset = frame.File, frame.Offset
+				if collapser != nil {
+					frame.Data = collapser.collapse(frame.Data)
 				}
-				select {
-				case errCh <- err:
-				case <-ctx.Done():
-					return
+				if deduper != nil && len(frame.Data) > 0 {
+					frame.Data = deduper.dedup(frame.Data)
+				}
+			}
+			if len(frame.Data) != 0 {
+				if err := emitFrame(frame); err != nil {
+					return err
 				}
 			}
 		}
-	}()
+		return flushHeld()
+	}
+
+	// Close followed streams that stop receiving data
+	var idle *idleTimer
+	if req.Follow {
+		idle = newIdleTimer(req.MaxIdle)
+		defer idle.stop()
+	}
+
+	// End the stream if its token no longer allows reading the logs
+	aclCheck, stopACLCheck := f.streamACLCheck(aclObj != nil)
+	defer stopACLCheck()
+
+	// Interleave snapshots of the newest log file among the frames
+	var statCh <-chan time.Time
+	if req.EmitStatEvery > 0 {
+		ticker := time.NewTicker(req.EmitStatEvery)
+		defer ticker.Stop()
+		statCh = ticker.C
+	}
 
+	var exitDrain <-chan time.Time
 	var streamErr error
 OUTER:
 	for {
 		select {
 		case streamErr = <-errCh:
 			break OUTER
-		case frame, ok := <-frames:
+		case <-aclCheck:
+			_, err := f.authorizeAlloc(alloc, req.QueryOptions.AuthToken,
+				acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs)
+			if err != nil {
+				handleStreamResultError(err, helper.Int64ToPtr(403), encoder)
+				return
+			}
+		case <-statCh:
+			stat, err := logFileStat(fs, req.Task, req.LogType)
+			if err != nil {
+				streamErr = err
+				break OUTER
+			}
+			if stat != nil {
+				if err := sendFrame(&sframer.StreamFrame{LogStat: stat}); err != nil {
+					streamErr = err
+					break OUTER
+				}
+			}
+		case <-taskExited:
+			taskExited = nil
+			exitDrain = time.After(taskExitDrainWait)
+		case <-exitDrain:
+			streamErr = flushEnd()
+			if streamErr == nil {
+				var frame *sframer.StreamFrame
+				frame, streamErr = exitTailFrame(fs, req.Task, otherLogType(req.LogType), req.TailOtherOnExit)
+				if streamErr == nil {
+					streamErr = sendFrame(frame)
+				}
+			}
+			break OUTER
+		case <-idle.C():
+			streamErr = flushEnd()
+			if streamErr == nil && (!req.PlainText || marker != nil) {
+				streamErr = sendFrame(&sframer.StreamFrame{FileEvent: idleTimeoutEvent})
+			}
+			break OUTER
+		case frame, ok := <-out:
 			if !ok {
-				// frame may have been closed when an error
+				// framer may have been closed when an error
 				// occurred. Check once more for an error.
 				select {
 				case streamErr = <-errCh:
 					// There was a pending error!
 				default:
 					// No error, continue on
+					streamErr = flushEnd()
+					if streamErr == nil && req.IncludeExitInfo {
+						streamErr = f.sendExitInfo(&req, pruned, sendFrame)
+					}
 				}
 
 				break OUTER
 			}
 
-			var resp cstructs.StreamErrWrapper
-			if req.PlainText {
-				resp.Payload = frame.Data
-			} else {
-				if err = frameCodec.Encode(frame); err != nil {
+			idle.update(frame)
+
+			if len(frame.Data) > 0 {
+				lastFile, lastOffset = frame.File, frame.Offset
+			}
+			if !filter(frame, false) {
+				continue
+			}
+
+			if frame.IsHeartbeat() {
+				if err := flushHeld(); err != nil {
 					streamErr = err
 					break OUTER
 				}
-
-				resp.Payload = buf.Bytes()
-				buf.Reset()
+			} else if (collapser != nil || deduper != nil) && len(frame.Data) > 0 {
+				heldFile, heldOffset = frame.File, frame.Offset
+				if collapser != nil {
+					frame.Data = collapser.collapse(frame.Data)
+				}
+				if deduper != nil && len(frame.Data) > 0 {
+					frame.Data = deduper.dedup(frame.Data)
+				}
+				if len(frame.Data) == 0 && frame.FileEvent == "" {
+					continue
+				}
 			}
 
-			if err := encoder.Encode(resp); err != nil {
+			if err := emitFrame(frame); err != nil {
 				streamErr = err
 				break OUTER
 			}
-			encoder.Reset(conn)
-		case <-ctx.Done():
-			break OUTER
 		}
 	}
 
 	if streamErr != nil {
-		handleStreamResultError(streamErr, helper.Int64ToPtr(500), encoder)
+		// If error has a Code, use it
+		var code int64 = 500
+		if codedErr, ok := streamErr.(interface{ Code() int }); ok {
+			code = int64(codedErr.Code())
+		}
+		handleStreamResultError(streamErr, &code, encoder)
 		return
 	}
 }
 
-// logs is is used to stream a task's logs.
-func (f *FileSystem) logs(conn io.ReadWriteCloser) {
-	defer metrics.MeasureSince([]string{"client", "file_system", "logs"}, time.Now())
-	defer conn.Close()
-
-	// Decode the arguments
-	var req cstructs.FsLogsRequest
-	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
-	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
-
-	if err := decoder.Decode(&req); err != nil {
-		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
-		return
-	}
+// watchTaskExited returns a channel that is closed once the task is dead,
+// either in the passed task states or in the updates received by the listener.
+func watchTaskExited(ctx context.Context, listener *cstructs.AllocListener,
+	states map[string]*structs.TaskState, task string) <-chan struct{} {
 
-	if req.AllocID == "" {
-		handleStreamResultError(allocIDNotPresentErr, helper.Int64ToPtr(400), encoder)
-		return
-	}
-	alloc, err := f.c.GetAlloc(req.AllocID)
-	if err != nil {
-		handleStreamResultError(structs.NewErrUnknownAllocation(req.AllocID), helper.Int64ToPtr(404), encoder)
-		return
+	exited := make(chan struct{})
+	isDead := func(states map[string]*structs.TaskState) bool {
+		ts := states[task]
+		return ts != nil && ts.State == structs.TaskStateDead
 	}
 
-	// Check read permissions
-	if aclObj, err := f.c.ResolveToken(req.QueryOptions.AuthToken); err != nil {
-		handleStreamResultError(err, nil, encoder)
-		return
-	} else if aclObj != nil {
-		readfs := aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadFS)
-		logs := aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadLogs)
-		if !readfs && !logs {
-			handleStreamResultError(structs.ErrPermissionDenied, nil, encoder)
+	go func() {
+		if isDead(states) {
+			close(exited)
 			return
 		}
-	}
-
-	// Validate the arguments
-	if req.Task == "" {
-		handleStreamResultError(taskNotPresentErr, helper.Int64ToPtr(400), encoder)
-		return
-	}
-	switch req.LogType {
-	case "stdout", "stderr":
-	default:
-		handleStreamResultError(logTypeNotPresentErr, helper.Int64ToPtr(400), encoder)
-		return
-	}
-	switch req.Origin {
-	case "start", "end":
-	case "":
-		req.Origin = "start"
-	default:
-		handleStreamResultError(invalidOrigin, helper.Int64ToPtr(400), encoder)
-		return
-	}
 
-	fs, err := f.c.GetAllocFS(req.AllocID)
-	if err != nil {
-		code := helper.Int64ToPtr(500)
-		if structs.IsErrUnknownAllocation(err) {
-			code = helper.Int64ToPtr(404)
+		for {
+			select {
+			case alloc, ok := <-listener.Ch():
+				if !ok {
+					return
+				}
+				if isDead(alloc.TaskStates) {
+					close(exited)
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		handleStreamResultError(err, code, encoder)
-		return
-	}
+	return exited
+}
 
-	allocState, err := f.c.GetAllocState(req.AllocID)
+// sendExitInfo sends the frame holding the exit status of the task once its
+// logs have been streamed. Nothing is sent if the task has not stopped.
+func (f *FileSystem) sendExitInfo(req *cstructs.FsLogsRequest, pruned *prunedAlloc,
+	send func(*sframer.StreamFrame) error) error {
+	allocState, err := f.getStreamAllocState(req.AllocID, pruned)
 	if err != nil {
-		code := helper.Int64ToPtr(500)
-		if structs.IsErrUnknownAllocation(err) {
-			code = helper.Int64ToPtr(404)
-		}
-
-		handleStreamResultError(err, code, encoder)
-		return
+		return err
 	}
 
-	// Check that the task is there
-	taskState := allocState.TaskStates[req.Task]
-	if taskState == nil {
-		handleStreamResultError(
-			fmt.Errorf("unknown task name %q", req.Task),
-			helper.Int64ToPtr(400),
-			encoder)
-		return
+	info := taskExitInfo(allocState.TaskStates[req.Task])
+	if info == nil {
+		return nil
 	}
 
-	if taskState.StartedAt.IsZero() {
-		handleStreamResultError(
-			fmt.Errorf("task %q not started yet. No logs available", req.Task),
-			helper.Int64ToPtr(404),
-			encoder)
-		return
+	return send(&sframer.StreamFrame{
+		FileEvent: taskExitInfoEvent,
+		ExitInfo:  info,
+	})
+}
+
+// taskExitInfo returns the exit status of the task from its most recent
+// terminated event, or nil if the task is not dead.
+func taskExitInfo(state *structs.TaskState) *sframer.TaskExitInfo {
+	if state == nil || state.State != structs.TaskStateDead {
+		return nil
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	info := &sframer.TaskExitInfo{FinishedAt: state.FinishedAt}
+	for i := len(state.Events) - 1; i >= 0; i-- {
+		e := state.Events[i]
+		if e.Type != structs.TaskTerminated {
+			continue
+		}
 
-	frames := make(chan *sframer.StreamFrame, streamFramesBuffer)
-	errCh := make(chan error)
+		info.ExitCode = e.ExitCode
+		info.Signal = e.Signal
+		info.OOMKilled = e.Details["oom_killed"] == "true"
+		break
+	}
 
-	// Start streaming
+	return info
+}
+
+// afterExitDrain returns a channel that is closed once the task has exited and
+// the logs it wrote just before stopping have had time to be written.
+func afterExitDrain(ctx context.Context, exited <-chan struct{}) <-chan struct{} {
+	drained := make(chan struct{})
 	go func() {
-		if err := f.logsImpl(ctx, req.Follow, req.PlainText,
-			req.Offset, req.Origin, req.Task, req.LogType, fs, frames); err != nil {
-			select {
-			case errCh <- err:
-			case <-ctx.Done():
-			}
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			return
 		}
-	}()
 
-	// Create a goroutine to detect the remote side closing
-	go func() {
-		for {
-			if _, err := conn.Read(nil); err != nil {
-				if err == io.EOF || err == io.ErrClosedPipe {
-					// One end of the pipe was explicitly closed, exit cleanly
-					cancel()
-					return
-				}
-				select {
-				case errCh <- err:
-				case <-ctx.Done():
-				}
-				return
-			}
+		select {
+		case <-time.After(taskExitDrainWait):
+			close(drained)
+		case <-ctx.Done():
 		}
 	}()
+	return drained
+}
 
-	var streamErr error
-	buf := new(bytes.Buffer)
-	frameCodec := codec.NewEncoder(buf, structs.JsonHandle)
-OUTER:
-	for {
-		select {
-		case streamErr = <-errCh:
-			break OUTER
-		case frame, ok := <-frames:
-			if !ok {
-				// framer may have been closed when an error
-				// occurred. Check once more for an error.
-				select {
-				case streamErr = <-errCh:
-					// There was a pending error!
-				default:
-					// No error, continue on
-				}
+// otherLogType returns the log type that is not the passed one.
+func otherLogType(logType string) string {
+	if logType == "stdout" {
+		return "stderr"
+	}
+	return "stdout"
+}
 
-				break OUTER
-			}
+// exitTailFrame returns the frame holding up to the last lines of the most
+// recent log file of the task and log type, sent when the task stops. Only the
+// end of the file is read so fewer lines are returned if they are long.
+func exitTailFrame(fs allocdir.AllocDirFS, task, logType string, lines int) (*sframer.StreamFrame, error) {
+	tail, err := tailLogLines(fs, task, logType, lines)
+	if err != nil {
+		return nil, err
+	}
 
-			var resp cstructs.StreamErrWrapper
-			if req.PlainText {
-				resp.Payload = frame.Data
-			} else {
-				if err = frameCodec.Encode(frame); err != nil {
-					streamErr = err
-					break OUTER
-				}
-				frameCodec.Reset(buf)
+	return &sframer.StreamFrame{
+		FileEvent: taskExitedEvent,
+		File:      tail.File,
+		Offset:    tail.Offset,
+		Data:      tail.Data,
+	}, nil
+}
+
+// tailLogLines returns up to the last lines of the most recent log file of the
+// task and log type. Only the last maxExitTailBytes of the file are read so
+// fewer lines are returned if they are long. The tail has no file if the task
+// has no log files of the log type.
+func tailLogLines(fs allocdir.AllocDirFS, task, logType string, lines int) (*cstructs.TaskLogTail, error) {
+	tail := &cstructs.TaskLogTail{Task: task}
+
+	logPath := filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName)
+	entries, err := fs.List(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list entries: %v", err)
+	}
+
+	indexes, err := logIndexes(entries, task, logType)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) == 0 {
+		return tail, nil
+	}
+	sort.Sort(indexes)
+	last := indexes[len(indexes)-1].entry
+
+	start := last.Size - maxExitTailBytes
+	if start < 0 {
+		start = 0
+	}
+
+	p := filepath.Join(logPath, last.Name)
+	r, err := fs.ReadAt(p, start)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
 
-				resp.Payload = buf.Bytes()
-				buf.Reset()
-			}
+	data, err := ioutil.ReadAll(io.LimitReader(r, last.Size-start))
+	if err != nil {
+		return nil, err
+	}
 
-			if err := encoder.Encode(resp); err != nil {
-				streamErr = err
-				break OUTER
-			}
-			encoder.Reset(conn)
-		}
+	tail.File = p
+	tail.Offset = start + int64(len(data))
+	tail.Data = lastLines(data, lines)
+	return tail, nil
+}
+
+// lastLines returns the last n lines of data. A trailing newline does not
+// start a line.
+func lastLines(data []byte, n int) []byte {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
 	}
 
-	if streamErr != nil {
-		// If error has a Code, use it
-		var code int64 = 500
-		if codedErr, ok := streamErr.(interface{ Code() int }); ok {
-			code = int64(codedErr.Code())
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			n--
+			if n == 0 {
+				return data[i+1:]
+			}
 		}
-		handleStreamResultError(streamErr, &code, encoder)
-		return
 	}
+	return data
 }
 
 // logsImpl is used to stream the logs of a the given task. Output is sent on
 // the passed frames channel and the method will return on EOF if follow is not
 // true otherwise when the context is cancelled or on an error.
-func (f *FileSystem) logsImpl(ctx context.Context, follow, plain bool, offset int64,
-	origin, task, logType string,
-	fs allocdir.AllocDirFS, frames chan<- *sframer.StreamFrame) error {
+func (f *FileSystem) logsImpl(ctx context.Context, req *cstructs.FsLogsRequest,
+	fs allocdir.AllocDirFS, stopFollow <-chan struct{}, frames chan<- *sframer.StreamFrame) error {
 
-	// Create the framer
-	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
-	framer.Run()
-	defer framer.Destroy()
+	follow := req.Follow
+	offset := req.Offset
+	task := req.Task
+	logType := req.LogType
 
 	// Path to the logs
 	logPath := filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName)
 
+	// The log directory may not have been created yet while the allocation
+	// starts
+	if req.WaitForStart {
+		f.waitForLogDir(ctx, fs, logPath)
+	}
+
 	// nextIdx is the next index to read logs from
 	var nextIdx int64
-	switch origin {
+	switch req.Origin {
 	case "start":
 		nextIdx = 0
 	case "end":
@@ -545,6 +3782,179 @@ func (f *FileSystem) logsImpl(ctx context.Context, follow, plain bool, offset in
 		return invalidOrigin
 	}
 
+	// Start at the first log file written to within the duration
+	if req.SinceDuration > 0 {
+		entries, err := listLogEntries(fs, logPath, task)
+		if err != nil {
+			return err
+		}
+
+		nextIdx, offset, err = sinceLogPosition(entries, task, logType, time.Now().Add(-req.SinceDuration))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Skip the logs written before the last MaxBacklog bytes
+	if req.MaxBacklog > 0 {
+		entries, err := listLogEntries(fs, logPath, task)
+		if err != nil {
+			return err
+		}
+
+		nextIdx, offset, err = backlogLogPosition(entries, task, logType, offset, req.MaxBacklog)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Start the requested number of lines before the end of the logs
+	if req.TailLines > 0 {
+		entries, err := listLogEntries(fs, logPath, task)
+		if err != nil {
+			return err
+		}
+
+		nextIdx, offset, err = tailLinesLogPosition(fs, entries, logPath, task, logType, req.TailLines)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Resolve the log files of the requested index range
+	var rangeIndexes indexTupleArray
+	indexRange := req.StartIndex != nil && req.EndIndex != nil
+	if indexRange {
+		entries, err := listLogEntries(fs, logPath, task)
+		if err != nil {
+			return err
+		}
+
+		rangeIndexes, err = logIndexRange(entries, task, logType, *req.StartIndex, *req.EndIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Snapshots stream the log files up to their sizes when the stream
+	// started, ignoring later writes
+	var snapshot []*cstructs.AllocFileInfo
+	if req.Snapshot && !follow {
+		var err error
+		snapshot, err = listLogEntries(fs, logPath, task)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Bound the number of log files streamed when not following
+	maxFiles := f.maxFilesSpanned
+	if req.MaxFilesSpanned > 0 && (maxFiles == 0 || req.MaxFilesSpanned < maxFiles) {
+		maxFiles = req.MaxFilesSpanned
+	}
+
+	// Describe the log files to be streamed, bounded as they are streamed,
+	// so the progress total and manifest match the data delivered
+	var manifest []*sframer.LogManifestEntry
+	if (req.Progress || req.Manifest) && !follow {
+		if indexRange {
+			manifest = logsManifestEntries(logPath, rangeIndexes, 0, maxFiles)
+		} else {
+			entries := snapshot
+			if entries == nil {
+				var err error
+				entries, err = listLogEntries(fs, logPath, task)
+				if err != nil {
+					return err
+				}
+			}
+
+			var err error
+			manifest, err = logsManifest(entries, logPath, task, logType, nextIdx, offset, maxFiles)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Send the total number of bytes to be streamed before any data so
+	// clients can track progress.
+	if req.Progress && !follow {
+		var total int64
+		if n := len(manifest); n > 0 {
+			total = manifest[n-1].End
+		}
+
+		select {
+		case frames <- &sframer.StreamFrame{TotalBytes: total}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	// Describe the log files to be streamed before any data so clients can
+	// attribute the data to them
+	if req.Manifest && !follow {
+		select {
+		case frames <- &sframer.StreamFrame{Manifest: manifest}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	// Create the framer
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.SetLineAligned(req.LineAligned || req.WholeLinesOnly)
+	framer.SetHoldPartial(req.WholeLinesOnly)
+	framer.Run()
+	defer framer.Destroy()
+
+	// Rotated log files are not modified, so stream each file in the index
+	// range in full and stop
+	if indexRange {
+		for n, i := range rangeIndexes {
+			if maxFiles > 0 && n >= maxFiles {
+				return parseFramerErr(framer.Send(filepath.Join(logPath, i.entry.Name), filesLimitEvent, nil, 0))
+			}
+
+			p := filepath.Join(logPath, i.entry.Name)
+			if err := f.streamFile(ctx, 0, p, 0, nil, fs, framer, nil, true, nil); err != nil {
+				if errors.Is(err, syscall.EPIPE) {
+					return nil
+				}
+				return fmt.Errorf("failed to stream %q: %v", p, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-framer.ExitCh():
+				return nil
+			default:
+			}
+		}
+		return nil
+	}
+
+	// rotatedRetries is the number of consecutive times the log file was
+	// rotated out before it could be opened
+	var rotatedRetries int
+
+	// lastIdx is the index of the log file streamed last, and spanned is
+	// the number of log files streamed
+	lastIdx := int64(-1)
+	spanned := 0
+
+	// Only followed logs are limited to the most recent log indexes, so that
+	// other streams deliver the log files their manifest and progress describe
+	indexCache := &logIndexCache{task: task, logType: logType}
+	if follow {
+		indexCache.max = f.maxLogIndexes
+	}
+
+	// The tail cache is only checked for the log file first attached to, as
+	// later log files are streamed from their start
+	checkTailCache := f.tailCache != nil && req.Origin == "end" && snapshot == nil
 	for {
 		// Logic for picking next file is:
 		// 1) List log files
@@ -552,27 +3962,52 @@ func (f *FileSystem) logsImpl(ctx context.Context, follow, plain bool, offset in
 		// 3) Open log file at correct offset
 		// 3a) No error, read contents
 		// 3b) If file doesn't exist, goto 1 as it may have been rotated out
-		entries, err := fs.List(logPath)
+
+		// Stop following once told to, streaming the logs written up to then
+		if follow && stopFollow != nil {
+			select {
+			case <-stopFollow:
+				follow = false
+			default:
+			}
+		}
+
+		entries := snapshot
+		if entries == nil {
+			var err error
+			entries, err = listLogEntries(fs, logPath, task)
+			if err != nil {
+				return err
+			}
+		}
+
+		indexes, err := indexCache.indexes(entries)
 		if err != nil {
-			return fmt.Errorf("failed to list entries: %v", err)
+			return err
 		}
 
 		// If we are not following logs, determine the max index for the logs we are
 		// interested in so we can stop there.
 		maxIndex := int64(math.MaxInt64)
 		if !follow {
-			_, idx, _, err := findClosest(entries, maxIndex, 0, task, logType)
+			_, idx, _, err := closestLogIndex(indexes, maxIndex, 0, task, logType)
 			if err != nil {
 				return err
 			}
 			maxIndex = idx
 		}
 
-		logEntry, idx, openOffset, err := findClosest(entries, nextIdx, offset, task, logType)
+		logEntry, idx, openOffset, err := closestLogIndex(indexes, nextIdx, offset, task, logType)
 		if err != nil {
 			return err
 		}
 
+		// The log file streamed last is not streamed again once following
+		// stops if no later log file was written
+		if !follow && idx <= lastIdx {
+			return nil
+		}
+
 		var eofCancelCh chan error
 		cancelAfterFirstEof := false
 		exitAfter := false
@@ -583,17 +4018,60 @@ func (f *FileSystem) logsImpl(ctx context.Context, follow, plain bool, offset in
 			// At the end
 			cancelAfterFirstEof = true
 			exitAfter = true
+		} else if snapshot != nil {
+			// Later log files are known to exist
+			cancelAfterFirstEof = true
 		} else {
 			eofCancelCh = blockUntilNextLog(ctx, fs, logPath, task, logType, idx+1)
+			if stopFollow != nil {
+				eofCancelCh = untilStopFollow(ctx, eofCancelCh, stopFollow)
+			}
+		}
+
+		// Only stream the data of the log file present in the snapshot
+		var limit int64
+		if snapshot != nil {
+			limit = logEntry.Size - openOffset
 		}
 
 		p := filepath.Join(logPath, logEntry.Name)
-		err = f.streamFile(ctx, openOffset, p, 0, fs, framer, eofCancelCh, cancelAfterFirstEof)
+		if !follow && maxFiles > 0 && spanned >= maxFiles {
+			return parseFramerErr(framer.Send(p, filesLimitEvent, nil, openOffset))
+		}
+
+		// Send the end of the log file from memory when attaching near it,
+		// and resume after it if the log file is rotated out
+		if checkTailCache {
+			checkTailCache = false
+			if data, ok := f.tailCache.tail(fs, req.AllocID, p, logEntry, openOffset); ok {
+				if err := parseFramerErr(framer.Send(p, "", data, logEntry.Size)); err != nil {
+					if errors.Is(err, syscall.EPIPE) {
+						return nil
+					}
+					return err
+				}
+				openOffset = logEntry.Size
+				nextIdx, offset = idx, logEntry.Size
+			}
+		}
+
+		// The log file being removed once a later one exists is a rotation
+		// rather than the logs being deleted
+		deletedEvent := func() string {
+			return logDeletedEvent(fs, logPath, task, logType, idx)
+		}
+		if snapshot == nil || limit > 0 {
+			err = f.streamFile(ctx, openOffset, p, limit, nil, fs, framer, eofCancelCh, cancelAfterFirstEof, deletedEvent)
+		}
 
-		// Check if the context is cancelled
+		// Stop before listing the log files again if the context is
+		// cancelled or the StreamFramer has stopped running, which avoids
+		// tight loops with goroutine leaks as in #3342
 		select {
 		case <-ctx.Done():
 			return nil
+		case <-framer.ExitCh():
+			return nil
 		default:
 		}
 
@@ -601,43 +4079,266 @@ func (f *FileSystem) logsImpl(ctx context.Context, follow, plain bool, offset in
 			// Check if there was an error where the file does not exist. That means
 			// it got rotated out from under us.
 			if os.IsNotExist(err) {
+				// The snapshot doesn't change, so move on to the next file
+				if snapshot != nil {
+					if exitAfter {
+						return nil
+					}
+					offset = 0
+					nextIdx = idx + 1
+					continue
+				}
+
+				// Back off before listing the log files again so that
+				// pathological rotation does not cause a busy loop
+				rotatedRetries++
+				if rotatedRetries > f.rotatedRetryLimit {
+					return fmt.Errorf("failed to stream %q: log file rotated out %d times in a row before it could be opened",
+						p, rotatedRetries)
+				}
+
+				select {
+				case <-time.After(rotatedRetryWait(f.rotatedRetryBackoff, rotatedRetries)):
+				case <-ctx.Done():
+					return nil
+				}
 				continue
 			}
 
 			// Check if the connection was closed
-			if err == syscall.EPIPE {
+			if errors.Is(err, syscall.EPIPE) {
 				return nil
 			}
 
 			return fmt.Errorf("failed to stream %q: %v", p, err)
 		}
 
-		if exitAfter {
-			return nil
-		}
+		if exitAfter {
+			return nil
+		}
+
+		// Since we successfully streamed, update the overall offset/idx.
+		offset = int64(0)
+		nextIdx = idx + 1
+		lastIdx = idx
+		spanned++
+		rotatedRetries = 0
+	}
+}
+
+// taskLogsImpl streams the logs of a task kept by its driver outside of the log
+// files, through the same framer as logsImpl. The frames name the logs as if
+// they were a single log file without an index.
+func (f *FileSystem) taskLogsImpl(ctx context.Context, req *cstructs.FsLogsRequest,
+	logs drivers.TaskLogsDriver, frames chan<- *sframer.StreamFrame) error {
+
+	size, err := logs.TaskLogsSize(req.AllocID, req.Task, req.LogType)
+	if err != nil {
+		return fmt.Errorf("failed to get size of logs: %v", err)
+	}
+
+	offset := req.Offset
+	if req.Origin == "end" {
+		offset = size - offset
+	}
+	if offset < 0 {
+		offset = 0
+	} else if offset > size {
+		offset = size
+	}
+
+	// Send the total number of bytes to be streamed before any data so
+	// clients can track progress.
+	if req.Progress && !req.Follow {
+		select {
+		case frames <- &sframer.StreamFrame{TotalBytes: size - offset}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	r, err := logs.TaskLogs(req.AllocID, req.Task, req.LogType, offset)
+	if err != nil {
+		return fmt.Errorf("failed to read logs: %v", err)
+	}
+	defer r.Close()
+
+	// Without following, only the logs present when the stream started are
+	// streamed
+	var reader io.Reader = r
+	if !req.Follow {
+		reader = io.LimitReader(r, size-offset)
+	}
+
+	// Create the framer
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.SetLineAligned(req.LineAligned || req.WholeLinesOnly)
+	framer.SetHoldPartial(req.WholeLinesOnly)
+	framer.Run()
+	defer framer.Destroy()
+
+	p := filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName, req.Task+"."+req.LogType)
+	data := make([]byte, streamFrameSize)
+	for {
+		n, readErr := reader.Read(data)
+		offset += int64(n)
+		if readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("failed to read logs: %v", readErr)
+		}
+
+		if n != 0 {
+			if err := parseFramerErr(framer.Send(p, "", data[:n], offset)); err != nil {
+				if errors.Is(err, syscall.EPIPE) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		if readErr == nil {
+			continue
+		}
+
+		// Send any partial line held back by the framer now that the end of
+		// the logs has been reached
+		framer.FlushPartial()
+		if !req.Follow {
+			return nil
+		}
+
+		select {
+		case <-time.After(taskLogsCheckRate):
+		case <-framer.ExitCh():
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// rotatedRetryWait returns how long to wait before the given consecutive retry
+// of opening a rotated out log file.
+func rotatedRetryWait(backoff time.Duration, retry int) time.Duration {
+	wait := backoff
+	for i := 1; i < retry && wait < maxRotatedLogRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRotatedLogRetryBackoff {
+		wait = maxRotatedLogRetryBackoff
+	}
+	return wait
+}
+
+// logDeletedEvent returns the file event to send when the log file with the
+// given index is deleted. It is rotatedEvent if a log file with a greater
+// index exists and deleteEvent otherwise.
+func logDeletedEvent(fs allocdir.AllocDirFS, logPath, task, logType string, idx int64) string {
+	entries, err := fs.List(logPath)
+	if err != nil {
+		return deleteEvent
+	}
+
+	indexes, err := logIndexes(entries, task, logType)
+	if err != nil {
+		return deleteEvent
+	}
+
+	for _, i := range indexes {
+		if i.idx > idx {
+			return rotatedEvent
+		}
+	}
+	return deleteEvent
+}
+
+// waitForLogDir retries listing the log directory a bounded number of times
+// while it does not exist, as it may not while the allocation starts.
+func (f *FileSystem) waitForLogDir(ctx context.Context, fs allocdir.AllocDirFS, logPath string) {
+	for retry := 1; retry <= f.allocFSRetryLimit; retry++ {
+		if _, err := fs.List(logPath); !os.IsNotExist(err) {
+			return
+		}
+
+		select {
+		case <-time.After(rotatedRetryWait(f.allocFSRetryBackoff, retry)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listLogEntries lists the log directory, returning a logsNotAvailableErr if
+// it does not exist, such as when attaching to a task that is still starting.
+func listLogEntries(fs allocdir.AllocDirFS, logPath, task string) ([]*cstructs.AllocFileInfo, error) {
+	entries, err := fs.List(logPath)
+	if os.IsNotExist(err) {
+		return nil, logsNotAvailableErr{taskName: task}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list entries: %v", err)
+	}
+	return entries, nil
+}
+
+// logsManifest returns the manifest of the log files a logs stream that is not
+// followed streams when starting at the given log index and offset, from the
+// entries of the log directory.
+func logsManifest(entries []*cstructs.AllocFileInfo, logPath, task, logType string,
+	nextIdx, offset int64, maxFiles int) ([]*sframer.LogManifestEntry, error) {
+
+	indexes, err := logIndexes(entries, task, logType)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(indexes)
+
+	_, idx, openOffset, err := closestLogIndex(indexes, nextIdx, offset, task, logType)
+	if err != nil {
+		return nil, err
+	}
 
-		// defensively check to make sure StreamFramer hasn't stopped
-		// running to avoid tight loops with goroutine leaks as in
-		// #3342
-		select {
-		case <-framer.ExitCh():
-			return nil
-		default:
-		}
+	i := sort.Search(len(indexes), func(i int) bool { return indexes[i].idx >= idx })
+	return logsManifestEntries(logPath, indexes[i:], openOffset, maxFiles), nil
+}
 
-		// Since we successfully streamed, update the overall offset/idx.
-		offset = int64(0)
-		nextIdx = idx + 1
+// logsManifestEntries returns the manifest entries of the log files streamed in
+// order, starting at the offset within the first one and streaming at most
+// maxFiles of them if it is positive.
+func logsManifestEntries(logPath string, indexes indexTupleArray, offset int64, maxFiles int) []*sframer.LogManifestEntry {
+	if maxFiles > 0 && len(indexes) > maxFiles {
+		indexes = indexes[:maxFiles]
+	}
+
+	manifest := make([]*sframer.LogManifestEntry, 0, len(indexes))
+	var start int64
+	for _, i := range indexes {
+		end := start + i.entry.Size - offset
+		manifest = append(manifest, &sframer.LogManifestEntry{
+			File:       filepath.Join(logPath, i.entry.Name),
+			Index:      i.idx,
+			Size:       i.entry.Size,
+			FileOffset: offset,
+			Start:      start,
+			End:        end,
+		})
+		start, offset = end, 0
 	}
+	return manifest
 }
 
 // streamFile is the internal method to stream the content of a file. If limit
 // is greater than zero, the stream will end once that many bytes have been
-// read. If eofCancelCh is triggered while at EOF, read one more frame and
-// cancel the stream on the next EOF. If the connection is broken an EPIPE
-// error is returned.
-func (f *FileSystem) streamFile(ctx context.Context, offset int64, path string, limit int64,
-	fs allocdir.AllocDirFS, framer *sframer.StreamFramer, eofCancelCh chan error, cancelAfterFirstEof bool) error {
+// read. The ordered byte ranges of skip are not read, and a frame with the
+// skippedEvent file event is sent at the end of each range instead. Skipped
+// bytes count towards the limit. If eofCancelCh is triggered while at EOF, read
+// one more frame and cancel the stream on the next EOF. If deletedEvent is set,
+// it returns the file event to send when the file is deleted in place of
+// deleteEvent. If the connection is broken an EPIPE error is returned.
+func (f *FileSystem) streamFile(ctx context.Context, offset int64, path string, limit int64, skip [][2]int64,
+	fs allocdir.AllocDirFS, framer *sframer.StreamFramer, eofCancelCh chan error, cancelAfterFirstEof bool,
+	deletedEvent func() string) error {
+
+	// limitEnd is the offset at which the limit is reached
+	limitEnd := offset + limit
 
 	// Get the reader
 	file, err := fs.ReadAt(path, offset)
@@ -673,10 +4374,73 @@ func (f *FileSystem) streamFile(ctx context.Context, offset int64, path string,
 		bufSize = limit
 	}
 	data := make([]byte, bufSize)
+
+	// Read ahead of the framer when configured so that slow reads do not
+	// stall sending the data already read
+	readAhead := f.c.GetConfig().FSReadAheadBuffers
+	reader := fileReader
+	if readAhead > 0 {
+		ra := newReadAheadReader(ctx, fileReader, readAhead, int(bufSize))
+		defer ra.Close()
+		reader = ra
+	}
+
+	// skipped is set once a range has been skipped, which may have moved
+	// the offset past the end of the file
+	skipped := false
 OUTER:
 	for {
-		// Read up to the max frame size
-		n, readErr := fileReader.Read(data)
+		// Reopen the file at the end of the next range to skip once its
+		// start is reached
+		if len(skip) > 0 && offset >= skip[0][0] {
+			end := skip[0][1]
+			skip = skip[1:]
+			if end <= offset {
+				continue
+			}
+
+			if err := framer.Send(path, skippedEvent, nil, end); err != nil {
+				return parseFramerErr(err)
+			}
+			if limit > 0 && end >= limitEnd {
+				return nil
+			}
+
+			if err := file.Close(); err != nil {
+				return err
+			}
+
+			offset = end
+			skipped = true
+			var err error
+			file, err = fs.ReadAt(path, offset)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			if limit <= 0 {
+				fileReader = file
+			} else {
+				fileReader = io.LimitReader(file, limitEnd-offset)
+			}
+
+			reader = fileReader
+			if readAhead > 0 {
+				ra := newReadAheadReader(ctx, fileReader, readAhead, int(bufSize))
+				defer ra.Close()
+				reader = ra
+			}
+			continue
+		}
+
+		// Read up to the max frame size, stopping at the start of the next
+		// range to skip
+		buf := data
+		if len(skip) > 0 && skip[0][0]-offset < int64(len(buf)) {
+			buf = data[:skip[0][0]-offset]
+		}
+		n, readErr := reader.Read(buf)
 
 		// Update the offset
 		offset += int64(n)
@@ -688,7 +4452,7 @@ OUTER:
 
 		// Send the frame
 		if n != 0 || lastEvent != "" {
-			if err := framer.Send(path, lastEvent, data[:n], offset); err != nil {
+			if err := framer.Send(path, lastEvent, buf[:n], offset); err != nil {
 				return parseFramerErr(err)
 			}
 		}
@@ -704,6 +4468,10 @@ OUTER:
 			continue
 		}
 
+		// Send any partial line held back by the framer now that the end of
+		// the file has been reached
+		framer.FlushPartial()
+
 		// At this point we can stop without waiting for more changes,
 		// because we have EOF and either we're not following at all,
 		// or we received an event from the eofCancelCh channel
@@ -714,18 +4482,46 @@ OUTER:
 
 		// If EOF is hit, wait for a change to the file
 		if changes == nil {
-			changes, err = fs.ChangeEvents(waitCtx, path, offset)
+			// The watcher reports a file smaller than the offset as
+			// truncated, so watch from the end of the file if a skipped
+			// range ended past it
+			watchOffset := offset
+			if skipped {
+				if info, err := fs.Stat(path); err == nil && info.Size < watchOffset {
+					watchOffset = info.Size
+				}
+			}
+
+			changes, err = fs.ChangeEvents(waitCtx, path, watchOffset)
 			if err != nil {
 				return err
 			}
+
+			// Data written after the EOF was read but before the watcher
+			// was established is not reported as a change, so read once
+			// more before waiting.
+			continue OUTER
+		}
+
+		// Periodically re-read while the file is empty since the watcher
+		// may miss it being written to.
+		var emptyCh <-chan time.Time
+		if offset == 0 {
+			emptyCh = time.After(emptyFileCheckRate)
 		}
 
 		for {
 			select {
 			case <-changes.Modified:
 				continue OUTER
+			case <-emptyCh:
+				continue OUTER
 			case <-changes.Deleted:
-				return parseFramerErr(framer.Send(path, deleteEvent, nil, offset))
+				event := deleteEvent
+				if deletedEvent != nil {
+					event = deletedEvent()
+				}
+				return parseFramerErr(framer.Send(path, event, nil, offset))
 			case <-changes.Truncated:
 				// Close the current reader
 				if err := file.Close(); err != nil {
@@ -753,6 +4549,13 @@ OUTER:
 					fileReader = io.LimitReader(file, lr.N)
 				}
 
+				reader = fileReader
+				if readAhead > 0 {
+					ra := newReadAheadReader(ctx, fileReader, readAhead, int(bufSize))
+					defer ra.Close()
+					reader = ra
+				}
+
 				// Store the last event
 				lastEvent = truncateEvent
 				continue OUTER
@@ -778,10 +4581,31 @@ OUTER:
 	}
 }
 
+// untilStopFollow returns a channel that forwards the result of next, or that
+// is sent nil once stopFollow is closed so that the log file being followed is
+// streamed up to its end.
+func untilStopFollow(ctx context.Context, next chan error, stopFollow <-chan struct{}) chan error {
+	out := make(chan error, 1)
+	go func() {
+		defer close(out)
+		select {
+		case err, ok := <-next:
+			if ok {
+				out <- err
+			}
+		case <-stopFollow:
+			out <- nil
+		case <-ctx.Done():
+			out <- nil
+		}
+	}()
+	return out
+}
+
 // blockUntilNextLog returns a channel that will have data sent when the next
 // log index or anything greater is created.
 func blockUntilNextLog(ctx context.Context, fs allocdir.AllocDirFS, logPath, task, logType string, nextIndex int64) chan error {
-	nextPath := filepath.Join(logPath, fmt.Sprintf("%s.%s.%d", task, logType, nextIndex))
+	nextPath := filepath.Join(logPath, fmt.Sprintf("%s%d", logFilePrefix(task, logType), nextIndex))
 	next := make(chan error, 1)
 
 	go func() {
@@ -792,9 +4616,12 @@ func blockUntilNextLog(ctx context.Context, fs allocdir.AllocDirFS, logPath, tas
 			return
 		}
 
-		ticker := time.NewTicker(nextLogCheckRate)
-		defer ticker.Stop()
-		scanCh := ticker.C
+		// Back off scanning while the logs are idle, resetting once they
+		// change again
+		rate := nextLogCheckRate
+		var lastSize int64 = -1
+		timer := time.NewTimer(rate)
+		defer timer.Stop()
 		for {
 			select {
 			case <-ctx.Done():
@@ -805,7 +4632,7 @@ func blockUntilNextLog(ctx context.Context, fs allocdir.AllocDirFS, logPath, tas
 				next <- err
 				close(next)
 				return
-			case <-scanCh:
+			case <-timer.C:
 				entries, err := fs.List(logPath)
 				if err != nil {
 					next <- fmt.Errorf("failed to list entries: %v", err)
@@ -822,13 +4649,23 @@ func blockUntilNextLog(ctx context.Context, fs allocdir.AllocDirFS, logPath, tas
 
 				// Scan and see if there are any entries larger than what we are
 				// waiting for.
+				var size int64
 				for _, entry := range indexes {
 					if entry.idx >= nextIndex {
 						next <- nil
 						close(next)
 						return
 					}
+					size += entry.entry.Size
 				}
+
+				if size != lastSize {
+					rate = nextLogCheckRate
+				} else {
+					rate = nextLogBackoff(rate)
+				}
+				lastSize = size
+				timer.Reset(rate)
 			}
 		}
 	}()
@@ -836,6 +4673,16 @@ func blockUntilNextLog(ctx context.Context, fs allocdir.AllocDirFS, logPath, tas
 	return next
 }
 
+// nextLogBackoff returns the interval to wait before the next scan for a log
+// entry after an idle scan at the given rate.
+func nextLogBackoff(rate time.Duration) time.Duration {
+	rate *= 2
+	if rate > maxNextLogCheckRate {
+		rate = maxNextLogCheckRate
+	}
+	return rate
+}
+
 // indexTuple and indexTupleArray are used to find the correct log entry to
 // start streaming logs from
 type indexTuple struct {
@@ -854,7 +4701,7 @@ func (a indexTupleArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 // error is returned.
 func logIndexes(entries []*cstructs.AllocFileInfo, task, logType string) (indexTupleArray, error) {
 	var indexes []indexTuple
-	prefix := fmt.Sprintf("%s.%s.", task, logType)
+	prefix := logFilePrefix(task, logType)
 	for _, entry := range entries {
 		if entry.IsDir {
 			continue
@@ -878,6 +4725,96 @@ func logIndexes(entries []*cstructs.AllocFileInfo, task, logType string) (indexT
 	return indexTupleArray(indexes), nil
 }
 
+// logIndexCache caches the sorted log indexes of a task's log files across
+// listings. The names of the log files are only parsed and sorted again when
+// the log files listed change, rather than just their sizes.
+type logIndexCache struct {
+	task    string
+	logType string
+
+	// max is the number of the most recent indexes returned, or all if zero
+	max int
+
+	// names are the names of the log files in the order they were listed
+	names []string
+
+	// positions are the positions in names of the returned log files,
+	// ordered by index, and idxs are their indexes
+	positions []int
+	idxs      []int64
+
+	// matched holds the log file entries of the latest listing
+	matched []*cstructs.AllocFileInfo
+}
+
+// indexes returns the log indexes of the entries, ordered by index. The
+// entries must be listed in a consistent order, as is done by List.
+func (c *logIndexCache) indexes(entries []*cstructs.AllocFileInfo) (indexTupleArray, error) {
+	prefix := logFilePrefix(c.task, c.logType)
+	c.matched = c.matched[:0]
+	changed := false
+	for _, entry := range entries {
+		if entry.IsDir || !strings.HasPrefix(entry.Name, prefix) {
+			continue
+		}
+		if n := len(c.matched); n >= len(c.names) || c.names[n] != entry.Name {
+			changed = true
+		}
+		c.matched = append(c.matched, entry)
+	}
+
+	if changed || len(c.matched) != len(c.names) {
+		if err := c.rebuild(); err != nil {
+			return nil, err
+		}
+	}
+
+	indexes := make(indexTupleArray, len(c.positions))
+	for i, pos := range c.positions {
+		indexes[i] = indexTuple{idx: c.idxs[i], entry: c.matched[pos]}
+	}
+	return indexes, nil
+}
+
+// rebuild parses and sorts the indexes of the matched log files.
+func (c *logIndexCache) rebuild() error {
+	c.names = c.names[:0]
+	c.positions = c.positions[:0]
+	c.idxs = c.idxs[:0]
+
+	unsorted, err := logIndexes(c.matched, c.task, c.logType)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range c.matched {
+		c.names = append(c.names, entry.Name)
+		c.positions = append(c.positions, i)
+	}
+	sort.Slice(c.positions, func(i, j int) bool {
+		return unsorted[c.positions[i]].idx < unsorted[c.positions[j]].idx
+	})
+	if c.max > 0 && len(c.positions) > c.max {
+		c.positions = c.positions[len(c.positions)-c.max:]
+	}
+	for _, pos := range c.positions {
+		c.idxs = append(c.idxs, unsorted[pos].idx)
+	}
+	return nil
+}
+
+// logFilePrefix returns the prefix of the names of the log files of a task
+// and log type, which are followed by the log index. The log files of an
+// allocation that are not specific to a task, such as those of a log
+// aggregating sidecar, are requested with an empty task and named by their
+// log type alone.
+func logFilePrefix(task, logType string) string {
+	if task == "" {
+		return logType + "."
+	}
+	return fmt.Sprintf("%s.%s.", task, logType)
+}
+
 // notFoundErr is returned when a log is requested but cannot be found.
 // Implements agent.HTTPCodedError but does not reference it to avoid circular
 // imports.
@@ -887,6 +4824,9 @@ type notFoundErr struct {
 }
 
 func (e notFoundErr) Error() string {
+	if e.taskName == "" {
+		return fmt.Sprintf("allocation log entry for log type %q not found", e.logType)
+	}
 	return fmt.Sprintf("log entry for task %q and log type %q not found", e.taskName, e.logType)
 }
 
@@ -895,6 +4835,72 @@ func (e notFoundErr) Code() int {
 	return http.StatusNotFound
 }
 
+// logIndexNotFoundErr is returned when a log index range bound cannot be
+// found.
+type logIndexNotFoundErr struct {
+	taskName string
+	logType  string
+	idx      int64
+}
+
+func (e logIndexNotFoundErr) Error() string {
+	return fmt.Sprintf("log index %d for task %q and log type %q not found", e.idx, e.taskName, e.logType)
+}
+
+// Code returns a 404 to avoid returning a 500
+func (e logIndexNotFoundErr) Code() int {
+	return http.StatusNotFound
+}
+
+// logsNotAvailableErr is returned when the log directory of an allocation does
+// not exist yet.
+type logsNotAvailableErr struct {
+	taskName string
+}
+
+func (e logsNotAvailableErr) Error() string {
+	if e.taskName == "" {
+		return "allocation logs not yet available"
+	}
+	return fmt.Sprintf("logs not yet available for task %q", e.taskName)
+}
+
+// Code returns a 404 to avoid returning a 500
+func (e logsNotAvailableErr) Code() int {
+	return http.StatusNotFound
+}
+
+// logIndexRange returns the log entries with indexes from start to end
+// inclusive, in order. Both bounds must exist, while missing indexes between
+// them are skipped.
+func logIndexRange(entries []*cstructs.AllocFileInfo, task, logType string, start, end int64) (indexTupleArray, error) {
+	if start > end {
+		return nil, invalidIndexRange
+	}
+
+	indexes, err := logIndexes(entries, task, logType)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(indexes)
+
+	var inRange indexTupleArray
+	for _, i := range indexes {
+		if i.idx >= start && i.idx <= end {
+			inRange = append(inRange, i)
+		}
+	}
+
+	if len(inRange) == 0 || inRange[0].idx != start {
+		return nil, logIndexNotFoundErr{taskName: task, logType: logType, idx: start}
+	}
+	if inRange[len(inRange)-1].idx != end {
+		return nil, logIndexNotFoundErr{taskName: task, logType: logType, idx: end}
+	}
+
+	return inRange, nil
+}
+
 // findClosest takes a list of entries, the desired log index and desired log
 // offset (which can be negative, treated as offset from end), task name and log
 // type and returns the log entry, the log index, the offset to read from and a
@@ -907,12 +4913,21 @@ func findClosest(entries []*cstructs.AllocFileInfo, desiredIdx, desiredOffset in
 	if err != nil {
 		return nil, 0, 0, err
 	}
+	sort.Sort(indexes)
+
+	return closestLogIndex(indexes, desiredIdx, desiredOffset, task, logType)
+}
+
+// closestLogIndex is like findClosest but takes the log indexes of the task's
+// log files ordered by index.
+func closestLogIndex(indexes indexTupleArray, desiredIdx, desiredOffset int64,
+	task, logType string) (*cstructs.AllocFileInfo, int64, int64, error) {
+
 	if len(indexes) == 0 {
 		return nil, 0, 0, notFoundErr{taskName: task, logType: logType}
 	}
 
 	// Binary search the indexes to get the desiredIdx
-	sort.Sort(indexes)
 	i := sort.Search(len(indexes), func(i int) bool { return indexes[i].idx >= desiredIdx })
 	l := len(indexes)
 	if i == l {
@@ -967,30 +4982,273 @@ func findClosest(entries []*cstructs.AllocFileInfo, desiredIdx, desiredOffset in
 	return indexes[idx].entry, indexes[idx].idx, offset, nil
 }
 
-// parseFramerErr takes an error and returns an error. The error will
-// potentially change if it was caused by the connection being closed.
-func parseFramerErr(err error) error {
-	if err == nil {
+// backlogLogPosition returns the index and offset to start streaming logs from
+// the start origin so that at most the last maxBacklog bytes of the existing
+// logs are streamed. The requested offset is used if it is closer to the end.
+// Logs are streamed from the start when none have been written yet.
+func backlogLogPosition(entries []*cstructs.AllocFileInfo, task, logType string,
+	offset, maxBacklog int64) (int64, int64, error) {
+
+	_, idx, openOffset, err := findClosest(entries, 0, offset, task, logType)
+	if _, ok := err.(notFoundErr); ok {
+		return 0, offset, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	_, backlogIdx, backlogOffset, err := findClosest(entries, math.MaxInt64, -maxBacklog, task, logType)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if backlogIdx > idx || (backlogIdx == idx && backlogOffset > openOffset) {
+		return backlogIdx, backlogOffset, nil
+	}
+	return idx, openOffset, nil
+}
+
+// tailLinesLogPosition returns the index and offset to start streaming logs
+// from so that the last lines of the existing logs are streamed. The log files
+// are read backwards from their end, continuing into the previous log file
+// until enough lines are found. As with lastLines, a trailing newline does not
+// start a line. Logs are streamed from the start when they have fewer lines or
+// none have been written yet.
+func tailLinesLogPosition(fs allocdir.AllocDirFS, entries []*cstructs.AllocFileInfo, logPath, task, logType string,
+	lines int) (int64, int64, error) {
+
+	indexes, err := logIndexes(entries, task, logType)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(indexes) == 0 {
+		return 0, 0, nil
+	}
+
+	sort.Sort(indexes)
+	last := true
+	for i := len(indexes) - 1; i >= 0; i-- {
+		index := indexes[i]
+		p := filepath.Join(logPath, index.entry.Name)
+		for end := index.entry.Size; end > 0; {
+			start := end - tailLinesChunk
+			if start < 0 {
+				start = 0
+			}
+
+			data, err := peekAt(fs, p, start, end-start)
+			if err != nil {
+				return 0, 0, err
+			}
+			if len(data) == 0 {
+				break
+			}
+
+			for j := len(data) - 1; j >= 0; j-- {
+				if data[j] == '\n' && !last {
+					lines--
+					if lines == 0 {
+						// Start at the next log file rather than the end
+						// of this one
+						offset := start + int64(j) + 1
+						if offset == index.entry.Size && i < len(indexes)-1 {
+							return indexes[i+1].idx, 0, nil
+						}
+						return index.idx, offset, nil
+					}
+				}
+				last = false
+			}
+			end = start
+		}
+	}
+
+	return indexes[0].idx, 0, nil
+}
+
+// sinceLogPosition returns the index and offset to start streaming logs from to
+// include everything written since the cutoff. Logs are started from the
+// beginning of the first log file modified after the cutoff, or from the end of
+// the last log file if none have been.
+func sinceLogPosition(entries []*cstructs.AllocFileInfo, task, logType string,
+	cutoff time.Time) (int64, int64, error) {
+
+	indexes, err := logIndexes(entries, task, logType)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(indexes) == 0 {
+		return 0, 0, notFoundErr{taskName: task, logType: logType}
+	}
+
+	sort.Sort(indexes)
+	for _, index := range indexes {
+		if !index.entry.ModTime.Before(cutoff) {
+			return index.idx, 0, nil
+		}
+	}
+
+	last := indexes[len(indexes)-1]
+	return last.idx, last.entry.Size, nil
+}
+
+// idleTimer fires once a stream has not sent any data for its timeout.
+// Heartbeats and frames carrying only file events are not activity. A nil
+// idleTimer never fires.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// newIdleTimer returns an idleTimer for the timeout, or nil if the timeout is
+// not positive.
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+	return &idleTimer{
+		timeout: timeout,
+		timer:   time.NewTimer(timeout),
+	}
+}
+
+// C returns the channel that receives once the stream is idle.
+func (i *idleTimer) C() <-chan time.Time {
+	if i == nil {
 		return nil
 	}
+	return i.timer.C
+}
+
+// update restarts the timer if the frame carries data.
+func (i *idleTimer) update(frame *sframer.StreamFrame) {
+	if i == nil || len(frame.Data) == 0 {
+		return
+	}
+	if !i.timer.Stop() {
+		select {
+		case <-i.timer.C:
+		default:
+		}
+	}
+	i.timer.Reset(i.timeout)
+}
+
+func (i *idleTimer) stop() {
+	if i != nil {
+		i.timer.Stop()
+	}
+}
+
+// sendIdleTimeout sends the final frame of a stream of the file closed for
+// being idle, with the sequence number seq if it is not zero.
+func sendIdleTimeout(file string, seq int64, handle codec.Handle, encoder *codec.Encoder, conn io.Writer) error {
+	var buf bytes.Buffer
+	frame := &sframer.StreamFrame{File: file, FileEvent: idleTimeoutEvent, Seq: seq}
+	if err := codec.NewEncoder(&buf, handle).Encode(frame); err != nil {
+		return err
+	}
+
+	if err := encoder.Encode(cstructs.StreamErrWrapper{Payload: buf.Bytes()}); err != nil {
+		return err
+	}
+	encoder.Reset(conn)
+	return nil
+}
+
+// sendStreamCompleted sends the final frame of a completed stream with the
+// checksum of the data streamed.
+func sendStreamCompleted(file string, seq int64, checksum string, handle codec.Handle,
+	encoder *codec.Encoder, conn io.Writer) error {
+	var buf bytes.Buffer
+	frame := &sframer.StreamFrame{File: file, FileEvent: streamCompletedEvent, Seq: seq, Checksum: checksum}
+	if err := codec.NewEncoder(&buf, handle).Encode(frame); err != nil {
+		return err
+	}
 
-	errMsg := err.Error()
+	if err := encoder.Encode(cstructs.StreamErrWrapper{Payload: buf.Bytes()}); err != nil {
+		return err
+	}
+	encoder.Reset(conn)
+	return nil
+}
+
+// sendValidated sends the only response of a stream request that is validated
+// rather than streamed. Plain text streams get an empty response.
+func sendValidated(file string, plainText bool, handle codec.Handle, encoder *codec.Encoder, conn io.Writer) error {
+	var resp cstructs.StreamErrWrapper
+	if !plainText {
+		var buf bytes.Buffer
+		frame := &sframer.StreamFrame{File: file, FileEvent: validatedEvent}
+		if err := codec.NewEncoder(&buf, handle).Encode(frame); err != nil {
+			return err
+		}
+		resp.Payload = buf.Bytes()
+	}
+
+	if err := encoder.Encode(resp); err != nil {
+		return err
+	}
+	encoder.Reset(conn)
+	return nil
+}
+
+// frameEncoding returns the handle used to encode the streamed frames for the
+// requested encoding.
+func frameEncoding(encoding string) (codec.Handle, error) {
+	switch encoding {
+	case "", "json":
+		return structs.JsonHandle, nil
+	case "msgpack":
+		return structs.MsgpackHandle, nil
+	default:
+		return nil, invalidEncoding
+	}
+}
+
+// closedConnErr wraps an error caused by the connection being closed. It
+// matches syscall.EPIPE with errors.Is while preserving the original error.
+type closedConnErr struct {
+	err error
+}
+
+func (e *closedConnErr) Error() string {
+	return e.err.Error()
+}
+
+func (e *closedConnErr) Unwrap() error {
+	return e.err
+}
+
+func (e *closedConnErr) Is(target error) bool {
+	return target == syscall.EPIPE
+}
 
-	if strings.Contains(errMsg, io.ErrClosedPipe.Error()) {
-		// The pipe check is for tests
-		return syscall.EPIPE
+// parseFramerErr takes an error and returns an error. If the error was caused
+// by the connection being closed it is wrapped so that it matches
+// syscall.EPIPE with errors.Is, otherwise it is returned unchanged.
+func parseFramerErr(err error) error {
+	if err == nil {
+		return nil
 	}
 
 	// The connection was closed by our peer
-	if strings.Contains(errMsg, syscall.EPIPE.Error()) || strings.Contains(errMsg, syscall.ECONNRESET.Error()) {
-		return syscall.EPIPE
+	if errors.Is(err, syscall.EPIPE) {
+		return err
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return &closedConnErr{err}
+	}
+
+	// The pipe check is for tests
+	if errors.Is(err, io.ErrClosedPipe) {
+		return &closedConnErr{err}
 	}
 
 	// Windows version of ECONNRESET
 	//XXX(schmichael) I could find no existing error or constant to
 	//                compare this against.
-	if strings.Contains(errMsg, "forcibly closed") {
-		return syscall.EPIPE
+	if strings.Contains(err.Error(), "forcibly closed") {
+		return &closedConnErr{err}
 	}
 
 	return err
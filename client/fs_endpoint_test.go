@@ -1,18 +1,28 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -22,11 +32,13 @@ import (
 	"github.com/hashicorp/nomad/client/config"
 	sframer "github.com/hashicorp/nomad/client/lib/streamframer"
 	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/helper"
 	"github.com/hashicorp/nomad/helper/testlog"
 	"github.com/hashicorp/nomad/helper/uuid"
 	"github.com/hashicorp/nomad/nomad"
 	"github.com/hashicorp/nomad/nomad/mock"
 	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -105,105 +117,211 @@ func TestFS_Stat(t *testing.T) {
 	require.Nil(err)
 	require.NotNil(resp.Info)
 	require.True(resp.Info.IsDir)
+	require.Equal("/", resp.Path)
+
+	// The canonical path of a messy path is returned
+	req.Path = "./alloc//logs/../logs/"
+	resp = cstructs.FsStatResponse{}
+	require.NoError(c.ClientRPC("FileSystem.Stat", req, &resp))
+	require.True(resp.Info.IsDir)
+	require.Equal("/alloc/logs", resp.Path)
 }
 
-func TestFS_Stat_ACL(t *testing.T) {
+func TestFS_Stat_Identity(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file identity is not available on windows")
+	}
 	t.Parallel()
+	require := require.New(t)
 
-	// Start a server
-	s, root, cleanupS := nomad.TestACLServer(t, nil)
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
 	defer cleanupS()
 	testutil.WaitForLeader(t, s.RPC)
 
-	client, cleanup := TestClient(t, func(c *config.Config) {
-		c.ACLEnabled = true
+	c, cleanupC := TestClient(t, func(c *config.Config) {
 		c.Servers = []string{s.GetConfig().RPCAddr.String()}
 	})
-	defer cleanup()
+	defer cleanupC()
 
-	// Create a bad token
-	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityDeny})
-	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
+	// Create and add an alloc
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-	policyGood := mock.NamespacePolicy(structs.DefaultNamespace, "",
-		[]string{acl.NamespaceCapabilityReadLogs, acl.NamespaceCapabilityReadFS})
-	tokenGood := mock.CreatePolicyAndToken(t, s.State(), 1009, "valid2", policyGood)
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir)
+	path := filepath.Join(dataDir, "app.log")
+	require.NoError(ioutil.WriteFile(path, []byte("foo"), 0666))
+
+	stat := func(identity bool) *cstructs.AllocFileInfo {
+		req := &cstructs.FsStatRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/data/app.log",
+			Identity:     identity,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+
+		var resp cstructs.FsStatResponse
+		require.NoError(c.ClientRPC("FileSystem.Stat", req, &resp))
+		return resp.Info
+	}
+
+	// The identity is only returned when requested
+	info := stat(false)
+	require.Nil(info.Inode)
+	require.Nil(info.Device)
 
+	first := stat(true)
+	require.NotNil(first.Inode)
+	require.NotNil(first.Device)
+
+	// Writing to the file keeps its identity
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(err)
+	_, err = f.WriteString("bar")
+	require.NoError(err)
+	require.NoError(f.Close())
+	require.Equal(*first.Inode, *stat(true).Inode)
+
+	// Rotating the file changes its identity
+	require.NoError(os.Rename(path, path+".1"))
+	require.NoError(ioutil.WriteFile(path, []byte("baz"), 0666))
+	rotated := stat(true)
+	require.Equal(*first.Device, *rotated.Device)
+	require.NotEqual(*first.Inode, *rotated.Inode)
+}
+
+func TestFS_ListStat_Owner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file owners are not available on windows")
+	}
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Create and add an alloc
 	job := mock.BatchJob()
 	job.TaskGroups[0].Count = 1
 	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for": "20s",
+		"run_for": "10s",
 	}
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-	// Wait for client to be running job
-	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir)
+	require.NoError(ioutil.WriteFile(filepath.Join(dataDir, "app.log"), []byte("foo"), 0666))
+
+	stat := func(owner bool) *cstructs.AllocFileInfo {
+		req := &cstructs.FsStatRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/data/app.log",
+			Owner:        owner,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
 
-	cases := []struct {
-		Name          string
-		Token         string
-		ExpectedError string
-	}{
-		{
-			Name:          "bad token",
-			Token:         tokenBad.SecretID,
-			ExpectedError: structs.ErrPermissionDenied.Error(),
-		},
-		{
-			Name:  "good token",
-			Token: tokenGood.SecretID,
-		},
-		{
-			Name:  "root token",
-			Token: root.SecretID,
-		},
+		var resp cstructs.FsStatResponse
+		require.NoError(c.ClientRPC("FileSystem.Stat", req, &resp))
+		return resp.Info
 	}
+	list := func(owner bool) *cstructs.AllocFileInfo {
+		req := &cstructs.FsListRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/data",
+			Owner:        owner,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
 
-	for _, c := range cases {
-		t.Run(c.Name, func(t *testing.T) {
-			req := &cstructs.FsStatRequest{
-				AllocID: alloc.ID,
-				Path:    "/",
-				QueryOptions: structs.QueryOptions{
-					Region:    "global",
-					AuthToken: c.Token,
-					Namespace: structs.DefaultNamespace,
-				},
-			}
+		var resp cstructs.FsListResponse
+		require.NoError(c.ClientRPC("FileSystem.List", req, &resp))
+		require.Len(resp.Files, 1)
+		return resp.Files[0]
+	}
 
-			var resp cstructs.FsStatResponse
-			err := client.ClientRPC("FileSystem.Stat", req, &resp)
-			if c.ExpectedError == "" {
-				require.NoError(t, err)
-			} else {
-				require.NotNil(t, err)
-				require.Contains(t, err.Error(), c.ExpectedError)
-			}
-		})
+	// The owner is only returned when requested
+	for _, info := range []*cstructs.AllocFileInfo{stat(false), list(false)} {
+		require.Nil(info.UID)
+		require.Nil(info.GID)
+	}
+	for _, info := range []*cstructs.AllocFileInfo{stat(true), list(true)} {
+		require.NotNil(info.UID)
+		require.NotNil(info.GID)
+		require.Equal(os.Getuid(), *info.UID)
+		require.Equal(os.Getgid(), *info.GID)
 	}
 }
 
-func TestFS_List_NoAlloc(t *testing.T) {
+func TestFS_Exists(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
 
-	// Start a client
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
 
-	// Make the request with bad allocation id
-	req := &cstructs.FsListRequest{
-		AllocID:      uuid.Generate(),
-		Path:         "foo",
-		QueryOptions: structs.QueryOptions{Region: "global"},
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Create and add an alloc
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": "hello",
 	}
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-	var resp cstructs.FsListResponse
-	err := c.ClientRPC("FileSystem.List", req, &resp)
-	require.NotNil(err)
-	require.True(structs.IsErrUnknownAllocation(err))
+	exists := func(path string) *cstructs.FsExistsResponse {
+		req := &cstructs.FsExistsRequest{
+			AllocID:      alloc.ID,
+			Path:         path,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+
+		var resp cstructs.FsExistsResponse
+		require.NoError(c.ClientRPC("FileSystem.Exists", req, &resp))
+		return &resp
+	}
+
+	// Existing file
+	testutil.WaitForResult(func() (bool, error) {
+		return exists("alloc/logs/web.stdout.0").Exists, fmt.Errorf("log file not created")
+	}, func(err error) {
+		t.Fatal(err)
+	})
+	resp := exists("alloc/logs/web.stdout.0")
+	require.False(resp.IsDir)
+
+	// Existing directory
+	resp = exists("alloc/logs")
+	require.True(resp.Exists)
+	require.True(resp.IsDir)
+
+	// Missing path
+	resp = exists("alloc/logs/missing")
+	require.False(resp.Exists)
+	require.False(resp.IsDir)
 }
 
-func TestFS_List(t *testing.T) {
+func TestFS_DiskUsage(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
 
@@ -221,26 +339,184 @@ func TestFS_List(t *testing.T) {
 	job := mock.BatchJob()
 	job.TaskGroups[0].Count = 1
 	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for": "500ms",
+		"run_for": "10s",
 	}
-	// Wait for alloc to be running
 	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-	// Make the request
-	req := &cstructs.FsListRequest{
+	// Create nested directories
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir)
+	files := map[string]int{
+		"top":             3,
+		"cache/a":         10,
+		"cache/nested/b":  20,
+		"cache/nested/c":  30,
+		"db/data":         100,
+		"db/empty/.keep":  0,
+		"db/more/deep/xy": 5,
+	}
+	for name, size := range files {
+		path := filepath.Join(dataDir, name)
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(ioutil.WriteFile(path, make([]byte, size), 0666))
+	}
+
+	req := &cstructs.FsDiskUsageRequest{
 		AllocID:      alloc.ID,
-		Path:         "/",
+		Path:         "alloc/data",
+		Breakdown:    true,
 		QueryOptions: structs.QueryOptions{Region: "global"},
 	}
 
-	var resp cstructs.FsListResponse
-	err := c.ClientRPC("FileSystem.List", req, &resp)
-	require.Nil(err)
-	require.NotEmpty(resp.Files)
-	require.True(resp.Files[0].IsDir)
+	var resp cstructs.FsDiskUsageResponse
+	require.NoError(c.ClientRPC("FileSystem.DiskUsage", req, &resp))
+	require.False(resp.Truncated)
+	require.Equal(cstructs.FsDiskUsage{Bytes: 168, Files: 7}, resp.Total)
+	require.Equal(map[string]*cstructs.FsDiskUsage{
+		"top":   {Bytes: 3, Files: 1},
+		"cache": {Bytes: 60, Files: 3},
+		"db":    {Bytes: 105, Files: 3},
+	}, resp.Breakdown)
+
+	// The breakdown is only returned when requested
+	req.Path = "alloc/data/cache/nested"
+	req.Breakdown = false
+	var resp2 cstructs.FsDiskUsageResponse
+	require.NoError(c.ClientRPC("FileSystem.DiskUsage", req, &resp2))
+	require.Equal(cstructs.FsDiskUsage{Bytes: 50, Files: 2}, resp2.Total)
+	require.Nil(resp2.Breakdown)
 }
 
-func TestFS_List_ACL(t *testing.T) {
+func TestFS_Find(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Create and add an alloc
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Create nested directories
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir)
+	for _, name := range []string{
+		"app.log",
+		"app.log.1",
+		"cache/index.db",
+		"cache/nested/app.log",
+		"db/data.db",
+		"db/logs/.keep",
+	} {
+		path := filepath.Join(dataDir, name)
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(ioutil.WriteFile(path, nil, 0666))
+	}
+
+	find := func(pattern string, regex bool, max int) (*cstructs.FsFindResponse, error) {
+		req := &cstructs.FsFindRequest{
+			AllocID:      alloc.ID,
+			Root:         "alloc/data",
+			NamePattern:  pattern,
+			Regex:        regex,
+			MaxResults:   max,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+
+		var resp cstructs.FsFindResponse
+		err := c.ClientRPC("FileSystem.Find", req, &resp)
+		return &resp, err
+	}
+
+	// Globs match the base name of files and directories
+	resp, err := find("*.db", false, 0)
+	require.NoError(err)
+	require.False(resp.Truncated)
+	require.Equal([]string{"alloc/data/cache/index.db", "alloc/data/db/data.db"}, resp.Paths)
+
+	resp, err = find("log*", false, 0)
+	require.NoError(err)
+	require.Equal([]string{"alloc/data/db/logs"}, resp.Paths)
+
+	// The root itself is not matched
+	resp, err = find("data", false, 0)
+	require.NoError(err)
+	require.Empty(resp.Paths)
+
+	// Regular expressions match anywhere in the base name
+	resp, err = find(`^app\.log(\.\d+)?$`, true, 0)
+	require.NoError(err)
+	require.False(resp.Truncated)
+	require.Equal([]string{
+		"alloc/data/app.log",
+		"alloc/data/app.log.1",
+		"alloc/data/cache/nested/app.log",
+	}, resp.Paths)
+
+	// Results are capped
+	resp, err = find(`app`, true, 2)
+	require.NoError(err)
+	require.True(resp.Truncated)
+	require.Equal([]string{"alloc/data/app.log", "alloc/data/app.log.1"}, resp.Paths)
+
+	resp, err = find(`app`, true, 3)
+	require.NoError(err)
+	require.False(resp.Truncated)
+	require.Len(resp.Paths, 3)
+
+	// Invalid patterns and limits are rejected
+	_, err = find("[", false, 0)
+	require.EqualError(err, invalidFindPattern.Error())
+	_, err = find("(", true, 0)
+	require.EqualError(err, invalidFindPattern.Error())
+	_, err = find("", false, 0)
+	require.EqualError(err, invalidFindPattern.Error())
+	_, err = find("*", false, maxFindResults+1)
+	require.EqualError(err, invalidFindResults.Error())
+}
+
+func TestFS_Health(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a client
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	req := &structs.NodeSpecificRequest{
+		NodeID:       c.NodeID(),
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	var resp cstructs.FsHealthResponse
+	require.NoError(c.ClientRPC("FileSystem.Health", req, &resp))
+	require.True(resp.Healthy)
+	require.Empty(resp.Reason)
+
+	// An inaccessible alloc dir makes the client unhealthy
+	c.endpoints.FileSystem.allocBaseDir = filepath.Join(c.config.AllocDir, "missing")
+
+	var resp2 cstructs.FsHealthResponse
+	require.NoError(c.ClientRPC("FileSystem.Health", req, &resp2))
+	require.False(resp2.Healthy)
+	require.Contains(resp2.Reason, "missing")
+}
+
+func TestFS_Health_ACL(t *testing.T) {
 	t.Parallel()
 
 	// Start a server
@@ -255,21 +531,11 @@ func TestFS_List_ACL(t *testing.T) {
 	defer cleanup()
 
 	// Create a bad token
-	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityDeny})
+	policyBad := mock.NodePolicy(acl.PolicyDeny)
 	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
 
-	policyGood := mock.NamespacePolicy(structs.DefaultNamespace, "",
-		[]string{acl.NamespaceCapabilityReadLogs, acl.NamespaceCapabilityReadFS})
-	tokenGood := mock.CreatePolicyAndToken(t, s.State(), 1009, "valid2", policyGood)
-
-	job := mock.BatchJob()
-	job.TaskGroups[0].Count = 1
-	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for": "20s",
-	}
-
-	// Wait for client to be running job
-	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
+	policyGood := mock.NodePolicy(acl.PolicyRead)
+	tokenGood := mock.CreatePolicyAndToken(t, s.State(), 1009, "valid", policyGood)
 
 	cases := []struct {
 		Name          string
@@ -293,21 +559,19 @@ func TestFS_List_ACL(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.Name, func(t *testing.T) {
-			// Make the request with bad allocation id
-			req := &cstructs.FsListRequest{
-				AllocID: alloc.ID,
-				Path:    "/",
+			req := &structs.NodeSpecificRequest{
+				NodeID: client.NodeID(),
 				QueryOptions: structs.QueryOptions{
 					Region:    "global",
 					AuthToken: c.Token,
-					Namespace: structs.DefaultNamespace,
 				},
 			}
 
-			var resp cstructs.FsListResponse
-			err := client.ClientRPC("FileSystem.List", req, &resp)
+			var resp cstructs.FsHealthResponse
+			err := client.ClientRPC("FileSystem.Health", req, &resp)
 			if c.ExpectedError == "" {
 				require.NoError(t, err)
+				require.True(t, resp.Healthy)
 			} else {
 				require.EqualError(t, err, c.ExpectedError)
 			}
@@ -315,82 +579,435 @@ func TestFS_List_ACL(t *testing.T) {
 	}
 }
 
-func TestFS_Stream_NoAlloc(t *testing.T) {
+func TestFS_Peek(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
 
-	// Start a client
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
 
-	// Make the request with bad allocation id
-	req := &cstructs.FsStreamRequest{
-		AllocID:      uuid.Generate(),
-		Path:         "foo",
-		Origin:       "start",
-		QueryOptions: structs.QueryOptions{Region: "global"},
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expected := strings.Repeat("0123456789", 10)
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": expected,
 	}
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-	// Get the handler
-	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
-	require.Nil(err)
+	peek := func(path string, head, tail int64) (*cstructs.FsPeekResponse, error) {
+		req := &cstructs.FsPeekRequest{
+			AllocID:      alloc.ID,
+			Path:         path,
+			HeadBytes:    head,
+			TailBytes:    tail,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
 
-	// Create a pipe
-	p1, p2 := net.Pipe()
-	defer p1.Close()
-	defer p2.Close()
+		var resp cstructs.FsPeekResponse
+		err := c.ClientRPC("FileSystem.Peek", req, &resp)
+		return &resp, err
+	}
 
-	errCh := make(chan error)
-	streamMsg := make(chan *cstructs.StreamErrWrapper)
+	// Wait for the whole log to be written
+	logFile := "alloc/logs/web.stdout.0"
+	testutil.WaitForResult(func() (bool, error) {
+		resp, err := peek(logFile, 1, 0)
+		if err != nil {
+			return false, err
+		}
+		return resp.Size == int64(len(expected)), fmt.Errorf("log file size %d", resp.Size)
+	}, func(err error) {
+		t.Fatal(err)
+	})
 
-	// Start the handler
-	go handler(p2)
+	// Files no larger than the head and tail are returned whole
+	resp, err := peek(logFile, 60, 40)
+	require.NoError(err)
+	require.Equal(expected, string(resp.Head))
+	require.Empty(resp.Tail)
+	require.Zero(resp.ElidedBytes)
 
-	// Start the decoder
-	go func() {
-		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-		for {
-			var msg cstructs.StreamErrWrapper
-			if err := decoder.Decode(&msg); err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "closed") {
-					return
-				}
-				errCh <- fmt.Errorf("error decoding: %v", err)
-			}
+	// The middle of larger files is elided
+	resp, err = peek(logFile, 15, 5)
+	require.NoError(err)
+	require.Equal(expected[:15], string(resp.Head))
+	require.Equal(expected[95:], string(resp.Tail))
+	require.EqualValues(80, resp.ElidedBytes)
+	require.EqualValues(100, resp.Size)
 
-			streamMsg <- &msg
+	// Only the tail may be requested
+	resp, err = peek(logFile, 0, 5)
+	require.NoError(err)
+	require.Empty(resp.Head)
+	require.Equal(expected[95:], string(resp.Tail))
+	require.EqualValues(95, resp.ElidedBytes)
+
+	// Invalid requests
+	_, err = peek(logFile, 0, 0)
+	require.EqualError(err, invalidPeekBytes.Error())
+	_, err = peek(logFile, -1, 5)
+	require.EqualError(err, invalidPeekBytes.Error())
+	_, err = peek(logFile, maxPeekBytes, 1)
+	require.EqualError(err, invalidPeekBytes.Error())
+	_, err = peek("alloc/logs", 5, 5)
+	require.Error(err)
+	require.Contains(err.Error(), "is a directory")
+}
+
+func TestFS_ReadBackward(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Lines of eight bytes each
+	var expected string
+	for i := 0; i < 10; i++ {
+		expected += fmt.Sprintf("line %02d\n", i)
+	}
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": expected,
+	}
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	readBackward := func(path string, offset, window int64) (*cstructs.FsReadBackwardResponse, error) {
+		req := &cstructs.FsReadBackwardRequest{
+			AllocID:      alloc.ID,
+			Path:         path,
+			Offset:       offset,
+			WindowBytes:  window,
+			QueryOptions: structs.QueryOptions{Region: "global"},
 		}
-	}()
 
-	// Send the request
-	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-	require.Nil(encoder.Encode(req))
+		var resp cstructs.FsReadBackwardResponse
+		err := c.ClientRPC("FileSystem.ReadBackward", req, &resp)
+		return &resp, err
+	}
 
-	timeout := time.After(3 * time.Second)
+	// Wait for the whole log to be written
+	logFile := "alloc/logs/web.stdout.0"
+	testutil.WaitForResult(func() (bool, error) {
+		resp, err := readBackward(logFile, 0, 1)
+		if err != nil {
+			return false, err
+		}
+		return resp.Size == int64(len(expected)), fmt.Errorf("log file size %d", resp.Size)
+	}, func(err error) {
+		t.Fatal(err)
+	})
 
-OUTER:
-	for {
-		select {
-		case <-timeout:
-			t.Fatal("timeout")
-		case err := <-errCh:
-			t.Fatal(err)
-		case msg := <-streamMsg:
-			t.Logf("Got msg %+v", msg)
-			if msg.Error == nil {
-				continue
-			}
+	cases := []struct {
+		Name   string
+		Offset int64
+		Window int64
+		Start  int64
+		End    int64
+	}{
+		{Name: "mid line start snapped to next line", Offset: 48, Window: 20, Start: 32, End: 48},
+		{Name: "line start kept", Offset: 48, Window: 16, Start: 32, End: 48},
+		{Name: "window within a line", Offset: 44, Window: 3, Start: 41, End: 44},
+		{Name: "near start", Offset: 12, Window: 20, Start: 0, End: 12},
+		{Name: "past end", Offset: 1000, Window: 8, Start: 72, End: 80},
+		{Name: "at start", Offset: 0, Window: 8, Start: 0, End: 0},
+	}
 
-			if structs.IsErrUnknownAllocation(msg.Error) {
-				break OUTER
-			} else {
-				t.Fatalf("bad error: %v", err)
-			}
+	for _, tc := range cases {
+		resp, err := readBackward(logFile, tc.Offset, tc.Window)
+		require.NoError(err, tc.Name)
+		require.Equal(expected[tc.Start:tc.End], string(resp.Data), tc.Name)
+		require.Equal(tc.Start, resp.Offset, tc.Name)
+	}
+
+	// Paging upwards from the end reads every line once
+	var paged string
+	offset := int64(len(expected))
+	for offset > 0 {
+		resp, err := readBackward(logFile, offset, 20)
+		require.NoError(err)
+		paged = string(resp.Data) + paged
+		offset = resp.Offset
+	}
+	require.Equal(expected, paged)
+
+	// Invalid requests
+	_, err := readBackward(logFile, 10, 0)
+	require.EqualError(err, invalidWindowBytes.Error())
+	_, err = readBackward(logFile, -1, 8)
+	require.EqualError(err, invalidWindowBytes.Error())
+	_, err = readBackward(logFile, 10, maxPeekBytes+1)
+	require.EqualError(err, invalidWindowBytes.Error())
+	_, err = readBackward("alloc/logs", 10, 8)
+	require.Error(err)
+	require.Contains(err.Error(), "is a directory")
+}
+
+func TestFS_ReadSet(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Write a configuration and its checksum
+	ar, err := c.getAllocRunner(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(ar.GetAllocDir().SharedDir, allocdir.SharedDataDir)
+	require.NoError(ioutil.WriteFile(filepath.Join(dataDir, "app.conf"), []byte("key = value\n"), 0666))
+	require.NoError(ioutil.WriteFile(filepath.Join(dataDir, "app.conf.sum"), []byte("abc\n"), 0666))
+
+	readSet := func(paths ...string) (*cstructs.FsReadSetResponse, error) {
+		req := &cstructs.FsReadSetRequest{
+			AllocID:      alloc.ID,
+			Paths:        paths,
+			QueryOptions: structs.QueryOptions{Region: "global"},
 		}
+
+		var resp cstructs.FsReadSetResponse
+		err := c.ClientRPC("FileSystem.ReadSet", req, &resp)
+		return &resp, err
+	}
+
+	resp, err := readSet("alloc/data/app.conf", "alloc/data/app.conf.sum")
+	require.NoError(err)
+	require.True(resp.Consistent)
+	require.Len(resp.Files, 2)
+	require.Equal("alloc/data/app.conf", resp.Files[0].Path)
+	require.Equal("key = value\n", string(resp.Files[0].Contents))
+	require.EqualValues(12, resp.Files[0].Info.Size)
+	require.Nil(resp.Files[0].Info.Inode)
+	require.False(resp.Files[0].Changed)
+	require.Equal("abc\n", string(resp.Files[1].Contents))
+
+	// Invalid requests
+	_, err = readSet()
+	require.EqualError(err, invalidReadSet.Error())
+	_, err = readSet(make([]string, maxReadSetFiles+1)...)
+	require.EqualError(err, invalidReadSet.Error())
+	_, err = readSet("alloc/data/app.conf", "")
+	require.EqualError(err, pathNotPresentErr.Error())
+	_, err = readSet("alloc/data")
+	require.Error(err)
+	require.Contains(err.Error(), "is a directory")
+	_, err = readSet("alloc/data/missing")
+	require.Error(err)
+}
+
+// modifyingAllocDir appends to a file when another file is read to simulate
+// the files of a set being updated while the set is read.
+type modifyingAllocDir struct {
+	*allocdir.AllocDir
+	t        *testing.T
+	readPath string
+	modPath  string
+}
+
+func (m *modifyingAllocDir) ReadAt(path string, offset int64) (io.ReadCloser, error) {
+	if path == m.readPath {
+		f, err := os.OpenFile(filepath.Join(m.AllocDir.AllocDir, m.modPath), os.O_APPEND|os.O_WRONLY, 0)
+		require.NoError(m.t, err)
+		_, err = f.WriteString("updated\n")
+		require.NoError(m.t, err)
+		require.NoError(m.t, f.Close())
 	}
+	return m.AllocDir.ReadAt(path, offset)
 }
 
-func TestFS_Stream_ACL(t *testing.T) {
+func TestFS_readSet_Modified(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ad := tempAllocDir(t)
+	require.NoError(ad.Build())
+	dataDir := filepath.Join(ad.SharedDir, allocdir.SharedDataDir)
+	require.NoError(ioutil.WriteFile(filepath.Join(dataDir, "app.conf"), []byte("key = value\n"), 0666))
+	require.NoError(ioutil.WriteFile(filepath.Join(dataDir, "app.conf.sum"), []byte("abc\n"), 0666))
+
+	conf := filepath.Join(allocdir.SharedAllocName, allocdir.SharedDataDir, "app.conf")
+	sum := conf + ".sum"
+
+	// Unmodified files are consistent
+	files, err := readSet(ad, []string{conf, sum})
+	require.NoError(err)
+	require.False(files[0].Changed)
+	require.False(files[1].Changed)
+
+	// The configuration is updated after it was read, while its checksum is
+	// read
+	fs := &modifyingAllocDir{AllocDir: ad, t: t, readPath: sum, modPath: conf}
+	files, err = readSet(fs, []string{conf, sum})
+	require.NoError(err)
+	require.True(files[0].Changed)
+	require.Equal("key = value\n", string(files[0].Contents))
+	require.EqualValues(12, files[0].Info.Size)
+	require.False(files[1].Changed)
+
+	// Files updated before being read are returned whole
+	fs = &modifyingAllocDir{AllocDir: ad, t: t, readPath: sum, modPath: sum}
+	files, err = readSet(fs, []string{conf, sum})
+	require.NoError(err)
+	require.False(files[0].Changed)
+	require.True(files[1].Changed)
+	require.Equal("abc\nupdated\n", string(files[1].Contents))
+}
+
+func TestFS_Changed(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	ar, err := c.getAllocRunner(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(ar.GetAllocDir().SharedDir, allocdir.SharedDataDir)
+	path := filepath.Join(dataDir, "progress")
+	require.NoError(ioutil.WriteFile(path, []byte("hello"), 0666))
+
+	changed := func(token string) (*cstructs.FsChangedResponse, error) {
+		req := &cstructs.FsChangedRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/data/progress",
+			Token:        token,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+
+		var resp cstructs.FsChangedResponse
+		err := c.ClientRPC("FileSystem.Changed", req, &resp)
+		return &resp, err
+	}
+
+	// Files are changed without a token
+	resp, err := changed("")
+	require.NoError(err)
+	require.True(resp.Changed)
+	require.False(resp.Recreated)
+	require.EqualValues(5, resp.SizeDelta)
+	require.EqualValues(5, resp.Info.Size)
+	require.NotEmpty(resp.Token)
+
+	// Unchanged files
+	token := resp.Token
+	resp, err = changed(token)
+	require.NoError(err)
+	require.False(resp.Changed)
+	require.False(resp.Recreated)
+	require.Zero(resp.SizeDelta)
+	require.Nil(resp.Info)
+	require.Equal(token, resp.Token)
+
+	// Grown files
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(err)
+	_, err = f.WriteString(" world")
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	resp, err = changed(token)
+	require.NoError(err)
+	require.True(resp.Changed)
+	require.False(resp.Recreated)
+	require.EqualValues(6, resp.SizeDelta)
+	require.EqualValues(11, resp.Info.Size)
+	require.NotEqual(token, resp.Token)
+
+	// Recreated files, replaced by a file of the same size
+	token = resp.Token
+	replacement := filepath.Join(dataDir, "progress.new")
+	require.NoError(ioutil.WriteFile(replacement, []byte("hello again"), 0666))
+	require.NoError(os.Rename(replacement, path))
+
+	resp, err = changed(token)
+	require.NoError(err)
+	require.True(resp.Changed)
+	require.Zero(resp.SizeDelta)
+	if runtime.GOOS != "windows" {
+		require.True(resp.Recreated)
+	}
+
+	// Invalid tokens
+	for _, token := range []string{"x", "1:x", "-1:5", "1:2:3"} {
+		_, err = changed(token)
+		require.EqualError(err, invalidChangedToken.Error(), token)
+	}
+
+	// Missing files
+	req := &cstructs.FsChangedRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/data/missing",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+	var missing cstructs.FsChangedResponse
+	require.Error(c.ClientRPC("FileSystem.Changed", req, &missing))
+}
+
+func TestFS_changedToken(t *testing.T) {
+	t.Parallel()
+
+	inode, device := uint64(42), uint64(7)
+	for _, token := range []*changedToken{
+		{Size: 10, ModTime: 1234},
+		{Size: 0, ModTime: -5, Inode: &inode, Device: &device},
+	} {
+		parsed, err := parseChangedToken(token.String())
+		require.NoError(t, err)
+		require.Equal(t, token, parsed)
+		require.True(t, parsed.sameFile(token))
+	}
+
+	other := uint64(43)
+	a := &changedToken{Inode: &inode, Device: &device}
+	require.False(t, a.sameFile(&changedToken{Inode: &other, Device: &device}))
+	require.True(t, a.sameFile(&changedToken{}))
+}
+
+func TestFS_Peek_ACL(t *testing.T) {
 	t.Parallel()
 
 	// Start a server
@@ -405,7 +1022,7 @@ func TestFS_Stream_ACL(t *testing.T) {
 	defer cleanup()
 
 	// Create a bad token
-	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityReadFS})
+	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityDeny})
 	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
 
 	policyGood := mock.NamespacePolicy(structs.DefaultNamespace, "",
@@ -415,7 +1032,8 @@ func TestFS_Stream_ACL(t *testing.T) {
 	job := mock.BatchJob()
 	job.TaskGroups[0].Count = 1
 	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for": "20s",
+		"run_for":       "20s",
+		"stdout_string": "hello",
 	}
 
 	// Wait for client to be running job
@@ -443,198 +1061,127 @@ func TestFS_Stream_ACL(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.Name, func(t *testing.T) {
-			// Make the request with bad allocation id
-			req := &cstructs.FsStreamRequest{
-				AllocID: alloc.ID,
-				Path:    "foo",
-				Origin:  "start",
+			req := &cstructs.FsPeekRequest{
+				AllocID:   alloc.ID,
+				Path:      "alloc/logs/web.stdout.0",
+				HeadBytes: 10,
+				TailBytes: 10,
 				QueryOptions: structs.QueryOptions{
-					Namespace: structs.DefaultNamespace,
 					Region:    "global",
 					AuthToken: c.Token,
+					Namespace: structs.DefaultNamespace,
 				},
 			}
 
-			// Get the handler
-			handler, err := client.StreamingRpcHandler("FileSystem.Stream")
-			require.Nil(t, err)
-
-			// Create a pipe
-			p1, p2 := net.Pipe()
-			defer p1.Close()
-			defer p2.Close()
-
-			errCh := make(chan error)
-			streamMsg := make(chan *cstructs.StreamErrWrapper)
-
-			// Start the handler
-			go handler(p2)
-
-			// Start the decoder
-			go func() {
-				decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-				for {
-					var msg cstructs.StreamErrWrapper
-					if err := decoder.Decode(&msg); err != nil {
-						errCh <- err
-						return
-					}
-
-					streamMsg <- &msg
-				}
-			}()
-
-			// Send the request
-			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-			require.NoError(t, encoder.Encode(req))
-
-			timeout := time.After(5 * time.Second)
-
-		OUTER:
-			for {
-				select {
-				case <-timeout:
-					t.Fatal("timeout")
-				case err := <-errCh:
-					eof := err == io.EOF || strings.Contains(err.Error(), "closed")
-					if c.ExpectedError == "" && eof {
-						// No error was expected!
-						return
-					}
-					t.Fatal(err)
-				case msg := <-streamMsg:
-					if msg.Error == nil {
-						continue
-					}
-
-					if strings.Contains(msg.Error.Error(), c.ExpectedError) {
-						break OUTER
-					} else {
-						t.Fatalf("Bad error: %v", msg.Error)
-					}
-				}
+			var resp cstructs.FsPeekResponse
+			err := client.ClientRPC("FileSystem.Peek", req, &resp)
+			if c.ExpectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.NotNil(t, err)
+				require.Contains(t, err.Error(), c.ExpectedError)
 			}
 		})
 	}
 }
 
-func TestFS_Stream(t *testing.T) {
+func TestFS_Stat_ACL(t *testing.T) {
 	t.Parallel()
-	require := require.New(t)
 
-	// Start a server and client
-	s, cleanupS := nomad.TestServer(t, nil)
+	// Start a server
+	s, root, cleanupS := nomad.TestACLServer(t, nil)
 	defer cleanupS()
 	testutil.WaitForLeader(t, s.RPC)
 
-	c, cleanupC := TestClient(t, func(c *config.Config) {
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.ACLEnabled = true
 		c.Servers = []string{s.GetConfig().RPCAddr.String()}
 	})
-	defer cleanupC()
+	defer cleanup()
+
+	// Create a bad token
+	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityDeny})
+	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
+
+	policyGood := mock.NamespacePolicy(structs.DefaultNamespace, "",
+		[]string{acl.NamespaceCapabilityReadLogs, acl.NamespaceCapabilityReadFS})
+	tokenGood := mock.CreatePolicyAndToken(t, s.State(), 1009, "valid2", policyGood)
 
-	expected := "Hello from the other side"
 	job := mock.BatchJob()
 	job.TaskGroups[0].Count = 1
 	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for":       "2s",
-		"stdout_string": expected,
+		"run_for": "20s",
 	}
 
-	// Wait for alloc to be running
-	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
 
-	// Make the request
-	req := &cstructs.FsStreamRequest{
-		AllocID:      alloc.ID,
-		Path:         "alloc/logs/web.stdout.0",
-		PlainText:    true,
-		QueryOptions: structs.QueryOptions{Region: "global"},
+	cases := []struct {
+		Name          string
+		Token         string
+		ExpectedError string
+	}{
+		{
+			Name:          "bad token",
+			Token:         tokenBad.SecretID,
+			ExpectedError: structs.ErrPermissionDenied.Error(),
+		},
+		{
+			Name:  "good token",
+			Token: tokenGood.SecretID,
+		},
+		{
+			Name:  "root token",
+			Token: root.SecretID,
+		},
 	}
 
-	// Get the handler
-	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
-	require.Nil(err)
-
-	// Create a pipe
-	p1, p2 := net.Pipe()
-	defer p1.Close()
-	defer p2.Close()
-
-	// Wrap the pipe so we can check it is closed
-	pipeChecker := &ReadWriteCloseChecker{ReadWriteCloser: p2}
-
-	errCh := make(chan error)
-	streamMsg := make(chan *cstructs.StreamErrWrapper)
-
-	// Start the handler
-	go handler(pipeChecker)
-
-	// Start the decoder
-	go func() {
-		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-		for {
-			var msg cstructs.StreamErrWrapper
-			if err := decoder.Decode(&msg); err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "closed") {
-					return
-				}
-				errCh <- fmt.Errorf("error decoding: %v", err)
-			}
-
-			streamMsg <- &msg
-		}
-	}()
-
-	// Send the request
-	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-	require.Nil(encoder.Encode(req))
-
-	timeout := time.After(3 * time.Second)
-	received := ""
-OUTER:
-	for {
-		select {
-		case <-timeout:
-			t.Fatal("timeout")
-		case err := <-errCh:
-			t.Fatal(err)
-		case msg := <-streamMsg:
-			if msg.Error != nil {
-				t.Fatalf("Got error: %v", msg.Error.Error())
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			req := &cstructs.FsStatRequest{
+				AllocID: alloc.ID,
+				Path:    "/",
+				QueryOptions: structs.QueryOptions{
+					Region:    "global",
+					AuthToken: c.Token,
+					Namespace: structs.DefaultNamespace,
+				},
 			}
 
-			// Add the payload
-			received += string(msg.Payload)
-			if received == expected {
-				break OUTER
+			var resp cstructs.FsStatResponse
+			err := client.ClientRPC("FileSystem.Stat", req, &resp)
+			if c.ExpectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.NotNil(t, err)
+				require.Contains(t, err.Error(), c.ExpectedError)
 			}
-		}
+		})
 	}
+}
 
-	testutil.WaitForResult(func() (bool, error) {
-		pipeChecker.l.Lock()
-		defer pipeChecker.l.Unlock()
+func TestFS_List_NoAlloc(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
 
-		return pipeChecker.Closed, nil
-	}, func(err error) {
-		t.Fatal("Pipe not closed")
-	})
-}
+	// Start a client
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
 
-type ReadWriteCloseChecker struct {
-	io.ReadWriteCloser
-	l      sync.Mutex
-	Closed bool
-}
+	// Make the request with bad allocation id
+	req := &cstructs.FsListRequest{
+		AllocID:      uuid.Generate(),
+		Path:         "foo",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
 
-func (r *ReadWriteCloseChecker) Close() error {
-	r.l.Lock()
-	r.Closed = true
-	r.l.Unlock()
-	return r.ReadWriteCloser.Close()
+	var resp cstructs.FsListResponse
+	err := c.ClientRPC("FileSystem.List", req, &resp)
+	require.NotNil(err)
+	require.True(structs.IsErrUnknownAllocation(err))
 }
 
-func TestFS_Stream_Follow(t *testing.T) {
+func TestFS_List(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
 
@@ -648,90 +1195,93 @@ func TestFS_Stream_Follow(t *testing.T) {
 	})
 	defer cleanupC()
 
-	expectedBase := "Hello from the other side"
-	repeat := 10
-
+	// Create and add an alloc
 	job := mock.BatchJob()
 	job.TaskGroups[0].Count = 1
 	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for":                "20s",
-		"stdout_string":          expectedBase,
-		"stdout_repeat":          repeat,
-		"stdout_repeat_duration": "200ms",
+		"run_for": "500ms",
 	}
-
 	// Wait for alloc to be running
 	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
 	// Make the request
-	req := &cstructs.FsStreamRequest{
+	req := &cstructs.FsListRequest{
 		AllocID:      alloc.ID,
-		Path:         "alloc/logs/web.stdout.0",
-		PlainText:    true,
-		Follow:       true,
+		Path:         "/",
 		QueryOptions: structs.QueryOptions{Region: "global"},
 	}
 
-	// Get the handler
-	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	var resp cstructs.FsListResponse
+	err := c.ClientRPC("FileSystem.List", req, &resp)
 	require.Nil(err)
+	require.NotEmpty(resp.Files)
+	require.True(resp.Files[0].IsDir)
+}
 
-	// Create a pipe
-	p1, p2 := net.Pipe()
-	defer p1.Close()
-	defer p2.Close()
-
-	errCh := make(chan error)
-	streamMsg := make(chan *cstructs.StreamErrWrapper)
-
-	// Start the handler
-	go handler(p2)
+func TestFS_List_Compress(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
 
-	// Start the decoder
-	go func() {
-		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-		for {
-			var msg cstructs.StreamErrWrapper
-			if err := decoder.Decode(&msg); err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "closed") {
-					return
-				}
-				errCh <- fmt.Errorf("error decoding: %v", err)
-			}
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
 
-			streamMsg <- &msg
-		}
-	}()
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
 
-	// Send the request
-	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-	require.Nil(encoder.Encode(req))
+	// Create and add an alloc
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-	timeout := time.After(20 * time.Second)
-	expected := strings.Repeat(expectedBase, repeat+1)
-	received := ""
-OUTER:
-	for {
-		select {
-		case <-timeout:
-			t.Fatal("timeout")
-		case err := <-errCh:
-			t.Fatal(err)
-		case msg := <-streamMsg:
-			if msg.Error != nil {
-				t.Fatalf("Got error: %v", msg.Error.Error())
-			}
+	// Create a large directory
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir)
+	for i := 0; i < 1000; i++ {
+		require.NoError(ioutil.WriteFile(filepath.Join(dataDir, fmt.Sprintf("file-%04d", i)), nil, 0666))
+	}
 
-			// Add the payload
-			received += string(msg.Payload)
-			if received == expected {
-				break OUTER
-			}
+	list := func(path string, compress bool) *cstructs.FsListResponse {
+		req := &cstructs.FsListRequest{
+			AllocID:      alloc.ID,
+			Path:         path,
+			Compress:     compress,
+			QueryOptions: structs.QueryOptions{Region: "global"},
 		}
+
+		var resp cstructs.FsListResponse
+		require.NoError(c.ClientRPC("FileSystem.List", req, &resp))
+		return &resp
 	}
+
+	// The large listing round trips through compression
+	plain := list("alloc/data", false)
+	require.Len(plain.Files, 1000)
+	require.Empty(plain.CompressedFiles)
+
+	compressed := list("alloc/data", true)
+	require.Empty(compressed.Files)
+	require.NotEmpty(compressed.CompressedFiles)
+	require.NoError(compressed.DecompressFiles())
+	require.Equal(plain.Files, compressed.Files)
+
+	// Small listings are not compressed
+	small := list("/", true)
+	require.NotEmpty(small.Files)
+	require.Empty(small.CompressedFiles)
+	require.NoError(small.DecompressFiles())
+	require.NotEmpty(small.Files)
 }
 
-func TestFS_Stream_Limit(t *testing.T) {
+func TestFS_List_Recursive(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
 
@@ -740,170 +1290,90 @@ func TestFS_Stream_Limit(t *testing.T) {
 	defer cleanupS()
 	testutil.WaitForLeader(t, s.RPC)
 
-	c, cleanup := TestClient(t, func(c *config.Config) {
+	c, cleanupC := TestClient(t, func(c *config.Config) {
 		c.Servers = []string{s.GetConfig().RPCAddr.String()}
 	})
-	defer cleanup()
+	defer cleanupC()
 
-	var limit int64 = 5
-	full := "Hello from the other side"
-	expected := full[:limit]
+	// Create and add an alloc
 	job := mock.BatchJob()
 	job.TaskGroups[0].Count = 1
 	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for":       "2s",
-		"stdout_string": full,
+		"run_for": "10s",
 	}
-
 	// Wait for alloc to be running
 	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-	// Make the request
-	req := &cstructs.FsStreamRequest{
-		AllocID:      alloc.ID,
-		Path:         "alloc/logs/web.stdout.0",
-		PlainText:    true,
-		Limit:        limit,
-		QueryOptions: structs.QueryOptions{Region: "global"},
+	// Create a directory tree
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir)
+	for _, name := range []string{"a/one", "a/two", "b/c/three", "four"} {
+		path := filepath.Join(dataDir, name)
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(ioutil.WriteFile(path, []byte(name), 0666))
 	}
 
-	// Get the handler
-	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
-	require.Nil(err)
-
-	// Create a pipe
-	p1, p2 := net.Pipe()
-	defer p1.Close()
-	defer p2.Close()
-
-	errCh := make(chan error)
-	streamMsg := make(chan *cstructs.StreamErrWrapper)
-
-	// Start the handler
-	go handler(p2)
-
-	// Start the decoder
-	go func() {
-		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-		for {
-			var msg cstructs.StreamErrWrapper
-			if err := decoder.Decode(&msg); err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "closed") {
-					return
-				}
-				errCh <- fmt.Errorf("error decoding: %v", err)
-			}
-
-			streamMsg <- &msg
+	list := func(max int) (*cstructs.FsListResponse, error) {
+		req := &cstructs.FsListRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/data",
+			Recursive:    true,
+			MaxEntries:   max,
+			QueryOptions: structs.QueryOptions{Region: "global"},
 		}
-	}()
-
-	// Send the request
-	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-	require.Nil(encoder.Encode(req))
-
-	timeout := time.After(3 * time.Second)
-	received := ""
-OUTER:
-	for {
-		select {
-		case <-timeout:
-			t.Fatal("timeout")
-		case err := <-errCh:
-			t.Fatal(err)
-		case msg := <-streamMsg:
-			if msg.Error != nil {
-				t.Fatalf("Got error: %v", msg.Error.Error())
-			}
 
-			// Add the payload
-			received += string(msg.Payload)
-			if received == expected {
-				break OUTER
-			}
+		var resp cstructs.FsListResponse
+		err := c.ClientRPC("FileSystem.List", req, &resp)
+		return &resp, err
+	}
+	names := func(files []*cstructs.AllocFileInfo) []string {
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
 		}
+		return names
 	}
-}
-
-func TestFS_Logs_NoAlloc(t *testing.T) {
-	t.Parallel()
-	require := require.New(t)
 
-	// Start a client
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
+	// The whole tree is listed in lexical order
+	resp, err := list(0)
+	require.NoError(err)
+	require.False(resp.Truncated)
+	require.Equal([]string{"a", "a/one", "a/two", "b", "b/c", "b/c/three", "four"}, names(resp.Files))
+	require.True(resp.Files[0].IsDir)
+	require.Equal(int64(len("b/c/three")), resp.Files[5].Size)
 
-	// Make the request with bad allocation id
-	req := &cstructs.FsLogsRequest{
-		AllocID:      uuid.Generate(),
-		Task:         "foo",
-		LogType:      "stdout",
-		Origin:       "start",
-		QueryOptions: structs.QueryOptions{Region: "global"},
+	// A tree exceeding the cap is truncated to its first entries
+	resp, err = list(4)
+	require.NoError(err)
+	require.True(resp.Truncated)
+	require.Equal([]string{"a", "a/one", "a/two", "b"}, names(resp.Files))
+	for _, file := range resp.Files {
+		require.NotEmpty(file.FileMode)
+		require.False(file.ModTime.IsZero())
 	}
 
-	// Get the handler
-	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
-	require.Nil(err)
-
-	// Create a pipe
-	p1, p2 := net.Pipe()
-	defer p1.Close()
-	defer p2.Close()
-
-	errCh := make(chan error)
-	streamMsg := make(chan *cstructs.StreamErrWrapper)
-
-	// Start the handler
-	go handler(p2)
-
-	// Start the decoder
-	go func() {
-		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-		for {
-			var msg cstructs.StreamErrWrapper
-			if err := decoder.Decode(&msg); err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "closed") {
-					return
-				}
-				errCh <- fmt.Errorf("error decoding: %v", err)
-			}
-
-			streamMsg <- &msg
-		}
-	}()
-
-	// Send the request
-	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-	require.Nil(encoder.Encode(req))
-
-	timeout := time.After(3 * time.Second)
+	resp, err = list(7)
+	require.NoError(err)
+	require.False(resp.Truncated)
+	require.Len(resp.Files, 7)
 
-OUTER:
-	for {
-		select {
-		case <-timeout:
-			t.Fatal("timeout")
-		case err := <-errCh:
-			t.Fatal(err)
-		case msg := <-streamMsg:
-			t.Logf("Got msg %+v", msg)
-			if msg.Error == nil {
-				continue
-			}
+	// Invalid caps are rejected
+	_, err = list(-1)
+	require.EqualError(err, invalidListEntries.Error())
 
-			if structs.IsErrUnknownAllocation(msg.Error) {
-				break OUTER
-			} else {
-				t.Fatalf("bad error: %v", err)
-			}
-		}
+	req := &cstructs.FsListRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/data",
+		MaxEntries:   1,
+		QueryOptions: structs.QueryOptions{Region: "global"},
 	}
+	var resp2 cstructs.FsListResponse
+	err = c.ClientRPC("FileSystem.List", req, &resp2)
+	require.EqualError(err, invalidListEntries.Error())
 }
 
-// TestFS_Logs_TaskPending asserts that trying to stream logs for tasks which
-// have not started returns a 404 error.
-func TestFS_Logs_TaskPending(t *testing.T) {
+func TestFS_List_Checksum(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
 
@@ -917,110 +1387,87 @@ func TestFS_Logs_TaskPending(t *testing.T) {
 	})
 	defer cleanupC()
 
+	// Create and add an alloc
 	job := mock.BatchJob()
 	job.TaskGroups[0].Count = 1
 	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"start_block_for": "10s",
+		"run_for": "10s",
 	}
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-	// Register job
-	args := &structs.JobRegisterRequest{}
-	args.Job = job
-	args.WriteRequest.Region = "global"
-	args.Namespace = job.Namespace
-	var jobResp structs.JobRegisterResponse
-	require.NoError(s.RPC("Job.Register", args, &jobResp))
-
-	// Get the allocation ID
-	var allocID string
-	testutil.WaitForResult(func() (bool, error) {
-		args := structs.AllocListRequest{}
-		args.Region = "global"
-		resp := structs.AllocListResponse{}
-		if err := s.RPC("Alloc.List", &args, &resp); err != nil {
-			return false, err
-		}
-
-		if len(resp.Allocations) != 1 {
-			return false, fmt.Errorf("expected 1 alloc, found %d", len(resp.Allocations))
-		}
-
-		allocID = resp.Allocations[0].ID
-
-		// wait for alloc runner to be created; otherwise, we get no alloc found error
-		if _, err := c.getAllocRunner(allocID); err != nil {
-			return false, fmt.Errorf("alloc runner was not created yet for %v", allocID)
+	// Create files to checksum, a directory and a file that is too large
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	dataDir := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir)
+	contents := map[string][]byte{
+		"empty": nil,
+		"hello": []byte("hello world"),
+	}
+	for name, data := range contents {
+		require.NoError(ioutil.WriteFile(filepath.Join(dataDir, name), data, 0666))
+	}
+	require.NoError(os.Mkdir(filepath.Join(dataDir, "dir"), 0777))
+	large, err := os.Create(filepath.Join(dataDir, "large"))
+	require.NoError(err)
+	require.NoError(large.Truncate(listChecksumMaxFileBytes + 1))
+	require.NoError(large.Close())
+
+	list := func(checksum string) (*cstructs.FsListResponse, error) {
+		req := &cstructs.FsListRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/data",
+			Checksum:     checksum,
+			QueryOptions: structs.QueryOptions{Region: "global"},
 		}
 
-		return true, nil
-	}, func(err error) {
-		t.Fatalf("error getting alloc id: %v", err)
-	})
-
-	// Make the request
-	req := &cstructs.FsLogsRequest{
-		AllocID:      allocID,
-		Task:         job.TaskGroups[0].Tasks[0].Name,
-		LogType:      "stdout",
-		Origin:       "start",
-		PlainText:    true,
-		QueryOptions: structs.QueryOptions{Region: "global"},
+		var resp cstructs.FsListResponse
+		err := c.ClientRPC("FileSystem.List", req, &resp)
+		return &resp, err
 	}
 
-	// Get the handler
-	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
-	require.Nil(err)
-
-	// Create a pipe
-	p1, p2 := net.Pipe()
-	defer p1.Close()
-	defer p2.Close()
-
-	errCh := make(chan error)
-	streamMsg := make(chan *cstructs.StreamErrWrapper)
-
-	// Start the handler
-	go handler(p2)
-
-	// Start the decoder
-	go func() {
-		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-		for {
-			var msg cstructs.StreamErrWrapper
-			if err := decoder.Decode(&msg); err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "closed") {
-					return
+	for _, algorithm := range []string{"md5", "sha256"} {
+		resp, err := list(algorithm)
+		require.NoError(err)
+		require.Len(resp.Files, 4)
+
+		for _, file := range resp.Files {
+			switch file.Name {
+			case "dir":
+				require.Empty(file.Checksum)
+				require.False(file.ChecksumSkipped)
+			case "large":
+				require.Empty(file.Checksum)
+				require.True(file.ChecksumSkipped)
+			default:
+				var sum []byte
+				if algorithm == "md5" {
+					s := md5.Sum(contents[file.Name])
+					sum = s[:]
+				} else {
+					s := sha256.Sum256(contents[file.Name])
+					sum = s[:]
 				}
-				errCh <- fmt.Errorf("error decoding: %v", err)
+				require.Equal(hex.EncodeToString(sum), file.Checksum, file.Name)
+				require.False(file.ChecksumSkipped)
 			}
-
-			streamMsg <- &msg
 		}
-	}()
-
-	// Send the request
-	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-	require.Nil(encoder.Encode(req))
+	}
 
-	for {
-		select {
-		case <-time.After(3 * time.Second):
-			t.Fatal("timeout")
-		case err := <-errCh:
-			t.Fatalf("unexpected stream error: %v", err)
-		case msg := <-streamMsg:
-			require.NotNil(msg.Error)
-			require.NotNil(msg.Error.Code)
-			require.EqualValues(404, *msg.Error.Code)
-			require.Contains(msg.Error.Message, "not started")
-			return
-		}
+	// Checksums are only computed when requested
+	resp, err := list("")
+	require.NoError(err)
+	for _, file := range resp.Files {
+		require.Empty(file.Checksum)
+		require.False(file.ChecksumSkipped)
 	}
+
+	_, err = list("crc32")
+	require.EqualError(err, invalidChecksum.Error())
 }
 
-func TestFS_Logs_ACL(t *testing.T) {
+func TestFS_List_ACL(t *testing.T) {
 	t.Parallel()
-	require := require.New(t)
 
 	// Start a server
 	s, root, cleanupS := nomad.TestACLServer(t, nil)
@@ -1034,7 +1481,7 @@ func TestFS_Logs_ACL(t *testing.T) {
 	defer cleanup()
 
 	// Create a bad token
-	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityReadFS})
+	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityDeny})
 	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
 
 	policyGood := mock.NamespacePolicy(structs.DefaultNamespace, "",
@@ -1073,127 +1520,225 @@ func TestFS_Logs_ACL(t *testing.T) {
 	for _, c := range cases {
 		t.Run(c.Name, func(t *testing.T) {
 			// Make the request with bad allocation id
-			req := &cstructs.FsLogsRequest{
+			req := &cstructs.FsListRequest{
 				AllocID: alloc.ID,
-				Task:    job.TaskGroups[0].Tasks[0].Name,
-				LogType: "stdout",
-				Origin:  "start",
+				Path:    "/",
 				QueryOptions: structs.QueryOptions{
-					Namespace: structs.DefaultNamespace,
 					Region:    "global",
 					AuthToken: c.Token,
+					Namespace: structs.DefaultNamespace,
 				},
 			}
 
-			// Get the handler
-			handler, err := client.StreamingRpcHandler("FileSystem.Logs")
-			require.Nil(err)
-
-			// Create a pipe
-			p1, p2 := net.Pipe()
-			defer p1.Close()
-			defer p2.Close()
+			var resp cstructs.FsListResponse
+			err := client.ClientRPC("FileSystem.List", req, &resp)
+			if c.ExpectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, c.ExpectedError)
+			}
+		})
+	}
+}
 
-			errCh := make(chan error)
-			streamMsg := make(chan *cstructs.StreamErrWrapper)
+func TestFS_SensitivePaths_ACL(t *testing.T) {
+	t.Parallel()
 
-			// Start the handler
-			go handler(p2)
+	// Start a server
+	s, root, cleanupS := nomad.TestACLServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
 
-			// Start the decoder
-			go func() {
-				decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-				for {
-					var msg cstructs.StreamErrWrapper
-					if err := decoder.Decode(&msg); err != nil {
-						errCh <- err
-						return
-					}
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.ACLEnabled = true
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+		c.FSSensitivePaths = []string{"*/secrets"}
+	})
+	defer cleanup()
 
-					streamMsg <- &msg
-				}
-			}()
+	policyRead := mock.NamespacePolicy(structs.DefaultNamespace, "",
+		[]string{acl.NamespaceCapabilityReadFS})
+	tokenRead := mock.CreatePolicyAndToken(t, s.State(), 1005, "read", policyRead)
 
-			// Send the request
-			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-			require.Nil(encoder.Encode(req))
+	policyExec := mock.NamespacePolicy(structs.DefaultNamespace, "",
+		[]string{acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityAllocExec})
+	tokenExec := mock.CreatePolicyAndToken(t, s.State(), 1009, "exec", policyExec)
 
-			timeout := time.After(5 * time.Second)
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "20s",
+	}
 
-		OUTER:
-			for {
-				select {
-				case <-timeout:
-					t.Fatal("timeout")
-				case err := <-errCh:
-					eof := err == io.EOF || strings.Contains(err.Error(), "closed")
-					if c.ExpectedError == "" && eof {
-						// No error was expected!
-						return
-					}
-					t.Fatal(err)
-				case msg := <-streamMsg:
-					if msg.Error == nil {
-						continue
-					}
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
+	task := job.TaskGroups[0].Tasks[0].Name
 
-					if strings.Contains(msg.Error.Error(), c.ExpectedError) {
-						// Ok! Error matched expectation.
-						break OUTER
-					} else {
-						t.Fatalf("Bad error: %v", msg.Error)
-					}
+	// Link to the secrets dir from the shared data dir
+	allocFS, err := client.GetAllocFS(alloc.ID)
+	require.NoError(t, err)
+	ad := allocFS.(*allocdir.AllocDir)
+	link := filepath.Join(allocdir.SharedAllocName, allocdir.SharedDataDir, "secrets-link")
+	require.NoError(t, os.Symlink(ad.TaskDirs[task].SecretsDir, filepath.Join(ad.AllocDir, link)))
+
+	cases := []struct {
+		Name    string
+		Token   string
+		Allowed bool
+	}{
+		{
+			Name:  "read-fs token",
+			Token: tokenRead.SecretID,
+		},
+		{
+			Name:    "alloc-exec token",
+			Token:   tokenExec.SecretID,
+			Allowed: true,
+		},
+		{
+			Name:    "root token",
+			Token:   root.SecretID,
+			Allowed: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			opts := structs.QueryOptions{
+				Region:    "global",
+				AuthToken: c.Token,
+				Namespace: structs.DefaultNamespace,
+			}
+
+			// The secrets dir is only listed for privileged tokens
+			listReq := &cstructs.FsListRequest{
+				AllocID:      alloc.ID,
+				Path:         task,
+				QueryOptions: opts,
+			}
+			var listResp cstructs.FsListResponse
+			require.NoError(t, client.ClientRPC("FileSystem.List", listReq, &listResp))
+
+			found := false
+			for _, file := range listResp.Files {
+				if file.Name == allocdir.TaskSecrets {
+					found = true
 				}
 			}
+			require.Equal(t, c.Allowed, found)
+
+			// Listing and stating the secrets dir directly is hidden
+			listReq.Path = filepath.Join(task, allocdir.TaskSecrets)
+			err := client.ClientRPC("FileSystem.List", listReq, &listResp)
+
+			statReq := &cstructs.FsStatRequest{
+				AllocID:      alloc.ID,
+				Path:         filepath.Join(task, allocdir.TaskSecrets),
+				QueryOptions: opts,
+			}
+			var statResp cstructs.FsStatResponse
+			statErr := client.ClientRPC("FileSystem.Stat", statReq, &statResp)
+
+			// Going through a symlink to the secrets dir is hidden as well
+			statReq.Path = link
+			var linkResp cstructs.FsStatResponse
+			linkErr := client.ClientRPC("FileSystem.Stat", statReq, &linkResp)
+
+			if c.Allowed {
+				require.NoError(t, err)
+				require.NoError(t, statErr)
+				require.True(t, statResp.Info.IsDir)
+				require.NoError(t, linkErr)
+			} else {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no such file or directory")
+				require.Error(t, statErr)
+				require.Contains(t, statErr.Error(), "no such file or directory")
+				require.Error(t, linkErr)
+				require.Contains(t, linkErr.Error(), "no such file or directory")
+			}
 		})
 	}
 }
 
-func TestFS_Logs(t *testing.T) {
+func TestFS_isSensitivePath(t *testing.T) {
 	t.Parallel()
-	require := require.New(t)
-
-	// Start a server and client
-	s, cleanupS := nomad.TestServer(t, nil)
-	defer cleanupS()
-	testutil.WaitForLeader(t, s.RPC)
 
-	c, cleanupC := TestClient(t, func(c *config.Config) {
-		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.FSSensitivePaths = []string{"*/secrets", "alloc/data/private"}
 	})
-	defer cleanupC()
+	defer cleanup()
 
-	expected := "Hello from the other side\n"
-	job := mock.BatchJob()
-	job.TaskGroups[0].Count = 1
-	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for":       "2s",
-		"stdout_string": expected,
+	endpoint := NewFileSystemEndpoint(client)
+
+	// Get a temp alloc dir with symlinks to sensitive paths
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	secrets := filepath.Join(ad.AllocDir, "web", "secrets")
+	require.NoError(t, os.MkdirAll(secrets, 0777))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secrets, "token"), []byte("secret"), 0666))
+	require.NoError(t, os.Symlink(secrets, filepath.Join(ad.SharedDir, "dir-link")))
+	require.NoError(t, os.Symlink(filepath.Join(secrets, "token"), filepath.Join(ad.SharedDir, "file-link")))
+
+	cases := map[string]bool{
+		"web/secrets":              true,
+		"/web/secrets/":            true,
+		"web/secrets/token":        true,
+		"web/../web/secrets":       true,
+		"alloc/data/private/key":   true,
+		"web/local":                false,
+		"web":                      false,
+		"alloc/data":               false,
+		"/":                        false,
+		"alloc/data/private-other": false,
+		"alloc/dir-link":           true,
+		"alloc/dir-link/token":     true,
+		"alloc/file-link":          true,
+		"alloc/missing-link":       false,
+	}
+	for path, expected := range cases {
+		require.Equal(t, expected, endpoint.isSensitivePath(ad, path), path)
 	}
+}
 
-	// Wait for client to be running job
-	testutil.WaitForRunning(t, s.RPC, job)
+func TestFS_authorizeErrCode(t *testing.T) {
+	t.Parallel()
 
-	// Get the allocation ID
-	args := structs.AllocListRequest{}
-	args.Region = "global"
-	resp := structs.AllocListResponse{}
-	require.NoError(s.RPC("Alloc.List", &args, &resp))
-	require.Len(resp.Allocations, 1)
-	allocID := resp.Allocations[0].ID
+	cases := []struct {
+		Err      error
+		Expected int64
+	}{
+		{structs.NewErrUnknownAllocation("foo"), 404},
+		{structs.ErrPermissionDenied, 403},
+		{structs.ErrTokenNotFound, 403},
+		{sensitivePathErr("web/secrets"), 404},
+		{errors.New("failed"), 500},
+	}
+	for _, tc := range cases {
+		require.Equal(t, tc.Expected, *authorizeErrCode(tc.Err), tc.Err.Error())
+	}
+}
 
-	// Make the request
-	req := &cstructs.FsLogsRequest{
-		AllocID:      allocID,
-		Task:         job.TaskGroups[0].Tasks[0].Name,
-		LogType:      "stdout",
+func TestFS_Stream_NoAlloc(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a client
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Make the request with bad allocation id
+	req := &cstructs.FsStreamRequest{
+		AllocID:      uuid.Generate(),
+		Path:         "foo",
 		Origin:       "start",
-		PlainText:    true,
 		QueryOptions: structs.QueryOptions{Region: "global"},
 	}
 
 	// Get the handler
-	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
 	require.Nil(err)
 
 	// Create a pipe
@@ -1228,7 +1773,7 @@ func TestFS_Logs(t *testing.T) {
 	require.Nil(encoder.Encode(req))
 
 	timeout := time.After(3 * time.Second)
-	received := ""
+
 OUTER:
 	for {
 		select {
@@ -1237,73 +1782,302 @@ OUTER:
 		case err := <-errCh:
 			t.Fatal(err)
 		case msg := <-streamMsg:
-			if msg.Error != nil {
-				t.Fatalf("Got error: %v", msg.Error.Error())
+			t.Logf("Got msg %+v", msg)
+			if msg.Error == nil {
+				continue
 			}
 
-			// Add the payload
-			received += string(msg.Payload)
-			if received == expected {
+			if structs.IsErrUnknownAllocation(msg.Error) {
 				break OUTER
+			} else {
+				t.Fatalf("bad error: %v", err)
 			}
 		}
 	}
 }
 
-func TestFS_Logs_Follow(t *testing.T) {
+func TestFS_Stream_ACL(t *testing.T) {
 	t.Parallel()
-	require := require.New(t)
 
-	// Start a server and client
-	s, cleanupS := nomad.TestServer(t, nil)
+	// Start a server
+	s, root, cleanupS := nomad.TestACLServer(t, nil)
 	defer cleanupS()
 	testutil.WaitForLeader(t, s.RPC)
 
-	c, cleanupC := TestClient(t, func(c *config.Config) {
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.ACLEnabled = true
 		c.Servers = []string{s.GetConfig().RPCAddr.String()}
 	})
-	defer cleanupC()
+	defer cleanup()
 
-	expectedBase := "Hello from the other side\n"
-	repeat := 10
+	// Create a bad token
+	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityReadFS})
+	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
+
+	policyGood := mock.NamespacePolicy(structs.DefaultNamespace, "",
+		[]string{acl.NamespaceCapabilityReadLogs, acl.NamespaceCapabilityReadFS})
+	tokenGood := mock.CreatePolicyAndToken(t, s.State(), 1009, "valid2", policyGood)
 
 	job := mock.BatchJob()
 	job.TaskGroups[0].Count = 1
 	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
-		"run_for":                "20s",
-		"stdout_string":          expectedBase,
-		"stdout_repeat":          repeat,
-		"stdout_repeat_duration": "200ms",
+		"run_for": "20s",
 	}
 
 	// Wait for client to be running job
-	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
 
-	// Make the request
-	req := &cstructs.FsLogsRequest{
-		AllocID:      alloc.ID,
-		Task:         job.TaskGroups[0].Tasks[0].Name,
-		LogType:      "stdout",
-		Origin:       "start",
-		PlainText:    true,
-		Follow:       true,
-		QueryOptions: structs.QueryOptions{Region: "global"},
+	cases := []struct {
+		Name          string
+		Token         string
+		ExpectedError string
+	}{
+		{
+			Name:          "bad token",
+			Token:         tokenBad.SecretID,
+			ExpectedError: structs.ErrPermissionDenied.Error(),
+		},
+		{
+			Name:  "good token",
+			Token: tokenGood.SecretID,
+		},
+		{
+			Name:  "root token",
+			Token: root.SecretID,
+		},
 	}
 
-	// Get the handler
-	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
-	require.NoError(err)
-
-	// Create a pipe
-	p1, p2 := net.Pipe()
-	defer p1.Close()
-	defer p2.Close()
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			// Make the request with bad allocation id
+			req := &cstructs.FsStreamRequest{
+				AllocID: alloc.ID,
+				Path:    "foo",
+				Origin:  "start",
+				QueryOptions: structs.QueryOptions{
+					Namespace: structs.DefaultNamespace,
+					Region:    "global",
+					AuthToken: c.Token,
+				},
+			}
 
-	errCh := make(chan error)
-	streamMsg := make(chan *cstructs.StreamErrWrapper)
+			// Get the handler
+			handler, err := client.StreamingRpcHandler("FileSystem.Stream")
+			require.Nil(t, err)
 
-	// Start the handler
-	go handler(p2)
+			// Create a pipe
+			p1, p2 := net.Pipe()
+			defer p1.Close()
+			defer p2.Close()
+
+			errCh := make(chan error)
+			streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+			// Start the handler
+			go handler(p2)
+
+			// Start the decoder
+			go func() {
+				decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+				for {
+					var msg cstructs.StreamErrWrapper
+					if err := decoder.Decode(&msg); err != nil {
+						errCh <- err
+						return
+					}
+
+					streamMsg <- &msg
+				}
+			}()
+
+			// Send the request
+			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+			require.NoError(t, encoder.Encode(req))
+
+			timeout := time.After(5 * time.Second)
+
+		OUTER:
+			for {
+				select {
+				case <-timeout:
+					t.Fatal("timeout")
+				case err := <-errCh:
+					eof := err == io.EOF || strings.Contains(err.Error(), "closed")
+					if c.ExpectedError == "" && eof {
+						// No error was expected!
+						return
+					}
+					t.Fatal(err)
+				case msg := <-streamMsg:
+					if msg.Error == nil {
+						continue
+					}
+
+					if strings.Contains(msg.Error.Error(), c.ExpectedError) {
+						break OUTER
+					} else {
+						t.Fatalf("Bad error: %v", msg.Error)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFS_Stream_TokenRevoked(t *testing.T) {
+	t.Parallel()
+	r := require.New(t)
+
+	// Start a server
+	s, root, cleanupS := nomad.TestACLServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	// Cache tokens briefly so that their revocation is noticed quickly
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.ACLEnabled = true
+		c.ACLTokenTTL = 100 * time.Millisecond
+		c.FSStreamACLCheckInterval = 100 * time.Millisecond
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanup()
+
+	policy := mock.NamespacePolicy(structs.DefaultNamespace, "", []string{acl.NamespaceCapabilityReadFS})
+	token := mock.CreatePolicyAndToken(t, s.State(), 1009, "valid", policy)
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "20s",
+		"stdout_string": "Hello from the other side\n",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
+
+	req := &cstructs.FsStreamRequest{
+		AllocID:   alloc.ID,
+		Path:      "alloc/logs/web.stdout.0",
+		PlainText: true,
+		Follow:    true,
+		QueryOptions: structs.QueryOptions{
+			Namespace: structs.DefaultNamespace,
+			Region:    "global",
+			AuthToken: token.SecretID,
+		},
+	}
+
+	handler, err := client.StreamingRpcHandler("FileSystem.Stream")
+	r.NoError(err)
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	go handler(p2)
+
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	r.NoError(encoder.Encode(req))
+
+	msgs := make(chan *cstructs.StreamErrWrapper)
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- &msg
+		}
+	}()
+
+	// The stream follows the file while the token is valid
+	select {
+	case msg := <-msgs:
+		r.NotNil(msg)
+		r.Nil(msg.Error)
+		r.Equal("Hello from the other side\n", string(msg.Payload))
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case msg := <-msgs:
+		t.Fatalf("unexpected message: %#v", msg)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Revoking the token ends the stream with an error
+	r.NoError(s.State().DeleteACLTokens(structs.MsgTypeTestSetup, 1010, []string{token.AccessorID}))
+
+	select {
+	case msg := <-msgs:
+		r.NotNil(msg)
+		r.NotNil(msg.Error)
+		r.Equal(structs.ErrTokenNotFound.Error(), msg.Error.Message)
+		r.EqualValues(403, *msg.Error.Code)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case _, ok := <-msgs:
+		r.False(ok)
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream not closed")
+	}
+}
+
+func TestFS_Stream(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expected := "Hello from the other side"
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": expected,
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/logs/web.stdout.0",
+		PlainText:    true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	// Wrap the pipe so we can check it is closed
+	pipeChecker := &ReadWriteCloseChecker{ReadWriteCloser: p2}
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(pipeChecker)
 
 	// Start the decoder
 	go func() {
@@ -1325,8 +2099,7 @@ func TestFS_Logs_Follow(t *testing.T) {
 	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
 	require.Nil(encoder.Encode(req))
 
-	timeout := time.After(20 * time.Second)
-	expected := strings.Repeat(expectedBase, repeat+1)
+	timeout := time.After(3 * time.Second)
 	received := ""
 OUTER:
 	for {
@@ -1347,653 +2120,7131 @@ OUTER:
 			}
 		}
 	}
+
+	testutil.WaitForResult(func() (bool, error) {
+		pipeChecker.l.Lock()
+		defer pipeChecker.l.Unlock()
+
+		return pipeChecker.Closed, nil
+	}, func(err error) {
+		t.Fatal("Pipe not closed")
+	})
 }
 
-func TestFS_findClosest(t *testing.T) {
-	task := "foo"
-	entries := []*cstructs.AllocFileInfo{
+type ReadWriteCloseChecker struct {
+	io.ReadWriteCloser
+	l      sync.Mutex
+	Closed bool
+}
+
+func (r *ReadWriteCloseChecker) Close() error {
+	r.l.Lock()
+	r.Closed = true
+	r.l.Unlock()
+	return r.ReadWriteCloser.Close()
+}
+
+func TestFS_Stream_Validate(t *testing.T) {
+	t.Parallel()
+
+	// Start a server
+	s, root, cleanupS := nomad.TestACLServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.ACLEnabled = true
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanup()
+
+	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityReadFS})
+	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "20s",
+		"stdout_string": "hello\n",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
+	logFile := "alloc/logs/web.stdout.0"
+	testutil.WaitForResult(func() (bool, error) {
+		fs, err := client.GetAllocFS(alloc.ID)
+		if err != nil {
+			return false, err
+		}
+		_, err = fs.Stat(logFile)
+		return err == nil, err
+	}, func(err error) {
+		t.Fatal(err)
+	})
+
+	cases := []struct {
+		Name         string
+		AllocID      string
+		Path         string
+		Origin       string
+		ResumeToken  string
+		Token        string
+		ExpectedCode int64
+	}{
 		{
-			Name: "foo.stdout.0",
-			Size: 100,
+			Name:         "unknown alloc",
+			AllocID:      uuid.Generate(),
+			Path:         logFile,
+			ExpectedCode: 404,
 		},
 		{
-			Name: "foo.stdout.1",
-			Size: 100,
+			Name:         "bad token",
+			Path:         logFile,
+			Token:        tokenBad.SecretID,
+			ExpectedCode: 403,
 		},
 		{
-			Name: "foo.stdout.2",
-			Size: 100,
+			Name:         "missing path",
+			Path:         "alloc/logs/missing",
+			ExpectedCode: 400,
 		},
 		{
-			Name: "foo.stdout.3",
-			Size: 100,
+			Name:         "directory",
+			Path:         "alloc/logs",
+			ExpectedCode: 400,
 		},
 		{
-			Name: "foo.stderr.0",
-			Size: 100,
+			Name:         "bad origin",
+			Path:         logFile,
+			Origin:       "middle",
+			ExpectedCode: 400,
 		},
 		{
-			Name: "foo.stderr.1",
-			Size: 100,
+			Name:         "bad resume token",
+			Path:         logFile,
+			ResumeToken:  "garbage",
+			ExpectedCode: 400,
 		},
 		{
-			Name: "foo.stderr.2",
-			Size: 100,
+			Name: "valid",
+			Path: logFile,
 		},
 	}
 
-	cases := []struct {
-		Entries        []*cstructs.AllocFileInfo
-		DesiredIdx     int64
-		DesiredOffset  int64
-		Task           string
-		LogType        string
-		ExpectedFile   string
-		ExpectedIdx    int64
-		ExpectedOffset int64
-		Error          bool
-	}{
-		// Test error cases
-		{
-			Entries:    nil,
-			DesiredIdx: 0,
-			Task:       task,
-			LogType:    "stdout",
-			Error:      true,
-		},
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			req := &cstructs.FsStreamRequest{
+				AllocID:     alloc.ID,
+				Path:        c.Path,
+				Origin:      "start",
+				ResumeToken: c.ResumeToken,
+				Follow:      true,
+				Validate:    true,
+				QueryOptions: structs.QueryOptions{
+					Namespace: structs.DefaultNamespace,
+					Region:    "global",
+					AuthToken: root.SecretID,
+				},
+			}
+			if c.AllocID != "" {
+				req.AllocID = c.AllocID
+			}
+			if c.Origin != "" {
+				req.Origin = c.Origin
+			}
+			if c.Token != "" {
+				req.AuthToken = c.Token
+			}
+
+			// Get the handler
+			handler, err := client.StreamingRpcHandler("FileSystem.Stream")
+			require.NoError(err)
+
+			// Create a pipe
+			p1, p2 := net.Pipe()
+			defer p1.Close()
+			defer p2.Close()
+
+			// Start the handler
+			go handler(p2)
+
+			// Send the request
+			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+			require.NoError(encoder.Encode(req))
+
+			// A single response is sent before the stream is closed, even
+			// though the file is followed
+			p1.SetReadDeadline(time.Now().Add(5 * time.Second))
+			decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+			var msg cstructs.StreamErrWrapper
+			require.NoError(decoder.Decode(&msg))
+			var next cstructs.StreamErrWrapper
+			require.Equal(io.EOF, decoder.Decode(&next))
+
+			if c.ExpectedCode != 0 {
+				require.NotNil(msg.Error)
+				require.NotNil(msg.Error.Code)
+				require.Equal(c.ExpectedCode, *msg.Error.Code, msg.Error.Message)
+				return
+			}
+
+			require.Nil(msg.Error)
+			var frame sframer.StreamFrame
+			require.NoError(json.Unmarshal(msg.Payload, &frame))
+			require.Equal(validatedEvent, frame.FileEvent)
+			require.Equal(logFile, frame.File)
+			require.Empty(frame.Data)
+		})
+	}
+}
+
+func TestFS_Stream_EventMarker(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "20s",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Stream a file of a temp alloc dir that can be truncated
+	ad := tempAllocDir(t)
+	require.NoError(ad.Build())
+	defer ad.Destroy()
+	c.endpoints.FileSystem.allocFS = func(string) (allocdir.AllocDirFS, error) {
+		return ad, nil
+	}
+
+	streamFilePath := filepath.Join(ad.AllocDir, "stream_file")
+	require.NoError(ioutil.WriteFile(streamFilePath, []byte("hello\nwor"), 0666))
+
+	// Without plain text the marker is rejected
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "stream_file",
+		Origin:       "start",
+		Follow:       true,
+		EventMarker:  "--- %s ---",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.NoError(err)
+
+	p1, p2 := net.Pipe()
+	go handler(p2)
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.NoError(encoder.Encode(req))
+	decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+	var msg cstructs.StreamErrWrapper
+	require.NoError(decoder.Decode(&msg))
+	require.NotNil(msg.Error)
+	require.Equal(invalidEventMarker.Error(), msg.Error.Error())
+	p1.Close()
+	p2.Close()
+
+	// Follow the file in plain text
+	req.PlainText = true
+	p1, p2 = net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	go handler(p2)
+	encoder = codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.NoError(encoder.Encode(req))
+
+	p1.SetReadDeadline(time.Now().Add(10 * time.Second))
+	decoder = codec.NewDecoder(p1, structs.MsgpackHandle)
+	received := ""
+	readUntil := func(expected string) {
+		for received != expected {
+			var msg cstructs.StreamErrWrapper
+			require.NoError(decoder.Decode(&msg))
+			require.Nil(msg.Error)
+			received += string(msg.Payload)
+			require.True(strings.HasPrefix(expected, received), "received %q", received)
+		}
+	}
+	readUntil("hello\nwor")
+
+	// Truncate the file and write to it again
+	require.NoError(os.Truncate(streamFilePath, 0))
+	readUntil("hello\nwor\n--- file truncated ---\n")
+
+	f, err := os.OpenFile(streamFilePath, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(err)
+	defer f.Close()
+	_, err = f.WriteString("again\n")
+	require.NoError(err)
+	readUntil("hello\nwor\n--- file truncated ---\nagain\n")
+}
+
+func TestFS_Stream_OriginPercent(t *testing.T) {
+	t.Parallel()
+	r := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "20s",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Stream a file of a temp alloc dir with lines of differing lengths
+	ad := tempAllocDir(t)
+	r.NoError(ad.Build())
+	defer ad.Destroy()
+	c.endpoints.FileSystem.allocFS = func(string) (allocdir.AllocDirFS, error) {
+		return ad, nil
+	}
+
+	content := "aaaa\nbbbbbbbbbb\ncccc\ndddddddddd\n"
+	streamFilePath := filepath.Join(ad.AllocDir, "stream_file")
+	r.NoError(ioutil.WriteFile(streamFilePath, []byte(content), 0666))
+
+	cases := []struct {
+		Name     string
+		Percent  int64
+		Expected string
+		Err      error
+	}{
+		{Name: "start", Percent: 0, Expected: content},
+		{Name: "mid line", Percent: 40, Expected: "cccc\ndddddddddd\n"},
+		{Name: "line start", Percent: 50, Expected: "cccc\ndddddddddd\n"},
+		{Name: "last line", Percent: 99, Expected: ""},
+		{Name: "end", Percent: 100, Expected: ""},
+		{Name: "negative", Percent: -1, Err: invalidPercentOrigin},
+		{Name: "too large", Percent: 101, Err: invalidPercentOrigin},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			req := &cstructs.FsStreamRequest{
+				AllocID:      alloc.ID,
+				Path:         "stream_file",
+				Origin:       OriginPercent,
+				Offset:       tc.Percent,
+				PlainText:    true,
+				QueryOptions: structs.QueryOptions{Region: "global"},
+			}
+
+			handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+			require.NoError(err)
+
+			p1, p2 := net.Pipe()
+			defer p1.Close()
+			defer p2.Close()
+			go handler(p2)
+
+			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+			require.NoError(encoder.Encode(req))
+
+			received := ""
+			decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+			for {
+				var msg cstructs.StreamErrWrapper
+				if err := decoder.Decode(&msg); err != nil {
+					require.Equal(io.EOF, err)
+					break
+				}
+				if msg.Error != nil {
+					require.NotNil(tc.Err)
+					require.Equal(tc.Err.Error(), msg.Error.Error())
+					return
+				}
+				received += string(msg.Payload)
+			}
+
+			require.Nil(tc.Err)
+			require.Equal(tc.Expected, received)
+		})
+	}
+}
+
+func TestFS_Stream_SourceEncoding(t *testing.T) {
+	t.Parallel()
+	r := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "20s",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Stream a Latin-1 file of a temp alloc dir
+	ad := tempAllocDir(t)
+	r.NoError(ad.Build())
+	defer ad.Destroy()
+	c.endpoints.FileSystem.allocFS = func(string) (allocdir.AllocDirFS, error) {
+		return ad, nil
+	}
+
+	streamFilePath := filepath.Join(ad.AllocDir, "stream_file")
+	r.NoError(ioutil.WriteFile(streamFilePath, []byte("d\xe9j\xe0 vu\nna\xefve\n"), 0666))
+
+	// A Shift-JIS file truncated within its last character
+	truncatedPath := filepath.Join(ad.AllocDir, "truncated_file")
+	r.NoError(ioutil.WriteFile(truncatedPath, []byte("\x93\xfa\x96"), 0666))
+
+	cases := []struct {
+		Name     string
+		Path     string
+		Encoding string
+		Expected string
+		Err      error
+	}{
+		{Name: "passthrough", Expected: "d\xe9j\xe0 vu\nna\xefve\n"},
+		{Name: "latin-1", Encoding: "ISO-8859-1", Expected: "déjà vu\nnaïve\n"},
+		{Name: "truncated", Path: "truncated_file", Encoding: "Shift_JIS", Expected: "\u65e5\ufffd"},
+		{Name: "unknown", Encoding: "klingon", Err: invalidSourceEnc},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			path := tc.Path
+			if path == "" {
+				path = "stream_file"
+			}
+			req := &cstructs.FsStreamRequest{
+				AllocID:        alloc.ID,
+				Path:           path,
+				Origin:         "start",
+				PlainText:      true,
+				SourceEncoding: tc.Encoding,
+				QueryOptions:   structs.QueryOptions{Region: "global"},
+			}
+
+			handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+			require.NoError(err)
+
+			p1, p2 := net.Pipe()
+			defer p1.Close()
+			defer p2.Close()
+			go handler(p2)
+
+			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+			require.NoError(encoder.Encode(req))
+
+			received := ""
+			decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+			for {
+				var msg cstructs.StreamErrWrapper
+				if err := decoder.Decode(&msg); err != nil {
+					require.Equal(io.EOF, err)
+					break
+				}
+				if msg.Error != nil {
+					require.NotNil(tc.Err)
+					require.Equal(tc.Err.Error(), msg.Error.Error())
+					return
+				}
+				received += string(msg.Payload)
+			}
+
+			require.Nil(tc.Err)
+			require.Equal(tc.Expected, received)
+		})
+	}
+}
+
+func TestFS_Stream_CompressMinBytes(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "20s",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Stream a file of a temp alloc dir that can be appended to
+	ad := tempAllocDir(t)
+	require.NoError(ad.Build())
+	defer ad.Destroy()
+	c.endpoints.FileSystem.allocFS = func(string) (allocdir.AllocDirFS, error) {
+		return ad, nil
+	}
+
+	small := "hello\n"
+	streamFilePath := filepath.Join(ad.AllocDir, "stream_file")
+	require.NoError(ioutil.WriteFile(streamFilePath, []byte(small), 0666))
+
+	// Plain text streams cannot be compressed
+	req := &cstructs.FsStreamRequest{
+		AllocID:          alloc.ID,
+		Path:             "stream_file",
+		Origin:           "start",
+		Follow:           true,
+		PlainText:        true,
+		CompressMinBytes: 1024,
+		QueryOptions:     structs.QueryOptions{Region: "global"},
+	}
+
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.NoError(err)
+
+	p1, p2 := net.Pipe()
+	go handler(p2)
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.NoError(encoder.Encode(req))
+	decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+	var msg cstructs.StreamErrWrapper
+	require.NoError(decoder.Decode(&msg))
+	require.NotNil(msg.Error)
+	require.Equal(invalidCompressMin.Error(), msg.Error.Error())
+	p1.Close()
+	p2.Close()
+
+	// Follow the file with frames
+	req.PlainText = false
+
+	p1, p2 = net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	go handler(p2)
+	encoder = codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.NoError(encoder.Encode(req))
+	decoder = codec.NewDecoder(p1, structs.MsgpackHandle)
+
+	// nextData returns the next frame with data
+	nextData := func() *sframer.StreamFrame {
+		for {
+			var msg cstructs.StreamErrWrapper
+			require.NoError(decoder.Decode(&msg))
+			require.Nil(msg.Error)
+
+			var frame sframer.StreamFrame
+			require.NoError(json.Unmarshal(msg.Payload, &frame))
+			if len(frame.Data) > 0 {
+				return &frame
+			}
+		}
+	}
+
+	// The small frame is not compressed
+	frame := nextData()
+	require.False(frame.Compressed)
+	require.Equal(small, string(frame.Data))
+
+	// A large frame is compressed
+	large := strings.Repeat("hello world\n", 1000)
+	f, err := os.OpenFile(streamFilePath, os.O_APPEND|os.O_WRONLY, 0666)
+	require.NoError(err)
+	_, err = f.WriteString(large)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	received := ""
+	compressed := 0
+	for received != large {
+		frame = nextData()
+		wasCompressed := frame.Compressed
+		if wasCompressed {
+			compressed++
+		}
+		require.NoError(frame.DecompressData())
+
+		// Only frames above the threshold are compressed
+		require.Equal(len(frame.Data) > req.CompressMinBytes, wasCompressed)
+		received += string(frame.Data)
+		require.True(strings.HasPrefix(large, received))
+	}
+	require.Greater(compressed, 0)
+}
+
+func TestFS_Stream_Follow(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expectedBase := "Hello from the other side"
+	repeat := 10
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":                "20s",
+		"stdout_string":          expectedBase,
+		"stdout_repeat":          repeat,
+		"stdout_repeat_duration": "200ms",
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/logs/web.stdout.0",
+		PlainText:    true,
+		Follow:       true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(20 * time.Second)
+	expected := strings.Repeat(expectedBase, repeat+1)
+	received := ""
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			// Add the payload
+			received += string(msg.Payload)
+			if received == expected {
+				break OUTER
+			}
+		}
+	}
+}
+
+func TestFS_Stream_SharedFollow(t *testing.T) {
+	t.Parallel()
+	r := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "20s",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Follow a file of a temp alloc dir
+	ad := tempAllocDir(t)
+	r.NoError(ad.Build())
+	defer ad.Destroy()
+	c.endpoints.FileSystem.allocFS = func(string) (allocdir.AllocDirFS, error) {
+		return ad, nil
+	}
+
+	streamFilePath := filepath.Join(ad.AllocDir, "stream_file")
+	r.NoError(ioutil.WriteFile(streamFilePath, []byte("before\n"), 0666))
+
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "stream_file",
+		Origin:       OriginEnd,
+		PlainText:    true,
+		Follow:       true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Start two identical follows
+	shared := c.endpoints.FileSystem.sharedStreams
+	received := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+		r.NoError(err)
+
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+		go handler(p2)
+
+		encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+		r.NoError(encoder.Encode(req))
+
+		go func() {
+			data := ""
+			decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+			for {
+				var msg cstructs.StreamErrWrapper
+				if err := decoder.Decode(&msg); err != nil || msg.Error != nil {
+					received <- fmt.Sprintf("error after %q: %v %v", data, err, msg.Error)
+					return
+				}
+				data += string(msg.Payload)
+				if strings.HasSuffix(data, "\n") {
+					received <- data
+					return
+				}
+			}
+		}()
+	}
+
+	// Wait for both follows to subscribe to the shared reader
+	key := sharedStreamKey{allocID: alloc.ID, path: "stream_file"}
+	testutil.WaitForResult(func() (bool, error) {
+		shared.l.Lock()
+		defer shared.l.Unlock()
+		stream, ok := shared.streams[key]
+		if !ok {
+			return false, fmt.Errorf("no shared stream")
+		}
+		return len(stream.subs) == 2, fmt.Errorf("%d subscribers", len(stream.subs))
+	}, func(err error) {
+		t.Fatal(err)
+	})
+
+	f, err := os.OpenFile(streamFilePath, os.O_APPEND|os.O_WRONLY, 0666)
+	r.NoError(err)
+	_, err = f.WriteString("after\n")
+	r.NoError(err)
+	r.NoError(f.Close())
+
+	// Both receive the appended data from a single reader of the file
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			r.Equal("after\n", data)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	shared.l.Lock()
+	defer shared.l.Unlock()
+	r.Equal(1, shared.readers)
+}
+
+func TestFS_Stream_MaxIdle(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expected := "Hello from the other side"
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "20s",
+		"stdout_string": expected,
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/logs/web.stdout.0",
+		Follow:       true,
+		MaxIdle:      2 * time.Second,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	// Start the handler
+	go handler(p2)
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	// The stream closes after the idle frame even though the task is still
+	// running and heartbeats were sent in the meantime
+	start := time.Now()
+	received := ""
+	idle := false
+	decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+	for {
+		var msg cstructs.StreamErrWrapper
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF || strings.Contains(err.Error(), "closed") {
+				break
+			}
+			t.Fatalf("error decoding: %v", err)
+		}
+		require.Nil(msg.Error)
+
+		var frame sframer.StreamFrame
+		require.NoError(json.Unmarshal(msg.Payload, &frame))
+		received += string(frame.Data)
+		if frame.FileEvent == idleTimeoutEvent {
+			idle = true
+		}
+	}
+
+	require.Equal(expected, received)
+	require.True(idle, "idle timeout frame not received")
+	require.Less(time.Since(start), 10*time.Second)
+}
+
+func TestFS_Stream_Compact(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expectedBase := "Hello from the other side"
+	repeat := 5
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":                "20s",
+		"stdout_string":          expectedBase,
+		"stdout_repeat":          repeat,
+		"stdout_repeat_duration": "300ms",
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	path := "alloc/logs/web.stdout.0"
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         path,
+		Follow:       true,
+		Compact:      true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(20 * time.Second)
+	expected := strings.Repeat(expectedBase, repeat+1)
+	received := ""
+	named, frames := 0, 0
+	var filler sframer.FileFiller
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			var frame sframer.StreamFrame
+			require.NoError(codec.NewDecoderBytes(msg.Payload, structs.JsonHandle).Decode(&frame))
+			if frame.IsHeartbeat() {
+				continue
+			}
+
+			// Only the first frame should name the file
+			if frame.File != "" {
+				named++
+			}
+			frames++
+
+			filler.Fill(&frame)
+			require.Equal(path, frame.File)
+
+			received += string(frame.Data)
+			if received == expected {
+				break OUTER
+			}
+		}
+	}
+
+	require.Equal(1, named)
+	require.Greater(frames, 1)
+}
+
+func TestFS_Stream_CanonicalPath(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": "Hello from the other side",
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	path := "./alloc//logs/../logs/web.stdout.0"
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         path,
+		IncludePath:  true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	// Start the handler
+	go handler(p2)
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	// The initial frame holds the canonical path
+	var msg cstructs.StreamErrWrapper
+	require.NoError(codec.NewDecoder(p1, structs.MsgpackHandle).Decode(&msg))
+	require.Nil(msg.Error)
+
+	var frame sframer.StreamFrame
+	require.NoError(codec.NewDecoderBytes(msg.Payload, structs.JsonHandle).Decode(&frame))
+	require.Equal(path, frame.File)
+	require.Equal("/alloc/logs/web.stdout.0", frame.Path)
+	require.Empty(frame.Data)
+}
+
+func TestFS_Stream_Limit(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanup := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanup()
+
+	var limit int64 = 5
+	full := "Hello from the other side"
+	expected := full[:limit]
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": full,
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/logs/web.stdout.0",
+		PlainText:    true,
+		Limit:        limit,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(3 * time.Second)
+	received := ""
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			// Add the payload
+			received += string(msg.Payload)
+			if received == expected {
+				break OUTER
+			}
+		}
+	}
+}
+
+func TestFS_Grep(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": "foo\nbar\nfoo bar\nbaz\nfoo\n",
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Wait for the logs to be written
+	logFile := "alloc/logs/web.stdout.0"
+	testutil.WaitForResult(func() (bool, error) {
+		var resp cstructs.FsStatResponse
+		err := c.ClientRPC("FileSystem.Stat", &cstructs.FsStatRequest{
+			AllocID:      alloc.ID,
+			Path:         logFile,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}, &resp)
+		if err != nil {
+			return false, err
+		}
+		return resp.Info.Size > 0, fmt.Errorf("log file is empty")
+	}, func(err error) {
+		t.Fatal(err)
+	})
+
+	// Make the request
+	req := &cstructs.FsGrepRequest{
+		AllocID:      alloc.ID,
+		Path:         logFile,
+		Pattern:      "^foo",
+		MaxMatches:   2,
+		ContextLines: 1,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Grep")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	// Start the handler
+	go handler(p2)
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	var matches []*cstructs.FsGrepMatch
+	decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+	for {
+		var msg cstructs.StreamErrWrapper
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF || strings.Contains(err.Error(), "closed") {
+				break
+			}
+			t.Fatalf("error decoding: %v", err)
+		}
+		require.Nil(msg.Error)
+
+		var match cstructs.FsGrepMatch
+		require.NoError(json.Unmarshal(msg.Payload, &match))
+		matches = append(matches, &match)
+	}
+
+	require.Equal([]*cstructs.FsGrepMatch{
+		{Offset: 0, Line: 1, Text: "foo", After: []string{"bar"}},
+		{Offset: 8, Line: 3, Text: "foo bar", Before: []string{"bar"}, After: []string{"baz"}},
+	}, matches)
+}
+
+func TestFS_LineIndex(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Write a file with lines of varying lengths
+	var b strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "line %d %s\n", i+1, strings.Repeat("x", i%37))
+	}
+	data := b.String()
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	path := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir, "lines")
+	require.NoError(ioutil.WriteFile(path, []byte(data), 0666))
+
+	handler, err := c.StreamingRpcHandler("FileSystem.LineIndex")
+	require.NoError(err)
+
+	// lineIndex returns the entries of the index and its final batch
+	lineIndex := func(req *cstructs.FsLineIndexRequest) ([]*cstructs.FsLineIndexEntry, *cstructs.FsLineIndexBatch, error) {
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+
+		go handler(p2)
+		require.NoError(codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+
+		var entries []*cstructs.FsLineIndexEntry
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				return nil, nil, err
+			}
+			if msg.Error != nil {
+				return nil, nil, msg.Error
+			}
+
+			var batch cstructs.FsLineIndexBatch
+			require.NoError(json.Unmarshal(msg.Payload, &batch))
+			entries = append(entries, batch.Entries...)
+			if batch.Done {
+				return entries, &batch, nil
+			}
+		}
+	}
+
+	req := &cstructs.FsLineIndexRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/data/lines",
+		Stride:       100,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+	entries, last, err := lineIndex(req)
+	require.NoError(err)
+	require.Len(entries, 50)
+	require.Equal(5000, last.Lines)
+	require.EqualValues(len(data), last.Bytes)
+
+	// Every offset lands on the start of the indexed line
+	for _, entry := range entries {
+		require.True(entry.Offset == 0 || data[entry.Offset-1] == '\n', "offset %d", entry.Offset)
+		require.True(strings.HasPrefix(data[entry.Offset:], fmt.Sprintf("line %d ", entry.Line)),
+			"line %d at offset %d", entry.Line, entry.Offset)
+	}
+
+	// The number of entries is bounded
+	req.MaxEntries = 10
+	entries, last, err = lineIndex(req)
+	require.NoError(err)
+	require.Len(entries, 10)
+	require.True(last.Truncated)
+
+	// Invalid requests
+	req.Stride = 0
+	_, _, err = lineIndex(req)
+	require.EqualError(err, invalidLineIndex.Error())
+	req.Stride = 1
+	req.MaxEntries = maxLineIndexEntries + 1
+	_, _, err = lineIndex(req)
+	require.EqualError(err, invalidLineIndex.Error())
+}
+
+func TestFS_Logs_NoAlloc(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a client
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Make the request with bad allocation id
+	req := &cstructs.FsLogsRequest{
+		AllocID:      uuid.Generate(),
+		Task:         "foo",
+		LogType:      "stdout",
+		Origin:       "start",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(3 * time.Second)
+
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case msg := <-streamMsg:
+			t.Logf("Got msg %+v", msg)
+			if msg.Error == nil {
+				continue
+			}
+
+			if structs.IsErrUnknownAllocation(msg.Error) {
+				break OUTER
+			} else {
+				t.Fatalf("bad error: %v", err)
+			}
+		}
+	}
+}
+
+// TestFS_Logs_TaskPending asserts that trying to stream logs for tasks which
+// have not started returns a 404 error.
+func TestFS_Logs_TaskPending(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"start_block_for": "10s",
+	}
+
+	// Register job
+	args := &structs.JobRegisterRequest{}
+	args.Job = job
+	args.WriteRequest.Region = "global"
+	args.Namespace = job.Namespace
+	var jobResp structs.JobRegisterResponse
+	require.NoError(s.RPC("Job.Register", args, &jobResp))
+
+	// Get the allocation ID
+	var allocID string
+	testutil.WaitForResult(func() (bool, error) {
+		args := structs.AllocListRequest{}
+		args.Region = "global"
+		resp := structs.AllocListResponse{}
+		if err := s.RPC("Alloc.List", &args, &resp); err != nil {
+			return false, err
+		}
+
+		if len(resp.Allocations) != 1 {
+			return false, fmt.Errorf("expected 1 alloc, found %d", len(resp.Allocations))
+		}
+
+		allocID = resp.Allocations[0].ID
+
+		// wait for alloc runner to be created; otherwise, we get no alloc found error
+		if _, err := c.getAllocRunner(allocID); err != nil {
+			return false, fmt.Errorf("alloc runner was not created yet for %v", allocID)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("error getting alloc id: %v", err)
+	})
+
+	// Make the request
+	req := &cstructs.FsLogsRequest{
+		AllocID:      allocID,
+		Task:         job.TaskGroups[0].Tasks[0].Name,
+		LogType:      "stdout",
+		Origin:       "start",
+		PlainText:    true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	for {
+		select {
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatalf("unexpected stream error: %v", err)
+		case msg := <-streamMsg:
+			require.NotNil(msg.Error)
+			require.NotNil(msg.Error.Code)
+			require.EqualValues(404, *msg.Error.Code)
+			require.Contains(msg.Error.Message, "not started")
+			return
+		}
+	}
+}
+
+func TestFS_Logs_ACL(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server
+	s, root, cleanupS := nomad.TestACLServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.ACLEnabled = true
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanup()
+
+	// Create a bad token
+	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityReadFS})
+	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
+
+	policyGood := mock.NamespacePolicy(structs.DefaultNamespace, "",
+		[]string{acl.NamespaceCapabilityReadLogs, acl.NamespaceCapabilityReadFS})
+	tokenGood := mock.CreatePolicyAndToken(t, s.State(), 1009, "valid2", policyGood)
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "20s",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
+
+	cases := []struct {
+		Name          string
+		Token         string
+		ExpectedError string
+	}{
+		{
+			Name:          "bad token",
+			Token:         tokenBad.SecretID,
+			ExpectedError: structs.ErrPermissionDenied.Error(),
+		},
+		{
+			Name:  "good token",
+			Token: tokenGood.SecretID,
+		},
+		{
+			Name:  "root token",
+			Token: root.SecretID,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			// Make the request with bad allocation id
+			req := &cstructs.FsLogsRequest{
+				AllocID: alloc.ID,
+				Task:    job.TaskGroups[0].Tasks[0].Name,
+				LogType: "stdout",
+				Origin:  "start",
+				QueryOptions: structs.QueryOptions{
+					Namespace: structs.DefaultNamespace,
+					Region:    "global",
+					AuthToken: c.Token,
+				},
+			}
+
+			// Get the handler
+			handler, err := client.StreamingRpcHandler("FileSystem.Logs")
+			require.Nil(err)
+
+			// Create a pipe
+			p1, p2 := net.Pipe()
+			defer p1.Close()
+			defer p2.Close()
+
+			errCh := make(chan error)
+			streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+			// Start the handler
+			go handler(p2)
+
+			// Start the decoder
+			go func() {
+				decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+				for {
+					var msg cstructs.StreamErrWrapper
+					if err := decoder.Decode(&msg); err != nil {
+						errCh <- err
+						return
+					}
+
+					streamMsg <- &msg
+				}
+			}()
+
+			// Send the request
+			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+			require.Nil(encoder.Encode(req))
+
+			timeout := time.After(5 * time.Second)
+
+		OUTER:
+			for {
+				select {
+				case <-timeout:
+					t.Fatal("timeout")
+				case err := <-errCh:
+					eof := err == io.EOF || strings.Contains(err.Error(), "closed")
+					if c.ExpectedError == "" && eof {
+						// No error was expected!
+						return
+					}
+					t.Fatal(err)
+				case msg := <-streamMsg:
+					if msg.Error == nil {
+						continue
+					}
+
+					if strings.Contains(msg.Error.Error(), c.ExpectedError) {
+						// Ok! Error matched expectation.
+						break OUTER
+					} else {
+						t.Fatalf("Bad error: %v", msg.Error)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFS_Logs_ReadLogsOnly_ACL(t *testing.T) {
+	t.Parallel()
+
+	// Start a server
+	s, root, cleanupS := nomad.TestACLServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.ACLEnabled = true
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanup()
+
+	policyLogs := mock.NamespacePolicy(structs.DefaultNamespace, "",
+		[]string{acl.NamespaceCapabilityReadLogs})
+	tokenLogs := mock.CreatePolicyAndToken(t, s.State(), 1005, "logs", policyLogs)
+
+	policyFS := mock.NamespacePolicy(structs.DefaultNamespace, "",
+		[]string{acl.NamespaceCapabilityReadFS})
+	tokenFS := mock.CreatePolicyAndToken(t, s.State(), 1009, "fs", policyFS)
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "20s",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
+	task := job.TaskGroups[0].Tasks[0].Name
+
+	cases := []struct {
+		Name          string
+		Token         string
+		Task          string
+		ExpectedError string
+	}{
+		{
+			Name:  "read-logs log path",
+			Token: tokenLogs.SecretID,
+			Task:  task,
+		},
+		{
+			// Task names outside of the allocation's tasks never
+			// resolve to a path outside of the log directory
+			Name:          "read-logs non-log path",
+			Token:         tokenLogs.SecretID,
+			Task:          "../../" + task + "/secrets/foo",
+			ExpectedError: "unknown task name",
+		},
+		{
+			Name:          "read-fs non-log path",
+			Token:         tokenFS.SecretID,
+			Task:          "../../" + task + "/secrets/foo",
+			ExpectedError: "unknown task name",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			req := &cstructs.FsLogsRequest{
+				AllocID: alloc.ID,
+				Task:    c.Task,
+				LogType: "stdout",
+				Origin:  "start",
+				QueryOptions: structs.QueryOptions{
+					Namespace: structs.DefaultNamespace,
+					Region:    "global",
+					AuthToken: c.Token,
+				},
+			}
+
+			// Get the handler
+			handler, err := client.StreamingRpcHandler("FileSystem.Logs")
+			require.NoError(t, err)
+
+			// Create a pipe
+			p1, p2 := net.Pipe()
+			defer p1.Close()
+			defer p2.Close()
+
+			errCh := make(chan error)
+			streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+			// Start the handler
+			go handler(p2)
+
+			// Start the decoder
+			go func() {
+				decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+				for {
+					var msg cstructs.StreamErrWrapper
+					if err := decoder.Decode(&msg); err != nil {
+						errCh <- err
+						return
+					}
+
+					streamMsg <- &msg
+				}
+			}()
+
+			// Send the request
+			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+			require.NoError(t, encoder.Encode(req))
+
+			timeout := time.After(5 * time.Second)
+
+			for {
+				select {
+				case <-timeout:
+					t.Fatal("timeout")
+				case err := <-errCh:
+					eof := err == io.EOF || strings.Contains(err.Error(), "closed")
+					if c.ExpectedError == "" && eof {
+						// No error was expected!
+						return
+					}
+					t.Fatal(err)
+				case msg := <-streamMsg:
+					if msg.Error == nil {
+						continue
+					}
+
+					require.Contains(t, msg.Error.Error(), c.ExpectedError)
+					require.NotEmpty(t, c.ExpectedError, "unexpected error: %v", msg.Error)
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestFS_Logs(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expected := "Hello from the other side\n"
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": expected,
+	}
+
+	// Wait for client to be running job
+	testutil.WaitForRunning(t, s.RPC, job)
+
+	// Get the allocation ID
+	args := structs.AllocListRequest{}
+	args.Region = "global"
+	resp := structs.AllocListResponse{}
+	require.NoError(s.RPC("Alloc.List", &args, &resp))
+	require.Len(resp.Allocations, 1)
+	allocID := resp.Allocations[0].ID
+
+	// Make the request
+	req := &cstructs.FsLogsRequest{
+		AllocID:      allocID,
+		Task:         job.TaskGroups[0].Tasks[0].Name,
+		LogType:      "stdout",
+		Origin:       "start",
+		PlainText:    true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(3 * time.Second)
+	received := ""
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			// Add the payload
+			received += string(msg.Payload)
+			if received == expected {
+				break OUTER
+			}
+		}
+	}
+}
+
+func TestFS_AllTasksTail(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Run two tasks, and a poststop task that does not start while they run
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	web := job.TaskGroups[0].Tasks[0]
+	web.Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	sidecar := web.Copy()
+	sidecar.Name = "sidecar"
+	poststop := web.Copy()
+	poststop.Name = "poststop"
+	poststop.Lifecycle = &structs.TaskLifecycleConfig{Hook: structs.TaskLifecycleHookPoststop}
+	job.TaskGroups[0].Tasks = append(job.TaskGroups[0].Tasks, sidecar, poststop)
+
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+	testutil.WaitForResult(func() (bool, error) {
+		state, err := c.GetAllocState(alloc.ID)
+		if err != nil {
+			return false, err
+		}
+		for _, task := range []string{web.Name, sidecar.Name} {
+			if ts := state.TaskStates[task]; ts == nil || ts.StartedAt.IsZero() {
+				return false, fmt.Errorf("task %q not started", task)
+			}
+		}
+		return true, nil
+	}, func(err error) {
+		require.NoError(err)
+	})
+
+	// Write logs of varying sizes in later log files than the tasks' own
+	ar, err := c.getAllocRunner(alloc.ID)
+	require.NoError(err)
+	logDir := filepath.Join(ar.GetAllocDir().SharedDir, allocdir.LogDirName)
+	var webLogs strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&webLogs, "web line %d\n", i)
+	}
+	require.NoError(ioutil.WriteFile(filepath.Join(logDir, web.Name+".stderr.0"), []byte("rotated\n"), 0666))
+	require.NoError(ioutil.WriteFile(filepath.Join(logDir, web.Name+".stderr.9"), []byte(webLogs.String()), 0666))
+	require.NoError(ioutil.WriteFile(filepath.Join(logDir, sidecar.Name+".stderr.9"), []byte("one\ntwo\nthree\n"), 0666))
+
+	req := &cstructs.FsAllTasksTailRequest{
+		AllocID:      alloc.ID,
+		LogType:      "stderr",
+		Lines:        3,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+	var reply cstructs.FsAllTasksTailResponse
+	require.NoError(c.ClientRPC("FileSystem.AllTasksTail", req, &reply))
+
+	// The tasks that started are returned in order with the last lines of
+	// their most recent log file
+	require.Len(reply.Tails, 2)
+	require.Equal(sidecar.Name, reply.Tails[0].Task)
+	require.Equal("one\ntwo\nthree\n", string(reply.Tails[0].Data))
+	require.Equal(web.Name, reply.Tails[1].Task)
+	require.Equal("web line 197\nweb line 198\nweb line 199\n", string(reply.Tails[1].Data))
+	require.Equal(filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName, web.Name+".stderr.9"), reply.Tails[1].File)
+	require.Equal(int64(webLogs.Len()), reply.Tails[1].Offset)
+
+	// Only the end of large log files is read
+	large := strings.Repeat(strings.Repeat("x", 1023)+"\n", 2*maxExitTailBytes/1024)
+	require.NoError(ioutil.WriteFile(filepath.Join(logDir, web.Name+".stderr.10"), []byte(large), 0666))
+	req.Lines = maxTailLines
+	require.NoError(c.ClientRPC("FileSystem.AllTasksTail", req, &reply))
+	require.Len(reply.Tails, 2)
+	require.Len(reply.Tails[1].Data, maxExitTailBytes)
+
+	// Invalid arguments are rejected
+	for _, lines := range []int{0, -1, maxTailLines + 1} {
+		req.Lines = lines
+		err = c.ClientRPC("FileSystem.AllTasksTail", req, &reply)
+		require.Error(err)
+		require.Contains(err.Error(), invalidTailLines.Error())
+	}
+	req.Lines = 3
+	req.LogType = "../secrets"
+	err = c.ClientRPC("FileSystem.AllTasksTail", req, &reply)
+	require.Error(err)
+	require.Contains(err.Error(), logTypeNotPresentErr.Error())
+}
+
+func TestFS_LogTypes(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	task := job.TaskGroups[0].Tasks[0].Name
+
+	// Wait for client to be running job
+	testutil.WaitForRunning(t, s.RPC, job)
+
+	// Get the allocation ID
+	args := structs.AllocListRequest{}
+	args.Region = "global"
+	resp := structs.AllocListResponse{}
+	require.NoError(s.RPC("Alloc.List", &args, &resp))
+	require.Len(resp.Allocations, 1)
+	allocID := resp.Allocations[0].ID
+
+	// Write the log file of a third log type as some drivers do
+	ar, err := c.getAllocRunner(allocID)
+	require.NoError(err)
+	logDir := filepath.Join(ar.GetAllocDir().SharedDir, allocdir.LogDirName)
+	expected := "events of the task\n"
+	require.NoError(ioutil.WriteFile(filepath.Join(logDir, task+".events.0"), []byte(expected), 0666))
+
+	// The log type is discovered
+	req := &cstructs.FsLogTypesRequest{
+		AllocID:      allocID,
+		Task:         task,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+	var reply cstructs.FsLogTypesResponse
+	require.NoError(c.ClientRPC("FileSystem.LogTypes", req, &reply))
+	require.Contains(reply.LogTypes, "events")
+
+	// Unknown tasks are rejected
+	req.Task = "unknown"
+	err = c.ClientRPC("FileSystem.LogTypes", req, &reply)
+	require.Error(err)
+	require.Contains(err.Error(), "unknown task name")
+
+	// The statistics include the log type
+	var stats cstructs.FsLogStatsResponse
+	require.NoError(c.ClientRPC("FileSystem.LogStats", &cstructs.FsLogStatsRequest{
+		AllocID:      allocID,
+		Task:         task,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}, &stats))
+	var found bool
+	for _, s := range stats.Stats {
+		if s.LogType == "events" {
+			found = true
+			require.Equal(int64(len(expected)), s.TotalBytes)
+		}
+	}
+	require.True(found, "events missing from %v", stats.Stats)
+
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
+
+	// streamLogs returns the payload streamed for the log type or the error
+	streamLogs := func(logType string) (string, error) {
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+		go handler(p2)
+
+		encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+		require.NoError(encoder.Encode(&cstructs.FsLogsRequest{
+			AllocID:      allocID,
+			Task:         task,
+			LogType:      logType,
+			Origin:       "start",
+			PlainText:    true,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}))
+
+		p1.SetReadDeadline(time.Now().Add(3 * time.Second))
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		received := ""
+		for received != expected {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				return received, err
+			}
+			if msg.Error != nil {
+				return received, msg.Error
+			}
+			received += string(msg.Payload)
+		}
+		return received, nil
+	}
+
+	// The discovered log type is streamed
+	received, err := streamLogs("events")
+	require.NoError(err)
+	require.Equal(expected, received)
+
+	// Log types that were not discovered are rejected
+	_, err = streamLogs("missing")
+	require.Error(err)
+	require.Contains(err.Error(), "unknown log type")
+}
+
+func TestFS_Logs_Validate(t *testing.T) {
+	t.Parallel()
+
+	// Start a server
+	s, root, cleanupS := nomad.TestACLServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	client, cleanup := TestClient(t, func(c *config.Config) {
+		c.ACLEnabled = true
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanup()
+
+	policyBad := mock.NamespacePolicy("other", "", []string{acl.NamespaceCapabilityReadLogs})
+	tokenBad := mock.CreatePolicyAndToken(t, s.State(), 1005, "invalid", policyBad)
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "20s",
+		"stdout_string": "hello\n",
+	}
+	task := job.TaskGroups[0].Tasks[0].Name
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunningWithToken(t, s.RPC, job, root.SecretID)[0]
+
+	cases := []struct {
+		Name         string
+		AllocID      string
+		Task         string
+		LogType      string
+		Origin       string
+		Token        string
+		ExpectedCode int64
+	}{
+		{
+			Name:         "unknown alloc",
+			AllocID:      uuid.Generate(),
+			ExpectedCode: 404,
+		},
+		{
+			Name:         "bad token",
+			Token:        tokenBad.SecretID,
+			ExpectedCode: 403,
+		},
+		{
+			Name:         "unknown task",
+			Task:         "missing",
+			ExpectedCode: 400,
+		},
+		{
+			Name:         "unknown log type",
+			LogType:      "missing",
+			ExpectedCode: 400,
+		},
+		{
+			Name:         "bad origin",
+			Origin:       "middle",
+			ExpectedCode: 400,
+		},
+		{
+			Name: "valid",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			require := require.New(t)
+
+			req := &cstructs.FsLogsRequest{
+				AllocID:  alloc.ID,
+				Task:     task,
+				LogType:  "stdout",
+				Origin:   "start",
+				Follow:   true,
+				Validate: true,
+				QueryOptions: structs.QueryOptions{
+					Namespace: structs.DefaultNamespace,
+					Region:    "global",
+					AuthToken: root.SecretID,
+				},
+			}
+			if c.AllocID != "" {
+				req.AllocID = c.AllocID
+			}
+			if c.Task != "" {
+				req.Task = c.Task
+			}
+			if c.LogType != "" {
+				req.LogType = c.LogType
+			}
+			if c.Origin != "" {
+				req.Origin = c.Origin
+			}
+			if c.Token != "" {
+				req.AuthToken = c.Token
+			}
+
+			// Get the handler
+			handler, err := client.StreamingRpcHandler("FileSystem.Logs")
+			require.NoError(err)
+
+			// Create a pipe
+			p1, p2 := net.Pipe()
+			defer p1.Close()
+			defer p2.Close()
+
+			// Start the handler
+			go handler(p2)
+
+			// Send the request
+			encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+			require.NoError(encoder.Encode(req))
+
+			// A single response is sent before the stream is closed, even
+			// though the logs are followed
+			p1.SetReadDeadline(time.Now().Add(5 * time.Second))
+			decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+			var msg cstructs.StreamErrWrapper
+			require.NoError(decoder.Decode(&msg))
+			var next cstructs.StreamErrWrapper
+			require.Equal(io.EOF, decoder.Decode(&next))
+
+			if c.ExpectedCode != 0 {
+				require.NotNil(msg.Error)
+				require.NotNil(msg.Error.Code)
+				require.Equal(c.ExpectedCode, *msg.Error.Code, msg.Error.Message)
+				return
+			}
+
+			require.Nil(msg.Error)
+			var frame sframer.StreamFrame
+			require.NoError(json.Unmarshal(msg.Payload, &frame))
+			require.Equal(validatedEvent, frame.FileEvent)
+			require.Empty(frame.Data)
+		})
+	}
+}
+
+func TestFS_Logs_Follow(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expectedBase := "Hello from the other side\n"
+	repeat := 10
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":                "20s",
+		"stdout_string":          expectedBase,
+		"stdout_repeat":          repeat,
+		"stdout_repeat_duration": "200ms",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	req := &cstructs.FsLogsRequest{
+		AllocID:      alloc.ID,
+		Task:         job.TaskGroups[0].Tasks[0].Name,
+		LogType:      "stdout",
+		Origin:       "start",
+		PlainText:    true,
+		Follow:       true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(20 * time.Second)
+	expected := strings.Repeat(expectedBase, repeat+1)
+	received := ""
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			// Add the payload
+			received += string(msg.Payload)
+			if received == expected {
+				break OUTER
+			}
+		}
+	}
+}
+
+func TestFS_Logs_LineRanges(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expectedBase := "Hello from\nthe other side\n"
+	repeat := 5
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":                "20s",
+		"stdout_string":          expectedBase,
+		"stdout_repeat":          repeat,
+		"stdout_repeat_duration": "200ms",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Line ranges are not visible in plain text
+	req := &cstructs.FsLogsRequest{
+		AllocID:      alloc.ID,
+		Task:         job.TaskGroups[0].Tasks[0].Name,
+		LogType:      "stdout",
+		Origin:       "start",
+		PlainText:    true,
+		Follow:       true,
+		LineRanges:   true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
+
+	p1, p2 := net.Pipe()
+	go handler(p2)
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.NoError(encoder.Encode(req))
+	decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+	var msg cstructs.StreamErrWrapper
+	require.NoError(decoder.Decode(&msg))
+	require.NotNil(msg.Error)
+	require.Equal(invalidLineRanges.Error(), msg.Error.Error())
+	p1.Close()
+	p2.Close()
+
+	// Follow the logs with frames
+	req.PlainText = false
+
+	p1, p2 = net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	go handler(p2)
+	encoder = codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.NoError(encoder.Encode(req))
+	decoder = codec.NewDecoder(p1, structs.MsgpackHandle)
+
+	expected := strings.Repeat(expectedBase, repeat+1)
+	received := ""
+	frames := 0
+	for received != expected {
+		var msg cstructs.StreamErrWrapper
+		require.NoError(decoder.Decode(&msg))
+		require.Nil(msg.Error)
+
+		var frame sframer.StreamFrame
+		require.NoError(json.Unmarshal(msg.Payload, &frame))
+		if len(frame.Data) == 0 {
+			continue
+		}
+		frames++
+
+		// The range covers the lines of the data counted from the start of
+		// the logs
+		first := int64(strings.Count(received, "\n")) + 1
+		received += string(frame.Data)
+		last := int64(strings.Count(received[:len(received)-1], "\n")) + 1
+		require.Equal(first, frame.FirstLine, "frame %d", frames)
+		require.Equal(last, frame.LastLine, "frame %d", frames)
+	}
+	require.Greater(frames, 1)
+}
+
+func TestFS_Logs_FlushHeldAtEnd(t *testing.T) {
+	t.Parallel()
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Add a log file that ends within a Shift-JIS character
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(t, err)
+	logDir := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.LogDirName)
+	testutil.WaitForResult(func() (bool, error) {
+		_, err := os.Stat(filepath.Join(logDir, "web.stdout.0"))
+		return err == nil, err
+	}, func(err error) {
+		t.Fatal(err)
+	})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "web.stdout.1"), []byte("\x93\xfa\x96"), 0666))
+
+	// readLogs returns the plain text logs streamed for the request
+	readLogs := func(req *cstructs.FsLogsRequest) string {
+		handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+		require.NoError(t, err)
+
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+
+		go handler(p2)
+		require.NoError(t, codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+
+		received := ""
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				require.Equal(t, io.EOF, err)
+				return received
+			}
+			require.Nil(t, msg.Error)
+			received += string(msg.Payload)
+		}
+	}
+
+	// The partial character is replaced once the logs end
+	require.Equal(t, "\u65e5\ufffd", readLogs(&cstructs.FsLogsRequest{
+		AllocID:        alloc.ID,
+		Task:           job.TaskGroups[0].Tasks[0].Name,
+		LogType:        "stdout",
+		Origin:         "start",
+		PlainText:      true,
+		SourceEncoding: "Shift_JIS",
+		QueryOptions:   structs.QueryOptions{Region: "global"},
+	}))
+
+	// A partial escape sequence at the end is passed on as is
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "web.stdout.1"), []byte("done\x1b[3"), 0666))
+	require.Equal(t, "done\x1b[3", readLogs(&cstructs.FsLogsRequest{
+		AllocID:      alloc.ID,
+		Task:         job.TaskGroups[0].Tasks[0].Name,
+		LogType:      "stdout",
+		Origin:       "start",
+		PlainText:    true,
+		StripANSI:    true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}))
+}
+
+func TestFS_Logs_EmitStatEvery(t *testing.T) {
+	t.Parallel()
+	r := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expectedBase := "Hello from the other side\n"
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":                "20s",
+		"stdout_string":          expectedBase,
+		"stdout_repeat":          20,
+		"stdout_repeat_duration": "100ms",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	r.NoError(err)
+
+	stream := func(req *cstructs.FsLogsRequest) (net.Conn, *codec.Decoder) {
+		p1, p2 := net.Pipe()
+		go handler(p2)
+		encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+		r.NoError(encoder.Encode(req))
+		return p1, codec.NewDecoder(p1, structs.MsgpackHandle)
+	}
+
+	// Invalid requests
+	invalid := []*cstructs.FsLogsRequest{
+		{EmitStatEvery: -time.Second, Follow: true},
+		{EmitStatEvery: time.Second},
+		{EmitStatEvery: time.Second, Follow: true, PlainText: true},
+	}
+	for _, req := range invalid {
+		req.AllocID = alloc.ID
+		req.Task = job.TaskGroups[0].Tasks[0].Name
+		req.LogType = "stdout"
+		req.QueryOptions = structs.QueryOptions{Region: "global"}
+
+		conn, decoder := stream(req)
+		var msg cstructs.StreamErrWrapper
+		r.NoError(decoder.Decode(&msg))
+		r.NotNil(msg.Error)
+		r.Equal(invalidEmitStat.Error(), msg.Error.Error())
+		conn.Close()
+	}
+
+	// Follow the logs with a stat frame every 250ms
+	interval := 250 * time.Millisecond
+	conn, decoder := stream(&cstructs.FsLogsRequest{
+		AllocID:       alloc.ID,
+		Task:          job.TaskGroups[0].Tasks[0].Name,
+		LogType:       "stdout",
+		Origin:        "start",
+		Follow:        true,
+		EmitStatEvery: interval,
+		QueryOptions:  structs.QueryOptions{Region: "global"},
+	})
+	defer conn.Close()
+
+	var stats []*sframer.LogFileStat
+	data := ""
+	start := time.Now()
+	for len(stats) < 6 {
+		var msg cstructs.StreamErrWrapper
+		r.NoError(decoder.Decode(&msg))
+		r.Nil(msg.Error)
+
+		var frame sframer.StreamFrame
+		r.NoError(json.Unmarshal(msg.Payload, &frame))
+		data += string(frame.Data)
+		if frame.LogStat != nil {
+			r.Empty(frame.Data)
+			stats = append(stats, frame.LogStat)
+		}
+	}
+	elapsed := time.Since(start)
+
+	// The stat frames arrive at roughly the requested cadence, interleaved
+	// with the data, and follow the growth of the log file
+	r.GreaterOrEqual(int64(elapsed), int64(5*interval))
+	r.Less(int64(elapsed), int64(6*interval+2*time.Second))
+	r.NotEmpty(data)
+	for i, stat := range stats {
+		r.Equal("alloc/logs/web.stdout.0", stat.File)
+		r.EqualValues(0, stat.Index)
+		if i > 0 {
+			r.GreaterOrEqual(stat.Size, stats[i-1].Size)
+		}
+	}
+	r.Greater(stats[len(stats)-1].Size, stats[0].Size)
+}
+
+func TestFS_Logs_StartAfterMatch(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "10s",
+		"stdout_string": "loading config\nconnecting to db\nStarting server on :8080\nGET /\nGET /health\n",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	req := &cstructs.FsLogsRequest{
+		AllocID:         alloc.ID,
+		Task:            job.TaskGroups[0].Tasks[0].Name,
+		LogType:         "stdout",
+		Origin:          "start",
+		PlainText:       true,
+		Follow:          true,
+		StartAfterMatch: "Starting server",
+		QueryOptions:    structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(10 * time.Second)
+	expected := "GET /\nGET /health\n"
+	received := ""
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout: got %q", received)
+		case err := <-errCh:
+			t.Fatal(err)
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			// Only the lines after the marker are streamed
+			received += string(msg.Payload)
+			require.True(strings.HasPrefix(expected, received), "unexpected logs %q", received)
+			if received == expected {
+				break OUTER
+			}
+		}
+	}
+}
+
+func TestFS_Logs_JumpToFirstError(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "10s",
+		"stdout_string": "INFO loading config\nINFO connecting to db\nERROR db unreachable\nINFO retrying\n",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Make the request
+	req := &cstructs.FsLogsRequest{
+		AllocID:          alloc.ID,
+		Task:             job.TaskGroups[0].Tasks[0].Name,
+		LogType:          "stdout",
+		Origin:           "start",
+		PlainText:        true,
+		Follow:           true,
+		JumpToFirstError: true,
+		QueryOptions:     structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(10 * time.Second)
+	expected := "ERROR db unreachable\nINFO retrying\n"
+	received := ""
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout: got %q", received)
+		case err := <-errCh:
+			t.Fatal(err)
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			// Streaming starts at the error line
+			received += string(msg.Payload)
+			require.True(strings.HasPrefix(expected, received), "unexpected logs %q", received)
+			if received == expected {
+				break OUTER
+			}
+		}
+	}
+}
+
+func TestFS_Logs_TailOtherOnExit(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": "first\nsecond\nthird\n",
+		"stderr_string": "crashed\n",
+	}
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Follow stderr and ask for the end of stdout once the task stops
+	req := &cstructs.FsLogsRequest{
+		AllocID:         alloc.ID,
+		Task:            job.TaskGroups[0].Tasks[0].Name,
+		LogType:         "stderr",
+		Origin:          "start",
+		Follow:          true,
+		TailOtherOnExit: 2,
+		QueryOptions:    structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+	doneCh := make(chan struct{})
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					close(doneCh)
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+				return
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(20 * time.Second)
+	stderr := ""
+	var last *sframer.StreamFrame
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-doneCh:
+			break OUTER
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			var frame sframer.StreamFrame
+			require.NoError(json.Unmarshal(msg.Payload, &frame))
+			if frame.IsHeartbeat() {
+				continue
+			}
+			if last != nil && last.FileEvent == taskExitedEvent {
+				t.Fatalf("unexpected frame after the task exited: %#v", frame)
+			}
+
+			if frame.FileEvent == "" {
+				stderr += string(frame.Data)
+			}
+			last = &frame
+		}
+	}
+
+	require.Equal("crashed\n", stderr)
+	require.NotNil(last)
+	require.Equal(taskExitedEvent, last.FileEvent)
+	require.Equal("alloc/logs/web.stdout.0", last.File)
+	require.Equal("second\nthird\n", string(last.Data))
+}
+
+func TestFS_Logs_StopOnTaskExit(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":                "2s",
+		"stdout_string":          "tick\n",
+		"stdout_repeat":          5,
+		"stdout_repeat_duration": "200ms",
+	}
+	task := job.TaskGroups[0].Tasks[0].Name
+
+	// Wait for client to be running job
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Follow stdout until the task stops
+	req := &cstructs.FsLogsRequest{
+		AllocID:        alloc.ID,
+		Task:           task,
+		LogType:        "stdout",
+		Origin:         "start",
+		Follow:         true,
+		StopOnTaskExit: true,
+		QueryOptions:   structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+	doneCh := make(chan struct{})
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					close(doneCh)
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+				return
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(20 * time.Second)
+	stdout := ""
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-doneCh:
+			break OUTER
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			var frame sframer.StreamFrame
+			require.NoError(json.Unmarshal(msg.Payload, &frame))
+			stdout += string(frame.Data)
+		}
+	}
+
+	// The stream only ends once the task has stopped, after all of its logs
+	state, err := c.GetAllocState(alloc.ID)
+	require.NoError(err)
+	require.Equal(structs.TaskStateDead, state.TaskStates[task].State)
+
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(err)
+	r, err := fs.ReadAt("alloc/logs/web.stdout.0", 0)
+	require.NoError(err)
+	defer r.Close()
+	logs, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(string(logs), stdout)
+	require.GreaterOrEqual(strings.Count(stdout, "tick\n"), 5)
+}
+
+func TestFS_Logs_IncludeExitInfo(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].RestartPolicy.Attempts = 0
+	job.TaskGroups[0].RestartPolicy.Mode = structs.RestartPolicyModeFail
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "100ms",
+		"stdout_string": "done\n",
+		"exit_code":     3,
+	}
+	task := job.TaskGroups[0].Tasks[0].Name
+
+	// Wait for the task to stop
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+	testutil.WaitForResult(func() (bool, error) {
+		state, err := c.GetAllocState(alloc.ID)
+		if err != nil {
+			return false, err
+		}
+		ts := state.TaskStates[task]
+		if ts == nil || ts.State != structs.TaskStateDead {
+			return false, fmt.Errorf("task not dead: %#v", ts)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatal(err)
+	})
+
+	req := &cstructs.FsLogsRequest{
+		AllocID:         alloc.ID,
+		Task:            task,
+		LogType:         "stdout",
+		Origin:          "start",
+		IncludeExitInfo: true,
+		QueryOptions:    structs.QueryOptions{Region: "global"},
+	}
+
+	// Get the handler
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+	doneCh := make(chan struct{})
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					close(doneCh)
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+				return
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	timeout := time.After(10 * time.Second)
+	stdout := ""
+	var last *sframer.StreamFrame
+OUTER:
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-doneCh:
+			break OUTER
+		case msg := <-streamMsg:
+			if msg.Error != nil {
+				t.Fatalf("Got error: %v", msg.Error.Error())
+			}
+
+			var frame sframer.StreamFrame
+			require.NoError(json.Unmarshal(msg.Payload, &frame))
+			if frame.IsHeartbeat() {
+				continue
+			}
+			if last != nil && last.FileEvent == taskExitInfoEvent {
+				t.Fatalf("unexpected frame after the exit info: %#v", frame)
+			}
+
+			stdout += string(frame.Data)
+			last = &frame
+		}
+	}
+
+	require.Equal("done\n", stdout)
+	require.NotNil(last)
+	require.Equal(taskExitInfoEvent, last.FileEvent)
+	require.NotNil(last.ExitInfo)
+	require.Equal(3, last.ExitInfo.ExitCode)
+	require.False(last.ExitInfo.OOMKilled)
+	require.False(last.ExitInfo.FinishedAt.IsZero())
+}
+
+func TestFS_Logs_PrunedAlloc(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "100ms",
+		"stdout_string": "replaced\n",
+	}
+	task := job.TaskGroups[0].Tasks[0].Name
+
+	// Wait for the alloc to complete and its state to reach the servers
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+	testutil.WaitForResult(func() (bool, error) {
+		a, err := s.State().AllocByID(nil, alloc.ID)
+		if err != nil {
+			return false, err
+		}
+		if a.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", a.ClientStatus)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatal(err)
+	})
+
+	// Prune the alloc from the client, leaving its alloc dir on disk
+	c.allocLock.Lock()
+	delete(c.allocs, alloc.ID)
+	c.allocLock.Unlock()
+	_, err := c.GetAlloc(alloc.ID)
+	require.True(structs.IsErrUnknownAllocation(err))
+
+	// stream returns the data streamed by the handler for the request
+	stream := func(method string, req interface{}) (string, error) {
+		handler, err := c.StreamingRpcHandler(method)
+		require.NoError(err)
+
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+		go handler(p2)
+
+		encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+		require.NoError(encoder.Encode(req))
+
+		p1.SetReadDeadline(time.Now().Add(5 * time.Second))
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		received := ""
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err == io.EOF {
+				return received, nil
+			} else if err != nil {
+				return received, err
+			}
+			if msg.Error != nil {
+				return received, msg.Error
+			}
+
+			var frame sframer.StreamFrame
+			require.NoError(json.Unmarshal(msg.Payload, &frame))
+			received += string(frame.Data)
+		}
+	}
+
+	// The logs of the task are still served from the alloc dir
+	logs, err := stream("FileSystem.Logs", &cstructs.FsLogsRequest{
+		AllocID:      alloc.ID,
+		Task:         task,
+		LogType:      "stdout",
+		Origin:       "start",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	})
+	require.NoError(err)
+	require.Equal("replaced\n", logs)
+
+	data, err := stream("FileSystem.Stream", &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/logs/web.stdout.0",
+		Origin:       "start",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	})
+	require.NoError(err)
+	require.Equal("replaced\n", data)
+}
+
+func TestFS_lastLines(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		data     string
+		n        int
+		expected string
+	}{
+		{"", 2, ""},
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\n", 5, "a\nb\n"},
+		{"a\n\n\n", 1, "\n"},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, string(lastLines([]byte(c.data), c.n)), "%q", c.data)
+	}
+}
+
+func TestFS_logStats(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	now := time.Now().Round(time.Second)
+	entries := []*cstructs.AllocFileInfo{
+		{
+			Name:    "foo.stdout.3",
+			Size:    50,
+			ModTime: now,
+		},
+		{
+			Name:    "foo.stdout.1",
+			Size:    100,
+			ModTime: now.Add(-2 * time.Minute),
+		},
+		{
+			Name:    "foo.stdout.2",
+			Size:    100,
+			ModTime: now.Add(-1 * time.Minute),
+		},
+		{
+			Name:    "foo.stderr.0",
+			Size:    10,
+			ModTime: now,
+		},
+		{
+			Name:  "foo.stdout.dir",
+			IsDir: true,
+		},
+	}
+
+	stats, err := logStats(entries, "foo", "stdout")
+	require.NoError(err)
+	require.Equal(&cstructs.TaskLogStats{
+		Task:       "foo",
+		LogType:    "stdout",
+		Files:      3,
+		MinIndex:   1,
+		MaxIndex:   3,
+		TotalBytes: 250,
+		Oldest:     now.Add(-2 * time.Minute),
+		Newest:     now,
+	}, stats)
+
+	// No logs for the task
+	stats, err = logStats(entries, "bar", "stdout")
+	require.NoError(err)
+	require.Equal(&cstructs.TaskLogStats{
+		Task:    "bar",
+		LogType: "stdout",
+	}, stats)
+}
+
+func TestFS_logTypes(t *testing.T) {
+	t.Parallel()
+
+	entries := []*cstructs.AllocFileInfo{
+		{Name: "foo.stdout.0"},
+		{Name: "foo.stdout.1"},
+		{Name: "foo.stderr.0"},
+		{Name: "foo.metrics.0"},
+		{Name: "foo.metrics.2"},
+		{Name: "foo.events.dir", IsDir: true},
+		{Name: "foo.stdout.fifo"},
+		{Name: "foo.api.stdout.0"},
+		{Name: "bar.stdout.0"},
+		{Name: "events.0"},
+	}
+
+	require.Equal(t, []string{"metrics", "stderr", "stdout"}, logTypes(entries, "foo"))
+	require.Equal(t, []string{"stdout"}, logTypes(entries, "bar"))
+	require.Equal(t, []string{"events"}, logTypes(entries, ""))
+	require.Empty(t, logTypes(entries, "baz"))
+
+	require.Equal(t, []string{"stdout", "stderr", "metrics"},
+		withStdLogTypes(logTypes(entries, "foo")))
+}
+
+func TestFS_findClosest(t *testing.T) {
+	task := "foo"
+	entries := []*cstructs.AllocFileInfo{
+		{
+			Name: "foo.stdout.0",
+			Size: 100,
+		},
+		{
+			Name: "foo.stdout.1",
+			Size: 100,
+		},
+		{
+			Name: "foo.stdout.2",
+			Size: 100,
+		},
+		{
+			Name: "foo.stdout.3",
+			Size: 100,
+		},
+		{
+			Name: "foo.stderr.0",
+			Size: 100,
+		},
+		{
+			Name: "foo.stderr.1",
+			Size: 100,
+		},
+		{
+			Name: "foo.stderr.2",
+			Size: 100,
+		},
+	}
+
+	cases := []struct {
+		Entries        []*cstructs.AllocFileInfo
+		DesiredIdx     int64
+		DesiredOffset  int64
+		Task           string
+		LogType        string
+		ExpectedFile   string
+		ExpectedIdx    int64
+		ExpectedOffset int64
+		Error          bool
+	}{
+		// Test error cases
+		{
+			Entries:    nil,
+			DesiredIdx: 0,
+			Task:       task,
+			LogType:    "stdout",
+			Error:      true,
+		},
+		{
+			Entries:    entries[0:3],
+			DesiredIdx: 0,
+			Task:       task,
+			LogType:    "stderr",
+			Error:      true,
+		},
+
+		// Test beginning cases
+		{
+			Entries:      entries,
+			DesiredIdx:   0,
+			Task:         task,
+			LogType:      "stdout",
+			ExpectedFile: entries[0].Name,
+			ExpectedIdx:  0,
+		},
+		{
+			// Desired offset should be ignored at edges
+			Entries:        entries,
+			DesiredIdx:     0,
+			DesiredOffset:  -100,
+			Task:           task,
+			LogType:        "stdout",
+			ExpectedFile:   entries[0].Name,
+			ExpectedIdx:    0,
+			ExpectedOffset: 0,
+		},
+		{
+			// Desired offset should be ignored at edges
+			Entries:        entries,
+			DesiredIdx:     1,
+			DesiredOffset:  -1000,
+			Task:           task,
+			LogType:        "stdout",
+			ExpectedFile:   entries[0].Name,
+			ExpectedIdx:    0,
+			ExpectedOffset: 0,
+		},
+		{
+			Entries:      entries,
+			DesiredIdx:   0,
+			Task:         task,
+			LogType:      "stderr",
+			ExpectedFile: entries[4].Name,
+			ExpectedIdx:  0,
+		},
+		{
+			Entries:      entries,
+			DesiredIdx:   0,
+			Task:         task,
+			LogType:      "stdout",
+			ExpectedFile: entries[0].Name,
+			ExpectedIdx:  0,
+		},
+
+		// Test middle cases
+		{
+			Entries:      entries,
+			DesiredIdx:   1,
+			Task:         task,
+			LogType:      "stdout",
+			ExpectedFile: entries[1].Name,
+			ExpectedIdx:  1,
+		},
+		{
+			Entries:        entries,
+			DesiredIdx:     1,
+			DesiredOffset:  10,
+			Task:           task,
+			LogType:        "stdout",
+			ExpectedFile:   entries[1].Name,
+			ExpectedIdx:    1,
+			ExpectedOffset: 10,
+		},
+		{
+			Entries:        entries,
+			DesiredIdx:     1,
+			DesiredOffset:  110,
+			Task:           task,
+			LogType:        "stdout",
+			ExpectedFile:   entries[2].Name,
+			ExpectedIdx:    2,
+			ExpectedOffset: 10,
+		},
+		{
+			Entries:      entries,
+			DesiredIdx:   1,
+			Task:         task,
+			LogType:      "stderr",
+			ExpectedFile: entries[5].Name,
+			ExpectedIdx:  1,
+		},
+		// Test end cases
+		{
+			Entries:      entries,
+			DesiredIdx:   math.MaxInt64,
+			Task:         task,
+			LogType:      "stdout",
+			ExpectedFile: entries[3].Name,
+			ExpectedIdx:  3,
+		},
+		{
+			Entries:        entries,
+			DesiredIdx:     math.MaxInt64,
+			DesiredOffset:  math.MaxInt64,
+			Task:           task,
+			LogType:        "stdout",
+			ExpectedFile:   entries[3].Name,
+			ExpectedIdx:    3,
+			ExpectedOffset: 100,
+		},
+		{
+			Entries:        entries,
+			DesiredIdx:     math.MaxInt64,
+			DesiredOffset:  -10,
+			Task:           task,
+			LogType:        "stdout",
+			ExpectedFile:   entries[3].Name,
+			ExpectedIdx:    3,
+			ExpectedOffset: 90,
+		},
+		{
+			Entries:      entries,
+			DesiredIdx:   math.MaxInt64,
+			Task:         task,
+			LogType:      "stderr",
+			ExpectedFile: entries[6].Name,
+			ExpectedIdx:  2,
+		},
+	}
+
+	for i, c := range cases {
+		entry, idx, offset, err := findClosest(c.Entries, c.DesiredIdx, c.DesiredOffset, c.Task, c.LogType)
+		if err != nil {
+			if !c.Error {
+				t.Fatalf("case %d: Unexpected error: %v", i, err)
+			}
+			continue
+		}
+
+		if entry.Name != c.ExpectedFile {
+			t.Fatalf("case %d: Got file %q; want %q", i, entry.Name, c.ExpectedFile)
+		}
+		if idx != c.ExpectedIdx {
+			t.Fatalf("case %d: Got index %d; want %d", i, idx, c.ExpectedIdx)
+		}
+		if offset != c.ExpectedOffset {
+			t.Fatalf("case %d: Got offset %d; want %d", i, offset, c.ExpectedOffset)
+		}
+	}
+}
+
+// rotatedLogEntries returns the entries of n log files of the task, listed
+// by name as List does.
+func rotatedLogEntries(task string, n int) []*cstructs.AllocFileInfo {
+	entries := make([]*cstructs.AllocFileInfo, 0, n)
+	for i := 0; i < n; i++ {
+		entries = append(entries, &cstructs.AllocFileInfo{
+			Name: fmt.Sprintf("%s.stdout.%d", task, i),
+			Size: 10,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+func TestFS_logIndexCache(t *testing.T) {
+	t.Parallel()
+
+	entries := append(rotatedLogEntries("foo", 12), &cstructs.AllocFileInfo{Name: "bar.stdout.0"})
+	cache := &logIndexCache{task: "foo", logType: "stdout"}
+
+	idxs := func(indexes indexTupleArray) []int64 {
+		var out []int64
+		for _, i := range indexes {
+			out = append(out, i.idx)
+		}
+		return out
+	}
+
+	// The indexes are ordered numerically rather than by name
+	indexes, err := cache.indexes(entries)
+	require.NoError(t, err)
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, idxs(indexes))
+
+	// The entries of the latest listing are returned with cached indexes
+	latest := rotatedLogEntries("foo", 12)
+	for _, e := range latest {
+		e.Size = 20
+	}
+	indexes, err = cache.indexes(latest)
+	require.NoError(t, err)
+	require.Len(t, indexes, 12)
+	for _, i := range indexes {
+		require.Equal(t, fmt.Sprintf("foo.stdout.%d", i.idx), i.entry.Name)
+		require.Equal(t, int64(20), i.entry.Size)
+	}
+
+	// A new log file invalidates the cache
+	indexes, err = cache.indexes(rotatedLogEntries("foo", 13))
+	require.NoError(t, err)
+	require.Len(t, indexes, 13)
+	require.Equal(t, int64(12), indexes[12].idx)
+
+	// Only the most recent indexes are returned when capped
+	cache = &logIndexCache{task: "foo", logType: "stdout", max: 3}
+	indexes, err = cache.indexes(entries)
+	require.NoError(t, err)
+	require.Equal(t, []int64{9, 10, 11}, idxs(indexes))
+
+	// Invalid indexes are an error
+	_, err = cache.indexes(append(entries, &cstructs.AllocFileInfo{Name: "foo.stdout.bad"}))
+	require.Error(t, err)
+}
+
+// BenchmarkLogIndexes compares picking the next log file of a task with many
+// rotated log files with and without caching the indexes across listings, as
+// is done for every log file streamed.
+func BenchmarkLogIndexes(b *testing.B) {
+	entries := rotatedLogEntries("foo", 5000)
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, _, err := findClosest(entries, math.MaxInt64, 0, "foo", "stdout"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		cache := &logIndexCache{task: "foo", logType: "stdout"}
+		for i := 0; i < b.N; i++ {
+			indexes, err := cache.indexes(entries)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, _, err := closestLogIndex(indexes, math.MaxInt64, 0, "foo", "stdout"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFS_streamFile_NoFile(t *testing.T) {
+	t.Parallel()
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	ad := tempAllocDir(t)
+	defer ad.Destroy()
+
+	frames := make(chan *sframer.StreamFrame, 32)
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	err := c.endpoints.FileSystem.streamFile(
+		context.Background(), 0, "foo", 0, nil, ad, framer, nil, false, nil)
+	require.Error(t, err)
+	if runtime.GOOS == "windows" {
+		require.Contains(t, err.Error(), "cannot find the file")
+	} else {
+		require.Contains(t, err.Error(), "no such file")
+	}
+}
+
+func TestFS_streamFile_Modify(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	// Create a file in the temp dir
+	streamFile := "stream_file"
+	f, err := os.Create(filepath.Join(ad.AllocDir, streamFile))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer f.Close()
+
+	data := []byte("helloworld")
+
+	// Start the reader
+	resultCh := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	go func() {
+		var collected []byte
+		for {
+			frame := <-frames
+			if frame.IsHeartbeat() {
+				continue
+			}
+
+			collected = append(collected, frame.Data...)
+			if reflect.DeepEqual(data, collected) {
+				resultCh <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	// Write a few bytes
+	if _, err := f.Write(data[:3]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	// Start streaming
+	go func() {
+		if err := c.endpoints.FileSystem.streamFile(
+			context.Background(), 0, streamFile, 0, nil, ad, framer, nil, false, nil); err != nil {
+			t.Fatalf("stream() failed: %v", err)
+		}
+	}()
+
+	// Sleep a little before writing more. This lets us check if the watch
+	// is working.
+	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
+	if _, err := f.Write(data[3:]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	select {
+	case <-resultCh:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("failed to send new data")
+	}
+}
+
+func TestFS_streamFile_SkipRanges(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	// Embed a large blob in the middle of the file
+	blob := strings.Repeat("x", 3*streamFrameSize+7)
+	head, tail := "head\n", "tail\n"
+	streamFile := "stream_file"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ad.AllocDir, streamFile), []byte(head+blob+tail), 0666))
+
+	// stream returns the frames streamed until the end of the file
+	stream := func(offset, limit int64, skip [][2]int64) []*sframer.StreamFrame {
+		frames := make(chan *sframer.StreamFrame, 32)
+		framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+		framer.Run()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- c.endpoints.FileSystem.streamFile(
+				context.Background(), offset, streamFile, limit, skip, ad, framer, nil, true, nil)
+			framer.Destroy()
+		}()
+
+		var received []*sframer.StreamFrame
+		for frame := range frames {
+			if !frame.IsHeartbeat() {
+				received = append(received, frame)
+			}
+		}
+		require.NoError(t, <-errCh)
+		return received
+	}
+
+	// data returns the data of the frames and the offsets of the skipped
+	// event frames
+	data := func(frames []*sframer.StreamFrame) (string, []int64) {
+		var data string
+		var skipped []int64
+		for _, frame := range frames {
+			data += string(frame.Data)
+			if frame.FileEvent == skippedEvent {
+				require.Empty(t, frame.Data)
+				skipped = append(skipped, frame.Offset)
+			}
+		}
+		return data, skipped
+	}
+
+	// The blob is elided and a marker is sent at its end
+	blobEnd := int64(len(head) + len(blob))
+	received, skipped := data(stream(0, 0, [][2]int64{{int64(len(head)), blobEnd}}))
+	require.Equal(t, head+tail, received)
+	require.Equal(t, []int64{blobEnd}, skipped)
+
+	// Ranges before the offset are ignored and a range containing it is
+	// skipped to its end
+	received, skipped = data(stream(2, 0, [][2]int64{{0, 1}, {1, blobEnd}}))
+	require.Equal(t, tail, received)
+	require.Equal(t, []int64{blobEnd}, skipped)
+
+	// Skipped bytes count towards the limit
+	received, skipped = data(stream(0, blobEnd+2, [][2]int64{{2, blobEnd}}))
+	require.Equal(t, "he"+"ta", received)
+	require.Equal(t, []int64{blobEnd}, skipped)
+
+	// Ranges past the end of the file are never reached
+	received, skipped = data(stream(0, 0, [][2]int64{{blobEnd + 100, blobEnd + 200}}))
+	require.Equal(t, head+blob+tail, received)
+	require.Empty(t, skipped)
+}
+
+func TestFS_streamFile_SkipRanges_Follow(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	streamFile := "stream_file"
+	f, err := os.Create(filepath.Join(ad.AllocDir, streamFile))
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString("abcdefg")
+	require.NoError(t, err)
+
+	frames := make(chan *sframer.StreamFrame, 32)
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Follow the file with a range to skip ending past its end
+	go c.endpoints.FileSystem.streamFile(
+		ctx, 0, streamFile, 0, [][2]int64{{5, 10}}, ad, framer, nil, false, nil)
+
+	// Data written within the range is skipped without being reported as
+	// a truncation
+	time.Sleep(500 * time.Millisecond)
+	_, err = f.WriteString("hi")
+	require.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+	_, err = f.WriteString("jklmn")
+	require.NoError(t, err)
+
+	var received string
+	var events []string
+	timeout := time.After(10 * time.Duration(testutil.TestMultiplier()) * time.Second)
+	for received != "abcdeklmn" {
+		select {
+		case frame := <-frames:
+			received += string(frame.Data)
+			if frame.FileEvent != "" {
+				events = append(events, frame.FileEvent)
+			}
+		case <-timeout:
+			t.Fatalf("timeout, received %q", received)
+		}
+	}
+	require.Equal(t, []string{skippedEvent}, events)
+}
+
+func TestFS_validateSkipRanges(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Ranges [][2]int64
+		Valid  bool
+	}{
+		{nil, true},
+		{[][2]int64{{0, 10}}, true},
+		{[][2]int64{{0, 10}, {10, 20}, {30, 40}}, true},
+		{[][2]int64{{-1, 10}}, false},
+		{[][2]int64{{10, 10}}, false},
+		{[][2]int64{{10, 5}}, false},
+		{[][2]int64{{0, 10}, {5, 20}}, false},
+		{[][2]int64{{20, 30}, {0, 10}}, false},
+	}
+
+	for _, c := range cases {
+		err := validateSkipRanges(c.Ranges)
+		if c.Valid {
+			require.NoError(t, err, "%v", c.Ranges)
+		} else {
+			require.Equal(t, invalidSkipRanges, err, "%v", c.Ranges)
+		}
+	}
+}
+
+func TestFS_streamFile_Empty(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	// Create an empty file in the temp dir
+	streamFile := "stream_file"
+	path := filepath.Join(ad.AllocDir, streamFile)
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+
+	data := []byte("helloworld")
+
+	// Start the reader
+	resultCh := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	go func() {
+		var collected []byte
+		for {
+			frame := <-frames
+			if frame.IsHeartbeat() {
+				continue
+			}
+
+			collected = append(collected, frame.Data...)
+			if reflect.DeepEqual(data, collected) {
+				resultCh <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	// Start streaming
+	go func() {
+		if err := c.endpoints.FileSystem.streamFile(
+			context.Background(), 0, streamFile, 0, nil, ad, framer, nil, false, nil); err != nil {
+			t.Errorf("stream() failed: %v", err)
+		}
+	}()
+
+	// Let the stream reach EOF and start watching before writing. Restore
+	// the modification time afterwards to simulate a filesystem with coarse
+	// timestamps, where the write is only visible through the size.
+	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(path, fi.ModTime(), fi.ModTime()))
+
+	select {
+	case <-resultCh:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("failed to send new data")
+	}
+}
+
+func TestFS_watchDirImpl(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	// Create the watched dir with an existing file that is not reported
+	dir := "out"
+	require.NoError(t, os.Mkdir(filepath.Join(ad.AllocDir, dir), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ad.AllocDir, dir, "existing"), []byte("old"), 0666))
+
+	frames := make(chan *sframer.StreamFrame, 32)
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		if err := c.endpoints.FileSystem.watchDirImpl(ctx, dir, true, true, ad, framer); err != nil {
+			t.Errorf("watchDirImpl() failed: %v", err)
+		}
+	}()
+
+	// Let the initial listing happen before creating files
+	time.Sleep(2 * watchDirCheckRate)
+
+	expected := map[string]string{
+		"out/a": "hello",
+		"out/b": "world",
+	}
+	for path, contents := range expected {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(ad.AllocDir, path), []byte(contents), 0666))
+	}
+
+	created := map[string]int{}
+	received := map[string]string{}
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case frame := <-frames:
+			if frame.IsHeartbeat() {
+				continue
+			}
+
+			if frame.FileEvent == createEvent {
+				created[frame.File]++
+			}
+			received[frame.File] += string(frame.Data)
+		case <-timeout:
+			t.Fatalf("timeout: created %v, received %v", created, received)
+		}
+
+		if reflect.DeepEqual(expected, received) {
+			break
+		}
+	}
+
+	// Give the watcher a chance to report entries more than once
+	time.Sleep(2 * watchDirCheckRate)
+	for len(frames) > 0 {
+		if frame := <-frames; frame.FileEvent == createEvent {
+			created[frame.File]++
+		}
+	}
+
+	require.Equal(t, map[string]int{"out/a": 1, "out/b": 1}, created)
+}
+
+func TestFS_grepImpl(t *testing.T) {
+	t.Parallel()
+
+	input := "one\nfoo 1\ntwo\nthree\nfoo 2\nfoo 3\nfour\r\nfoo 4"
+
+	cases := []struct {
+		name         string
+		pattern      string
+		maxMatches   int
+		contextLines int
+		expected     []*cstructs.FsGrepMatch
+	}{
+		{
+			name:    "all matches",
+			pattern: "foo",
+			expected: []*cstructs.FsGrepMatch{
+				{Offset: 4, Line: 2, Text: "foo 1"},
+				{Offset: 20, Line: 5, Text: "foo 2"},
+				{Offset: 26, Line: 6, Text: "foo 3"},
+				{Offset: 38, Line: 8, Text: "foo 4"},
+			},
+		},
+		{
+			name:       "max matches",
+			pattern:    "foo",
+			maxMatches: 2,
+			expected: []*cstructs.FsGrepMatch{
+				{Offset: 4, Line: 2, Text: "foo 1"},
+				{Offset: 20, Line: 5, Text: "foo 2"},
+			},
+		},
+		{
+			name:         "context lines",
+			pattern:      "foo",
+			contextLines: 1,
+			expected: []*cstructs.FsGrepMatch{
+				{Offset: 4, Line: 2, Text: "foo 1", Before: []string{"one"}, After: []string{"two"}},
+				{Offset: 20, Line: 5, Text: "foo 2", Before: []string{"three"}, After: []string{"foo 3"}},
+				{Offset: 26, Line: 6, Text: "foo 3", Before: []string{"foo 2"}, After: []string{"four"}},
+				{Offset: 38, Line: 8, Text: "foo 4", Before: []string{"four"}},
+			},
+		},
+		{
+			name:         "context lines with max matches",
+			pattern:      "foo 1",
+			maxMatches:   1,
+			contextLines: 2,
+			expected: []*cstructs.FsGrepMatch{
+				{Offset: 4, Line: 2, Text: "foo 1", Before: []string{"one"}, After: []string{"two", "three"}},
+			},
+		},
+		{
+			name:    "no matches",
+			pattern: "bar",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var matches []*cstructs.FsGrepMatch
+			err := grepImpl(context.Background(), strings.NewReader(input), regexp.MustCompile(c.pattern),
+				c.maxMatches, c.contextLines, func(match *cstructs.FsGrepMatch) error {
+					matches = append(matches, match)
+					return nil
+				})
+			require.NoError(t, err)
+			require.Equal(t, c.expected, matches)
+		})
+	}
+}
+
+func TestFS_lineIndexImpl(t *testing.T) {
+	t.Parallel()
+
+	// index returns the entries of the line index of the input and its final
+	// batch
+	index := func(input string, stride, maxEntries int) ([]*cstructs.FsLineIndexEntry, *cstructs.FsLineIndexBatch) {
+		var entries []*cstructs.FsLineIndexEntry
+		var last *cstructs.FsLineIndexBatch
+		err := lineIndexImpl(context.Background(), strings.NewReader(input), stride, maxEntries,
+			func(batch *cstructs.FsLineIndexBatch) error {
+				require.Nil(t, last, "batch after the final batch")
+				require.LessOrEqual(t, len(batch.Entries), lineIndexBatchSize)
+				entries = append(entries, batch.Entries...)
+				if batch.Done {
+					last = batch
+				}
+				return nil
+			})
+		require.NoError(t, err)
+		require.NotNil(t, last)
+		return entries, last
+	}
+
+	input := "one\ntwo\n\nfour\r\nfive"
+	entries, last := index(input, 1, 0)
+	require.Equal(t, []*cstructs.FsLineIndexEntry{
+		{Line: 1, Offset: 0},
+		{Line: 2, Offset: 4},
+		{Line: 3, Offset: 8},
+		{Line: 4, Offset: 9},
+		{Line: 5, Offset: 15},
+	}, entries)
+	require.Equal(t, 5, last.Lines)
+	require.EqualValues(t, len(input), last.Bytes)
+	require.False(t, last.Truncated)
+
+	// Every stride'th line is indexed
+	entries, _ = index(input, 2, 0)
+	require.Equal(t, []*cstructs.FsLineIndexEntry{
+		{Line: 1, Offset: 0},
+		{Line: 3, Offset: 8},
+		{Line: 5, Offset: 15},
+	}, entries)
+
+	// The index is truncated at the maximum number of entries
+	entries, last = index(input, 2, 2)
+	require.Len(t, entries, 2)
+	require.True(t, last.Truncated)
+	require.Equal(t, 4, last.Lines)
+	require.EqualValues(t, 15, last.Bytes)
+
+	// Empty files have no lines
+	entries, last = index("", 1, 0)
+	require.Empty(t, entries)
+	require.Zero(t, last.Lines)
+
+	// Lines longer than the read buffer and indexes larger than a batch are
+	// handled
+	var b strings.Builder
+	var offsets []int64
+	for i := 0; i < 3*lineIndexBatchSize; i++ {
+		offsets = append(offsets, int64(b.Len()))
+		if i%1000 == 0 {
+			b.WriteString(strings.Repeat("x", 10000))
+		}
+		b.WriteString("line\n")
+	}
+	entries, last = index(b.String(), 1, 0)
+	require.Len(t, entries, len(offsets))
+	for i, entry := range entries {
+		require.Equal(t, i+1, entry.Line)
+		require.Equal(t, offsets[i], entry.Offset)
+	}
+	require.Equal(t, len(offsets), last.Lines)
+}
+
+func TestFS_streamFile_Truncate(t *testing.T) {
+	t.Parallel()
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	// Create a file in the temp dir
+	data := []byte("helloworld")
+	streamFile := "stream_file"
+	streamFilePath := filepath.Join(ad.AllocDir, streamFile)
+	f, err := os.Create(streamFilePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Start the reader
+	truncateCh := make(chan struct{})
+	truncateClosed := false
+	dataPostTruncCh := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	go func() {
+		var collected []byte
+		for {
+			frame := <-frames
+			if frame.IsHeartbeat() {
+				continue
+			}
+
+			if frame.FileEvent == truncateEvent && !truncateClosed {
+				close(truncateCh)
+				truncateClosed = true
+			}
+
+			collected = append(collected, frame.Data...)
+			if reflect.DeepEqual(data, collected) {
+				close(dataPostTruncCh)
+				return
+			}
+		}
+	}()
+
+	// Write a few bytes
+	if _, err := f.Write(data[:3]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	// Start streaming
+	go func() {
+		if err := c.endpoints.FileSystem.streamFile(
+			context.Background(), 0, streamFile, 0, nil, ad, framer, nil, false, nil); err != nil {
+			t.Fatalf("stream() failed: %v", err)
+		}
+	}()
+
+	// Sleep a little before truncating. This lets us check if the watch
+	// is working.
+	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
+	if err := f.Truncate(0); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close file: %v", err)
+	}
+
+	f2, err := os.OpenFile(streamFilePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen file: %v", err)
+	}
+	defer f2.Close()
+	if _, err := f2.Write(data[3:5]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	select {
+	case <-truncateCh:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive truncate")
+	}
+
+	// Sleep a little before writing more. This lets us check if the watch
+	// is working.
+	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
+	if _, err := f2.Write(data[5:]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	select {
+	case <-dataPostTruncCh:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive post truncate data")
+	}
+}
+
+func TestFS_streamImpl_Delete(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows does not allow us to delete a file while it is open")
+	}
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	// Create a file in the temp dir
+	data := []byte("helloworld")
+	streamFile := "stream_file"
+	streamFilePath := filepath.Join(ad.AllocDir, streamFile)
+	f, err := os.Create(streamFilePath)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer f.Close()
+
+	// Start the reader
+	deleteCh := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	go func() {
+		for {
+			frame, ok := <-frames
+			if !ok {
+				return
+			}
+
+			if frame.IsHeartbeat() {
+				continue
+			}
+
+			if frame.FileEvent == deleteEvent {
+				close(deleteCh)
+				return
+			}
+		}
+	}()
+
+	// Write a few bytes
+	if _, err := f.Write(data[:3]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	// Start streaming
+	go func() {
+		if err := c.endpoints.FileSystem.streamFile(
+			context.Background(), 0, streamFile, 0, nil, ad, framer, nil, false, nil); err != nil {
+			t.Fatalf("stream() failed: %v", err)
+		}
+	}()
+
+	// Sleep a little before deleting. This lets us check if the watch
+	// is working.
+	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
+	if err := os.Remove(streamFilePath); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	select {
+	case <-deleteCh:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive delete")
+	}
+}
+
+func TestFS_streamFile_Rotated(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows does not allow us to rename a file while it is open")
+	}
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	task, logType := "foo", "stdout"
+	logPath := filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName)
+	logFile := filepath.Join(logDir, "foo.stdout.0")
+	require.NoError(t, ioutil.WriteFile(logFile, []byte("hello"), 0777))
+
+	// Start the reader
+	eventCh := make(chan string, 1)
+	frames := make(chan *sframer.StreamFrame, 4)
+	go func() {
+		for {
+			frame, ok := <-frames
+			if !ok {
+				return
+			}
+
+			if frame.FileEvent != "" {
+				eventCh <- frame.FileEvent
+				return
+			}
+		}
+	}()
+
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.Run()
+	defer framer.Destroy()
+
+	// Start streaming
+	deletedEvent := func() string {
+		return logDeletedEvent(ad, logPath, task, logType, 0)
+	}
+	go func() {
+		if err := c.endpoints.FileSystem.streamFile(
+			context.Background(), 0, filepath.Join(logPath, "foo.stdout.0"), 0, nil, ad, framer, nil, false, deletedEvent); err != nil {
+			t.Errorf("stream() failed: %v", err)
+		}
+	}()
+
+	// Sleep a little before rotating. This lets us check if the watch
+	// is working.
+	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
+	require.NoError(t, os.Rename(logFile, filepath.Join(logDir, "foo.stdout.1")))
+
+	select {
+	case event := <-eventCh:
+		require.Equal(t, rotatedEvent, event)
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive rotation")
+	}
+}
+
+func TestFS_logDeletedEvent(t *testing.T) {
+	t.Parallel()
+
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+	logPath := filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName)
+
+	// Without a later log file the logs were deleted
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "foo.stdout.0"), nil, 0777))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "foo.stderr.1"), nil, 0777))
+	require.Equal(t, deleteEvent, logDeletedEvent(ad, logPath, "foo", "stdout", 0))
+
+	// Logs rotated to a later file
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "foo.stdout.2"), nil, 0777))
+	require.Equal(t, rotatedEvent, logDeletedEvent(ad, logPath, "foo", "stdout", 0))
+	require.Equal(t, deleteEvent, logDeletedEvent(ad, logPath, "foo", "stdout", 2))
+}
+
+func TestFS_blockUntilNextLog(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name    string
+		Created string
+		Timeout time.Duration
+	}{
+		{
+			// Detected by watching for the next entry
+			Name:    "next index",
+			Created: "web.stdout.1",
+			Timeout: 2 * time.Second,
+		},
+		{
+			// Detected by scanning once backed off
+			Name:    "skipped index",
+			Created: "web.stdout.2",
+			Timeout: maxNextLogCheckRate + time.Second,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			ad := tempAllocDir(t)
+			require.NoError(t, ad.Build())
+			defer ad.Destroy()
+
+			logPath := filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName)
+			logDir := filepath.Join(ad.AllocDir, logPath)
+			require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "web.stdout.0"), []byte("0"), 0666))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			next := blockUntilNextLog(ctx, ad, logPath, "web", "stdout", 1)
+
+			// Let the scan back off while the logs are idle
+			time.Sleep(maxNextLogCheckRate + 500*time.Millisecond)
+			select {
+			case err := <-next:
+				t.Fatalf("unexpected signal before next log: %v", err)
+			default:
+			}
+
+			require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, tc.Created), []byte("1"), 0666))
+
+			select {
+			case err := <-next:
+				require.NoError(t, err)
+			case <-time.After(time.Duration(testutil.TestMultiplier()) * tc.Timeout):
+				t.Fatalf("next log %q not detected", tc.Created)
+			}
+		})
+	}
+}
+
+func TestFS_nextLogBackoff(t *testing.T) {
+	t.Parallel()
+
+	rate := nextLogCheckRate
+	for i := 0; i < 10; i++ {
+		next := nextLogBackoff(rate)
+		require.True(t, next >= rate)
+		require.True(t, next <= maxNextLogCheckRate)
+		rate = next
+	}
+	require.Equal(t, maxNextLogCheckRate, rate)
+}
+
+func TestFS_logsImpl_NoFollow(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	if err := os.MkdirAll(logDir, 0777); err != nil {
+		t.Fatalf("Failed to make log dir: %v", err)
+	}
+
+	// Create a series of log files in the temp dir
+	task := "foo"
+	logType := "stdout"
+	expected := []byte("012")
+	for i := 0; i < 3; i++ {
+		logFile := fmt.Sprintf("%s.%s.%d", task, logType, i)
+		logFilePath := filepath.Join(logDir, logFile)
+		err := ioutil.WriteFile(logFilePath, expected[i:i+1], 0777)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	// Start the reader
+	resultCh := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	var received []byte
+	go func() {
+		for {
+			frame, ok := <-frames
+			if !ok {
+				return
+			}
+
+			if frame.IsHeartbeat() {
+				continue
+			}
+
+			received = append(received, frame.Data...)
+			if reflect.DeepEqual(received, expected) {
+				close(resultCh)
+				return
+			}
+		}
+	}()
+
+	// Start streaming logs
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	req := &cstructs.FsLogsRequest{
+		Task:    task,
+		LogType: logType,
+		Origin:  OriginStart,
+	}
+	if err := c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames); err != nil {
+		t.Fatalf("logsImpl failed: %v", err)
+	}
+
+	select {
+	case <-resultCh:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive data: got %q", string(received))
+	}
+}
+
+func TestFS_logsImpl_LineNumbers(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Rotation may split a line across log files
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "foo.stdout.0"), []byte("a\nb\nc"), 0777))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "foo.stdout.1"), []byte("c\nd\n"), 0777))
+
+	frames := make(chan *sframer.StreamFrame, 32)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	req := &cstructs.FsLogsRequest{
+		Task:        "foo",
+		LogType:     "stdout",
+		Origin:      OriginStart,
+		LineNumbers: true,
+	}
+	require.NoError(t, c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames))
+
+	// Number the streamed frames as the handler does
+	numberer := new(lineNumberer)
+	var received string
+	timeout := time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow)
+	for received != "     1\ta\n     2\tb\n     3\tcc\n     4\td\n" {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				t.Fatalf("frames closed: got %q", received)
+			}
+			if len(frame.Data) > 0 {
+				received += string(numberer.number(frame.Data))
+			}
+		case <-timeout:
+			t.Fatalf("did not receive numbered logs: got %q", received)
+		}
+	}
+}
+
+func TestFS_logIndexes_AllocLog(t *testing.T) {
+	t.Parallel()
+
+	entries := []*cstructs.AllocFileInfo{
+		{Name: "stdout.0"},
+		{Name: "stdout.2"},
+		{Name: "stderr.1"},
+		{Name: "foo.stdout.1"},
+		{Name: "stdout.3", IsDir: true},
+	}
+
+	indexes, err := logIndexes(entries, "", "stdout")
+	require.NoError(t, err)
+	sort.Sort(indexes)
+
+	var names []string
+	for _, idx := range indexes {
+		names = append(names, idx.entry.Name)
+	}
+	require.Equal(t, []string{"stdout.0", "stdout.2"}, names)
+
+	// The task logs do not include the allocation logs
+	indexes, err = logIndexes(entries, "foo", "stdout")
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, "foo.stdout.1", indexes[0].entry.Name)
+
+	entry, idx, _, err := findClosest(entries, math.MaxInt64, 0, "", "stdout")
+	require.NoError(t, err)
+	require.Equal(t, "stdout.2", entry.Name)
+	require.EqualValues(t, 2, idx)
+}
+
+func TestFS_logsImpl_AllocLog(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Create allocation logs next to the logs of a task, which must not be
+	// streamed
+	expected := []byte("012")
+	for i := 0; i < 3; i++ {
+		p := filepath.Join(logDir, fmt.Sprintf("stdout.%d", i))
+		require.NoError(t, ioutil.WriteFile(p, expected[i:i+1], 0777))
+	}
+	p := filepath.Join(logDir, "foo.stdout.0")
+	require.NoError(t, ioutil.WriteFile(p, []byte("task"), 0777))
+
+	frames := make(chan *sframer.StreamFrame, 32)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	req := &cstructs.FsLogsRequest{
+		AllocLog: true,
+		LogType:  "stdout",
+		Origin:   OriginStart,
+	}
+	require.NoError(t, c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames))
+
+	var received []byte
+	for frame := range frames {
+		received = append(received, frame.Data...)
+	}
+	require.Equal(t, expected, received)
+
+	// A missing allocation log is reported without a task name
+	req.LogType = "stderr"
+	err := c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, make(chan *sframer.StreamFrame, 32))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "allocation log entry")
+}
+
+func TestFS_logsImpl_IndexRange(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Create a series of log files in the temp dir
+	task := "foo"
+	logType := "stdout"
+	contents := "012345"
+	for i := range contents {
+		logFile := fmt.Sprintf("%s.%s.%d", task, logType, i)
+		err := ioutil.WriteFile(filepath.Join(logDir, logFile), []byte(contents[i:i+1]), 0777)
+		require.NoError(t, err)
+	}
+
+	cases := []struct {
+		name        string
+		start, end  int64
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "valid range",
+			start:    1,
+			end:      3,
+			expected: "123",
+		},
+		{
+			name:     "single index",
+			start:    4,
+			end:      4,
+			expected: "4",
+		},
+		{
+			name:        "partially missing range",
+			start:       3,
+			end:         7,
+			expectedErr: `log index 7 for task "foo" and log type "stdout" not found`,
+		},
+		{
+			name:        "inverted range",
+			start:       3,
+			end:         1,
+			expectedErr: invalidIndexRange.Error(),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			frames := make(chan *sframer.StreamFrame, 32)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			req := &cstructs.FsLogsRequest{
+				Task:       task,
+				LogType:    logType,
+				Origin:     OriginStart,
+				StartIndex: helper.Int64ToPtr(tc.start),
+				EndIndex:   helper.Int64ToPtr(tc.end),
+			}
+			err := c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			// The stream ends after the range so all the frames are buffered
+			var received string
+			for {
+				select {
+				case frame, ok := <-frames:
+					if !ok {
+						require.Equal(t, tc.expected, received)
+						return
+					}
+					received += string(frame.Data)
+				case <-ctx.Done():
+					t.Fatalf("frames not closed: got %q", received)
+				}
+			}
+		})
+	}
+}
+
+func TestFS_logsImpl_Snapshot(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// The first log file is larger than a frame so streaming blocks until
+	// the first frame is received
+	first := bytes.Repeat([]byte("a"), streamFrameSize+1024)
+	second := []byte("bc")
+	logFile := func(i int) string {
+		return filepath.Join(logDir, fmt.Sprintf("foo.stdout.%d", i))
+	}
+	require.NoError(t, ioutil.WriteFile(logFile(0), first, 0777))
+	require.NoError(t, ioutil.WriteFile(logFile(1), second, 0777))
+
+	appendFile := func(path, data string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0777)
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.WriteString(data)
+		require.NoError(t, err)
+	}
+
+	// Write to the log files once streaming has started
+	frames := make(chan *sframer.StreamFrame)
+	doneCh := make(chan []byte)
+	go func() {
+		var received []byte
+		appended := false
+		for frame := range frames {
+			if !appended && len(frame.Data) > 0 {
+				appendFile(logFile(0), "ZZ")
+				appendFile(logFile(1), "YY")
+				appendFile(logFile(2), "XX")
+				appended = true
+			}
+			received = append(received, frame.Data...)
+		}
+		doneCh <- received
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &cstructs.FsLogsRequest{
+		Task:     "foo",
+		LogType:  "stdout",
+		Origin:   OriginStart,
+		Snapshot: true,
+	}
+	require.NoError(t, c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames))
+
+	select {
+	case received := <-doneCh:
+		require.Equal(t, string(first)+string(second), string(received))
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestFS_logsImpl_Follow(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	if err := os.MkdirAll(logDir, 0777); err != nil {
+		t.Fatalf("Failed to make log dir: %v", err)
+	}
+
+	// Create a series of log files in the temp dir
+	task := "foo"
+	logType := "stdout"
+	expected := []byte("012345")
+	initialWrites := 3
+
+	filePath := func(index int) string {
+		logFile := fmt.Sprintf("%s.%s.%d", task, logType, index)
+		return filepath.Join(logDir, logFile)
+	}
+	writeToFile := func(index int, data []byte) {
+		logFilePath := filePath(index)
+		err := ioutil.WriteFile(logFilePath, data, 0777)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	appendToFile := func(index int, data []byte) {
+		logFilePath := filePath(index)
+		f, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+
+		defer f.Close()
+
+		if _, err = f.Write(data); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	for i := 0; i < initialWrites; i++ {
+		writeToFile(i, expected[i:i+1])
+	}
+
+	// Start the reader
+	firstResultCh := make(chan struct{})
+	fullResultCh := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	var received []byte
+	go func() {
+		for {
+			frame, ok := <-frames
+			if !ok {
+				return
+			}
+
+			if frame.IsHeartbeat() {
+				continue
+			}
+
+			received = append(received, frame.Data...)
+			if reflect.DeepEqual(received, expected[:initialWrites]) {
+				close(firstResultCh)
+			} else if reflect.DeepEqual(received, expected) {
+				close(fullResultCh)
+				return
+			}
+		}
+	}()
+
+	// Start streaming logs
+	req := &cstructs.FsLogsRequest{
+		Task:    task,
+		LogType: logType,
+		Origin:  OriginStart,
+		Follow:  true,
+	}
+	go c.endpoints.FileSystem.logsImpl(context.Background(), req, ad, nil, frames)
+
+	select {
+	case <-firstResultCh:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive data: got %q", string(received))
+	}
+
+	// We got the first chunk of data, write out the rest splitted
+	// between the last file and to the next file
+	// at an index much ahead to check that it is following and detecting
+	// skips
+	skipTo := initialWrites + 10
+	appendToFile(initialWrites-1, expected[initialWrites:initialWrites+1])
+	writeToFile(skipTo, expected[initialWrites+1:])
+
+	select {
+	case <-fullResultCh:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive data: got %q", string(received))
+	}
+}
+
+func TestFS_logsImpl_WholeLinesOnly(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Write the first half of a line
+	logFile := filepath.Join(logDir, "foo.stdout.0")
+	require.NoError(t, ioutil.WriteFile(logFile, []byte("first\nhel"), 0777))
+
+	frames := make(chan *sframer.StreamFrame, 32)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req := &cstructs.FsLogsRequest{
+		Task:           "foo",
+		LogType:        "stdout",
+		Origin:         OriginStart,
+		Follow:         true,
+		WholeLinesOnly: true,
+	}
+	go c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames)
+
+	// nextData returns the data of the next frame or fails after the timeout
+	nextData := func(timeout time.Duration) (string, bool) {
+		deadline := time.After(timeout)
+		for {
+			select {
+			case frame := <-frames:
+				if len(frame.Data) > 0 {
+					return string(frame.Data), true
+				}
+			case <-deadline:
+				return "", false
+			}
+		}
+	}
+
+	wait := 10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow
+	data, ok := nextData(wait)
+	require.True(t, ok)
+	require.Equal(t, "first\n", data)
+
+	// The partial line is held back at the end of the file
+	data, ok = nextData(wait)
+	require.False(t, ok, "received partial line %q", data)
+
+	// It is sent once completed
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("lo\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	data, ok = nextData(wait)
+	require.True(t, ok)
+	require.Equal(t, "hello\n", data)
+}
+
+func TestFS_logsImpl_Manifest(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Create rotated log files of differing sizes
+	contents := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("foo.stdout.%d", i)
+		content := strings.Repeat(fmt.Sprintf("line %d\n", i), i+2)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, name), []byte(content), 0777))
+		contents[filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName, name)] = content
+	}
+
+	startIdx, endIdx := int64(1), int64(2)
+	cases := []struct {
+		Name   string
+		Req    cstructs.FsLogsRequest
+		Files  int
+		Offset int64
+	}{
+		{Name: "start", Req: cstructs.FsLogsRequest{Origin: OriginStart}, Files: 4},
+		{Name: "start offset", Req: cstructs.FsLogsRequest{Origin: OriginStart, Offset: 17}, Files: 3, Offset: 3},
+		{Name: "end offset", Req: cstructs.FsLogsRequest{Origin: OriginEnd, Offset: 45}, Files: 2, Offset: 18},
+		{Name: "index range", Req: cstructs.FsLogsRequest{Origin: OriginStart, StartIndex: &startIdx, EndIndex: &endIdx}, Files: 2},
+		{Name: "max files", Req: cstructs.FsLogsRequest{Origin: OriginStart, MaxFilesSpanned: 2}, Files: 2},
+		{Name: "snapshot", Req: cstructs.FsLogsRequest{Origin: OriginStart, Snapshot: true}, Files: 4},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			fs := &FileSystem{c: c}
+
+			frames := make(chan *sframer.StreamFrame, 32)
+			req := tc.Req
+			req.Task = "foo"
+			req.LogType = "stdout"
+			req.Manifest = true
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			require.NoError(t, fs.logsImpl(ctx, &req, ad, nil, frames))
+
+			// The manifest is sent before any data
+			var manifest []*sframer.LogManifestEntry
+			var received string
+			perFile := make(map[string]string)
+			for frame := range frames {
+				if frame.IsHeartbeat() || frame.FileEvent == filesLimitEvent {
+					continue
+				}
+				if manifest == nil {
+					require.NotNil(t, frame.Manifest)
+					manifest = frame.Manifest
+					continue
+				}
+				require.Nil(t, frame.Manifest)
+				received += string(frame.Data)
+				perFile[frame.File] += string(frame.Data)
+			}
+
+			// The ranges of the manifest match the data streamed from each
+			// file
+			require.Len(t, manifest, tc.Files)
+			require.Equal(t, tc.Offset, manifest[0].FileOffset)
+			var end int64
+			for _, entry := range manifest {
+				content := contents[entry.File]
+				require.EqualValues(t, len(content), entry.Size)
+				require.Equal(t, end, entry.Start)
+				require.Equal(t, content[entry.FileOffset:], received[entry.Start:entry.End])
+				require.Equal(t, perFile[entry.File], received[entry.Start:entry.End])
+				end = entry.End
+			}
+			require.EqualValues(t, len(received), end)
+		})
+	}
+}
+
+func TestFS_logsImpl_MaxFilesSpanned(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Create more log files than streamed by a request
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("foo.stdout.%d", i)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, name), []byte(fmt.Sprintf("%d\n", i)), 0777))
+	}
+
+	cases := []struct {
+		Name      string
+		ClientMax int
+		ReqMax    int
+		Expected  string
+		Limited   bool
+	}{
+		{Name: "client limit", ClientMax: 2, Expected: "0\n1\n", Limited: true},
+		{Name: "request limit", ClientMax: 4, ReqMax: 3, Expected: "0\n1\n2\n", Limited: true},
+		{Name: "request above client limit", ClientMax: 2, ReqMax: 10, Expected: "0\n1\n", Limited: true},
+		{Name: "under limit", ClientMax: 5, Expected: "0\n1\n2\n3\n4\n"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			fs := &FileSystem{
+				c:               c,
+				maxFilesSpanned: tc.ClientMax,
+			}
+
+			frames := make(chan *sframer.StreamFrame, 32)
+			req := &cstructs.FsLogsRequest{
+				Task:            "foo",
+				LogType:         "stdout",
+				Origin:          OriginStart,
+				MaxFilesSpanned: tc.ReqMax,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			require.NoError(t, fs.logsImpl(ctx, req, ad, nil, frames))
+
+			var received string
+			var last *sframer.StreamFrame
+			for frame := range frames {
+				if frame.IsHeartbeat() {
+					continue
+				}
+				received += string(frame.Data)
+				last = frame
+			}
+
+			require.Equal(t, tc.Expected, received)
+			require.NotNil(t, last)
+			if tc.Limited {
+				require.Equal(t, filesLimitEvent, last.FileEvent)
+			} else {
+				require.Empty(t, last.FileEvent)
+			}
+		})
+	}
+}
+
+func TestFS_logsImpl_MaxBacklog(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Write the history across several log files
+	filePath := func(index int) string {
+		return filepath.Join(logDir, fmt.Sprintf("foo.stdout.%d", index))
+	}
+	for i, data := range []string{"0123", "4567", "89"} {
+		require.NoError(t, ioutil.WriteFile(filePath(i), []byte(data), 0777))
+	}
+
+	// Start the reader
+	history := make(chan struct{})
+	live := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	go func() {
+		var received string
+		for frame := range frames {
+			received += string(frame.Data)
+			switch received {
+			case "789":
+				close(history)
+			case "789ab":
+				close(live)
+				return
+			}
+		}
+	}()
+
+	// Start streaming logs with only the last three bytes of history
+	req := &cstructs.FsLogsRequest{
+		Task:       "foo",
+		LogType:    "stdout",
+		Origin:     OriginStart,
+		Follow:     true,
+		MaxBacklog: 3,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames)
+
+	select {
+	case <-history:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive the backlog")
+	}
+
+	// Live data is streamed after the backlog
+	f, err := os.OpenFile(filePath(2), os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("ab"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	select {
+	case <-live:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive live data")
+	}
+}
+
+func TestFS_logsImpl_FollowFromEnd(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Write the history across several log files
+	filePath := func(index int) string {
+		return filepath.Join(logDir, fmt.Sprintf("foo.stdout.%d", index))
+	}
+	require.NoError(t, ioutil.WriteFile(filePath(0), []byte("line 1\nline 2\n"), 0777))
+	require.NoError(t, ioutil.WriteFile(filePath(1), []byte("line 3\nline 4\n"), 0777))
+
+	history := make(chan struct{})
+	live := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	go func() {
+		var received string
+		for frame := range frames {
+			received += string(frame.Data)
+			switch received {
+			case "line 2\nline 3\nline 4\n":
+				close(history)
+			case "line 2\nline 3\nline 4\nline 5\nline 6\n":
+				close(live)
+				return
+			}
+		}
+	}()
+
+	// Stream the last three lines of history and then follow
+	req := &cstructs.FsLogsRequest{
+		Task:    "foo",
+		LogType: "stdout",
+		Origin:  OriginEnd,
+		Offset:  21,
+		Follow:  true,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames)
+
+	select {
+	case <-history:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive the history")
+	}
+
+	// Live lines written to the current and a new log file follow the
+	// history without being duplicated or dropped
+	f, err := os.OpenFile(filePath(1), os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("line 5\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, ioutil.WriteFile(filePath(2), []byte("line 6\n"), 0777))
+
+	select {
+	case <-live:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive live data")
+	}
+}
+
+func TestFS_logsImpl_MissingLogDir(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir without a log dir, as if the task was still
+	// starting
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.RemoveAll(logDir))
+
+	fs := &FileSystem{
+		c:                   c,
+		allocFSRetryBackoff: 10 * time.Millisecond,
+		allocFSRetryLimit:   10,
+	}
+	req := &cstructs.FsLogsRequest{
+		Task:    "foo",
+		LogType: "stdout",
+		Origin:  OriginStart,
+	}
+
+	// The missing log dir is reported as the logs not being available yet
+	frames := make(chan *sframer.StreamFrame, 32)
+	err := fs.logsImpl(context.Background(), req, ad, nil, frames)
+	require.EqualError(t, err, `logs not yet available for task "foo"`)
+	codedErr, ok := err.(interface{ Code() int })
+	require.True(t, ok)
+	require.Equal(t, http.StatusNotFound, codedErr.Code())
+
+	// Waiting for the allocation to start retries until the log dir exists
+	tmpDir := filepath.Join(ad.SharedDir, "tmp-logs")
+	require.NoError(t, os.MkdirAll(tmpDir, 0777))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "foo.stdout.0"), []byte("hello"), 0777))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Rename(tmpDir, logDir)
+	}()
+
+	req.WaitForStart = true
+	frames = make(chan *sframer.StreamFrame, 32)
+	require.NoError(t, fs.logsImpl(context.Background(), req, ad, nil, frames))
+
+	var received string
+	for frame := range frames {
+		received += string(frame.Data)
+	}
+	require.Equal(t, "hello", received)
+}
+
+func TestFS_logsImpl_TailLines(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Write the history across several log files
+	filePath := func(index int) string {
+		return filepath.Join(logDir, fmt.Sprintf("foo.stdout.%d", index))
+	}
+	require.NoError(t, ioutil.WriteFile(filePath(0), []byte("line 1\nline 2\nline 3\n"), 0777))
+	require.NoError(t, ioutil.WriteFile(filePath(1), []byte("line 4\nline 5\n"), 0777))
+
+	history := make(chan struct{})
+	live := make(chan struct{})
+	frames := make(chan *sframer.StreamFrame, 4)
+	go func() {
+		var received string
+		for frame := range frames {
+			received += string(frame.Data)
+			switch received {
+			case "line 3\nline 4\nline 5\n":
+				close(history)
+			case "line 3\nline 4\nline 5\nline 6\n":
+				close(live)
+				return
+			}
+		}
+	}()
+
+	// Stream the last three lines of history and then follow, with the
+	// origin overridden
+	req := &cstructs.FsLogsRequest{
+		Task:      "foo",
+		LogType:   "stdout",
+		Origin:    OriginEnd,
+		TailLines: 3,
+		Follow:    true,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames)
+
+	select {
+	case <-history:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive the history")
+	}
+
+	// Live data follows exactly the last lines of history
+	f, err := os.OpenFile(filePath(1), os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("line 6\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	select {
+	case <-live:
+	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
+		t.Fatalf("did not receive live data")
+	}
+}
+
+func TestFS_tailLinesLogPosition(t *testing.T) {
+	t.Parallel()
+
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logPath := filepath.Join(allocdir.SharedAllocName, allocdir.LogDirName)
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// No logs have been written yet
+	idx, offset, err := tailLinesLogPosition(ad, nil, logPath, "foo", "stdout", 3)
+	require.NoError(t, err)
+	require.Zero(t, idx)
+	require.Zero(t, offset)
+
+	// The last log file ends with a partial line
+	for i, data := range []string{"a\nb\n", "c\nd\ne"} {
+		name := fmt.Sprintf("foo.stdout.%d", i)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, name), []byte(data), 0777))
+	}
+	entries, err := ad.List(logPath)
+	require.NoError(t, err)
+
+	cases := []struct {
+		Lines  int
+		Idx    int64
+		Offset int64
+	}{
+		{Lines: 1, Idx: 1, Offset: 4},
+		{Lines: 3, Idx: 1, Offset: 0},
+		{Lines: 4, Idx: 0, Offset: 2},
+		{Lines: 100, Idx: 0, Offset: 0},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d lines", c.Lines), func(t *testing.T) {
+			idx, offset, err := tailLinesLogPosition(ad, entries, logPath, "foo", "stdout", c.Lines)
+			require.NoError(t, err)
+			require.Equal(t, c.Idx, idx)
+			require.Equal(t, c.Offset, offset)
+		})
+	}
+}
+
+func TestFS_backlogLogPosition(t *testing.T) {
+	t.Parallel()
+
+	entries := []*cstructs.AllocFileInfo{
+		{Name: "foo.stdout.0", Size: 4},
+		{Name: "foo.stdout.1", Size: 4},
+		{Name: "foo.stdout.2", Size: 2},
+	}
+
+	cases := []struct {
+		Name       string
+		Offset     int64
+		MaxBacklog int64
+		Idx        int64
+		OpenOffset int64
+	}{
 		{
-			Entries:    entries[0:3],
-			DesiredIdx: 0,
-			Task:       task,
-			LogType:    "stderr",
-			Error:      true,
+			Name:       "within last file",
+			MaxBacklog: 1,
+			Idx:        2,
+			OpenOffset: 1,
 		},
-
-		// Test beginning cases
 		{
-			Entries:      entries,
-			DesiredIdx:   0,
-			Task:         task,
-			LogType:      "stdout",
-			ExpectedFile: entries[0].Name,
-			ExpectedIdx:  0,
+			Name:       "spans files",
+			MaxBacklog: 5,
+			Idx:        1,
+			OpenOffset: 1,
 		},
 		{
-			// Desired offset should be ignored at edges
-			Entries:        entries,
-			DesiredIdx:     0,
-			DesiredOffset:  -100,
-			Task:           task,
-			LogType:        "stdout",
-			ExpectedFile:   entries[0].Name,
-			ExpectedIdx:    0,
-			ExpectedOffset: 0,
+			Name:       "larger than history",
+			MaxBacklog: 100,
+			Idx:        0,
+			OpenOffset: 0,
 		},
 		{
-			// Desired offset should be ignored at edges
-			Entries:        entries,
-			DesiredIdx:     1,
-			DesiredOffset:  -1000,
-			Task:           task,
-			LogType:        "stdout",
-			ExpectedFile:   entries[0].Name,
-			ExpectedIdx:    0,
-			ExpectedOffset: 0,
+			Name:       "offset closer to the end",
+			Offset:     9,
+			MaxBacklog: 5,
+			Idx:        2,
+			OpenOffset: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			idx, offset, err := backlogLogPosition(entries, "foo", "stdout", c.Offset, c.MaxBacklog)
+			require.NoError(t, err)
+			require.Equal(t, c.Idx, idx)
+			require.Equal(t, c.OpenOffset, offset)
+		})
+	}
+
+	// No logs have been written yet
+	idx, offset, err := backlogLogPosition(nil, "foo", "stdout", 0, 5)
+	require.NoError(t, err)
+	require.Zero(t, idx)
+	require.Zero(t, offset)
+}
+
+// rotatingAllocDir simulates a log file that is always rotated out between
+// being listed and being opened.
+type rotatingAllocDir struct {
+	*allocdir.AllocDir
+
+	l     sync.Mutex
+	opens []time.Time
+}
+
+func (r *rotatingAllocDir) ReadAt(path string, offset int64) (io.ReadCloser, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.opens = append(r.opens, time.Now())
+	return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+}
+
+func TestFS_logsImpl_RotatedRetry(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "foo.stdout.0"), []byte("foo"), 0777))
+
+	fs := &FileSystem{
+		c:                   c,
+		rotatedRetryBackoff: 10 * time.Millisecond,
+		rotatedRetryLimit:   3,
+	}
+	rotating := &rotatingAllocDir{AllocDir: ad}
+
+	frames := make(chan *sframer.StreamFrame, 32)
+	req := &cstructs.FsLogsRequest{
+		Task:    "foo",
+		LogType: "stdout",
+		Origin:  OriginStart,
+	}
+
+	start := time.Now()
+	err := fs.logsImpl(context.Background(), req, rotating, nil, frames)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rotated out 4 times in a row")
+
+	// Each retry waits for a doubling backoff
+	require.Len(t, rotating.opens, 4)
+	for i, wait := range []time.Duration{10, 20, 40} {
+		require.GreaterOrEqual(t, int64(rotating.opens[i+1].Sub(rotating.opens[i])), int64(wait*time.Millisecond))
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(70*time.Millisecond))
+}
+
+// cancellingAllocDir cancels the stream when a file is opened and counts the
+// listings made.
+type cancellingAllocDir struct {
+	*allocdir.AllocDir
+	cancel context.CancelFunc
+
+	l     sync.Mutex
+	lists int
+}
+
+func (c *cancellingAllocDir) List(path string) ([]*cstructs.AllocFileInfo, error) {
+	c.l.Lock()
+	c.lists++
+	c.l.Unlock()
+	return c.AllocDir.List(path)
+}
+
+func (c *cancellingAllocDir) ReadAt(path string, offset int64) (io.ReadCloser, error) {
+	c.cancel()
+	return c.AllocDir.ReadAt(path, offset)
+}
+
+func (c *cancellingAllocDir) listCount() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.lists
+}
+
+func TestFS_logsImpl_CancelStopsListing(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "foo.stdout.0"), []byte("foo"), 0777))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelling := &cancellingAllocDir{AllocDir: ad, cancel: cancel}
+
+	frames := make(chan *sframer.StreamFrame, 32)
+	req := &cstructs.FsLogsRequest{
+		Task:    "foo",
+		LogType: "stdout",
+		Origin:  OriginStart,
+		Follow:  true,
+	}
+	require.NoError(t, c.endpoints.FileSystem.logsImpl(ctx, req, cancelling, nil, frames))
+
+	// Only the listing picking the log file is made, and the logs are not
+	// listed again by the stream or while waiting for the next log file
+	require.Equal(t, 1, cancelling.listCount())
+	time.Sleep(2 * nextLogCheckRate)
+	require.Equal(t, 1, cancelling.listCount())
+}
+
+func TestFS_rotatedRetryWait(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, 50*time.Millisecond, rotatedRetryWait(50*time.Millisecond, 1))
+	require.Equal(t, 200*time.Millisecond, rotatedRetryWait(50*time.Millisecond, 3))
+	require.Equal(t, maxRotatedLogRetryBackoff, rotatedRetryWait(50*time.Millisecond, 30))
+}
+
+func TestFS_logsImpl_Progress(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Create a series of log files of differing sizes in the temp dir
+	task := "foo"
+	logType := "stdout"
+	contents := []string{"0", "11", "222"}
+	for i, content := range contents {
+		logFile := fmt.Sprintf("%s.%s.%d", task, logType, i)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, logFile), []byte(content), 0777))
+	}
+
+	cases := []struct {
+		Name     string
+		Origin   string
+		Offset   int64
+		MaxFiles int
+		Expected int64
+	}{
+		{
+			Name:     "all files",
+			Origin:   OriginStart,
+			Expected: 6,
 		},
 		{
-			Entries:      entries,
-			DesiredIdx:   0,
-			Task:         task,
-			LogType:      "stderr",
-			ExpectedFile: entries[4].Name,
-			ExpectedIdx:  0,
+			Name:     "offset from start",
+			Origin:   OriginStart,
+			Offset:   2,
+			Expected: 4,
 		},
 		{
-			Entries:      entries,
-			DesiredIdx:   0,
-			Task:         task,
-			LogType:      "stdout",
-			ExpectedFile: entries[0].Name,
-			ExpectedIdx:  0,
+			Name:     "offset from end",
+			Origin:   OriginEnd,
+			Offset:   4,
+			Expected: 4,
 		},
-
-		// Test middle cases
 		{
-			Entries:      entries,
-			DesiredIdx:   1,
-			Task:         task,
-			LogType:      "stdout",
-			ExpectedFile: entries[1].Name,
-			ExpectedIdx:  1,
+			Name:     "bounded files",
+			Origin:   OriginStart,
+			MaxFiles: 2,
+			Expected: 3,
 		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			frames := make(chan *sframer.StreamFrame, 32)
+			req := &cstructs.FsLogsRequest{
+				Task:            task,
+				LogType:         logType,
+				Origin:          tc.Origin,
+				Offset:          tc.Offset,
+				MaxFilesSpanned: tc.MaxFiles,
+				Progress:        true,
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			require.NoError(t, c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames))
+
+			// The first frame reports the total and the data adds up to it
+			var first *sframer.StreamFrame
+			var received int64
+			for frame := range frames {
+				if first == nil {
+					first = frame
+					continue
+				}
+				received += int64(len(frame.Data))
+			}
+
+			require.NotNil(t, first)
+			require.Equal(t, tc.Expected, first.TotalBytes)
+			require.Empty(t, first.Data)
+			require.Equal(t, tc.Expected, received)
+		})
+	}
+}
+
+func TestFS_logsImpl_MaxLogIndexes(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+	c.endpoints.FileSystem.maxLogIndexes = 2
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Create more log files than the indexes considered when following
+	task := "foo"
+	logType := "stdout"
+	contents := []string{"0", "11", "222"}
+	for i, content := range contents {
+		logFile := fmt.Sprintf("%s.%s.%d", task, logType, i)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, logFile), []byte(content), 0777))
+	}
+
+	// Logs that are not followed are streamed from the oldest log file, as
+	// described by their manifest
+	frames := make(chan *sframer.StreamFrame, 32)
+	req := &cstructs.FsLogsRequest{
+		Task:     task,
+		LogType:  logType,
+		Origin:   OriginStart,
+		Manifest: true,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames))
+
+	var manifest []*sframer.LogManifestEntry
+	received := ""
+	for frame := range frames {
+		if frame.Manifest != nil {
+			manifest = frame.Manifest
+		}
+		received += string(frame.Data)
+	}
+	require.Equal(t, "011222", received)
+	require.Len(t, manifest, 3)
+	require.Equal(t, int64(0), manifest[0].Index)
+}
+
+func TestFS_logsImpl_SinceDuration(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, nil)
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+
+	// Create a series of log files last written to an hour, 20 minutes and
+	// 5 minutes ago
+	task := "foo"
+	logType := "stdout"
+	contents := []string{"0", "11", "222"}
+	ages := []time.Duration{time.Hour, 20 * time.Minute, 5 * time.Minute}
+	now := time.Now()
+	for i, content := range contents {
+		logFile := filepath.Join(logDir, fmt.Sprintf("%s.%s.%d", task, logType, i))
+		require.NoError(t, ioutil.WriteFile(logFile, []byte(content), 0777))
+
+		modTime := now.Add(-ages[i])
+		require.NoError(t, os.Chtimes(logFile, modTime, modTime))
+	}
+
+	cases := []struct {
+		Name     string
+		Since    time.Duration
+		Expected string
+	}{
 		{
-			Entries:        entries,
-			DesiredIdx:     1,
-			DesiredOffset:  10,
-			Task:           task,
-			LogType:        "stdout",
-			ExpectedFile:   entries[1].Name,
-			ExpectedIdx:    1,
-			ExpectedOffset: 10,
+			Name:     "all files",
+			Since:    2 * time.Hour,
+			Expected: "011222",
 		},
 		{
-			Entries:        entries,
-			DesiredIdx:     1,
-			DesiredOffset:  110,
-			Task:           task,
-			LogType:        "stdout",
-			ExpectedFile:   entries[2].Name,
-			ExpectedIdx:    2,
-			ExpectedOffset: 10,
+			Name:     "recent files",
+			Since:    30 * time.Minute,
+			Expected: "11222",
 		},
 		{
-			Entries:      entries,
-			DesiredIdx:   1,
-			Task:         task,
-			LogType:      "stderr",
-			ExpectedFile: entries[5].Name,
-			ExpectedIdx:  1,
+			Name:     "latest file",
+			Since:    10 * time.Minute,
+			Expected: "222",
 		},
-		// Test end cases
 		{
-			Entries:      entries,
-			DesiredIdx:   math.MaxInt64,
-			Task:         task,
-			LogType:      "stdout",
-			ExpectedFile: entries[3].Name,
-			ExpectedIdx:  3,
+			Name:     "no recent files",
+			Since:    time.Minute,
+			Expected: "",
 		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			frames := make(chan *sframer.StreamFrame, 32)
+			req := &cstructs.FsLogsRequest{
+				Task:          task,
+				LogType:       logType,
+				Origin:        OriginStart,
+				SinceDuration: tc.Since,
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			require.NoError(t, c.endpoints.FileSystem.logsImpl(ctx, req, ad, nil, frames))
+
+			var received string
+			for frame := range frames {
+				received += string(frame.Data)
+			}
+			require.Equal(t, tc.Expected, received)
+		})
+	}
+}
+
+func TestFS_sinceLogPosition(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	now := time.Now()
+	entries := []*cstructs.AllocFileInfo{
 		{
-			Entries:        entries,
-			DesiredIdx:     math.MaxInt64,
-			DesiredOffset:  math.MaxInt64,
-			Task:           task,
-			LogType:        "stdout",
-			ExpectedFile:   entries[3].Name,
-			ExpectedIdx:    3,
-			ExpectedOffset: 100,
+			Name:    "foo.stdout.1",
+			Size:    100,
+			ModTime: now.Add(-10 * time.Minute),
 		},
 		{
-			Entries:        entries,
-			DesiredIdx:     math.MaxInt64,
-			DesiredOffset:  -10,
-			Task:           task,
-			LogType:        "stdout",
-			ExpectedFile:   entries[3].Name,
-			ExpectedIdx:    3,
-			ExpectedOffset: 90,
+			Name:    "foo.stdout.0",
+			Size:    100,
+			ModTime: now.Add(-time.Hour),
 		},
 		{
-			Entries:      entries,
-			DesiredIdx:   math.MaxInt64,
-			Task:         task,
-			LogType:      "stderr",
-			ExpectedFile: entries[6].Name,
-			ExpectedIdx:  2,
+			Name:    "foo.stdout.2",
+			Size:    50,
+			ModTime: now.Add(-time.Minute),
 		},
 	}
 
-	for i, c := range cases {
-		entry, idx, offset, err := findClosest(c.Entries, c.DesiredIdx, c.DesiredOffset, c.Task, c.LogType)
-		if err != nil {
-			if !c.Error {
-				t.Fatalf("case %d: Unexpected error: %v", i, err)
-			}
-			continue
-		}
+	idx, offset, err := sinceLogPosition(entries, "foo", "stdout", now.Add(-15*time.Minute))
+	require.NoError(err)
+	require.EqualValues(1, idx)
+	require.Zero(offset)
 
-		if entry.Name != c.ExpectedFile {
-			t.Fatalf("case %d: Got file %q; want %q", i, entry.Name, c.ExpectedFile)
-		}
-		if idx != c.ExpectedIdx {
-			t.Fatalf("case %d: Got index %d; want %d", i, idx, c.ExpectedIdx)
-		}
-		if offset != c.ExpectedOffset {
-			t.Fatalf("case %d: Got offset %d; want %d", i, offset, c.ExpectedOffset)
-		}
-	}
+	// Nothing written since the cutoff starts at the end of the last file
+	idx, offset, err = sinceLogPosition(entries, "foo", "stdout", now)
+	require.NoError(err)
+	require.EqualValues(2, idx)
+	require.EqualValues(50, offset)
+
+	_, _, err = sinceLogPosition(entries, "foo", "stderr", now)
+	require.Error(err)
 }
 
-func TestFS_streamFile_NoFile(t *testing.T) {
+func TestFS_resumeToken(t *testing.T) {
 	t.Parallel()
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
 
+	// Get a temp alloc dir
 	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
 	defer ad.Destroy()
 
-	frames := make(chan *sframer.StreamFrame, 32)
-	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
-	framer.Run()
-	defer framer.Destroy()
+	streamFile := "stream_file"
+	streamFilePath := filepath.Join(ad.AllocDir, streamFile)
+	initial := []byte("hello world\n")
+	require.NoError(t, ioutil.WriteFile(streamFilePath, initial, 0777))
+
+	// Track the delivery of the initial content across two frames and take a
+	// token at the end of it
+	tracker := newResumeTracker(0)
+	tracker.update(&sframer.StreamFrame{Data: initial[:5]})
+	tracker.update(&sframer.StreamFrame{Data: initial[5:]})
+	token, err := parseResumeToken(tracker.token().String())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(initial)), token.Offset)
 
-	err := c.endpoints.FileSystem.streamFile(
-		context.Background(), 0, "foo", 0, ad, framer, nil, false)
-	require.Error(t, err)
-	if runtime.GOOS == "windows" {
-		require.Contains(t, err.Error(), "cannot find the file")
-	} else {
-		require.Contains(t, err.Error(), "no such file")
+	// Appending to the file keeps the token valid
+	f, err := os.OpenFile(streamFilePath, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("more\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	info, err := ad.Stat(streamFile)
+	require.NoError(t, err)
+	ok, err := token.matches(ad, streamFile, info.Size)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Rotate the file between disconnect and reconnect, replacing it with a
+	// larger file with different content
+	require.NoError(t, os.Rename(streamFilePath, streamFilePath+".1"))
+	require.NoError(t, ioutil.WriteFile(streamFilePath, []byte("rotated content\n"), 0777))
+
+	info, err = ad.Stat(streamFile)
+	require.NoError(t, err)
+	ok, err = token.matches(ad, streamFile, info.Size)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Replacing the file with a smaller one also invalidates the token
+	require.NoError(t, ioutil.WriteFile(streamFilePath, []byte("tiny"), 0777))
+	info, err = ad.Stat(streamFile)
+	require.NoError(t, err)
+	ok, err = token.matches(ad, streamFile, info.Size)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Truncation resets the tracked position
+	tracker.update(&sframer.StreamFrame{FileEvent: truncateEvent, Data: []byte("abc")})
+	require.Equal(t, int64(3), tracker.token().Offset)
+	require.Equal(t, int64(3), tracker.token().Length)
+
+	// Malformed tokens are rejected
+	for _, bad := range []string{"", "1:2", "a:0:00", "1:2:zz", "0:5:" + strings.Repeat("00", 32)} {
+		_, err := parseResumeToken(bad)
+		require.Equal(t, invalidResumeToken, err, bad)
 	}
 }
 
-func TestFS_streamFile_Modify(t *testing.T) {
+func TestFS_prefixResumeToken(t *testing.T) {
 	t.Parallel()
 
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
-
-	// Get a temp alloc dir
 	ad := tempAllocDir(t)
 	require.NoError(t, ad.Build())
 	defer ad.Destroy()
 
-	// Create a file in the temp dir
 	streamFile := "stream_file"
-	f, err := os.Create(filepath.Join(ad.AllocDir, streamFile))
-	if err != nil {
-		t.Fatalf("Failed to create file: %v", err)
+	content := []byte("hello world\nmore\n")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ad.AllocDir, streamFile), content, 0777))
+	info, err := ad.Stat(streamFile)
+	require.NoError(t, err)
+
+	held := content[:12]
+	sum := sha256.Sum256(held)
+
+	// The start of the file matches the content held by the client
+	token, err := prefixResumeToken(int64(len(held)), hex.EncodeToString(sum[:]))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(held)), token.Offset)
+	ok, err := token.matches(ad, streamFile, info.Size)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The start of the file diverged from the content held by the client
+	other := sha256.Sum256([]byte("hello there\n"))
+	token, err = prefixResumeToken(int64(len(held)), hex.EncodeToString(other[:]))
+	require.NoError(t, err)
+	ok, err = token.matches(ad, streamFile, info.Size)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// The client holds more than the file
+	long := sha256.Sum256(append(content, 'x'))
+	token, err = prefixResumeToken(int64(len(content)+1), hex.EncodeToString(long[:]))
+	require.NoError(t, err)
+	ok, err = token.matches(ad, streamFile, info.Size)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Malformed checksums are rejected
+	for _, bad := range []string{"", "zz", "00", hex.EncodeToString(sum[:]) + "00"} {
+		_, err := prefixResumeToken(1, bad)
+		require.Equal(t, invalidResumeSHA256, err, bad)
 	}
-	defer f.Close()
+	_, err = prefixResumeToken(-1, hex.EncodeToString(sum[:]))
+	require.Equal(t, invalidResumeSHA256, err)
+}
+
+func TestFS_Stream_ResumeSHA256(t *testing.T) {
+	t.Parallel()
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expected := "Hello from the other side"
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": expected,
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// stream resumes the log after the held content, returning the data and
+	// file events streamed
+	stream := func(held string) (string, []string) {
+		sum := sha256.Sum256([]byte(held))
+		req := &cstructs.FsStreamRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/logs/web.stdout.0",
+			ResumeLength: int64(len(held)),
+			ResumeSHA256: hex.EncodeToString(sum[:]),
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+
+		handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+		require.NoError(t, err)
+
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+
+		go handler(p2)
+		require.NoError(t, codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+
+		var data string
+		var events []string
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				require.Equal(t, io.EOF, err)
+				return data, events
+			}
+			require.Nil(t, msg.Error)
+
+			var frame sframer.StreamFrame
+			require.NoError(t, codec.NewDecoderBytes(msg.Payload, structs.JsonHandle).Decode(&frame))
+			data += string(frame.Data)
+			if frame.FileEvent != "" {
+				events = append(events, frame.FileEvent)
+			}
+		}
+	}
+
+	// Wait for the task to have written its output
+	testutil.WaitForResult(func() (bool, error) {
+		data, _ := stream("")
+		return data == expected, fmt.Errorf("got %q", data)
+	}, func(err error) {
+		t.Fatal(err)
+	})
+
+	// Only the remainder is streamed when the held content matches
+	data, events := stream("Hello ")
+	require.Equal(t, "from the other side", data)
+	require.Empty(t, events)
+
+	// The stream restarts with a marker when the held content diverged
+	data, events = stream("Howdy ")
+	require.Equal(t, expected, data)
+	require.Equal(t, []string{resumeRestartEvent}, events)
+}
+
+func TestFS_Stream_Sequenced(t *testing.T) {
+	t.Parallel()
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Write a file spanning multiple frames
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(t, err)
+	expected := strings.Repeat("x", 3*streamFrameSize)
+	path := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir, "large")
+	require.NoError(t, ioutil.WriteFile(path, []byte(expected), 0666))
+
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/data/large",
+		Sequenced:    true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.NoError(t, err)
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	go handler(p2)
+	require.NoError(t, codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+
+	// Every frame other than heartbeats is numbered in order
+	var data string
+	var seqs []int64
+	decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+	for {
+		var msg cstructs.StreamErrWrapper
+		if err := decoder.Decode(&msg); err != nil {
+			require.Equal(t, io.EOF, err)
+			break
+		}
+		require.Nil(t, msg.Error)
+
+		var frame sframer.StreamFrame
+		require.NoError(t, codec.NewDecoderBytes(msg.Payload, structs.JsonHandle).Decode(&frame))
+		if frame.IsHeartbeat() {
+			continue
+		}
+		data += string(frame.Data)
+		seqs = append(seqs, frame.Seq)
+	}
+
+	require.Equal(t, expected, data)
+	require.GreaterOrEqual(t, len(seqs), 3)
+	for i, seq := range seqs {
+		require.Equal(t, int64(i+1), seq)
+	}
+}
+
+func TestFS_Stream_UseCache(t *testing.T) {
+	t.Parallel()
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+		c.FSStreamCacheBytes = 1024
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(t, err)
+	artifact := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir, "artifact")
+	require.NoError(t, ioutil.WriteFile(artifact, []byte("hello"), 0666))
+
+	// stream returns the data of the file streamed using the cache
+	stream := func() string {
+		req := &cstructs.FsStreamRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/data/artifact",
+			PlainText:    true,
+			UseCache:     true,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+
+		handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+		require.NoError(t, err)
+
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+
+		go handler(p2)
+		require.NoError(t, codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+
+		var data string
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				require.Equal(t, io.EOF, err)
+				return data
+			}
+			require.Nil(t, msg.Error)
+			data += string(msg.Payload)
+		}
+	}
+
+	// The first stream caches a copy of the file
+	require.Equal(t, "hello", stream())
+	cache := c.endpoints.FileSystem.streamCache
+	require.Equal(t, 1, cache.entries.Len())
+	_, v, ok := cache.entries.GetOldest()
+	require.True(t, ok)
+
+	// The second stream is served from the copy, which is altered to tell
+	// it apart from the file
+	require.NoError(t, ioutil.WriteFile(v.(*cachedFile).path, []byte("HELLO"), 0600))
+	require.Equal(t, "HELLO", stream())
+
+	// Changing the file invalidates the copy
+	require.NoError(t, ioutil.WriteFile(artifact, []byte("hello world"), 0666))
+	require.Equal(t, "hello world", stream())
+	require.Equal(t, 2, cache.entries.Len())
+	require.Equal(t, int64(len("HELLO")+len("hello world")), cache.bytes)
+}
+
+func TestFS_Stream_CurrentOrigin(t *testing.T) {
+	t.Parallel()
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expected := "Hello from the other side"
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": expected,
+	}
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// stream streams the log with the current origin, returning the data
+	// streamed or the error
+	stream := func(offset int64, resumeLength int64) (string, error) {
+		req := &cstructs.FsStreamRequest{
+			AllocID:      alloc.ID,
+			Path:         "alloc/logs/web.stdout.0",
+			Origin:       OriginCurrent,
+			Offset:       offset,
+			PlainText:    true,
+			ResumeLength: resumeLength,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+
+		handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+		require.NoError(t, err)
 
-	data := []byte("helloworld")
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
 
-	// Start the reader
-	resultCh := make(chan struct{})
-	frames := make(chan *sframer.StreamFrame, 4)
-	go func() {
-		var collected []byte
+		go handler(p2)
+		require.NoError(t, codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+
+		var data string
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
 		for {
-			frame := <-frames
-			if frame.IsHeartbeat() {
-				continue
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				require.Equal(t, io.EOF, err)
+				return data, nil
 			}
-
-			collected = append(collected, frame.Data...)
-			if reflect.DeepEqual(data, collected) {
-				resultCh <- struct{}{}
-				return
+			if msg.Error != nil {
+				return data, msg.Error
 			}
+			data += string(msg.Payload)
 		}
-	}()
-
-	// Write a few bytes
-	if _, err := f.Write(data[:3]); err != nil {
-		t.Fatalf("write failed: %v", err)
 	}
 
-	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
-	framer.Run()
-	defer framer.Destroy()
+	// Wait for the task to have written its output
+	testutil.WaitForResult(func() (bool, error) {
+		data, err := stream(int64(len(expected)), 0)
+		return data == expected, fmt.Errorf("got %q: %v", data, err)
+	}, func(err error) {
+		t.Fatal(err)
+	})
 
-	// Start streaming
-	go func() {
-		if err := c.endpoints.FileSystem.streamFile(
-			context.Background(), 0, streamFile, 0, ad, framer, nil, false); err != nil {
-			t.Fatalf("stream() failed: %v", err)
-		}
-	}()
+	// The offset is applied backwards from the end of the file
+	data, err := stream(4, 0)
+	require.NoError(t, err)
+	require.Equal(t, "side", data)
 
-	// Sleep a little before writing more. This lets us check if the watch
-	// is working.
-	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
-	if _, err := f.Write(data[3:]); err != nil {
-		t.Fatalf("write failed: %v", err)
+	// The current origin cannot be resumed
+	_, err = stream(0, 5)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), invalidCurrentOrigin.Error())
+}
+
+// growingAllocDir simulates a file that is appended to every time it is
+// statted.
+type growingAllocDir struct {
+	*allocdir.AllocDir
+	path string
+}
+
+func (g *growingAllocDir) Stat(path string) (*cstructs.AllocFileInfo, error) {
+	info, err := g.AllocDir.Stat(path)
+	if err != nil {
+		return nil, err
 	}
 
-	select {
-	case <-resultCh:
-	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
-		t.Fatalf("failed to send new data")
+	f, err := os.OpenFile(filepath.Join(g.AllocDir.AllocDir, g.path), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
+	_, err = f.WriteString("more")
+	return info, err
 }
 
-func TestFS_streamFile_Truncate(t *testing.T) {
+func TestFS_currentOffset(t *testing.T) {
 	t.Parallel()
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
 
-	// Get a temp alloc dir
 	ad := tempAllocDir(t)
 	require.NoError(t, ad.Build())
 	defer ad.Destroy()
 
-	// Create a file in the temp dir
-	data := []byte("helloworld")
-	streamFile := "stream_file"
-	streamFilePath := filepath.Join(ad.AllocDir, streamFile)
-	f, err := os.Create(streamFilePath)
+	path := filepath.Join(allocdir.SharedAllocName, "foo")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ad.AllocDir, path), []byte("foo"), 0777))
+	fs := &growingAllocDir{AllocDir: ad, path: path}
+
+	// The size written by an earlier stat is used
+	_, err := fs.Stat(path)
 	require.NoError(t, err)
-	defer f.Close()
+	offset, err := currentOffset(fs, path, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(len("foomore")-2), offset)
 
-	// Start the reader
-	truncateCh := make(chan struct{})
-	truncateClosed := false
-	dataPostTruncCh := make(chan struct{})
-	frames := make(chan *sframer.StreamFrame, 4)
-	go func() {
-		var collected []byte
-		for {
-			frame := <-frames
-			if frame.IsHeartbeat() {
-				continue
-			}
+	// Offsets past the start of the file are clamped
+	offset, err = currentOffset(fs, path, 100)
+	require.NoError(t, err)
+	require.Zero(t, offset)
 
-			if frame.FileEvent == truncateEvent && !truncateClosed {
-				close(truncateCh)
-				truncateClosed = true
-			}
+	_, err = currentOffset(fs, "alloc/missing", 0)
+	require.Error(t, err)
+}
 
-			collected = append(collected, frame.Data...)
-			if reflect.DeepEqual(data, collected) {
-				close(dataPostTruncCh)
-				return
-			}
-		}
-	}()
+func TestFS_parseFramerErr(t *testing.T) {
+	t.Parallel()
 
-	// Write a few bytes
-	if _, err := f.Write(data[:3]); err != nil {
-		t.Fatalf("write failed: %v", err)
-	}
+	unrelated := errors.New("failed to read file: broken pipe in name")
 
-	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
-	framer.Run()
-	defer framer.Destroy()
+	cases := []struct {
+		name   string
+		err    error
+		closed bool
+	}{
+		{
+			name:   "epipe",
+			err:    syscall.EPIPE,
+			closed: true,
+		},
+		{
+			name:   "wrapped epipe",
+			err:    &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)},
+			closed: true,
+		},
+		{
+			name:   "wrapped econnreset",
+			err:    fmt.Errorf("sending frame: %w", os.NewSyscallError("read", syscall.ECONNRESET)),
+			closed: true,
+		},
+		{
+			name:   "closed pipe",
+			err:    fmt.Errorf("sending frame: %w", io.ErrClosedPipe),
+			closed: true,
+		},
+		{
+			name:   "windows connection reset",
+			err:    errors.New("An existing connection was forcibly closed by the remote host."),
+			closed: true,
+		},
+		{
+			name: "other errno",
+			err:  fmt.Errorf("reading: %w", os.NewSyscallError("read", syscall.EIO)),
+		},
+		{
+			name: "unrelated error text",
+			err:  unrelated,
+		},
+	}
 
-	// Start streaming
-	go func() {
-		if err := c.endpoints.FileSystem.streamFile(
-			context.Background(), 0, streamFile, 0, ad, framer, nil, false); err != nil {
-			t.Fatalf("stream() failed: %v", err)
-		}
-	}()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := parseFramerErr(c.err)
+			require.Equal(t, c.closed, errors.Is(err, syscall.EPIPE))
 
-	// Sleep a little before truncating. This lets us check if the watch
-	// is working.
-	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
-	if err := f.Truncate(0); err != nil {
-		t.Fatalf("truncate failed: %v", err)
-	}
-	if err := f.Sync(); err != nil {
-		t.Fatalf("sync failed: %v", err)
-	}
-	if err := f.Close(); err != nil {
-		t.Fatalf("failed to close file: %v", err)
+			// The original error is preserved
+			require.True(t, errors.Is(err, c.err))
+			require.Equal(t, c.err.Error(), err.Error())
+		})
 	}
 
-	f2, err := os.OpenFile(streamFilePath, os.O_RDWR, 0)
-	if err != nil {
-		t.Fatalf("failed to reopen file: %v", err)
+	require.NoError(t, parseFramerErr(nil))
+}
+
+func TestFS_Stream_WaitForStart(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	expected := "Hello from the other side"
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "2s",
+		"stdout_string": expected,
 	}
-	defer f2.Close()
-	if _, err := f2.Write(data[3:5]); err != nil {
-		t.Fatalf("write failed: %v", err)
+
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Fail getting the allocation directory the first few times as if the
+	// allocation was still starting
+	var l sync.Mutex
+	var calls int
+	f := c.endpoints.FileSystem
+	f.allocFSRetryBackoff = 10 * time.Millisecond
+	f.allocFS = func(allocID string) (allocdir.AllocDirFS, error) {
+		l.Lock()
+		defer l.Unlock()
+		calls++
+		if allocID == alloc.ID && calls%4 != 0 {
+			return nil, fmt.Errorf("allocation directory not available")
+		}
+		return c.GetAllocFS(allocID)
 	}
 
-	select {
-	case <-truncateCh:
-	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
-		t.Fatalf("did not receive truncate")
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.NoError(err)
+
+	// stream returns the payload streamed for the request or the error
+	stream := func(req *cstructs.FsStreamRequest) (string, error) {
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+		go handler(p2)
+
+		encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+		require.NoError(encoder.Encode(req))
+
+		p1.SetReadDeadline(time.Now().Add(3 * time.Second))
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		received := ""
+		for received != expected {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				return received, err
+			}
+			if msg.Error != nil {
+				return received, msg.Error
+			}
+			received += string(msg.Payload)
+		}
+		return received, nil
 	}
 
-	// Sleep a little before writing more. This lets us check if the watch
-	// is working.
-	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
-	if _, err := f2.Write(data[5:]); err != nil {
-		t.Fatalf("write failed: %v", err)
+	// Without waiting the stream fails immediately
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/logs/web.stdout.0",
+		PlainText:    true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+	_, err = stream(req)
+	require.Error(err)
+	require.Contains(err.Error(), "not available")
+	require.Equal(1, calls)
+
+	// Waiting for the allocation to start retries until the directory is
+	// available
+	req.WaitForStart = true
+	received, err := stream(req)
+	require.NoError(err)
+	require.Equal(expected, received)
+	require.Equal(4, calls)
+
+	// Unknown allocations are not retried
+	f.allocFS = func(allocID string) (allocdir.AllocDirFS, error) {
+		l.Lock()
+		defer l.Unlock()
+		calls++
+		return nil, structs.NewErrUnknownAllocation(allocID)
+	}
+	_, err = stream(req)
+	require.Error(err)
+	require.True(structs.IsErrUnknownAllocation(err), err.Error())
+	require.Equal(5, calls)
+
+	// Closing the stream stops waiting for the directory
+	f.allocFSRetryBackoff = time.Minute
+	f.allocFS = func(allocID string) (allocdir.AllocDirFS, error) {
+		return nil, fmt.Errorf("allocation directory not available")
 	}
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	done := make(chan struct{})
+	go func() {
+		handler(p2)
+		close(done)
+	}()
+	require.NoError(codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+	require.NoError(p1.Close())
 
 	select {
-	case <-dataPostTruncCh:
-	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
-		t.Fatalf("did not receive post truncate data")
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not stop waiting once closed")
 	}
 }
 
-func TestFS_streamImpl_Delete(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("Windows does not allow us to delete a file while it is open")
-	}
+func TestFS_Stream_Checksum(t *testing.T) {
 	t.Parallel()
 
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
 
-	// Get a temp alloc dir
-	ad := tempAllocDir(t)
-	require.NoError(t, ad.Build())
-	defer ad.Destroy()
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
 
-	// Create a file in the temp dir
-	data := []byte("helloworld")
-	streamFile := "stream_file"
-	streamFilePath := filepath.Join(ad.AllocDir, streamFile)
-	f, err := os.Create(streamFilePath)
-	if err != nil {
-		t.Fatalf("Failed to create file: %v", err)
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for": "10s",
 	}
-	defer f.Close()
 
-	// Start the reader
-	deleteCh := make(chan struct{})
-	frames := make(chan *sframer.StreamFrame, 4)
-	go func() {
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+
+	// Write a file spanning multiple frames
+	fs, err := c.GetAllocFS(alloc.ID)
+	require.NoError(t, err)
+	expected := strings.Repeat("0123456789", streamFrameSize/4)
+	path := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir, "large")
+	require.NoError(t, ioutil.WriteFile(path, []byte(expected), 0666))
+
+	handler, err := c.StreamingRpcHandler("FileSystem.Stream")
+	require.NoError(t, err)
+
+	// stream returns the data streamed and the final frame of the stream
+	stream := func(req *cstructs.FsStreamRequest) (string, *sframer.StreamFrame, error) {
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+
+		go handler(p2)
+		require.NoError(t, codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+
+		var data string
+		var last *sframer.StreamFrame
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
 		for {
-			frame, ok := <-frames
-			if !ok {
-				return
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				require.Equal(t, io.EOF, err)
+				return data, last, nil
+			}
+			if msg.Error != nil {
+				return data, last, msg.Error
 			}
 
+			var frame sframer.StreamFrame
+			require.NoError(t, codec.NewDecoderBytes(msg.Payload, structs.JsonHandle).Decode(&frame))
 			if frame.IsHeartbeat() {
 				continue
 			}
-
-			if frame.FileEvent == deleteEvent {
-				close(deleteCh)
-				return
-			}
+			data += string(frame.Data)
+			last = &frame
 		}
-	}()
-
-	// Write a few bytes
-	if _, err := f.Write(data[:3]); err != nil {
-		t.Fatalf("write failed: %v", err)
 	}
 
-	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
-	framer.Run()
-	defer framer.Destroy()
-
-	// Start streaming
-	go func() {
-		if err := c.endpoints.FileSystem.streamFile(
-			context.Background(), 0, streamFile, 0, ad, framer, nil, false); err != nil {
-			t.Fatalf("stream() failed: %v", err)
-		}
-	}()
-
-	// Sleep a little before deleting. This lets us check if the watch
-	// is working.
-	time.Sleep(1 * time.Duration(testutil.TestMultiplier()) * time.Second)
-	if err := os.Remove(streamFilePath); err != nil {
-		t.Fatalf("delete failed: %v", err)
+	// The final frame carries the checksum of the data streamed
+	req := &cstructs.FsStreamRequest{
+		AllocID:      alloc.ID,
+		Path:         "alloc/data/large",
+		Checksum:     "sha256",
+		Sequenced:    true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
 	}
-
-	select {
-	case <-deleteCh:
-	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
-		t.Fatalf("did not receive delete")
+	data, last, err := stream(req)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+	require.Equal(t, streamCompletedEvent, last.FileEvent)
+	require.Empty(t, last.Data)
+	require.NotZero(t, last.Seq)
+	sha := sha256.Sum256([]byte(expected))
+	require.Equal(t, hex.EncodeToString(sha[:]), last.Checksum)
+
+	// Only the data streamed is checksummed
+	req.Checksum = "md5"
+	req.Offset = 10
+	req.Limit = 100
+	data, last, err = stream(req)
+	require.NoError(t, err)
+	require.Equal(t, expected[10:110], data)
+	md := md5.Sum([]byte(expected[10:110]))
+	require.Equal(t, hex.EncodeToString(md[:]), last.Checksum)
+
+	// Transcoded data is checksummed as streamed
+	latin1 := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir, "latin1")
+	require.NoError(t, ioutil.WriteFile(latin1, []byte("d\xe9j\xe0 vu\n"), 0666))
+	encReq := &cstructs.FsStreamRequest{
+		AllocID:        alloc.ID,
+		Path:           "alloc/data/latin1",
+		Checksum:       "sha256",
+		SourceEncoding: "ISO-8859-1",
+		QueryOptions:   structs.QueryOptions{Region: "global"},
 	}
+	data, last, err = stream(encReq)
+	require.NoError(t, err)
+	require.Equal(t, "déjà vu\n", data)
+	sha = sha256.Sum256([]byte(data))
+	require.Equal(t, hex.EncodeToString(sha[:]), last.Checksum)
+
+	// A trailing partial character is flushed and checksummed
+	sjis := filepath.Join(fs.(*allocdir.AllocDir).SharedDir, allocdir.SharedDataDir, "sjis")
+	require.NoError(t, ioutil.WriteFile(sjis, []byte("\x93\xfa\x96"), 0666))
+	encReq.Path = "alloc/data/sjis"
+	encReq.SourceEncoding = "Shift_JIS"
+	data, last, err = stream(encReq)
+	require.NoError(t, err)
+	require.Equal(t, "\u65e5\ufffd", data)
+	sha = sha256.Sum256([]byte(data))
+	require.Equal(t, hex.EncodeToString(sha[:]), last.Checksum)
+
+	// Without a checksum no final frame is sent
+	req.Checksum = ""
+	_, last, err = stream(req)
+	require.NoError(t, err)
+	require.Empty(t, last.Checksum)
+	require.NotEqual(t, streamCompletedEvent, last.FileEvent)
+
+	// Invalid requests
+	req.Checksum = "crc32"
+	_, _, err = stream(req)
+	require.EqualError(t, err, invalidStreamSum.Error())
+	req.Checksum = "sha256"
+	req.Follow = true
+	_, _, err = stream(req)
+	require.EqualError(t, err, invalidStreamSum.Error())
 }
 
-func TestFS_logsImpl_NoFollow(t *testing.T) {
+func TestFS_StreamLogs_Encoding(t *testing.T) {
 	t.Parallel()
 
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
 
-	// Get a temp alloc dir and create the log dir
-	ad := tempAllocDir(t)
-	require.NoError(t, ad.Build())
-	defer ad.Destroy()
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
 
-	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
-	if err := os.MkdirAll(logDir, 0777); err != nil {
-		t.Fatalf("Failed to make log dir: %v", err)
+	expected := "binary \x00\x1b data\n"
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "10s",
+		"stdout_string": expected,
 	}
 
-	// Create a series of log files in the temp dir
-	task := "foo"
-	logType := "stdout"
-	expected := []byte("012")
-	for i := 0; i < 3; i++ {
-		logFile := fmt.Sprintf("%s.%s.%d", task, logType, i)
-		logFilePath := filepath.Join(logDir, logFile)
-		err := ioutil.WriteFile(logFilePath, expected[i:i+1], 0777)
+	// Wait for the logs to be written
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
+	logFile := "alloc/logs/web.stdout.0"
+	testutil.WaitForResult(func() (bool, error) {
+		var resp cstructs.FsStatResponse
+		err := c.ClientRPC("FileSystem.Stat", &cstructs.FsStatRequest{
+			AllocID:      alloc.ID,
+			Path:         logFile,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}, &resp)
 		if err != nil {
-			t.Fatalf("Failed to create file: %v", err)
+			return false, err
 		}
-	}
+		return resp.Info.Size == int64(len(expected)), fmt.Errorf("log file size %d", resp.Info.Size)
+	}, func(err error) {
+		t.Fatal(err)
+	})
 
-	// Start the reader
-	resultCh := make(chan struct{})
-	frames := make(chan *sframer.StreamFrame, 4)
-	var received []byte
-	go func() {
+	// frames returns the frames streamed by the handler for the request,
+	// decoding them with the handle
+	frames := func(method string, req interface{}, handle codec.Handle) ([]*sframer.StreamFrame, error) {
+		handler, err := c.StreamingRpcHandler(method)
+		require.NoError(t, err)
+
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+
+		go handler(p2)
+		require.NoError(t, codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
+
+		var frames []*sframer.StreamFrame
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
 		for {
-			frame, ok := <-frames
-			if !ok {
-				return
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				require.Equal(t, io.EOF, err)
+				return frames, nil
 			}
-
-			if frame.IsHeartbeat() {
-				continue
+			if msg.Error != nil {
+				return nil, msg.Error
 			}
 
-			received = append(received, frame.Data...)
-			if reflect.DeepEqual(received, expected) {
-				close(resultCh)
-				return
+			var frame sframer.StreamFrame
+			require.NoError(t, codec.NewDecoderBytes(msg.Payload, handle).Decode(&frame))
+			if !frame.IsHeartbeat() {
+				frames = append(frames, &frame)
 			}
 		}
-	}()
+	}
 
-	// Start streaming logs
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+	streamReq := func(encoding string) *cstructs.FsStreamRequest {
+		return &cstructs.FsStreamRequest{
+			AllocID:      alloc.ID,
+			Path:         logFile,
+			Encoding:     encoding,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+	}
+	logsReq := func(encoding string) *cstructs.FsLogsRequest {
+		return &cstructs.FsLogsRequest{
+			AllocID:      alloc.ID,
+			Task:         job.TaskGroups[0].Tasks[0].Name,
+			LogType:      "stdout",
+			Origin:       "start",
+			Encoding:     encoding,
+			QueryOptions: structs.QueryOptions{Region: "global"},
+		}
+	}
 
-	if err := c.endpoints.FileSystem.logsImpl(
-		ctx, false, false, 0,
-		OriginStart, task, logType, ad, frames); err != nil {
-		t.Fatalf("logsImpl failed: %v", err)
+	for _, method := range []string{"FileSystem.Stream", "FileSystem.Logs"} {
+		t.Run(method, func(t *testing.T) {
+			newReq := func(encoding string) interface{} {
+				if method == "FileSystem.Stream" {
+					return streamReq(encoding)
+				}
+				return logsReq(encoding)
+			}
+
+			jsonFrames, err := frames(method, newReq(""), structs.JsonHandle)
+			require.NoError(t, err)
+			msgpackFrames, err := frames(method, newReq("msgpack"), structs.MsgpackHandle)
+			require.NoError(t, err)
+
+			// The frames are the same under both encodings
+			require.NotEmpty(t, jsonFrames)
+			require.Equal(t, jsonFrames, msgpackFrames)
+
+			var data string
+			for _, frame := range msgpackFrames {
+				data += string(frame.Data)
+			}
+			require.Equal(t, expected, data)
+
+			// Unknown encodings are rejected
+			_, err = frames(method, newReq("xml"), structs.JsonHandle)
+			require.EqualError(t, err, invalidEncoding.Error())
+		})
 	}
+}
 
-	select {
-	case <-resultCh:
-	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
-		t.Fatalf("did not receive data: got %q", string(received))
+// fakeJournal is a TaskLogsDriver keeping the logs of tasks in memory, as a
+// driver writing them to a journal would.
+type fakeJournal struct {
+	l    sync.Mutex
+	logs map[string][]byte
+}
+
+func (j *fakeJournal) write(task, logType, data string) {
+	j.l.Lock()
+	defer j.l.Unlock()
+	j.logs[task+"."+logType] = append(j.logs[task+"."+logType], data...)
+}
+
+func (j *fakeJournal) TaskLogs(allocID, taskName, logType string, offset int64) (io.ReadCloser, error) {
+	return ioutil.NopCloser(&fakeJournalReader{j: j, key: taskName + "." + logType, offset: offset}), nil
+}
+
+func (j *fakeJournal) TaskLogsSize(allocID, taskName, logType string) (int64, error) {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return int64(len(j.logs[taskName+"."+logType])), nil
+}
+
+type fakeJournalReader struct {
+	j      *fakeJournal
+	key    string
+	offset int64
+}
+
+func (r *fakeJournalReader) Read(p []byte) (int, error) {
+	r.j.l.Lock()
+	defer r.j.l.Unlock()
+	data := r.j.logs[r.key]
+	if r.offset >= int64(len(data)) {
+		return 0, io.EOF
 	}
+	n := copy(p, data[r.offset:])
+	r.offset += int64(n)
+	return n, nil
 }
 
-func TestFS_logsImpl_Follow(t *testing.T) {
+func TestFS_validateLogsRequest(t *testing.T) {
 	t.Parallel()
 
-	c, cleanup := TestClient(t, nil)
-	defer cleanup()
+	// An unset origin defaults to the start of the logs
+	req := &cstructs.FsLogsRequest{Task: "web", LogType: "stdout"}
+	require.NoError(t, validateLogsRequest(req))
+	require.Equal(t, "start", req.Origin)
 
-	// Get a temp alloc dir and create the log dir
-	ad := tempAllocDir(t)
-	require.NoError(t, ad.Build())
-	defer ad.Destroy()
+	// Conflicting options are rejected
+	req.Snapshot = true
+	req.Follow = true
+	require.Equal(t, invalidSnapshot, validateLogsRequest(req))
 
-	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
-	if err := os.MkdirAll(logDir, 0777); err != nil {
-		t.Fatalf("Failed to make log dir: %v", err)
-	}
+	req = &cstructs.FsLogsRequest{Task: "web", LogType: "stdout", IncludeExitInfo: true, PlainText: true}
+	require.Equal(t, invalidExitInfo, validateLogsRequest(req))
+}
 
-	// Create a series of log files in the temp dir
-	task := "foo"
-	logType := "stdout"
-	expected := []byte("012345")
-	initialWrites := 3
+func TestFS_validateTaskLogsRequest(t *testing.T) {
+	t.Parallel()
 
-	filePath := func(index int) string {
-		logFile := fmt.Sprintf("%s.%s.%d", task, logType, index)
-		return filepath.Join(logDir, logFile)
-	}
-	writeToFile := func(index int, data []byte) {
-		logFilePath := filePath(index)
-		err := ioutil.WriteFile(logFilePath, data, 0777)
-		if err != nil {
-			t.Fatalf("Failed to create file: %v", err)
-		}
+	req := &cstructs.FsLogsRequest{Follow: true, Origin: "end"}
+	require.NoError(t, validateTaskLogsRequest(req))
+
+	// Every unsupported option set is named
+	req.TailLines = 10
+	req.StopOnTaskExit = true
+	err := validateTaskLogsRequest(req)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tail lines, stop on task exit not supported")
+}
+
+func TestFS_Logs_TaskLogsDriver(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := nomad.TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.GetConfig().RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	job := mock.BatchJob()
+	job.TaskGroups[0].Count = 1
+	job.TaskGroups[0].Tasks[0].Config = map[string]interface{}{
+		"run_for":       "20s",
+		"stdout_string": "from the log file\n",
 	}
-	appendToFile := func(index int, data []byte) {
-		logFilePath := filePath(index)
-		f, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			t.Fatalf("Failed to create file: %v", err)
-		}
+	task := job.TaskGroups[0].Tasks[0].Name
 
-		defer f.Close()
+	// Wait for alloc to be running
+	alloc := testutil.WaitForRunning(t, s.RPC, job)[0]
 
-		if _, err = f.Write(data); err != nil {
-			t.Fatalf("Failed to write file: %v", err)
+	// Keep the logs of the task in a journal rather than in the log files
+	journal := &fakeJournal{logs: make(map[string][]byte)}
+	journal.write(task, "stdout", "first line\nsecond line\n")
+	c.endpoints.FileSystem.taskLogs = func(allocID, taskName string) (drivers.TaskLogsDriver, error) {
+		if allocID == alloc.ID && taskName == task {
+			return journal, nil
 		}
-	}
-	for i := 0; i < initialWrites; i++ {
-		writeToFile(i, expected[i:i+1])
+		return nil, nil
 	}
 
-	// Start the reader
-	firstResultCh := make(chan struct{})
-	fullResultCh := make(chan struct{})
-	frames := make(chan *sframer.StreamFrame, 4)
-	var received []byte
-	go func() {
-		for {
-			frame, ok := <-frames
-			if !ok {
-				return
-			}
+	handler, err := c.StreamingRpcHandler("FileSystem.Logs")
+	require.NoError(err)
 
-			if frame.IsHeartbeat() {
-				continue
-			}
+	// stream sends the request and returns the payloads received until the
+	// stream ends or, if until is set, until they match it. write is called
+	// once the first payload is received.
+	stream := func(req *cstructs.FsLogsRequest, until string, write func()) (string, error) {
+		p1, p2 := net.Pipe()
+		defer p1.Close()
+		defer p2.Close()
+		go handler(p2)
 
-			received = append(received, frame.Data...)
-			if reflect.DeepEqual(received, expected[:initialWrites]) {
-				close(firstResultCh)
-			} else if reflect.DeepEqual(received, expected) {
-				close(fullResultCh)
-				return
+		encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+		require.NoError(encoder.Encode(req))
+
+		p1.SetReadDeadline(time.Now().Add(10 * time.Second))
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		received := ""
+		for until == "" || received != until {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF {
+					return received, nil
+				}
+				return received, err
+			}
+			if msg.Error != nil {
+				return received, msg.Error
+			}
+			received += string(msg.Payload)
+			if write != nil && received != "" {
+				write()
+				write = nil
 			}
 		}
-	}()
-
-	// Start streaming logs
-	go c.endpoints.FileSystem.logsImpl(
-		context.Background(), true, false, 0,
-		OriginStart, task, logType, ad, frames)
+		return received, nil
+	}
 
-	select {
-	case <-firstResultCh:
-	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
-		t.Fatalf("did not receive data: got %q", string(received))
+	req := &cstructs.FsLogsRequest{
+		AllocID:      alloc.ID,
+		Task:         task,
+		LogType:      "stdout",
+		Origin:       "start",
+		PlainText:    true,
+		QueryOptions: structs.QueryOptions{Region: "global"},
 	}
 
-	// We got the first chunk of data, write out the rest splitted
-	// between the last file and to the next file
-	// at an index much ahead to check that it is following and detecting
-	// skips
-	skipTo := initialWrites + 10
-	appendToFile(initialWrites-1, expected[initialWrites:initialWrites+1])
-	writeToFile(skipTo, expected[initialWrites+1:])
+	// The logs are streamed from the journal until their end
+	received, err := stream(req, "", nil)
+	require.NoError(err)
+	require.Equal("first line\nsecond line\n", received)
 
-	select {
-	case <-fullResultCh:
-	case <-time.After(10 * time.Duration(testutil.TestMultiplier()) * streamBatchWindow):
-		t.Fatalf("did not receive data: got %q", string(received))
+	// Offsets from the end are relative to the end of the journal
+	req.Origin = "end"
+	req.Offset = 12
+	received, err = stream(req, "", nil)
+	require.NoError(err)
+	require.Equal("second line\n", received)
+
+	// Following streams the logs written to the journal later
+	req.Follow = true
+	received, err = stream(req, "second line\nthird line\n", func() {
+		journal.write(task, "stdout", "third line\n")
+	})
+	require.NoError(err)
+	require.Equal("second line\nthird line\n", received)
+
+	// Options depending on the log files are rejected
+	req = &cstructs.FsLogsRequest{
+		AllocID:       alloc.ID,
+		Task:          task,
+		LogType:       "stdout",
+		Origin:        "start",
+		SinceDuration: time.Minute,
+		QueryOptions:  structs.QueryOptions{Region: "global"},
 	}
+	_, err = stream(req, "", nil)
+	require.Error(err)
+	require.Contains(err.Error(), "since duration not supported by the task's driver")
 }
@@ -0,0 +1,890 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	sframer "github.com/hashicorp/nomad/client/lib/streamframer"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+const (
+	// maxANSISequence is the longest escape sequence that will be buffered
+	// while waiting for it to be terminated. Longer runs are not treated as
+	// escape sequences and are passed through as is.
+	maxANSISequence = 64
+
+	// logLevelNone is the level of lines in which no level is detected
+	logLevelNone = "none"
+
+	// defaultMaxLineBytes is the longest partial line that is held back by
+	// the line aware filters when a request does not set a limit.
+	defaultMaxLineBytes = 1024 * 1024
+)
+
+var (
+	// logLevels are the levels that can be detected in log lines, in order
+	// of increasing severity.
+	logLevels = []string{"trace", "debug", "info", "warn", "error"}
+
+	// defaultLevelPatterns match the common ways of writing the log level of
+	// a line. They are used for the levels a request has no pattern for.
+	defaultLevelPatterns = map[string]string{
+		"trace": `\b(TRACE|TRC)\b|\blevel=trace\b`,
+		"debug": `\b(DEBUG|DBG)\b|\blevel=debug\b`,
+		"info":  `\b(INFO|INF)\b|\blevel=info\b`,
+		"warn":  `\b(WARN|WARNING|WRN)\b|\blevel=warn(ing)?\b`,
+		"error": `\b(ERROR|ERR|FATAL|PANIC|CRITICAL)\b|\blevel=(error|fatal|panic)\b`,
+	}
+)
+
+// transcoder transcodes streamed data from a character encoding to UTF-8. A
+// multibyte character split across calls to transcode is buffered until it is
+// complete.
+type transcoder struct {
+	decoder transform.Transformer
+	pending []byte
+}
+
+// newTranscoder returns a transcoder from the character encoding with the
+// given IANA name, or nil if the name is empty.
+func newTranscoder(name string) (*transcoder, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, invalidSourceEnc
+	}
+	return &transcoder{decoder: enc.NewDecoder()}, nil
+}
+
+// transcode returns data transcoded to UTF-8. A trailing incomplete character
+// is held back and prepended to the data of the next call.
+func (t *transcoder) transcode(data []byte) []byte {
+	if len(t.pending) > 0 {
+		data = append(t.pending, data...)
+		t.pending = nil
+	}
+
+	out := make([]byte, 0, len(data))
+	dst := make([]byte, 2*len(data)+utf8.UTFMax)
+	for {
+		nDst, nSrc, err := t.decoder.Transform(dst, data, false)
+		out = append(out, dst[:nDst]...)
+		data = data[nSrc:]
+
+		switch err {
+		case transform.ErrShortDst:
+			if nDst == 0 {
+				dst = make([]byte, 2*len(dst))
+			}
+			continue
+		case transform.ErrShortSrc:
+			// Wait for the rest of the character
+			t.pending = append([]byte(nil), data...)
+		case nil:
+		default:
+			// Stream data that cannot be transcoded as is
+			out = append(out, data...)
+		}
+		return out
+	}
+}
+
+// flush returns the incomplete character held back once the stream ends. It
+// is transcoded as the end of the data, so it is replaced rather than dropped.
+func (t *transcoder) flush() []byte {
+	if len(t.pending) == 0 {
+		return nil
+	}
+
+	data := t.pending
+	t.pending = nil
+	out, _, err := transform.Bytes(t.decoder, data)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// ansiStripper removes ANSI CSI escape sequences, such as SGR color codes,
+// from streamed data. A sequence split across calls to strip is buffered until
+// it is complete.
+type ansiStripper struct {
+	pending []byte
+}
+
+// strip returns data with any escape sequences removed. A trailing incomplete
+// sequence is held back and prepended to the data of the next call.
+func (a *ansiStripper) strip(data []byte) []byte {
+	if len(a.pending) > 0 {
+		data = append(a.pending, data...)
+		a.pending = nil
+	}
+
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		if data[i] != 0x1b {
+			out = append(out, data[i])
+			i++
+			continue
+		}
+
+		n, complete := csiLength(data[i:])
+		if !complete && len(data)-i < maxANSISequence {
+			// Wait for the rest of the sequence
+			a.pending = append([]byte(nil), data[i:]...)
+			return out
+		}
+
+		if n == 0 {
+			// Not an escape sequence we strip
+			out = append(out, data[i])
+			i++
+			continue
+		}
+
+		i += n
+	}
+
+	return out
+}
+
+// flush returns the incomplete sequence held back once the stream ends. It
+// cannot be stripped so it is passed on as is.
+func (a *ansiStripper) flush() []byte {
+	data := a.pending
+	a.pending = nil
+	return data
+}
+
+// csiLength returns the length of the CSI escape sequence at the start of b,
+// which must begin with an escape character. A length of zero is returned if b
+// does not start with a CSI sequence, and complete is false if b ends before
+// it can be determined.
+func csiLength(b []byte) (n int, complete bool) {
+	if len(b) < 2 {
+		return 0, false
+	}
+	if b[1] != '[' {
+		return 0, true
+	}
+
+	for i := 2; i < len(b); i++ {
+		switch c := b[i]; {
+		case c >= 0x40 && c <= 0x7e:
+			// Final byte
+			return i + 1, true
+		case c >= 0x20 && c <= 0x3f:
+			// Parameter and intermediate bytes
+		default:
+			return 0, true
+		}
+	}
+
+	return 0, false
+}
+
+// linePacer limits the number of lines streamed per second. Lines in excess of
+// the limit are either delayed until the next one second window or dropped.
+type linePacer struct {
+	limit int
+	lossy bool
+
+	windowStart time.Time
+	count       int
+	dropped     int64
+}
+
+func newLinePacer(limit int, lossy bool) *linePacer {
+	return &linePacer{
+		limit: limit,
+		lossy: lossy,
+	}
+}
+
+// pace sends the data of the frame using send, splitting it into multiple
+// frames to keep within the line limit. It blocks until the frame's data has
+// been sent or dropped, or the context is cancelled.
+func (p *linePacer) pace(ctx context.Context, frame *sframer.StreamFrame,
+	send func(*sframer.StreamFrame) error) error {
+
+	data := frame.Data
+	first := true
+	for len(data) > 0 {
+		now := time.Now()
+		if elapsed := now.Sub(p.windowStart); elapsed >= time.Second {
+			p.windowStart = now
+			p.count = 0
+		}
+
+		// Wait for the next window or drop the rest of the data once the
+		// limit is reached
+		if p.count >= p.limit {
+			if p.lossy {
+				p.dropped += int64(countLines(data))
+				return nil
+			}
+
+			select {
+			case <-time.After(time.Second - now.Sub(p.windowStart)):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+
+		n, lines := splitLines(data, p.limit-p.count)
+		p.count += lines
+
+		out := &sframer.StreamFrame{
+			Offset:       frame.Offset - int64(len(data)) + int64(n),
+			Data:         data[:n],
+			File:         frame.File,
+			DroppedLines: p.dropped,
+			Level:        frame.Level,
+		}
+		if first {
+			out.FileEvent = frame.FileEvent
+			first = false
+		}
+		p.dropped = 0
+		data = data[n:]
+
+		if err := send(out); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitLines returns the number of bytes at the start of data covering at most
+// max lines, and the number of lines covered. A trailing partial line counts as
+// a line.
+func splitLines(data []byte, max int) (int, int) {
+	n, lines := 0, 0
+	for lines < max && n < len(data) {
+		i := bytes.IndexByte(data[n:], '\n')
+		if i < 0 {
+			n = len(data)
+		} else {
+			n += i + 1
+		}
+		lines++
+	}
+	return n, lines
+}
+
+// countLines returns the number of lines in data, counting a trailing partial
+// line as a line.
+func countLines(data []byte) int {
+	_, lines := splitLines(data, len(data))
+	return lines
+}
+
+// coalesceFrames returns a channel of the frames received on frames, sent at
+// most perSecond times a second. Consecutive data frames of the same file
+// received while waiting to send are coalesced into a single frame, and
+// heartbeats are dropped while data is waiting, so no data is dropped. The
+// frames waiting are sent as soon as frames is closed, after which the
+// returned channel is closed.
+func coalesceFrames(ctx context.Context, frames <-chan *sframer.StreamFrame, perSecond int) <-chan *sframer.StreamFrame {
+	out := make(chan *sframer.StreamFrame)
+	interval := time.Second / time.Duration(perSecond)
+
+	go func() {
+		defer close(out)
+
+		// owned is the frame waiting last if its data was copied by
+		// coalescing, so that later frames can be appended to it in place
+		var pending []*sframer.StreamFrame
+		var owned *sframer.StreamFrame
+
+		in := frames
+		ready := true
+		var wait <-chan time.Time
+		for {
+			if in == nil && len(pending) == 0 {
+				return
+			}
+
+			var send chan<- *sframer.StreamFrame
+			var next *sframer.StreamFrame
+			if len(pending) > 0 && (ready || in == nil) {
+				send, next = out, pending[0]
+			}
+
+			select {
+			case frame, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+
+				last := len(pending) - 1
+				switch {
+				case last >= 0 && frame.IsHeartbeat():
+				case last >= 0 && coalescable(pending[last], frame):
+					// The coalesced frame keeps the offset of the first
+					// frame, as when the framer merges data
+					prev := pending[last]
+					if owned != prev {
+						prev.Data = append([]byte(nil), prev.Data...)
+						owned = prev
+					}
+					prev.Data = append(prev.Data, frame.Data...)
+				default:
+					pending = append(pending, frame)
+				}
+			case send <- next:
+				pending = pending[1:]
+				if owned == next {
+					owned = nil
+				}
+				ready = false
+				wait = time.After(interval)
+			case <-wait:
+				ready = true
+				wait = nil
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// coalescable returns whether the frame b can be appended to the frame a, which
+// is the case for frames of the same file that only hold data.
+func coalescable(a, b *sframer.StreamFrame) bool {
+	dataOnly := func(f *sframer.StreamFrame) bool {
+		return len(f.Data) > 0 && f.FileEvent == "" && f.TotalBytes == 0 &&
+			f.ResumeToken == "" && f.DroppedLines == 0 && f.Path == "" &&
+			f.Level == "" && f.Checksum == ""
+	}
+	return a.File == b.File && dataOnly(a) && dataOnly(b)
+}
+
+// lineDeduper collapses runs of consecutive identical lines. The current run
+// and any trailing partial line are held back until a different line arrives
+// or they are flushed, so a run may span multiple frames.
+type lineDeduper struct {
+	// maxLine is the longest partial line held back, if set. Longer partial
+	// lines are returned as is.
+	maxLine int
+
+	partial []byte
+	last    []byte
+	count   int
+}
+
+// dedup returns the lines of data that complete a run, with repeated lines
+// collapsed into a single line suffixed with the repetition count.
+func (d *lineDeduper) dedup(data []byte) []byte {
+	if len(d.partial) > 0 {
+		data = append(d.partial, data...)
+		d.partial = nil
+	}
+
+	var out []byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			d.partial = append([]byte(nil), data...)
+			break
+		}
+
+		line := data[:i]
+		data = data[i+1:]
+		if d.count > 0 && bytes.Equal(line, d.last) {
+			d.count++
+			continue
+		}
+
+		out = d.appendRun(out)
+		d.last = append(d.last[:0], line...)
+		d.count = 1
+	}
+
+	if d.maxLine > 0 && len(d.partial) > d.maxLine {
+		out = append(out, d.flush()...)
+	}
+
+	return out
+}
+
+// flush returns the held back run and partial line.
+func (d *lineDeduper) flush() []byte {
+	out := d.appendRun(nil)
+	d.count = 0
+	out = append(out, d.partial...)
+	d.partial = nil
+	return out
+}
+
+// appendRun appends the current run to out.
+func (d *lineDeduper) appendRun(out []byte) []byte {
+	switch {
+	case d.count == 0:
+		return out
+	case d.count == 1:
+		out = append(out, d.last...)
+	default:
+		out = append(out, d.last...)
+		out = append(out, fmt.Sprintf(" (x%d)", d.count)...)
+	}
+	return append(out, '\n')
+}
+
+// blankLineCollapser collapses runs of consecutive blank lines, including those
+// containing only whitespace, into a single empty line or drops them. A run
+// may span multiple frames. Whitespace at the start of a line is held back
+// until the line is known to be blank or not.
+type blankLineCollapser struct {
+	// drop drops blank lines rather than collapsing them
+	drop bool
+
+	// maxLine is the longest run of leading whitespace held back, if set.
+	// Longer runs are returned as is.
+	maxLine int
+
+	pending []byte
+
+	// midLine is set while the rest of a line that is not blank is streamed
+	midLine bool
+
+	// inRun is set once a blank line has been collapsed until a line that is
+	// not blank is streamed
+	inRun bool
+}
+
+// collapse returns data with runs of blank lines collapsed.
+func (b *blankLineCollapser) collapse(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if b.midLine {
+			if i < 0 {
+				return append(out, data...)
+			}
+			out = append(out, data[:i+1]...)
+			data = data[i+1:]
+			b.midLine = false
+			continue
+		}
+
+		line := data
+		if i >= 0 {
+			line = data[:i]
+		}
+		if len(bytes.TrimSpace(line)) != 0 {
+			// The line is not blank so stream it with its held back
+			// whitespace
+			out = append(out, b.pending...)
+			b.pending = nil
+			b.inRun = false
+			b.midLine = true
+			continue
+		}
+
+		if i < 0 {
+			b.pending = append(b.pending, line...)
+			if b.maxLine > 0 && len(b.pending) > b.maxLine {
+				out = append(out, b.pending...)
+				b.pending = nil
+				b.inRun = false
+				b.midLine = true
+			}
+			return out
+		}
+
+		if !b.inRun && !b.drop {
+			out = append(out, '\n')
+		}
+		b.pending = nil
+		b.inRun = true
+		data = data[i+1:]
+	}
+	return out
+}
+
+// flush returns the held back whitespace.
+func (b *blankLineCollapser) flush() []byte {
+	out := b.pending
+	b.pending = nil
+	if len(out) > 0 {
+		b.inRun = false
+		b.midLine = true
+	}
+	return out
+}
+
+// markerGate drops streamed data up to and including the first line matching a
+// start marker and passes the data after it through. A trailing partial line
+// is held back while waiting for the marker since it may contain it.
+type markerGate struct {
+	match func(line []byte) bool
+
+	// inclusive passes the marker line through along with the data after it
+	inclusive bool
+
+	// maxLine is the longest partial line held back, if set. Longer lines
+	// are skipped without being matched.
+	maxLine int
+
+	partial []byte
+
+	// skipping is set while dropping the rest of a line that was too long to
+	// be held back
+	skipping bool
+	open     bool
+}
+
+// newMarkerGate returns a gate opening after the first line containing match
+// or matching the regular expression pattern. It returns nil if neither is
+// set.
+func newMarkerGate(match, pattern string) (*markerGate, error) {
+	switch {
+	case match != "" && pattern != "":
+		return nil, fmt.Errorf("start after match and regex cannot be combined")
+	case match != "":
+		m := []byte(match)
+		return &markerGate{match: func(line []byte) bool { return bytes.Contains(line, m) }}, nil
+	case pattern != "":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start after regex: %v", err)
+		}
+		return &markerGate{match: re.Match}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// newErrorGate returns a gate opening at the first line detected as the error
+// level, using the passed patterns, keyed by level, in place of the defaults.
+// The error line is passed through.
+func newErrorGate(patterns map[string]string) (*markerGate, error) {
+	l, err := newLevelTagger(patterns, "")
+	if err != nil {
+		return nil, err
+	}
+
+	errorRank := logLevelRank("error")
+	return &markerGate{
+		match:     func(line []byte) bool { return l.detect(line) == errorRank },
+		inclusive: true,
+	}, nil
+}
+
+// gate returns the data following the marker line, or nothing if the marker
+// has not been seen yet.
+func (g *markerGate) gate(data []byte) []byte {
+	if g.open {
+		return data
+	}
+	if len(g.partial) > 0 {
+		data = append(g.partial, data...)
+		g.partial = nil
+	}
+
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if !g.skipping {
+				if g.maxLine > 0 && len(data) > g.maxLine {
+					g.skipping = true
+				} else {
+					g.partial = append([]byte(nil), data...)
+				}
+			}
+			return nil
+		}
+
+		line := data[:i]
+		rest := data[i+1:]
+		if g.skipping {
+			g.skipping = false
+			data = rest
+			continue
+		}
+		if g.match(line) {
+			g.open = true
+			if g.inclusive {
+				return data
+			}
+			return rest
+		}
+		data = rest
+	}
+
+	return nil
+}
+
+// lineNumberer prefixes each line of streamed data with its line number, in
+// the format of "cat -n". The numbering continues across calls so a line may
+// span multiple frames.
+type lineNumberer struct {
+	// lines is the number of lines started so far
+	lines int64
+
+	// midLine is set while the data of the last started line is streamed
+	midLine bool
+}
+
+// number returns data with the line number inserted at the start of each
+// line.
+func (n *lineNumberer) number(data []byte) []byte {
+	out := make([]byte, 0, len(data)+8)
+	for len(data) > 0 {
+		if !n.midLine {
+			n.lines++
+			out = append(out, fmt.Sprintf("%6d\t", n.lines)...)
+			n.midLine = true
+		}
+
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			out = append(out, data...)
+			break
+		}
+
+		out = append(out, data[:i+1]...)
+		data = data[i+1:]
+		n.midLine = false
+	}
+	return out
+}
+
+// lineRange returns the numbers of the first and last lines of data, if it is
+// the next data streamed. It does not advance the numbering.
+func (n *lineNumberer) lineRange(data []byte) (first, last int64) {
+	first = n.lines
+	if !n.midLine {
+		first++
+	}
+
+	last = first + int64(bytes.Count(data, []byte{'\n'}))
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		last--
+	}
+	return first, last
+}
+
+// advance advances the numbering past data without numbering its lines.
+func (n *lineNumberer) advance(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	_, n.lines = n.lineRange(data)
+	n.midLine = data[len(data)-1] != '\n'
+}
+
+// levelTagger detects the level of log lines and splits streamed data into
+// frames of consecutive lines sharing a level, dropping lines below a minimum
+// level. A trailing partial line is held back until it is completed or
+// flushed.
+type levelTagger struct {
+	patterns []*regexp.Regexp
+	min      int
+
+	// maxLine is the longest partial line held back, if set. Longer partial
+	// lines are tagged as if they were complete.
+	maxLine int
+
+	partial []byte
+	file    string
+	offset  int64
+}
+
+// newLevelTagger returns a tagger using the passed patterns, keyed by level,
+// in place of the defaults. Lines below minLevel are dropped unless it is
+// empty. Lines without a detected level are never dropped.
+func newLevelTagger(patterns map[string]string, minLevel string) (*levelTagger, error) {
+	l := &levelTagger{
+		patterns: make([]*regexp.Regexp, len(logLevels)),
+	}
+
+	for level := range patterns {
+		if logLevelRank(level) < 0 {
+			return nil, fmt.Errorf("unknown log level %q; must be one of %v", level, logLevels)
+		}
+	}
+
+	for i, level := range logLevels {
+		pattern, ok := patterns[level]
+		if !ok {
+			pattern = defaultLevelPatterns[level]
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for log level %q: %v", level, err)
+		}
+		l.patterns[i] = re
+	}
+
+	if minLevel != "" {
+		l.min = logLevelRank(minLevel)
+		if l.min < 0 {
+			return nil, fmt.Errorf("unknown minimum log level %q; must be one of %v", minLevel, logLevels)
+		}
+	}
+
+	return l, nil
+}
+
+// logLevelRank returns the severity of the level or -1 if it is unknown.
+func logLevelRank(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// detect returns the rank of the level of the line, or -1 if none is found.
+// The earliest match in the line wins, and the more severe level on a tie.
+func (l *levelTagger) detect(line []byte) int {
+	rank, pos := -1, len(line)
+	for i := len(l.patterns) - 1; i >= 0; i-- {
+		loc := l.patterns[i].FindIndex(line)
+		if loc != nil && loc[0] < pos {
+			rank, pos = i, loc[0]
+		}
+	}
+	return rank
+}
+
+// tag returns the frames holding the lines of the frame's data that pass the
+// minimum level, each annotated with the level of its lines. The frame's file
+// event is kept on the first returned frame, or on a frame without data if
+// no lines are returned.
+func (l *levelTagger) tag(frame *sframer.StreamFrame) []*sframer.StreamFrame {
+	data := frame.Data
+	if len(l.partial) > 0 {
+		data = append(l.partial, data...)
+		l.partial = nil
+	}
+
+	// Frame offsets are those of the end of their data
+	base := frame.Offset - int64(len(data))
+
+	var out []*sframer.StreamFrame
+	var cur *sframer.StreamFrame
+	curRank := -2
+	for i := 0; i < len(data); {
+		n := bytes.IndexByte(data[i:], '\n')
+		if n < 0 && (l.maxLine <= 0 || len(data)-i <= l.maxLine) {
+			l.partial = append([]byte(nil), data[i:]...)
+			l.file, l.offset = frame.File, frame.Offset
+			break
+		}
+
+		var line []byte
+		if n < 0 {
+			line = data[i:]
+			i = len(data)
+		} else {
+			line = data[i : i+n+1]
+			i += n + 1
+		}
+
+		rank := l.detect(line)
+		if rank >= 0 && rank < l.min {
+			cur, curRank = nil, -2
+			continue
+		}
+
+		if cur == nil || rank != curRank {
+			cur = &sframer.StreamFrame{File: frame.File, Level: levelName(rank)}
+			curRank = rank
+			out = append(out, cur)
+		}
+		cur.Data = append(cur.Data, line...)
+		cur.Offset = base + int64(i)
+	}
+
+	if frame.FileEvent != "" {
+		if len(out) == 0 {
+			out = append(out, &sframer.StreamFrame{File: frame.File, Offset: frame.Offset})
+		}
+		out[0].FileEvent = frame.FileEvent
+	}
+
+	return out
+}
+
+// flush returns a frame holding the held back partial line, or nil if there
+// is none or it is below the minimum level.
+func (l *levelTagger) flush() *sframer.StreamFrame {
+	if len(l.partial) == 0 {
+		return nil
+	}
+
+	line := l.partial
+	l.partial = nil
+
+	rank := l.detect(line)
+	if rank >= 0 && rank < l.min {
+		return nil
+	}
+
+	return &sframer.StreamFrame{
+		File:   l.file,
+		Offset: l.offset,
+		Data:   line,
+		Level:  levelName(rank),
+	}
+}
+
+// levelName returns the name of the level with the passed rank.
+func levelName(rank int) string {
+	if rank < 0 {
+		return logLevelNone
+	}
+	return logLevels[rank]
+}
+
+// eventMarker writes a marker line for each file event into a plain text
+// stream, in which the events are otherwise invisible as they carry no data.
+type eventMarker struct {
+	// format is the marker line, with each "%s" replaced by the event.
+	format string
+
+	// midLine is set while the data written so far does not end with a
+	// newline, in which case the marker is moved onto a line of its own.
+	midLine bool
+}
+
+// mark returns the data of the frame, preceded by a marker line if the frame
+// has a file event.
+func (m *eventMarker) mark(frame *sframer.StreamFrame) []byte {
+	data := frame.Data
+	if frame.FileEvent != "" {
+		var marked []byte
+		if m.midLine {
+			marked = append(marked, '\n')
+		}
+		marked = append(marked, strings.ReplaceAll(m.format, "%s", frame.FileEvent)...)
+		marked = append(marked, '\n')
+		data = append(marked, data...)
+	}
+
+	if len(data) > 0 {
+		m.midLine = data[len(data)-1] != '\n'
+	}
+	return data
+}
@@ -0,0 +1,741 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	sframer "github.com/hashicorp/nomad/client/lib/streamframer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS_ansiStripper(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Frames   []string
+		Expected string
+	}{
+		{
+			Name:     "plain",
+			Frames:   []string{"hello world\n"},
+			Expected: "hello world\n",
+		},
+		{
+			Name:     "colors",
+			Frames:   []string{"\x1b[31mred\x1b[0m and \x1b[1;32mbold green\x1b[m\n"},
+			Expected: "red and bold green\n",
+		},
+		{
+			Name:     "cursor movement",
+			Frames:   []string{"progress\x1b[2K\x1b[1Gdone\n"},
+			Expected: "progressdone\n",
+		},
+		{
+			Name:     "split sequence",
+			Frames:   []string{"\x1b[3", "1mred\x1b", "[0m\n"},
+			Expected: "red\n",
+		},
+		{
+			Name:     "split after escape byte",
+			Frames:   []string{"a\x1b", "[1mb"},
+			Expected: "ab",
+		},
+		{
+			Name:     "non csi escape",
+			Frames:   []string{"a\x1b(Bb"},
+			Expected: "a\x1b(Bb",
+		},
+		{
+			Name:     "partial sequence at end",
+			Frames:   []string{"done\x1b[3"},
+			Expected: "done\x1b[3",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var s ansiStripper
+			var out []byte
+			for _, frame := range tc.Frames {
+				out = append(out, s.strip([]byte(frame))...)
+			}
+			out = append(out, s.flush()...)
+			require.Equal(t, tc.Expected, string(out))
+		})
+	}
+}
+
+func TestFS_linePacer(t *testing.T) {
+	t.Parallel()
+
+	limit := 10
+	lines := 25
+	data := strings.Repeat("line\n", lines)
+
+	// Record when each line was sent and the offset of each frame, which
+	// is at the end of its data
+	base := int64(100)
+	var sent []byte
+	var times []time.Time
+	var offsets, expectedOffsets []int64
+	send := func(frame *sframer.StreamFrame) error {
+		sent = append(sent, frame.Data...)
+		offsets = append(offsets, frame.Offset)
+		expectedOffsets = append(expectedOffsets, base+int64(len(sent)))
+		now := time.Now()
+		for i := 0; i < bytes.Count(frame.Data, []byte("\n")); i++ {
+			times = append(times, now)
+		}
+		return nil
+	}
+
+	start := time.Now()
+	p := newLinePacer(limit, false)
+	frame := &sframer.StreamFrame{File: "foo", Offset: base + int64(len(data)), Data: []byte(data)}
+	require.NoError(t, p.pace(context.Background(), frame, send))
+
+	// All of the content is delivered, spread across three windows
+	require.Equal(t, data, string(sent))
+	require.Len(t, offsets, 3)
+	require.Equal(t, expectedOffsets, offsets)
+	require.Len(t, times, lines)
+	require.GreaterOrEqual(t, time.Since(start), 2*time.Second)
+
+	// No second long window contains more lines than the limit
+	for i := range times {
+		inWindow := 0
+		for _, ts := range times[i:] {
+			if ts.Sub(times[i]) < time.Second {
+				inWindow++
+			}
+		}
+		require.LessOrEqual(t, inWindow, limit)
+	}
+}
+
+func TestFS_linePacer_Lossy(t *testing.T) {
+	t.Parallel()
+
+	var frames []*sframer.StreamFrame
+	send := func(frame *sframer.StreamFrame) error {
+		frames = append(frames, frame)
+		return nil
+	}
+
+	p := newLinePacer(2, true)
+	ctx := context.Background()
+
+	// Lines over the limit are dropped without blocking
+	start := time.Now()
+	require.NoError(t, p.pace(ctx, &sframer.StreamFrame{Offset: 8, Data: []byte("a\nb\nc\nd\n")}, send))
+	require.NoError(t, p.pace(ctx, &sframer.StreamFrame{Offset: 10, Data: []byte("e\n")}, send))
+	require.Less(t, time.Since(start), time.Second)
+	require.Len(t, frames, 1)
+	require.Equal(t, "a\nb\n", string(frames[0].Data))
+	require.Equal(t, int64(4), frames[0].Offset)
+
+	// The dropped lines are reported with the next frame that is sent
+	p.windowStart = time.Time{}
+	require.NoError(t, p.pace(ctx, &sframer.StreamFrame{Offset: 12, Data: []byte("f\n")}, send))
+	require.Len(t, frames, 2)
+	require.Equal(t, "f\n", string(frames[1].Data))
+	require.Equal(t, int64(12), frames[1].Offset)
+	require.Equal(t, int64(3), frames[1].DroppedLines)
+}
+
+func TestFS_coalesceFrames(t *testing.T) {
+	t.Parallel()
+
+	limit := 5
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan *sframer.StreamFrame)
+	out := coalesceFrames(ctx, in, limit)
+
+	// Write a burst of small frames with heartbeats in between, spread
+	// over more than a second
+	var expected string
+	go func() {
+		for i := 0; i < 120; i++ {
+			data := fmt.Sprintf("line %d\n", i)
+			expected += data
+			in <- &sframer.StreamFrame{File: "foo", Offset: int64(i), Data: []byte(data)}
+			if i%10 == 0 {
+				in <- &sframer.StreamFrame{}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		in <- &sframer.StreamFrame{File: "foo", FileEvent: deleteEvent}
+		close(in)
+	}()
+
+	var frames []*sframer.StreamFrame
+	var times []time.Time
+	for frame := range out {
+		frames = append(frames, frame)
+		times = append(times, time.Now())
+	}
+
+	// All of the content is delivered in order, followed by the event.
+	// Heartbeats are only sent while no data is waiting.
+	var received string
+	for _, frame := range frames[:len(frames)-1] {
+		require.Empty(t, frame.FileEvent)
+		if !frame.IsHeartbeat() {
+			require.NotEmpty(t, frame.Data)
+			received += string(frame.Data)
+		}
+	}
+	require.Equal(t, expected, received)
+	require.Equal(t, deleteEvent, frames[len(frames)-1].FileEvent)
+	require.Equal(t, int64(0), frames[0].Offset)
+
+	// Frames are spaced to keep within the limit, allowing for scheduling
+	// delays, except for the data and event frames that may be sent at once
+	// when the input is closed
+	interval := time.Second / time.Duration(limit)
+	for i := 1; i < len(times)-2; i++ {
+		require.GreaterOrEqual(t, times[i].Sub(times[i-1]), interval*9/10)
+	}
+	require.Less(t, len(frames), 2*limit)
+}
+
+func TestFS_coalesceFrames_Cancel(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan *sframer.StreamFrame)
+	out := coalesceFrames(ctx, in, 1)
+
+	// The output is closed once the context is cancelled
+	cancel()
+	select {
+	case _, ok := <-out:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestFS_lineDeduper(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Frames   []string
+		Expected []string
+	}{
+		{
+			Name:     "distinct lines",
+			Frames:   []string{"a\nb\nc\n"},
+			Expected: []string{"a\nb\n", "c\n"},
+		},
+		{
+			Name:     "repeated lines",
+			Frames:   []string{"a\na\na\nb\n"},
+			Expected: []string{"a (x3)\n", "b\n"},
+		},
+		{
+			Name:     "run across frame boundary",
+			Frames:   []string{"err\nerr\n", "err\nerr\n", "ok\n"},
+			Expected: []string{"", "", "err (x4)\n", "ok\n"},
+		},
+		{
+			Name:     "line split across frames",
+			Frames:   []string{"err\ne", "rr\nok"},
+			Expected: []string{"", "", "err (x2)\nok"},
+		},
+		{
+			Name:     "run after a different line",
+			Frames:   []string{"a\nb\nb\na\n"},
+			Expected: []string{"a\nb (x2)\n", "a\n"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var d lineDeduper
+			var out []string
+			for _, frame := range tc.Frames {
+				out = append(out, string(d.dedup([]byte(frame))))
+			}
+			out = append(out, string(d.flush()))
+
+			require.Equal(t, tc.Expected, out)
+
+			// Nothing is held back after a flush
+			require.Empty(t, d.flush())
+		})
+	}
+}
+
+func TestFS_blankLineCollapser(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Drop     bool
+		Frames   []string
+		Expected []string
+	}{
+		{
+			Name:     "no blank lines",
+			Frames:   []string{"a\nb\n"},
+			Expected: []string{"a\nb\n", ""},
+		},
+		{
+			Name:     "single blank line",
+			Frames:   []string{"a\n\nb\n"},
+			Expected: []string{"a\n\nb\n", ""},
+		},
+		{
+			Name:     "whitespace only lines",
+			Frames:   []string{"a\n  \n\t\r\n\nb\n"},
+			Expected: []string{"a\n\nb\n", ""},
+		},
+		{
+			Name:     "run across frame boundaries",
+			Frames:   []string{"a\n\n\n", "\n \n", "   ", "\n\nb\n"},
+			Expected: []string{"a\n\n", "", "", "b\n", ""},
+		},
+		{
+			Name:     "leading whitespace of a line",
+			Frames:   []string{"a\n\n  ", "  b\n"},
+			Expected: []string{"a\n\n", "    b\n", ""},
+		},
+		{
+			Name:     "line split across frames",
+			Frames:   []string{"a\n\nb", "c\n\n", "d"},
+			Expected: []string{"a\n\nb", "c\n\n", "d", ""},
+		},
+		{
+			Name:     "held back whitespace is flushed",
+			Frames:   []string{"a\n\n  "},
+			Expected: []string{"a\n\n", "  "},
+		},
+		{
+			Name:     "drop",
+			Drop:     true,
+			Frames:   []string{"a\n\n\n", " \nb\n\n", "c\n"},
+			Expected: []string{"a\n", "b\n", "c\n", ""},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			b := blankLineCollapser{drop: tc.Drop}
+			var out []string
+			for _, frame := range tc.Frames {
+				out = append(out, string(b.collapse([]byte(frame))))
+			}
+			out = append(out, string(b.flush()))
+
+			require.Equal(t, tc.Expected, out)
+
+			// Nothing is held back after a flush
+			require.Empty(t, b.flush())
+		})
+	}
+}
+
+func TestFS_blankLineCollapser_MaxLine(t *testing.T) {
+	t.Parallel()
+
+	b := blankLineCollapser{maxLine: 4096}
+	chunk := bytes.Repeat([]byte(" "), 1024)
+
+	// Leading whitespace is streamed as is once it is too long to hold
+	var out []byte
+	for i := 0; i < 10; i++ {
+		out = append(out, b.collapse(chunk)...)
+		require.LessOrEqual(t, len(b.pending), b.maxLine)
+	}
+	out = append(out, b.collapse([]byte("\n\n\nok\n"))...)
+	out = append(out, b.flush()...)
+
+	require.Equal(t, strings.Repeat(" ", 10*1024)+"\n\nok\n", string(out))
+}
+
+func TestFS_markerGate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Match    string
+		Regex    string
+		Frames   []string
+		Expected string
+	}{
+		{
+			Name:     "match",
+			Match:    "Starting server",
+			Frames:   []string{"boot\nStarting server on :80\nready\n"},
+			Expected: "ready\n",
+		},
+		{
+			Name:     "regex",
+			Regex:    `^Starting \w+$`,
+			Frames:   []string{"Starting up now\nStarting server\nready\n"},
+			Expected: "ready\n",
+		},
+		{
+			Name:     "marker split across frames",
+			Match:    "Starting server",
+			Frames:   []string{"boot\nStart", "ing server\nre", "ady\n"},
+			Expected: "ready\n",
+		},
+		{
+			Name:     "marker never seen",
+			Match:    "Starting server",
+			Frames:   []string{"boot\n", "still booting"},
+			Expected: "",
+		},
+		{
+			Name:     "later markers are streamed",
+			Match:    "Starting server",
+			Frames:   []string{"Starting server\n", "Starting server\n"},
+			Expected: "Starting server\n",
+		},
+		{
+			Name:     "long lines are skipped",
+			Match:    "Starting server",
+			Frames:   []string{strings.Repeat("x", 20), "Starting server\n", "Starting server\nready\n"},
+			Expected: "ready\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			g, err := newMarkerGate(tc.Match, tc.Regex)
+			require.NoError(t, err)
+			g.maxLine = 16
+
+			var out string
+			for _, frame := range tc.Frames {
+				out += string(g.gate([]byte(frame)))
+			}
+			require.Equal(t, tc.Expected, out)
+		})
+	}
+
+	g, err := newMarkerGate("", "")
+	require.NoError(t, err)
+	require.Nil(t, g)
+
+	_, err = newMarkerGate("a", "b")
+	require.Error(t, err)
+
+	_, err = newMarkerGate("", "(")
+	require.Error(t, err)
+}
+
+func TestFS_errorGate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		Patterns map[string]string
+		Frames   []string
+		Expected string
+	}{
+		{
+			Name:     "error line",
+			Frames:   []string{"INFO boot\nINFO ready\nERROR failed\nINFO retry\n"},
+			Expected: "ERROR failed\nINFO retry\n",
+		},
+		{
+			Name:     "error split across frames",
+			Frames:   []string{"INFO boot\nERR", "OR failed\nINFO", " retry\n"},
+			Expected: "ERROR failed\nINFO retry\n",
+		},
+		{
+			Name:     "no error yet",
+			Frames:   []string{"INFO boot\n", "WARN slow"},
+			Expected: "",
+		},
+		{
+			Name:     "level patterns",
+			Patterns: map[string]string{"error": `^E `},
+			Frames:   []string{"ERROR not matched\nE failed\nI retry\n"},
+			Expected: "E failed\nI retry\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			g, err := newErrorGate(tc.Patterns)
+			require.NoError(t, err)
+
+			var out string
+			for _, frame := range tc.Frames {
+				out += string(g.gate([]byte(frame)))
+			}
+			require.Equal(t, tc.Expected, out)
+		})
+	}
+
+	_, err := newErrorGate(map[string]string{"error": "("})
+	require.Error(t, err)
+}
+
+func TestFS_transcoder(t *testing.T) {
+	t.Parallel()
+
+	// Without an encoding data is streamed as is
+	tc, err := newTranscoder("")
+	require.NoError(t, err)
+	require.Nil(t, tc)
+
+	_, err = newTranscoder("not-an-encoding")
+	require.Equal(t, invalidSourceEnc, err)
+
+	// Latin-1 characters are single bytes
+	tc, err = newTranscoder("ISO-8859-1")
+	require.NoError(t, err)
+	require.Equal(t, "caf\u00e9 cr\u00e8me\n", string(tc.transcode([]byte("caf\xe9 cr\xe8me\n"))))
+
+	// A multibyte Shift-JIS character split across frames is held back
+	tc, err = newTranscoder("Shift_JIS")
+	require.NoError(t, err)
+	var out string
+	for _, frame := range []string{"\x93\xfa", "\x96", "\x7b\n"} {
+		out += string(tc.transcode([]byte(frame)))
+	}
+	require.Equal(t, "\u65e5\u672c\n", out)
+
+	// A partial character left at the end of the stream is replaced
+	require.Equal(t, "\u65e5", string(tc.transcode([]byte("\x93\xfa\x96"))))
+	require.Equal(t, "\ufffd", string(tc.flush()))
+	require.Empty(t, tc.flush())
+}
+
+func TestFS_lineNumberer(t *testing.T) {
+	t.Parallel()
+
+	n := new(lineNumberer)
+	var out string
+	for _, frame := range []string{"first\nsec", "ond\n", "\nthird"} {
+		out += string(n.number([]byte(frame)))
+	}
+	require.Equal(t, "     1\tfirst\n     2\tsecond\n     3\t\n     4\tthird", out)
+
+	// The next frame continues the partial line
+	require.Equal(t, " line\n", string(n.number([]byte(" line\n"))))
+	require.Equal(t, "     5\tfifth\n", string(n.number([]byte("fifth\n"))))
+}
+
+func TestFS_lineNumberer_Ranges(t *testing.T) {
+	t.Parallel()
+
+	n := new(lineNumberer)
+	var ranges [][2]int64
+	for _, frame := range []string{"first\nsec", "ond\n", "\nthird"} {
+		first, last := n.lineRange([]byte(frame))
+		ranges = append(ranges, [2]int64{first, last})
+		n.advance([]byte(frame))
+	}
+	require.Equal(t, [][2]int64{{1, 2}, {2, 2}, {3, 4}}, ranges)
+
+	// Numbering lines continues from the advanced position
+	require.Equal(t, " line\n", string(n.number([]byte(" line\n"))))
+	first, last := n.lineRange([]byte("fifth\n"))
+	require.Equal(t, int64(5), first)
+	require.Equal(t, int64(5), last)
+}
+
+func TestFS_lineDeduper_MaxLine(t *testing.T) {
+	t.Parallel()
+
+	d := lineDeduper{maxLine: 4096}
+	chunk := bytes.Repeat([]byte("x"), 1024)
+
+	// An unterminated line is streamed as is once it is too long to hold
+	var out []byte
+	for i := 0; i < 100; i++ {
+		out = append(out, d.dedup(chunk)...)
+		require.LessOrEqual(t, len(d.partial), d.maxLine)
+	}
+	out = append(out, d.dedup([]byte("\nok\n"))...)
+	out = append(out, d.flush()...)
+
+	require.Equal(t, strings.Repeat("x", 100*1024)+"\nok\n", string(out))
+}
+
+func TestFS_levelTagger(t *testing.T) {
+	t.Parallel()
+
+	// level is the expected level and data of a tagged frame
+	type level struct {
+		Level string
+		Data  string
+	}
+
+	mixed := "2021-01-01T00:00:00Z [INFO]  starting\n" +
+		"2021-01-01T00:00:01Z [DEBUG] config loaded\n" +
+		"2021-01-01T00:00:02Z [WARN]  disk almost full\n" +
+		"  retrying in 5s\n" +
+		"ts=1 level=error msg=\"write failed\"\n" +
+		"ts=2 level=error msg=\"write failed again\"\n"
+
+	cases := []struct {
+		Name     string
+		Patterns map[string]string
+		MinLevel string
+		Frames   []string
+		Expected []level
+	}{
+		{
+			Name:   "mixed levels",
+			Frames: []string{mixed},
+			Expected: []level{
+				{"info", "2021-01-01T00:00:00Z [INFO]  starting\n"},
+				{"debug", "2021-01-01T00:00:01Z [DEBUG] config loaded\n"},
+				{"warn", "2021-01-01T00:00:02Z [WARN]  disk almost full\n"},
+				{"none", "  retrying in 5s\n"},
+				{"error", "ts=1 level=error msg=\"write failed\"\nts=2 level=error msg=\"write failed again\"\n"},
+			},
+		},
+		{
+			Name:     "min level",
+			MinLevel: "warn",
+			Frames:   []string{mixed},
+			Expected: []level{
+				{"warn", "2021-01-01T00:00:02Z [WARN]  disk almost full\n"},
+				{"none", "  retrying in 5s\n"},
+				{"error", "ts=1 level=error msg=\"write failed\"\nts=2 level=error msg=\"write failed again\"\n"},
+			},
+		},
+		{
+			Name:   "earliest level wins",
+			Frames: []string{"INFO: recovered from ERROR\n"},
+			Expected: []level{
+				{"info", "INFO: recovered from ERROR\n"},
+			},
+		},
+		{
+			Name:     "custom pattern",
+			Patterns: map[string]string{"error": `^E\d+`},
+			Frames:   []string{"E0101 failed\nERROR not matched\n"},
+			Expected: []level{
+				{"error", "E0101 failed\n"},
+				{"none", "ERROR not matched\n"},
+			},
+		},
+		{
+			Name:   "line split across frames",
+			Frames: []string{"[WA", "RN] low\n[ERR", "OR] out"},
+			Expected: []level{
+				{"warn", "[WARN] low\n"},
+				{"error", "[ERROR] out"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			l, err := newLevelTagger(tc.Patterns, tc.MinLevel)
+			require.NoError(t, err)
+
+			var offset int64
+			var out []*sframer.StreamFrame
+			for _, data := range tc.Frames {
+				offset += int64(len(data))
+				out = append(out, l.tag(&sframer.StreamFrame{Data: []byte(data), Offset: offset})...)
+			}
+			if frame := l.flush(); frame != nil {
+				out = append(out, frame)
+			}
+
+			var levels []level
+			for _, frame := range out {
+				levels = append(levels, level{frame.Level, string(frame.Data)})
+			}
+			require.Equal(t, tc.Expected, levels)
+
+			// The last frame ends at the end of the data
+			require.Equal(t, offset, out[len(out)-1].Offset)
+		})
+	}
+}
+
+func TestFS_levelTagger_MaxLine(t *testing.T) {
+	t.Parallel()
+
+	l, err := newLevelTagger(nil, "")
+	require.NoError(t, err)
+	l.maxLine = 4096
+
+	// An unterminated line is tagged as is once it is too long to hold
+	chunk := []byte("ERROR " + strings.Repeat("x", 1018))
+	var out []byte
+	var offset int64
+	for i := 0; i < 100; i++ {
+		offset += int64(len(chunk))
+		for _, frame := range l.tag(&sframer.StreamFrame{File: "foo", Offset: offset, Data: chunk}) {
+			require.Equal(t, offset, frame.Offset)
+			out = append(out, frame.Data...)
+		}
+		require.LessOrEqual(t, len(l.partial), l.maxLine)
+	}
+	if frame := l.flush(); frame != nil {
+		out = append(out, frame.Data...)
+	}
+
+	require.Equal(t, strings.Repeat(string(chunk), 100), string(out))
+}
+
+func TestFS_levelTagger_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := newLevelTagger(map[string]string{"fatal": "FATAL"}, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown log level")
+
+	_, err = newLevelTagger(map[string]string{"error": "("}, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid pattern")
+
+	_, err = newLevelTagger(nil, "loud")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown minimum log level")
+}
+
+func TestFS_levelTagger_FileEvent(t *testing.T) {
+	t.Parallel()
+
+	l, err := newLevelTagger(nil, "error")
+	require.NoError(t, err)
+
+	// A file event is kept even when all the lines are dropped
+	out := l.tag(&sframer.StreamFrame{File: "f", FileEvent: truncateEvent, Data: []byte("[INFO] a\n"), Offset: 9})
+	require.Len(t, out, 1)
+	require.Equal(t, truncateEvent, out[0].FileEvent)
+	require.Empty(t, out[0].Data)
+	require.Equal(t, int64(9), out[0].Offset)
+}
+
+func TestFS_eventMarker(t *testing.T) {
+	t.Parallel()
+
+	m := &eventMarker{format: "--- %s ---"}
+	mark := func(event, data string) string {
+		return string(m.mark(&sframer.StreamFrame{FileEvent: event, Data: []byte(data)}))
+	}
+
+	// Data without events is untouched
+	require.Equal(t, "a\n", mark("", "a\n"))
+	require.Equal(t, "--- file truncated ---\n", mark(truncateEvent, ""))
+
+	// Markers are moved onto a line of their own and precede the data of
+	// their frame
+	require.Equal(t, "b", mark("", "b"))
+	require.Equal(t, "\n--- file deleted ---\nc\n", mark(deleteEvent, "c\n"))
+	require.Equal(t, "", mark("", ""))
+	require.Equal(t, "--- idle timeout ---\n", mark(idleTimeoutEvent, ""))
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/hashicorp/nomad/client/allocdir"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+)
+
+const (
+	// logTailCacheEntries is the number of log files whose ends are held in
+	// the log tail cache.
+	logTailCacheEntries = 256
+)
+
+// logTail is the end of a log file as of when it had the given size and
+// modification time.
+type logTail struct {
+	size    int64
+	modTime time.Time
+
+	// data holds the bytes of the file ending at size
+	data []byte
+}
+
+// logTailCache holds the ends of recently streamed log files in memory, so
+// that many clients attaching to the end of the same logs do not each read
+// them from disk. Entries are only used while the listed size and
+// modification time of the log file are unchanged, so rotation and truncation
+// invalidate them.
+type logTailCache struct {
+	// size is the number of bytes held from the end of each log file
+	size int64
+
+	entries *lru.Cache
+}
+
+func newLogTailCache(size int64) *logTailCache {
+	// Creating the cache only fails for a non-positive number of entries
+	entries, _ := lru.New(logTailCacheEntries)
+	return &logTailCache{
+		size:    size,
+		entries: entries,
+	}
+}
+
+// tail returns the data of the listed log file from offset to its listed
+// size, reading the end of the file into the cache if it is not held. It
+// returns false if the data doesn't fit in the cache or cannot be read, in
+// which case the file should be read from disk.
+func (c *logTailCache) tail(fs allocdir.AllocDirFS, allocID, path string,
+	entry *cstructs.AllocFileInfo, offset int64) ([]byte, bool) {
+
+	if offset >= entry.Size || entry.Size-offset > c.size {
+		return nil, false
+	}
+
+	key := allocID + "/" + path
+	if v, ok := c.entries.Get(key); ok {
+		t := v.(*logTail)
+		if t.size == entry.Size && t.modTime.Equal(entry.ModTime) {
+			return t.data[int64(len(t.data))-(entry.Size-offset):], true
+		}
+	}
+
+	start := entry.Size - c.size
+	if start < 0 {
+		start = 0
+	}
+	data, err := peekAt(fs, path, start, entry.Size-start)
+	if err != nil || int64(len(data)) != entry.Size-start {
+		// The file was removed or truncated since it was listed
+		return nil, false
+	}
+
+	c.entries.Add(key, &logTail{
+		size:    entry.Size,
+		modTime: entry.ModTime,
+		data:    data,
+	})
+	return data[offset-start:], true
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	sframer "github.com/hashicorp/nomad/client/lib/streamframer"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/stretchr/testify/require"
+)
+
+// readAtRecorder records the offsets files are read from.
+type readAtRecorder struct {
+	allocdir.AllocDirFS
+
+	l       sync.Mutex
+	offsets []int64
+}
+
+func (r *readAtRecorder) ReadAt(path string, offset int64) (io.ReadCloser, error) {
+	r.l.Lock()
+	r.offsets = append(r.offsets, offset)
+	r.l.Unlock()
+	return r.AllocDirFS.ReadAt(path, offset)
+}
+
+func (r *readAtRecorder) reset() []int64 {
+	r.l.Lock()
+	defer r.l.Unlock()
+	offsets := r.offsets
+	r.offsets = nil
+	return offsets
+}
+
+func TestFS_logsImpl_TailCache(t *testing.T) {
+	t.Parallel()
+
+	c, cleanup := TestClient(t, func(c *config.Config) {
+		c.FSLogTailCacheBytes = 8
+	})
+	defer cleanup()
+
+	// Get a temp alloc dir and create the log dir
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	logDir := filepath.Join(ad.SharedDir, allocdir.LogDirName)
+	require.NoError(t, os.MkdirAll(logDir, 0777))
+	logFile := filepath.Join(logDir, "foo.stdout.0")
+	require.NoError(t, ioutil.WriteFile(logFile, []byte("0123456789"), 0777))
+
+	fs := &readAtRecorder{AllocDirFS: ad}
+	attach := func(expected string) {
+		frames := make(chan *sframer.StreamFrame, 32)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		req := &cstructs.FsLogsRequest{
+			AllocID: "foo",
+			Task:    "foo",
+			LogType: "stdout",
+			Origin:  OriginEnd,
+			Offset:  4,
+		}
+		require.NoError(t, c.endpoints.FileSystem.logsImpl(ctx, req, fs, nil, frames))
+
+		var received string
+		timeout := time.After(time.Second)
+		for received != expected {
+			select {
+			case frame, ok := <-frames:
+				if !ok {
+					t.Fatalf("frames closed: got %q", received)
+				}
+				received += string(frame.Data)
+			case <-timeout:
+				t.Fatalf("did not receive logs: got %q", received)
+			}
+		}
+	}
+
+	// The first attach reads the end of the file into the cache
+	attach("6789")
+	require.Equal(t, []int64{2, 10}, fs.reset())
+
+	// The second attach is served from the cache and only reads new data
+	attach("6789")
+	require.Equal(t, []int64{10}, fs.reset())
+
+	// Writing to the file invalidates the cache
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("ab")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	attach("89ab")
+	require.Equal(t, []int64{4, 12}, fs.reset())
+
+	// Only the log file attached to is served from the cache, later ones
+	// are streamed from disk
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "foo.stdout.1"), []byte("cd"), 0777))
+	attach("abcd")
+	require.Equal(t, []int64{12, 0}, fs.reset())
+}
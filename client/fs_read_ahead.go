@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// readAheadChunk is the result of a single read of the underlying reader.
+type readAheadChunk struct {
+	buf  []byte
+	data []byte
+	err  error
+}
+
+// readAheadReader reads from an underlying reader in a background goroutine
+// so that slow reads do not stall the consumer. At most depth buffers of size
+// bytes are held at once and data is returned in the order it was read.
+//
+// The background goroutine stops after the underlying reader returns an
+// error, such as io.EOF, and is restarted by the next call to Read. This
+// allows the reader to be used to follow files that grow after EOF.
+type readAheadReader struct {
+	r io.Reader
+
+	// chunks holds read results waiting to be consumed and free holds the
+	// buffers available to the background goroutine.
+	chunks chan readAheadChunk
+	free   chan []byte
+
+	// running is true while the background goroutine has not yet delivered
+	// a chunk with an error.
+	running bool
+
+	// cur is the chunk being consumed
+	cur *readAheadChunk
+
+	doneCh   chan struct{}
+	doneOnce sync.Once
+}
+
+// newReadAheadReader returns a reader that reads ahead of the consumer from r
+// using depth buffers of size bytes. The reader is closed once the context is
+// done.
+func newReadAheadReader(ctx context.Context, r io.Reader, depth, size int) *readAheadReader {
+	free := make(chan []byte, depth)
+	for i := 0; i < depth; i++ {
+		free <- make([]byte, size)
+	}
+
+	ra := &readAheadReader{
+		r:      r,
+		chunks: make(chan readAheadChunk, depth),
+		free:   free,
+		doneCh: make(chan struct{}),
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ra.Close()
+		case <-ra.doneCh:
+		}
+	}()
+	return ra
+}
+
+// run reads from the underlying reader until it returns an error or the
+// reader is closed.
+func (r *readAheadReader) run() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.free:
+		case <-r.doneCh:
+			return
+		}
+
+		n, err := r.r.Read(buf)
+		select {
+		case r.chunks <- readAheadChunk{buf: buf, data: buf[:n], err: err}:
+		case <-r.doneCh:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read reads the next buffered data into p, blocking until the background
+// goroutine has read some. The error of the underlying reader is returned
+// once all the data read before it has been consumed.
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	if r.cur == nil {
+		if !r.running {
+			r.running = true
+			go r.run()
+		}
+
+		select {
+		case c := <-r.chunks:
+			r.cur = &c
+		case <-r.doneCh:
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	n := copy(p, r.cur.data)
+	r.cur.data = r.cur.data[n:]
+	if len(r.cur.data) != 0 {
+		return n, nil
+	}
+
+	// The chunk has been consumed so its buffer can be reused
+	err := r.cur.err
+	r.free <- r.cur.buf
+	r.cur = nil
+	if err != nil {
+		r.running = false
+	}
+	return n, err
+}
+
+// Close stops the background goroutine and unblocks a pending Read, which
+// returns io.ErrClosedPipe. It may be called concurrently with Read. It does
+// not close the underlying reader, whose outstanding read must complete before
+// the background goroutine exits.
+func (r *readAheadReader) Close() error {
+	r.doneOnce.Do(func() { close(r.doneCh) })
+	return nil
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// slowReader delays every read to simulate high latency storage
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+// eofReader returns the contents of a buffer that may be appended to after
+// EOF has been returned, like a followed file.
+type eofReader struct {
+	buf *bytes.Buffer
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	if e.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return e.buf.Read(p)
+}
+
+func TestFS_readAheadReader(t *testing.T) {
+	t.Parallel()
+
+	input := make([]byte, 10*1024+7)
+	for i := range input {
+		input[i] = byte(i % 251)
+	}
+
+	r := newReadAheadReader(context.Background(), bytes.NewReader(input), 3, 1024)
+	defer r.Close()
+
+	// Read with a buffer smaller than the chunks to check that partially
+	// consumed chunks keep their order
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(len(input))))
+	require.NoError(t, err)
+	require.Equal(t, input, out)
+
+	n, err := r.Read(make([]byte, 10))
+	require.Zero(t, n)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestFS_readAheadReader_ResumeAfterEOF(t *testing.T) {
+	t.Parallel()
+
+	buf := bytes.NewBufferString("foo")
+	r := newReadAheadReader(context.Background(), &eofReader{buf: buf}, 2, 16)
+	defer r.Close()
+
+	p := make([]byte, 16)
+	n, err := r.Read(p)
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(p[:n]))
+
+	n, err = r.Read(p)
+	require.Zero(t, n)
+	require.Equal(t, io.EOF, err)
+
+	// Data written after EOF is read once reading resumes
+	buf.WriteString("bar")
+	n, err = r.Read(p)
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(p[:n]))
+}
+
+func TestFS_readAheadReader_Error(t *testing.T) {
+	t.Parallel()
+
+	readErr := errors.New("disk on fire")
+	src := io.MultiReader(bytes.NewReader([]byte("data")), &errReader{readErr})
+	r := newReadAheadReader(context.Background(), src, 2, 16)
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(r)
+	require.Equal(t, readErr, err)
+	require.Equal(t, "data", string(out))
+}
+
+// blockingReader blocks every read until it is closed
+type blockingReader struct {
+	closeCh chan struct{}
+}
+
+func (b *blockingReader) Read([]byte) (int, error) {
+	<-b.closeCh
+	return 0, io.EOF
+}
+
+func TestFS_readAheadReader_Close(t *testing.T) {
+	t.Parallel()
+
+	src := &blockingReader{closeCh: make(chan struct{})}
+	defer close(src.closeCh)
+
+	// read returns the error of a read that blocks on the underlying reader
+	read := func(r *readAheadReader) <-chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := r.Read(make([]byte, 16))
+			errCh <- err
+		}()
+		return errCh
+	}
+
+	// Closing the reader unblocks the pending read
+	r := newReadAheadReader(context.Background(), src, 2, 16)
+	errCh := read(r)
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, r.Close())
+	select {
+	case err := <-errCh:
+		require.Equal(t, io.ErrClosedPipe, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not unblocked by close")
+	}
+
+	// As does cancelling its context
+	ctx, cancel := context.WithCancel(context.Background())
+	r = newReadAheadReader(ctx, src, 2, 16)
+	errCh = read(r)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		require.Equal(t, io.ErrClosedPipe, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not unblocked by cancelling the context")
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// BenchmarkReadAheadReader streams from a slow reader to a consumer that also
+// spends time on every frame, as when sending frames to a remote client.
+// Reading ahead overlaps the two so throughput improves with the depth.
+func BenchmarkReadAheadReader(b *testing.B) {
+	const (
+		frames    = 20
+		readDelay = time.Millisecond
+		sendDelay = time.Millisecond
+	)
+	input := make([]byte, frames*streamFrameSize)
+
+	for _, depth := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("depth_%d", depth), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			data := make([]byte, streamFrameSize)
+			for i := 0; i < b.N; i++ {
+				var r io.Reader = &slowReader{r: bytes.NewReader(input), delay: readDelay}
+				var ra *readAheadReader
+				if depth > 0 {
+					ra = newReadAheadReader(context.Background(), r, depth, streamFrameSize)
+					r = ra
+				}
+
+				for {
+					n, err := r.Read(data)
+					if n > 0 {
+						time.Sleep(sendDelay)
+					}
+					if err == io.EOF {
+						break
+					}
+					require.NoError(b, err)
+				}
+
+				if ra != nil {
+					ra.Close()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	sframer "github.com/hashicorp/nomad/client/lib/streamframer"
+)
+
+// sharedStreamKey identifies followed streams of a file that produce the same
+// frames when streaming from the same offset.
+type sharedStreamKey struct {
+	allocID     string
+	path        string
+	lineAligned bool
+}
+
+// sharedStreams deduplicates identical followed streams of the same file, such
+// as many operators tailing the same log during an incident. Rather than each
+// stream reading the file, a single reader is shared and its frames are
+// broadcast to every stream following the file.
+//
+// A stream only joins a shared reader whose frames so far end at the offset
+// the stream starts at, so joining never skips or repeats any data. Streams
+// that fall behind the reader by more than their buffer of frames are dropped
+// from it so that a slow stream cannot stall the others, and are expected to
+// continue reading the file themselves.
+type sharedStreams struct {
+	l       sync.Mutex
+	streams map[sharedStreamKey]*sharedStream
+
+	// readers is the number of shared readers started
+	readers int
+}
+
+// sharedStream is a reader of a file shared by its subscribers.
+type sharedStream struct {
+	subs   map[*sharedStreamSub]struct{}
+	cancel context.CancelFunc
+
+	// pos tracks the position of the data broadcast so far
+	pos *resumeTracker
+}
+
+// sharedStreamSub is a stream subscribed to a shared reader. Its frames are
+// sent to the channel given when subscribing, which is closed once the reader
+// stops or the subscriber falls behind.
+type sharedStreamSub struct {
+	s      *sharedStreams
+	key    sharedStreamKey
+	stream *sharedStream
+	frames chan *sframer.StreamFrame
+
+	// err is the error the reader stopped with and lagged whether the
+	// subscriber was dropped for falling behind. Both are set before
+	// frames is closed.
+	err    error
+	lagged bool
+}
+
+func newSharedStreams() *sharedStreams {
+	return &sharedStreams{
+		streams: make(map[sharedStreamKey]*sharedStream),
+	}
+}
+
+// subscribe sends the frames of the file identified by the key, starting at
+// offset, to frames. If no reader of the file is shared, one is started that
+// streams the file into a framer with read. nil is returned if the file is
+// already being read from another position, in which case the caller must
+// read the file itself.
+func (s *sharedStreams) subscribe(key sharedStreamKey, offset int64, frames chan *sframer.StreamFrame,
+	read func(ctx context.Context, framer *sframer.StreamFramer) error) *sharedStreamSub {
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	stream, ok := s.streams[key]
+	if ok && stream.pos.offset != offset {
+		return nil
+	}
+
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = &sharedStream{
+			subs:   make(map[*sharedStreamSub]struct{}),
+			cancel: cancel,
+			pos:    newResumeTracker(offset),
+		}
+		s.streams[key] = stream
+		s.readers++
+		go s.run(ctx, key, stream, read)
+	}
+
+	sub := &sharedStreamSub{
+		s:      s,
+		key:    key,
+		stream: stream,
+		frames: frames,
+	}
+	stream.subs[sub] = struct{}{}
+	return sub
+}
+
+// run reads the file of a shared stream and broadcasts its frames until the
+// reader stops or the stream has no subscribers left.
+func (s *sharedStreams) run(ctx context.Context, key sharedStreamKey, stream *sharedStream,
+	read func(ctx context.Context, framer *sframer.StreamFramer) error) {
+
+	frames := make(chan *sframer.StreamFrame, streamFramesBuffer)
+	framer := sframer.NewStreamFramer(frames, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
+	framer.SetLineAligned(key.lineAligned)
+	framer.Run()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- read(ctx, framer)
+		framer.Destroy()
+	}()
+
+	for frame := range frames {
+		s.l.Lock()
+		stream.pos.update(frame)
+		for sub := range stream.subs {
+			select {
+			case sub.frames <- frame.Copy():
+			default:
+				sub.lagged = true
+				s.removeLocked(sub)
+				close(sub.frames)
+			}
+		}
+		s.l.Unlock()
+	}
+
+	// Stop the remaining subscribers with the error of the reader, unless it
+	// was stopped since no subscribers were left
+	err := <-errCh
+	s.l.Lock()
+	defer s.l.Unlock()
+	for sub := range stream.subs {
+		sub.err = err
+		s.removeLocked(sub)
+		close(sub.frames)
+	}
+	if s.streams[key] == stream {
+		delete(s.streams, key)
+	}
+	stream.cancel()
+}
+
+// leave unsubscribes the subscriber, stopping the reader if no subscribers are
+// left. Its frames channel is not closed.
+func (sub *sharedStreamSub) leave() {
+	sub.s.l.Lock()
+	defer sub.s.l.Unlock()
+	sub.s.removeLocked(sub)
+}
+
+// removeLocked removes the subscriber from its stream, stopping the reader if
+// no subscribers are left. Must be called with the lock held.
+func (s *sharedStreams) removeLocked(sub *sharedStreamSub) {
+	stream := sub.stream
+	if _, ok := stream.subs[sub]; !ok {
+		return
+	}
+
+	delete(stream.subs, sub)
+	if len(stream.subs) == 0 {
+		if s.streams[sub.key] == stream {
+			delete(s.streams, sub.key)
+		}
+		stream.cancel()
+	}
+}
+
+// result returns whether the subscriber was dropped for falling behind and the
+// error the reader stopped with, once its frames channel is closed.
+func (sub *sharedStreamSub) result() (bool, error) {
+	sub.s.l.Lock()
+	defer sub.s.l.Unlock()
+	return sub.lagged, sub.err
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sframer "github.com/hashicorp/nomad/client/lib/streamframer"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveData returns the data of the frames received until it amounts to n
+// bytes.
+func receiveData(t *testing.T, frames <-chan *sframer.StreamFrame, n int) string {
+	t.Helper()
+
+	var data string
+	timeout := time.After(5 * time.Second)
+	for len(data) < n {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				t.Fatalf("frames closed after receiving %q", data)
+			}
+			data += string(frame.Data)
+		case <-timeout:
+			t.Fatalf("timed out after receiving %q", data)
+		}
+	}
+	return data
+}
+
+func TestFS_sharedStreams(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s := newSharedStreams()
+	key := sharedStreamKey{allocID: "alloc", path: "file"}
+
+	// The reader sends data whenever asked to until it is stopped
+	send := make(chan string)
+	stopped := make(chan struct{})
+	read := func(ctx context.Context, framer *sframer.StreamFramer) error {
+		defer close(stopped)
+		offset := int64(0)
+		for {
+			select {
+			case data := <-send:
+				if err := framer.Send("file", "", []byte(data), offset); err != nil {
+					return err
+				}
+				offset += int64(len(data))
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+
+	frames1 := make(chan *sframer.StreamFrame, streamFramesBuffer)
+	sub1 := s.subscribe(key, 0, frames1, read)
+	require.NotNil(sub1)
+
+	send <- "hello "
+	require.Equal("hello ", receiveData(t, frames1, 6))
+
+	// Joining from an offset other than the position of the reader fails
+	require.Nil(s.subscribe(key, 0, make(chan *sframer.StreamFrame, 1), read))
+
+	// Joining from the position of the reader shares it
+	frames2 := make(chan *sframer.StreamFrame, streamFramesBuffer)
+	sub2 := s.subscribe(key, 6, frames2, read)
+	require.NotNil(sub2)
+
+	send <- "world"
+	require.Equal("world", receiveData(t, frames1, 5))
+	require.Equal("world", receiveData(t, frames2, 5))
+	require.Equal(1, s.readers)
+
+	// A different file has a reader of its own
+	other := make(chan *sframer.StreamFrame, streamFramesBuffer)
+	sub3 := s.subscribe(sharedStreamKey{allocID: "alloc", path: "other"}, 6, other,
+		func(ctx context.Context, _ *sframer.StreamFramer) error {
+			<-ctx.Done()
+			return nil
+		})
+	require.NotNil(sub3)
+	require.Equal(2, s.readers)
+	sub3.leave()
+
+	// The reader stops once all subscribers left
+	sub1.leave()
+	select {
+	case <-stopped:
+		t.Fatalf("reader stopped while subscribed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sub2.leave()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reader not stopped")
+	}
+}
+
+func TestFS_sharedStreams_Lagged(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s := newSharedStreams()
+	key := sharedStreamKey{allocID: "alloc", path: "file"}
+
+	// The reader sends frames as fast as they are broadcast once both
+	// subscribers joined
+	const frameCount = 10
+	start := make(chan struct{})
+	read := func(ctx context.Context, framer *sframer.StreamFramer) error {
+		<-start
+		data := make([]byte, streamFrameSize)
+		for i := 0; i < frameCount; i++ {
+			if err := framer.Send("file", "", data, int64(i*streamFrameSize)); err != nil {
+				return err
+			}
+		}
+		<-ctx.Done()
+		return nil
+	}
+
+	// The subscriber that is not read from falls behind without stalling the
+	// other one
+	slow := make(chan *sframer.StreamFrame, 1)
+	fast := make(chan *sframer.StreamFrame, streamFramesBuffer)
+	subSlow := s.subscribe(key, 0, slow, read)
+	subFast := s.subscribe(key, 0, fast, read)
+	require.NotNil(subSlow)
+	require.NotNil(subFast)
+	defer subFast.leave()
+	close(start)
+
+	receiveData(t, fast, frameCount*streamFrameSize)
+
+	received := 0
+	for range slow {
+		received++
+	}
+	require.Equal(1, received)
+
+	lagged, err := subSlow.result()
+	require.True(lagged)
+	require.NoError(err)
+
+	lagged, _ = subFast.result()
+	require.False(lagged)
+}
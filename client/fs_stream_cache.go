@@ -0,0 +1,179 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/hashicorp/nomad/client/allocdir"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+)
+
+const (
+	// fileStreamCacheDir is the directory within the client's state
+	// directory holding the copies of cached files.
+	fileStreamCacheDir = "fs_stream_cache"
+
+	// defaultFileStreamCacheTTL is how long cached files are served for when
+	// the client does not configure a TTL.
+	defaultFileStreamCacheTTL = 10 * time.Minute
+)
+
+// cachedFile is a copy of a streamed file held on disk.
+type cachedFile struct {
+	path  string
+	size  int64
+	added time.Time
+}
+
+// fileStreamCache caches copies of streamed files on disk, so that repeated
+// streams of the same unchanged file, such as by debug tooling fetching an
+// artifact, are served without reading it from the allocation directory.
+// Copies are keyed by the allocation, path, size and modification time of the
+// file, are evicted least recently used first to stay within a total size and
+// expire after a TTL.
+type fileStreamCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+
+	l       sync.Mutex
+	entries *simplelru.LRU
+	bytes   int64
+}
+
+func newFileStreamCache(dir string, maxBytes int64, ttl time.Duration) *fileStreamCache {
+	if ttl == 0 {
+		ttl = defaultFileStreamCacheTTL
+	}
+
+	// Copies cached by a previous run of the agent are not tracked
+	os.RemoveAll(dir)
+
+	c := &fileStreamCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+	}
+
+	// Entries are bounded by their total size rather than their number, and
+	// creating the LRU only fails for a non-positive number of entries
+	c.entries, _ = simplelru.NewLRU(math.MaxInt32, c.evicted)
+	return c
+}
+
+// evicted removes the copy of an evicted file. It is called with the lock
+// held.
+func (c *fileStreamCache) evicted(_, value interface{}) {
+	f := value.(*cachedFile)
+	c.bytes -= f.size
+	os.Remove(f.path)
+}
+
+// fileStreamCacheKey returns the key of the copy of the file with the passed
+// info, so that changing the file invalidates its copy.
+func fileStreamCacheKey(allocID, path string, info *cstructs.AllocFileInfo) string {
+	return fmt.Sprintf("%s/%s/%d/%d", allocID, path, info.Size, info.ModTime.UnixNano())
+}
+
+// open returns the cached copy of the file with the passed key, or false if
+// there is no unexpired copy. The caller must close the returned file.
+func (c *fileStreamCache) open(key string) (*os.File, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	v, ok := c.entries.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	f := v.(*cachedFile)
+	if time.Since(f.added) > c.ttl {
+		c.entries.Remove(key)
+		return nil, false
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		c.entries.Remove(key)
+		return nil, false
+	}
+	return file, true
+}
+
+// add copies the file at path in the allocation directory into the cache and
+// returns the open copy. It returns false if the file is larger than the cache
+// or does not have the passed size when copied, such as when it is being
+// written to. The caller must close the returned file.
+func (c *fileStreamCache) add(fs allocdir.AllocDirFS, key, path string, size int64) (*os.File, bool, error) {
+	if size > c.maxBytes {
+		return nil, false, nil
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, false, err
+	}
+	copied, err := ioutil.TempFile(c.dir, "file")
+	if err != nil {
+		return nil, false, err
+	}
+
+	// One more byte than the size is read to detect the file growing
+	n, err := copyFile(copied, fs, path, size+1)
+	if err != nil || n != size {
+		copied.Close()
+		os.Remove(copied.Name())
+		return nil, false, err
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	// Replacing an entry does not evict it, so the copy made by a concurrent
+	// stream of the same file is removed first
+	c.entries.Remove(key)
+	c.entries.Add(key, &cachedFile{
+		path:  copied.Name(),
+		size:  size,
+		added: time.Now(),
+	})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.entries.RemoveOldest()
+	}
+
+	return copied, true, nil
+}
+
+// copyFile copies up to limit bytes of the file at path in the allocation
+// directory into w, returning the number of bytes copied.
+func copyFile(w io.Writer, fs allocdir.AllocDirFS, path string, limit int64) (int64, error) {
+	r, err := fs.ReadAt(path, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return io.Copy(w, io.LimitReader(r, limit))
+}
+
+// cachedFileFS reads a single path of an allocation directory from a cached
+// copy of the file.
+type cachedFileFS struct {
+	allocdir.AllocDirFS
+
+	path string
+	file *os.File
+}
+
+func (c *cachedFileFS) ReadAt(path string, offset int64) (io.ReadCloser, error) {
+	if path != c.path {
+		return c.AllocDirFS.ReadAt(path, offset)
+	}
+	return ioutil.NopCloser(io.NewSectionReader(c.file, offset, math.MaxInt64-offset)), nil
+}
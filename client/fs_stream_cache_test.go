@@ -0,0 +1,82 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS_fileStreamCache(t *testing.T) {
+	t.Parallel()
+
+	ad := tempAllocDir(t)
+	require.NoError(t, ad.Build())
+	defer ad.Destroy()
+
+	dataDir := filepath.Join(ad.SharedDir, allocdir.SharedDataDir)
+	for name, data := range map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccccccccc"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dataDir, name), []byte(data), 0666))
+	}
+
+	dir := filepath.Join(t.TempDir(), fileStreamCacheDir)
+	cache := newFileStreamCache(dir, 8, time.Hour)
+
+	add := func(name string, size int64) bool {
+		f, ok, err := cache.add(ad, name, filepath.Join("alloc/data", name), size)
+		require.NoError(t, err)
+		if ok {
+			require.NoError(t, f.Close())
+		}
+		return ok
+	}
+	cached := func(key string) bool {
+		f, ok := cache.open(key)
+		if ok {
+			require.NoError(t, f.Close())
+		}
+		return ok
+	}
+
+	// Copies are read back from the cache
+	require.True(t, add("a", 4))
+	f, ok := cache.open("a")
+	require.True(t, ok)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, "aaaa", string(data))
+
+	// Files larger than the cache or that changed are not cached
+	require.False(t, add("c", 10))
+	require.False(t, add("b", 3))
+	require.Equal(t, 1, cache.entries.Len())
+
+	// The least recently used copy is evicted and removed to stay within
+	// the size of the cache
+	require.True(t, add("b", 4))
+	require.True(t, cached("a"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dataDir, "c"), []byte("cccc"), 0666))
+	require.True(t, add("c", 4))
+
+	require.False(t, cached("b"))
+	require.Equal(t, int64(8), cache.bytes)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// Expired copies are not served
+	cache.ttl = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	require.False(t, cached("a"))
+	require.Equal(t, 1, cache.entries.Len())
+
+	// Copies from a previous run are removed
+	newFileStreamCache(dir, 8, time.Hour)
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+}
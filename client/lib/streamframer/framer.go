@@ -2,7 +2,9 @@ package framer
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io/ioutil"
 	"sync"
 	"time"
 )
@@ -27,11 +29,105 @@ type StreamFrame struct {
 	// FileEvent is the last file event that occurred that could cause the
 	// streams position to change or end
 	FileEvent string `json:",omitempty"`
+
+	// TotalBytes is the total number of bytes the stream will deliver. It is
+	// only set on the initial frame of a bounded stream when requested.
+	TotalBytes int64 `json:",omitempty"`
+
+	// ResumeToken identifies the position in the file after this frame's
+	// data and can be used to resume the stream after reconnecting.
+	ResumeToken string `json:",omitempty"`
+
+	// DroppedLines is the number of lines dropped by rate limiting since the
+	// previous frame.
+	DroppedLines int64 `json:",omitempty"`
+
+	// Path is the canonical path of the streamed file within the allocation
+	// directory. It is only set on the initial frame of a stream.
+	Path string `json:",omitempty"`
+
+	// Level is the log level detected in the lines of the frame's data, when
+	// level detection is requested.
+	Level string `json:",omitempty"`
+
+	// Seq is the sequence number of the frame when a sequenced stream is
+	// requested. It starts at one and increases by one for every frame sent
+	// other than heartbeats, so clients can detect missing or reordered
+	// frames.
+	Seq int64 `json:",omitempty"`
+
+	// Checksum is the hex encoded checksum of all the data streamed, using
+	// the algorithm requested. It is only set on the final frame of a
+	// completed stream.
+	Checksum string `json:",omitempty"`
+
+	// ExitInfo is the exit status of the task, set on the final frame of a
+	// completed log stream of a stopped task when requested.
+	ExitInfo *TaskExitInfo `json:",omitempty"`
+
+	// FirstLine and LastLine are the numbers of the first and last lines of
+	// the frame's data, counted from the start of the logs, when line ranges
+	// are requested. A line split across frames is included in the range of
+	// each of them.
+	FirstLine int64 `json:",omitempty"`
+	LastLine  int64 `json:",omitempty"`
+
+	// Compressed marks that Data is gzip compressed, which is only done for
+	// frames with more data than the compression threshold of the request.
+	Compressed bool `json:",omitempty"`
+
+	// LogStat is a snapshot of the newest file of a followed log, sent
+	// periodically when requested.
+	LogStat *LogFileStat `json:",omitempty"`
+
+	// Manifest lists the log files streamed by a logs stream that is not
+	// followed, in the order they are streamed. It is only set on the
+	// initial frame of the stream when requested.
+	Manifest []*LogManifestEntry `json:",omitempty"`
+}
+
+// TaskExitInfo is the exit status of a stopped task.
+type TaskExitInfo struct {
+	ExitCode   int
+	Signal     int
+	OOMKilled  bool
+	FinishedAt time.Time
+}
+
+// LogFileStat is a snapshot of the newest file of a log.
+type LogFileStat struct {
+	// File is the path of the log file and Index its rotation index
+	File  string
+	Index int64
+
+	// Size is the size of the log file when the snapshot was taken
+	Size int64
+}
+
+// LogManifestEntry describes a log file streamed by a logs stream and the
+// range of the stream's bytes read from it.
+type LogManifestEntry struct {
+	// File is the path of the log file and Index its rotation index
+	File  string
+	Index int64
+
+	// Size is the size of the log file and FileOffset the offset within
+	// it the stream starts reading it at
+	Size       int64
+	FileOffset int64
+
+	// Start and End are the offsets within the combined data of the stream
+	// of the first byte read from the file and of the byte after the last
+	Start int64
+	End   int64
 }
 
 // IsHeartbeat returns if the frame is a heartbeat frame
 func (s *StreamFrame) IsHeartbeat() bool {
-	return s.Offset == 0 && len(s.Data) == 0 && s.File == "" && s.FileEvent == ""
+	return s.Offset == 0 && len(s.Data) == 0 && s.File == "" && s.FileEvent == "" &&
+		s.TotalBytes == 0 && s.ResumeToken == "" && s.DroppedLines == 0 && s.Path == "" &&
+		s.Level == "" && s.Seq == 0 && s.Checksum == "" && s.ExitInfo == nil && s.FirstLine == 0 && s.LastLine == 0 && !s.Compressed &&
+		s.LogStat == nil && len(s.Manifest) == 0
 }
 
 func (s *StreamFrame) Clear() {
@@ -39,6 +135,19 @@ func (s *StreamFrame) Clear() {
 	s.Data = nil
 	s.File = ""
 	s.FileEvent = ""
+	s.TotalBytes = 0
+	s.ResumeToken = ""
+	s.DroppedLines = 0
+	s.Path = ""
+	s.Level = ""
+	s.Seq = 0
+	s.Checksum = ""
+	s.ExitInfo = nil
+	s.FirstLine = 0
+	s.LastLine = 0
+	s.Compressed = false
+	s.LogStat = nil
+	s.Manifest = nil
 }
 
 func (s *StreamFrame) IsCleared() bool {
@@ -50,6 +159,30 @@ func (s *StreamFrame) IsCleared() bool {
 		return false
 	} else if s.FileEvent != "" {
 		return false
+	} else if s.TotalBytes != 0 {
+		return false
+	} else if s.ResumeToken != "" {
+		return false
+	} else if s.DroppedLines != 0 {
+		return false
+	} else if s.Path != "" {
+		return false
+	} else if s.Level != "" {
+		return false
+	} else if s.Seq != 0 {
+		return false
+	} else if s.Checksum != "" {
+		return false
+	} else if s.ExitInfo != nil {
+		return false
+	} else if s.FirstLine != 0 || s.LastLine != 0 {
+		return false
+	} else if s.Compressed {
+		return false
+	} else if s.LogStat != nil {
+		return false
+	} else if s.Manifest != nil {
+		return false
 	} else {
 		return true
 	}
@@ -60,9 +193,84 @@ func (s *StreamFrame) Copy() *StreamFrame {
 	*n = *s
 	n.Data = make([]byte, len(s.Data))
 	copy(n.Data, s.Data)
+	if s.ExitInfo != nil {
+		info := *s.ExitInfo
+		n.ExitInfo = &info
+	}
+	if s.LogStat != nil {
+		stat := *s.LogStat
+		n.LogStat = &stat
+	}
+	if s.Manifest != nil {
+		n.Manifest = make([]*LogManifestEntry, len(s.Manifest))
+		for i, entry := range s.Manifest {
+			e := *entry
+			n.Manifest[i] = &e
+		}
+	}
 	return n
 }
 
+// CompressData gzip compresses the frame's data if it is larger than minBytes.
+// Smaller frames are left uncompressed since compressing them wastes CPU and
+// can inflate their size.
+func (s *StreamFrame) CompressData(minBytes int) error {
+	if s.Compressed || len(s.Data) <= minBytes {
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(s.Data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	s.Data = compressed.Bytes()
+	s.Compressed = true
+	return nil
+}
+
+// DecompressData restores the frame's data if it was compressed.
+func (s *StreamFrame) DecompressData() error {
+	if !s.Compressed {
+		return nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(s.Data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.Data = data
+	s.Compressed = false
+	return nil
+}
+
+// FileFiller fills in the File of frames received from a compact stream, in
+// which only the first frame for a file sets its name.
+type FileFiller struct {
+	file string
+}
+
+// Fill sets the frame's File to the last file seen if it is omitted. Heartbeat
+// frames are left untouched.
+func (f *FileFiller) Fill(frame *StreamFrame) {
+	if frame.File != "" {
+		f.file = frame.File
+	} else if !frame.IsHeartbeat() {
+		frame.File = f.file
+	}
+}
+
 // StreamFramer is used to buffer and send frames as well as heartbeat.
 type StreamFramer struct {
 	// out is where frames are sent and is closed when no more frames will
@@ -94,6 +302,14 @@ type StreamFramer struct {
 
 	// Captures whether the framer is running
 	running bool
+
+	// lineAligned holds back data after the last newline so that frames end
+	// on line boundaries, unless flushPartial is set. holdPartial ignores
+	// calls to FlushPartial so that partial lines are only sent once the
+	// framer stops.
+	lineAligned  bool
+	flushPartial bool
+	holdPartial  bool
 }
 
 // NewStreamFramer creates a new stream framer that will output StreamFrames to
@@ -144,6 +360,36 @@ func (s *StreamFramer) Destroy() {
 	}
 }
 
+// SetLineAligned sets whether frames must end on a line boundary. When set,
+// data after the last newline is held back until the line is completed or
+// FlushPartial is called. Lines longer than the frame size are still split.
+func (s *StreamFramer) SetLineAligned(aligned bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.lineAligned = aligned
+}
+
+// SetHoldPartial sets whether a trailing partial line held back by line
+// alignment is kept until the line is completed even when FlushPartial is
+// called, such as when following a file that is still being written. The
+// partial line is still sent once the framer stops.
+func (s *StreamFramer) SetHoldPartial(hold bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.holdPartial = hold
+}
+
+// FlushPartial allows a trailing partial line held back by line alignment to
+// be sent, such as when the end of the file has been reached. Data sent
+// afterwards is line aligned again.
+func (s *StreamFramer) FlushPartial() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if !s.holdPartial {
+		s.flushPartial = true
+	}
+}
+
 // Run starts a long lived goroutine that handles sending data as well as
 // heartbeating
 func (s *StreamFramer) Run() {
@@ -199,6 +445,7 @@ OUTER:
 
 	s.l.Lock()
 	// Send() may have left a partial frame. Send it now.
+	s.flushPartial = true
 	if !s.f.IsCleared() {
 		s.f.Data = s.readData()
 
@@ -222,9 +469,22 @@ func (s *StreamFramer) send() {
 	}
 
 	s.f.Data = s.readData()
+
+	// Wait for the rest of the line when all the data is held back
+	if len(s.f.Data) == 0 && s.f.FileEvent == "" && s.data.Len() != 0 {
+		return
+	}
+
 	select {
 	case s.out <- s.f.Copy():
+		// Keep the file of a partial line held back so that it is still sent
+		// when flushed
+		file, offset := s.f.File, s.f.Offset
 		s.f.Clear()
+		if s.data.Len() != 0 {
+			s.f.File = file
+			s.f.Offset = offset
+		}
 	case <-s.exitCh:
 	}
 }
@@ -238,6 +498,17 @@ func (s *StreamFramer) readData() []byte {
 	if size > s.frameSize {
 		size = s.frameSize
 	}
+
+	// Only read up to the last complete line, unless the line does not fit
+	// in a frame
+	if s.lineAligned && !s.flushPartial && size > 0 {
+		if i := bytes.LastIndexByte(s.data.Bytes()[:size], '\n'); i >= 0 {
+			size = i + 1
+		} else if s.data.Len() < s.frameSize {
+			size = 0
+		}
+	}
+
 	if size == 0 {
 		return nil
 	}
@@ -259,8 +530,17 @@ func (s *StreamFramer) Send(file, fileEvent string, data []byte, offset int64) e
 
 	// Check if not mergeable
 	if !s.f.IsCleared() && (s.f.File != file || s.f.FileEvent != fileEvent) {
-		// Flush the old frame
+		// Flush the old frame, including any partial line held back since
+		// it cannot be merged into the new frame
+		flushPartial := s.flushPartial
+		s.flushPartial = true
 		s.send()
+		s.flushPartial = flushPartial
+	}
+
+	// New data may complete a held back line
+	if len(data) != 0 {
+		s.flushPartial = false
 	}
 
 	// Store the new data as the current frame.
@@ -304,5 +584,11 @@ func (s *StreamFramer) Send(file, fileEvent string, data []byte, offset int64) e
 		s.f.Offset += int64(len(s.f.Data))
 	}
 
+	// A frame carrying only a file event has been sent in full, so clear it to
+	// avoid it being sent again on the next flush.
+	if s.data.Len() == 0 && len(data) == 0 && s.f.FileEvent != "" {
+		s.f.Clear()
+	}
+
 	return nil
 }
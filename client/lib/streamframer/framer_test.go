@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -258,3 +259,200 @@ func TestStreamFramer_Order(t *testing.T) {
 		t.Fatal("out channel should be closed")
 	}
 }
+
+func TestFileFiller_Fill(t *testing.T) {
+	var filler FileFiller
+
+	frames := []*StreamFrame{
+		{File: "foo", Data: []byte("a")},
+		{Data: []byte("b")},
+		{},
+		{FileEvent: "file truncated"},
+		{File: "bar", Data: []byte("c")},
+		{Data: []byte("d")},
+	}
+	expected := []string{"foo", "foo", "", "foo", "bar", "bar"}
+
+	for i, frame := range frames {
+		filler.Fill(frame)
+		if frame.File != expected[i] {
+			t.Fatalf("frame %d: got file %q; want %q", i, frame.File, expected[i])
+		}
+	}
+}
+
+// This test checks that a frame carrying only a file event is sent once.
+func TestStreamFramer_FileEventOnce(t *testing.T) {
+	frames := make(chan *StreamFrame, 10)
+	hRate, bWindow := 100*time.Millisecond, 50*time.Millisecond
+	sf := NewStreamFramer(frames, hRate, bWindow, 100)
+	sf.Run()
+	defer sf.Destroy()
+
+	if err := sf.Send("foo", "file created", nil, 0); err != nil {
+		t.Fatalf("Send() failed %v", err)
+	}
+	if err := sf.Send("foo", "", []byte("data"), 0); err != nil {
+		t.Fatalf("Send() failed %v", err)
+	}
+
+	var events, data int
+	timeout := time.After(5 * bWindow)
+OUTER:
+	for {
+		select {
+		case f := <-frames:
+			if f.FileEvent != "" {
+				events++
+			}
+			if len(f.Data) > 0 {
+				data++
+			}
+		case <-timeout:
+			break OUTER
+		}
+	}
+
+	if events != 1 || data != 1 {
+		t.Fatalf("got %d event frames and %d data frames; want 1 of each", events, data)
+	}
+}
+
+func TestStreamFramer_LineAligned(t *testing.T) {
+	frames := make(chan *StreamFrame, 32)
+	hRate, bWindow := 100*time.Millisecond, 20*time.Millisecond
+	sf := NewStreamFramer(frames, hRate, bWindow, 16)
+	sf.SetLineAligned(true)
+	sf.Run()
+	defer sf.Destroy()
+
+	// Lines of varying length sent in chunks that don't align to either the
+	// lines or the frame size
+	lines := []string{"short\n", "a longer line\n", "x\n", "exactly 16 byte\n", "another one\n"}
+	input := []byte(strings.Join(lines, "") + "partial")
+	for start := 0; start < len(input); start += 7 {
+		end := start + 7
+		if end > len(input) {
+			end = len(input)
+		}
+		if err := sf.Send("foo", "", input[start:end], int64(end)); err != nil {
+			t.Fatalf("Send() failed %v", err)
+		}
+		time.Sleep(bWindow / 2)
+	}
+
+	// Collect the frames until only the partial line is held back
+	var received []string
+	timeout := time.After(5 * bWindow)
+OUTER:
+	for {
+		select {
+		case f := <-frames:
+			if len(f.Data) > 0 {
+				received = append(received, string(f.Data))
+			}
+		case <-timeout:
+			break OUTER
+		}
+	}
+
+	for _, data := range received {
+		if !strings.HasSuffix(data, "\n") {
+			t.Fatalf("frame %q does not end on a line boundary; got %q", data, received)
+		}
+	}
+	if got := strings.Join(received, ""); got != strings.Join(lines, "") {
+		t.Fatalf("got %q; want %q", got, strings.Join(lines, ""))
+	}
+
+	// The partial line is sent once flushed
+	sf.FlushPartial()
+	timeout = time.After(5 * bWindow)
+	for {
+		select {
+		case f := <-frames:
+			if f.IsHeartbeat() {
+				continue
+			}
+			if string(f.Data) != "partial" {
+				t.Fatalf("got %q; want %q", f.Data, "partial")
+			}
+			return
+		case <-timeout:
+			t.Fatalf("partial line not flushed")
+		}
+	}
+}
+
+func TestStreamFramer_HoldPartial(t *testing.T) {
+	frames := make(chan *StreamFrame, 32)
+	hRate, bWindow := 100*time.Millisecond, 20*time.Millisecond
+	sf := NewStreamFramer(frames, hRate, bWindow, 64)
+	sf.SetLineAligned(true)
+	sf.SetHoldPartial(true)
+	sf.Run()
+
+	if err := sf.Send("foo", "", []byte("line\npartial"), 0); err != nil {
+		t.Fatalf("Send() failed %v", err)
+	}
+
+	// The partial line is held back even when flushed
+	sf.FlushPartial()
+	var received []string
+	timeout := time.After(5 * bWindow)
+OUTER:
+	for {
+		select {
+		case f := <-frames:
+			if len(f.Data) > 0 {
+				received = append(received, string(f.Data))
+			}
+		case <-timeout:
+			break OUTER
+		}
+	}
+	if !reflect.DeepEqual(received, []string{"line\n"}) {
+		t.Fatalf("got %q; want only the complete line", received)
+	}
+
+	// It is sent once the framer stops
+	sf.Destroy()
+	received = nil
+	for f := range frames {
+		if len(f.Data) > 0 {
+			received = append(received, string(f.Data))
+		}
+	}
+	if !reflect.DeepEqual(received, []string{"partial"}) {
+		t.Fatalf("got %q; want the partial line", received)
+	}
+}
+
+func TestStreamFrame_CompressData(t *testing.T) {
+	small := []byte("hello\n")
+	large := bytes.Repeat([]byte("hello world\n"), 100)
+
+	// Frames not larger than the threshold are left uncompressed
+	f := &StreamFrame{Data: small}
+	if err := f.CompressData(len(small)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.Compressed || !bytes.Equal(f.Data, small) {
+		t.Fatalf("small frame compressed: %#v", f)
+	}
+
+	f = &StreamFrame{Data: large}
+	if err := f.CompressData(len(small)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !f.Compressed || len(f.Data) >= len(large) {
+		t.Fatalf("large frame not compressed: %d bytes", len(f.Data))
+	}
+
+	if err := f.DecompressData(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.Compressed || !bytes.Equal(f.Data, large) {
+		t.Fatalf("decompressed frame does not match")
+	}
+}
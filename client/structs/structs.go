@@ -3,9 +3,13 @@ package structs
 //go:generate codecgen -c github.com/hashicorp/go-msgpack/codec -st codec -d 102 -t codegen_generated -o structs.generated.go structs.go
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
+	"io/ioutil"
 	"time"
 
+	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/nomad/client/stats"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/plugins/device"
@@ -62,6 +66,25 @@ type AllocFileInfo struct {
 	FileMode    string
 	ModTime     time.Time
 	ContentType string `json:",omitempty"`
+
+	// UID and GID are the numeric owner and group of the file. They are only
+	// set when requested from List or Stat and are nil on platforms without
+	// integer ownership identifiers such as Windows.
+	UID *int `json:",omitempty"`
+	GID *int `json:",omitempty"`
+
+	// Inode and Device identify the file on the host so that a file being
+	// replaced, such as when a log is rotated, can be detected. They are
+	// only set when requested from Stat or Changed and are nil on platforms
+	// that do not provide them such as Windows.
+	Inode  *uint64 `json:",omitempty"`
+	Device *uint64 `json:",omitempty"`
+
+	// Checksum is the hex encoded digest of the file's contents using the
+	// algorithm requested from List. ChecksumSkipped is set instead for
+	// files that are not regular files or that exceed the checksum limits.
+	Checksum        string `json:",omitempty"`
+	ChecksumSkipped bool   `json:",omitempty"`
 }
 
 // FsListRequest is used to list an allocation's directory.
@@ -72,6 +95,29 @@ type FsListRequest struct {
 	// Path is the path to list
 	Path string
 
+	// Recursive lists the whole directory tree below the path. The names of
+	// the files are their paths relative to the listed path, in lexical
+	// order.
+	Recursive bool
+
+	// MaxEntries is the maximum number of files returned by a recursive
+	// listing. It defaults to, and is capped at, the maximum number of
+	// entries of the client.
+	MaxEntries int
+
+	// Compress allows large listings to be returned compressed in
+	// CompressedFiles instead of in Files.
+	Compress bool
+
+	// Checksum is the algorithm, one of "md5", "sha1" or "sha256", used to
+	// checksum the contents of each listed file. No checksums are computed
+	// if it is empty. Files larger than 64MiB, or read after 256MiB have
+	// been checksummed, are skipped.
+	Checksum string
+
+	// Owner includes the owner and group of the files in the response
+	Owner bool
+
 	structs.QueryOptions
 }
 
@@ -80,9 +126,72 @@ type FsListResponse struct {
 	// Files are the result of listing a directory.
 	Files []*AllocFileInfo
 
+	// CompressedFiles holds the gzip compressed msgpack encoding of the files
+	// when the compression of a large listing was requested. Files is empty
+	// when set. Use DecompressFiles to restore Files.
+	CompressedFiles []byte
+
+	// Truncated is set when a recursive listing found more files than its
+	// maximum number of entries, in which case only the first are returned
+	Truncated bool
+
 	structs.QueryMeta
 }
 
+// CompressFiles replaces the files with their compressed encoding if it is at
+// least threshold bytes. Smaller listings are left uncompressed since the
+// savings would not be worth the overhead.
+func (r *FsListResponse) CompressFiles(threshold int) error {
+	var encoded bytes.Buffer
+	if err := codec.NewEncoder(&encoded, structs.MsgpackHandle).Encode(r.Files); err != nil {
+		return err
+	}
+	if encoded.Len() < threshold {
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(encoded.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	r.Files = nil
+	r.CompressedFiles = compressed.Bytes()
+	return nil
+}
+
+// DecompressFiles restores the files from their compressed encoding, if the
+// listing was compressed.
+func (r *FsListResponse) DecompressFiles() error {
+	if len(r.CompressedFiles) == 0 {
+		return nil
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(r.CompressedFiles))
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	encoded, err := ioutil.ReadAll(gr)
+	if err != nil {
+		return err
+	}
+
+	var files []*AllocFileInfo
+	if err := codec.NewDecoderBytes(encoded, structs.MsgpackHandle).Decode(&files); err != nil {
+		return err
+	}
+
+	r.Files = files
+	r.CompressedFiles = nil
+	return nil
+}
+
 // FsStatRequest is used to stat a file
 type FsStatRequest struct {
 	// AllocID is the allocation to stat the file in
@@ -91,17 +200,401 @@ type FsStatRequest struct {
 	// Path is the path to list
 	Path string
 
+	// Identity includes the inode and device of the file in the response
+	Identity bool
+
+	// Owner includes the owner and group of the file in the response
+	Owner bool
+
 	structs.QueryOptions
 }
 
+// FsExistsRequest is used to check whether a file exists
+type FsExistsRequest struct {
+	// AllocID is the allocation to check the file in
+	AllocID string
+
+	// Path is the path to check
+	Path string
+
+	structs.QueryOptions
+}
+
+// FsExistsResponse is used to return whether a file exists
+type FsExistsResponse struct {
+	// Exists is whether the path exists
+	Exists bool
+
+	// IsDir is whether the path is a directory
+	IsDir bool
+
+	structs.QueryMeta
+}
+
+// FsChangedRequest is used to cheaply check whether a file changed since it
+// was last checked.
+type FsChangedRequest struct {
+	// AllocID is the allocation the file is in
+	AllocID string
+
+	// Path is the path of the file to check
+	Path string
+
+	// Token is the token returned by the previous check of the file. The
+	// file is reported as changed if it is empty.
+	Token string
+
+	structs.QueryOptions
+}
+
+// FsChangedResponse is used to return whether a file changed since a token was
+// issued for it.
+type FsChangedResponse struct {
+	// Changed is set if the size or modification time of the file differ
+	// from those of the token, or if the file was recreated
+	Changed bool
+
+	// Recreated is set if the file is no longer the file the token was
+	// issued for, such as when it was rotated or removed and created again
+	Recreated bool
+
+	// SizeDelta is the change in size of the file since the token was
+	// issued. It is negative if the file was truncated or recreated smaller.
+	SizeDelta int64
+
+	// Info is the result of stating the file. It is only set if the file
+	// changed and does not include the content type.
+	Info *AllocFileInfo
+
+	// Token identifies the current state of the file and is passed to the
+	// next check
+	Token string
+
+	structs.QueryMeta
+}
+
+// FsDiskUsageRequest is used to summarize the disk usage of a directory
+type FsDiskUsageRequest struct {
+	// AllocID is the allocation to summarize the disk usage of
+	AllocID string
+
+	// Path is the path of the directory to summarize
+	Path string
+
+	// Breakdown additionally summarizes each entry of the directory
+	Breakdown bool
+
+	structs.QueryOptions
+}
+
+// FsDiskUsage is the disk usage of the files in a directory tree
+type FsDiskUsage struct {
+	// Bytes is the total size of the files
+	Bytes int64
+
+	// Files is the number of files, excluding directories
+	Files int64
+}
+
+// FsDiskUsageResponse is used to return the disk usage of a directory
+type FsDiskUsageResponse struct {
+	// Total is the disk usage of the whole directory tree
+	Total FsDiskUsage
+
+	// Breakdown is the disk usage of each entry of the directory, keyed by
+	// name, if requested
+	Breakdown map[string]*FsDiskUsage
+
+	// Truncated is set when the directory tree was too large to be walked
+	// completely, in which case the usage only covers the part walked
+	Truncated bool
+
+	structs.QueryMeta
+}
+
+// FsFindRequest is used to find the files and directories of a directory tree
+// by name
+type FsFindRequest struct {
+	// AllocID is the allocation to search
+	AllocID string
+
+	// Root is the path of the directory to search below
+	Root string
+
+	// NamePattern is the glob, or the regular expression if Regex is set,
+	// that the base name of the files and directories found must match
+	NamePattern string
+
+	// Regex treats the NamePattern as a regular expression
+	Regex bool
+
+	// MaxResults is the maximum number of paths returned. It defaults to and
+	// may not exceed the maximum number of results of the client.
+	MaxResults int
+
+	structs.QueryOptions
+}
+
+// FsFindResponse is used to return the paths found
+type FsFindResponse struct {
+	// Paths are the paths of the files and directories found, relative to
+	// the allocation directory, in lexical order
+	Paths []string
+
+	// Truncated is set when more paths matched than the maximum number of
+	// results or the directory tree was too large to be searched completely
+	Truncated bool
+
+	structs.QueryMeta
+}
+
+// FsHealthResponse is the response of a file system health check of a client.
+type FsHealthResponse struct {
+	// Healthy is set if the client can serve file system requests
+	Healthy bool
+
+	// Reason describes why the client is unhealthy
+	Reason string
+
+	structs.QueryMeta
+}
+
+// FsPeekRequest is used to read the start and end of a file
+type FsPeekRequest struct {
+	// AllocID is the allocation to read the file from
+	AllocID string
+
+	// Path is the path of the file to read
+	Path string
+
+	// HeadBytes is the number of bytes to read from the start of the file
+	HeadBytes int64
+
+	// TailBytes is the number of bytes to read from the end of the file
+	TailBytes int64
+
+	structs.QueryOptions
+}
+
+// FsPeekResponse is used to return the start and end of a file. Files no
+// larger than the requested head and tail are returned whole in Head.
+type FsPeekResponse struct {
+	// Head is the data read from the start of the file
+	Head []byte
+
+	// Tail is the data read from the end of the file
+	Tail []byte
+
+	// ElidedBytes is the size of the middle of the file between the head and
+	// tail that was not returned
+	ElidedBytes int64
+
+	// Size is the size of the file when it was peeked
+	Size int64
+
+	structs.QueryMeta
+}
+
+// FsReadBackwardRequest is used to read the window of a file preceding an
+// offset, such as when scrolling upwards through a file.
+type FsReadBackwardRequest struct {
+	// AllocID is the allocation to read the file from
+	AllocID string
+
+	// Path is the path of the file to read
+	Path string
+
+	// Offset is the end of the window to read. Offsets past the end of the
+	// file read the end of the file.
+	Offset int64
+
+	// WindowBytes is the maximum number of bytes preceding Offset to read
+	WindowBytes int64
+
+	structs.QueryOptions
+}
+
+// FsReadBackwardResponse is used to return the window of a file preceding an
+// offset. The window starts at a line boundary, unless it starts at the
+// start of the file or holds no line boundary.
+type FsReadBackwardResponse struct {
+	// Data is the data of the window
+	Data []byte
+
+	// Offset is the offset of the start of the window, which is the offset
+	// to read backward from next
+	Offset int64
+
+	// Size is the size of the file when it was read
+	Size int64
+
+	structs.QueryMeta
+}
+
+// FsReadSetRequest is used to read a small set of related files, such as a
+// configuration file and its checksum, that are updated together.
+type FsReadSetRequest struct {
+	// AllocID is the allocation to read the files from
+	AllocID string
+
+	// Paths are the paths of the files to read
+	Paths []string
+
+	structs.QueryOptions
+}
+
+// FsReadSetFile is a file read as part of a set
+type FsReadSetFile struct {
+	// Path is the path of the file as requested
+	Path string
+
+	// Contents is the data read from the file
+	Contents []byte
+
+	// Info is the result of stating the file before it was read
+	Info *AllocFileInfo
+
+	// Changed is set if the file was modified, replaced or removed while the
+	// set was being read, in which case Contents may not match Info or the
+	// other files of the set.
+	Changed bool
+}
+
+// FsReadSetResponse is used to return the contents of a set of files. The
+// files are not read atomically; callers should retry the read when the set
+// is not Consistent.
+type FsReadSetResponse struct {
+	// Files are the files read, in the order requested
+	Files []*FsReadSetFile
+
+	// Consistent is set if none of the files changed while the set was read
+	Consistent bool
+
+	structs.QueryMeta
+}
+
 // FsStatResponse is used to return the stat results of a file
 type FsStatResponse struct {
 	// Info is the result of stating a file
 	Info *AllocFileInfo
 
+	// Path is the canonical path of the file within the allocation
+	// directory, after cleaning the requested path and resolving any
+	// symlinks that stay within the allocation directory.
+	Path string
+
+	structs.QueryMeta
+}
+
+// FsLogStatsRequest is used to retrieve the retention statistics of the
+// task logs of an allocation.
+type FsLogStatsRequest struct {
+	// AllocID is the allocation to retrieve log statistics for
+	AllocID string
+
+	// Task optionally limits the statistics to a single task. If empty,
+	// statistics are returned for every task in the allocation.
+	Task string
+
+	structs.QueryOptions
+}
+
+// FsLogStatsResponse is used to return the log statistics of an allocation.
+type FsLogStatsResponse struct {
+	// Stats contains an entry per task and log type
+	Stats []*TaskLogStats
+
+	structs.QueryMeta
+}
+
+// TaskLogStats describes the rotated log files kept for a task's log type.
+type TaskLogStats struct {
+	// Task and LogType identify the logs described
+	Task    string
+	LogType string
+
+	// Files is the number of rotated log files
+	Files int
+
+	// MinIndex and MaxIndex are the lowest and highest rotation indexes
+	MinIndex int64
+	MaxIndex int64
+
+	// TotalBytes is the disk consumed by all the rotated files
+	TotalBytes int64
+
+	// Oldest and Newest are the oldest and newest modification times of the
+	// rotated files
+	Oldest time.Time
+	Newest time.Time
+}
+
+// FsLogTypesRequest is used to discover the log types written by a task, such
+// as the additional named streams of some drivers.
+type FsLogTypesRequest struct {
+	// AllocID is the allocation to discover log types in
+	AllocID string
+
+	// Task is the task whose log types are discovered
+	Task string
+
+	// AllocLog discovers the log types of the allocation's logs rather than
+	// those of a task. It cannot be combined with Task.
+	AllocLog bool
+
+	structs.QueryOptions
+}
+
+// FsLogTypesResponse is used to return the log types written by a task.
+type FsLogTypesResponse struct {
+	// LogTypes are the sorted log types with log files in the log directory
+	LogTypes []string
+
+	structs.QueryMeta
+}
+
+// FsAllTasksTailRequest is used to read the last lines of the logs of every
+// task of an allocation.
+type FsAllTasksTailRequest struct {
+	// AllocID is the allocation whose tasks' logs are read
+	AllocID string
+
+	// LogType is the log type read for each task, such as "stderr"
+	LogType string
+
+	// Lines is the number of lines to read from the end of each task's logs
+	Lines int
+
+	structs.QueryOptions
+}
+
+// FsAllTasksTailResponse is used to return the last lines of the logs of every
+// started task of an allocation.
+type FsAllTasksTailResponse struct {
+	// Tails holds the last lines of each started task, ordered by task name
+	Tails []*TaskLogTail
+
 	structs.QueryMeta
 }
 
+// TaskLogTail is the end of the most recent log file of a task.
+type TaskLogTail struct {
+	// Task is the name of the task
+	Task string
+
+	// File is the path of the log file read, or empty if the task has not
+	// written a log file of the log type
+	File string
+
+	// Offset is the offset of the end of the data read in the log file
+	Offset int64
+
+	// Data holds up to the requested number of lines from the end of the log
+	// file. Only the end of the log file is read, so fewer lines are returned
+	// if they are long.
+	Data []byte
+}
+
 // FsStreamRequest is the initial request for streaming the content of a file.
 type FsStreamRequest struct {
 	// AllocID is the allocation to stream logs from
@@ -113,46 +606,486 @@ type FsStreamRequest struct {
 	// Offset is the offset to start streaming data at.
 	Offset int64
 
-	// Origin can either be "start" or "end" and determines where the offset is
-	// applied.
+	// Origin can either be "start", "end", "current" or "percent" and
+	// determines where the offset is applied. Like "end", "current" offsets
+	// backwards from the size of the file, but the size is taken immediately
+	// before reading so that data written while the request is processed is
+	// not streamed. It cannot be combined with a resume token or checksum.
+	// With "percent" the offset is a percentage between 0 and 100 of the
+	// size of the file, and the stream starts at the first line after it.
 	Origin string
 
 	// PlainText disables base64 encoding.
 	PlainText bool
 
+	// IncludePath sends a frame holding the canonical path of the file
+	// within the allocation directory, after cleaning the requested path and
+	// resolving any symlinks, before any data. It is ignored for plain text
+	// streams.
+	IncludePath bool
+
+	// EventMarker is written as a line of its own into plain text streams
+	// for each file event, such as the file being truncated, with each "%s"
+	// replaced by the event, for example "--- %s ---". File events are not
+	// visible in plain text streams otherwise. It requires PlainText.
+	EventMarker string
+
+	// CompressMinBytes enables the gzip compression of the data of frames
+	// larger than the given number of bytes, which are marked as compressed.
+	// Smaller frames, such as single lines when tailing, are not compressed.
+	// It cannot be combined with PlainText.
+	CompressMinBytes int
+
+	// SourceEncoding is the IANA name of the character encoding of the
+	// file, such as "ISO-8859-1" or "Shift_JIS". If set, the streamed data
+	// is transcoded from it to UTF-8, while offsets still refer to the bytes
+	// of the file. By default the data is streamed as is.
+	SourceEncoding string
+
 	// Limit is the number of bytes to read
 	Limit int64
 
 	// Follow follows the file.
 	Follow bool
 
+	// Validate runs the checks made before streaming, such as the allocation,
+	// file and origin being valid, and responds with either their error or a
+	// single frame with the "request validated" file event without streaming
+	// the file. An empty response is sent for plain text streams.
+	Validate bool
+
+	// SkipRanges are byte ranges of the file, each from its start offset up
+	// to its end offset, that are not streamed. A frame with the "range
+	// skipped" file event and the end offset of the range is sent in place
+	// of the data of each range. The ranges must be ordered and must not
+	// overlap. Skipped bytes count towards the Limit.
+	SkipRanges [][2]int64
+
+	// MaxIdle closes a followed stream once no data has been streamed for the
+	// duration, after sending a frame with the "idle timeout" file event
+	// unless streaming plain text. Heartbeats are not counted as data. Zero
+	// disables the timeout.
+	MaxIdle time.Duration
+
+	// Resumable includes resume tokens in the streamed frames that can be
+	// passed back as ResumeToken to continue the stream after reconnecting.
+	Resumable bool
+
+	// ResumeToken resumes the stream from the position identified by a token
+	// returned by a previous stream. If the file no longer matches the token
+	// the stream restarts from the beginning of the file.
+	ResumeToken string
+
+	// ResumeLength and ResumeSHA256 resume the stream after the first
+	// ResumeLength bytes of the file if their hex encoded SHA-256 checksum is
+	// ResumeSHA256, such as when the client already holds that content. If
+	// the file no longer starts with that content the stream restarts from
+	// the beginning of the file. They cannot be combined with ResumeToken.
+	ResumeLength int64
+	ResumeSHA256 string
+
+	// LineAligned ensures every frame ends on a line boundary, except for
+	// lines longer than a frame and the remainder of the file at EOF.
+	LineAligned bool
+
+	// MaxFramesPerSecond limits the number of frames streamed per second.
+	// Frames in excess of the limit are coalesced into fewer, larger frames
+	// rather than dropping any data.
+	MaxFramesPerSecond int
+
+	// Compact omits the File field from every frame after the first one that
+	// sets it. Clients are expected to fill it in, for example with a
+	// streamframer.FileFiller.
+	Compact bool
+
+	// Sequenced numbers the streamed frames, other than heartbeats, with
+	// consecutive sequence numbers starting at one so that clients can detect
+	// missing or reordered frames. It is ignored for plain text streams.
+	Sequenced bool
+
+	// UseCache serves the file from a copy cached on the client if the file
+	// is unchanged since it was cached, caching it otherwise. It is ignored
+	// if the client does not enable caching, and cannot be combined with
+	// Follow or the "current" origin.
+	UseCache bool
+
+	// WaitForStart retries briefly when the allocation's directory is not
+	// available yet, as it may not be while the allocation is starting,
+	// rather than failing immediately. Unknown allocations are not retried.
+	WaitForStart bool
+
+	// Checksum is the algorithm, one of "md5", "sha1" or "sha256", used to
+	// checksum the data streamed, after any transcoding from SourceEncoding.
+	// Once the stream completes, a final frame with the "stream completed"
+	// file event carries the checksum so that clients can detect truncated
+	// or corrupted data. It cannot be combined with Follow or PlainText.
+	Checksum string
+
+	// Encoding is the encoding of the frames streamed as payloads, either
+	// "json", the default, or "msgpack". It is ignored for plain text
+	// streams.
+	Encoding string
+
+	structs.QueryOptions
+}
+
+// FsWatchDirRequest is the initial request for watching a directory for newly
+// created entries.
+type FsWatchDirRequest struct {
+	// AllocID is the allocation to watch the directory in
+	AllocID string
+
+	// Path is the path to the directory to watch
+	Path string
+
+	// Follow streams the contents of each newly created file in addition to
+	// reporting its creation.
+	Follow bool
+
+	structs.QueryOptions
+}
+
+// FsGrepRequest is the initial request for searching a file for lines matching
+// a pattern.
+type FsGrepRequest struct {
+	// AllocID is the allocation to search the file in
+	AllocID string
+
+	// Path is the path to the file to search
+	Path string
+
+	// Pattern is the regular expression lines are matched against
+	Pattern string
+
+	// MaxMatches is the maximum number of matches to return. If zero, all
+	// matches are returned.
+	MaxMatches int
+
+	// ContextLines is the number of lines before and after each match to
+	// return along with it.
+	ContextLines int
+
+	structs.QueryOptions
+}
+
+// FsGrepMatch is a line matching the pattern of a FsGrepRequest. Each match is
+// streamed JSON encoded as the payload of a StreamErrWrapper.
+type FsGrepMatch struct {
+	// Offset is the byte offset of the start of the line in the file
+	Offset int64
+
+	// Line is the line number of the line, starting at one
+	Line int
+
+	// Text is the matching line without its line ending
+	Text string
+
+	// Before and After are the lines surrounding the match when context lines
+	// are requested
+	Before []string `json:",omitempty"`
+	After  []string `json:",omitempty"`
+}
+
+// FsLineIndexRequest is the initial request for indexing the byte offsets of
+// the lines of a file.
+type FsLineIndexRequest struct {
+	// AllocID is the allocation to index the file in
+	AllocID string
+
+	// Path is the path to the file to index
+	Path string
+
+	// Stride is the number of lines between indexed lines. The first line
+	// and every Stride'th line after it are indexed.
+	Stride int
+
+	// MaxEntries is the maximum number of index entries to return. If zero,
+	// up to 1,000,000 entries are returned.
+	MaxEntries int
+
 	structs.QueryOptions
 }
 
+// FsLineIndexBatch is a batch of entries of a line index. Each batch is
+// streamed JSON encoded as the payload of a StreamErrWrapper, the last one
+// with Done set.
+type FsLineIndexBatch struct {
+	// Entries are the indexed lines in the order they occur
+	Entries []*FsLineIndexEntry `json:",omitempty"`
+
+	// Done is set on the final batch of the index
+	Done bool `json:",omitempty"`
+
+	// Truncated is set on the final batch if the index was cut short by
+	// reaching the maximum number of entries
+	Truncated bool `json:",omitempty"`
+
+	// Lines and Bytes are the number of lines and bytes scanned. They are
+	// only set on the final batch.
+	Lines int   `json:",omitempty"`
+	Bytes int64 `json:",omitempty"`
+}
+
+// FsLineIndexEntry is the byte offset of the start of a line in a file
+type FsLineIndexEntry struct {
+	// Line is the line number, starting at one
+	Line int
+
+	// Offset is the byte offset of the start of the line
+	Offset int64
+}
+
 // FsLogsRequest is the initial request for accessing allocation logs.
 type FsLogsRequest struct {
 	// AllocID is the allocation to stream logs from
 	AllocID string
 
+	// JobID streams the logs of the job's most recent allocation running the
+	// task when AllocID is not set. When following, the stream switches to
+	// the replacement allocation once the current one stops.
+	JobID string
+
+	// TaskGroup optionally limits the allocations considered when streaming
+	// by JobID to those of the task group.
+	TaskGroup string
+
 	// Task is the task to stream logs from
 	Task string
 
-	// LogType indicates whether "stderr" or "stdout" should be streamed
+	// AllocLog streams the allocation level log files that are not specific
+	// to a task, named "<LogType>.<index>" in the shared log directory, if
+	// present. Task must not be set.
+	AllocLog bool
+
+	// LogType indicates whether "stderr", "stdout" or another log type
+	// returned by FileSystem.LogTypes should be streamed
 	LogType string
 
 	// Offset is the offset to start streaming data at.
 	Offset int64
 
 	// Origin can either be "start" or "end" and determines where the offset is
-	// applied.
+	// applied. Following from the "end" origin streams the last Offset bytes
+	// of the existing logs before the new logs, without duplicating any.
 	Origin string
 
+	// SinceDuration starts the logs at the first log file written to within
+	// the duration, as measured by the client's clock. It cannot be combined
+	// with an offset or the "end" origin.
+	SinceDuration time.Duration
+
+	// TailLines starts the logs the given number of lines before their
+	// current end, across rotated log files, like "tail -n", and overrides
+	// Origin. Following streams continue with the new logs after them. It
+	// cannot be combined with an offset, SinceDuration, MaxBacklog or an
+	// index range. Zero disables it.
+	TailLines int
+
+	// Snapshot streams the logs as they were when the stream started,
+	// excluding data written to the log files while streaming. It cannot be
+	// combined with following.
+	Snapshot bool
+
+	// StartIndex and EndIndex stream exactly the rotated log files with
+	// indexes from StartIndex to EndIndex inclusive and then stop. Both must
+	// be set together and cannot be combined with following, an offset, the
+	// "end" origin or SinceDuration.
+	StartIndex *int64
+	EndIndex   *int64
+
 	// PlainText disables base64 encoding.
 	PlainText bool
 
+	// EventMarker is written as a line of its own into plain text streams
+	// for each file event, such as the file being truncated, with each "%s"
+	// replaced by the event, for example "--- %s ---". File events are not
+	// visible in plain text streams otherwise. It requires PlainText.
+	EventMarker string
+
+	// CompressMinBytes enables the gzip compression of the data of frames
+	// larger than the given number of bytes, which are marked as compressed.
+	// Smaller frames, such as single lines when tailing, are not compressed.
+	// It cannot be combined with PlainText.
+	CompressMinBytes int
+
+	// SourceEncoding is the IANA name of the character encoding of the
+	// file, such as "ISO-8859-1" or "Shift_JIS". If set, the streamed data
+	// is transcoded from it to UTF-8, while offsets still refer to the bytes
+	// of the file. By default the data is streamed as is.
+	SourceEncoding string
+
 	// Follow follows logs.
 	Follow bool
 
+	// Validate runs the checks made before streaming, such as the task having
+	// started and the log type being valid, and responds with either their
+	// error or a single frame with the "request validated" file event without
+	// streaming the logs. An empty response is sent for plain text streams.
+	Validate bool
+
+	// MaxIdle closes a followed stream once no data has been streamed for the
+	// duration, after sending a frame with the "idle timeout" file event
+	// unless streaming plain text. Heartbeats are not counted as data. Zero
+	// disables the timeout.
+	MaxIdle time.Duration
+
+	// Progress sends the total number of bytes that will be streamed in the
+	// initial frame. It is ignored when following logs.
+	Progress bool
+
+	// Manifest sends a frame listing the log files to be streamed before any
+	// data, with the size and index of each and the range of the stream's
+	// combined data read from it, so that positions in the stream can be
+	// attributed to log files. Ranges refer to the data as read from the
+	// files, before options transforming it such as line numbers. Data
+	// written to the last log file after the manifest is sent is streamed
+	// past the end of its range unless Snapshot is set. It cannot be
+	// combined with Follow or PlainText.
+	Manifest bool
+
+	// MaxBacklog limits the logs streamed from the start origin to at most
+	// the last MaxBacklog bytes that have already been written, rather than
+	// replaying all of them, before following new logs. Zero streams all the
+	// existing logs.
+	MaxBacklog int64
+
+	// MaxFilesSpanned lowers the number of log files streamed by a request
+	// for logs that are not followed below the client's limit. Once reached
+	// the stream ends with a frame marking that the limit was reached. Zero
+	// uses the client's limit.
+	MaxFilesSpanned int
+
+	// TailOtherOnExit ends a followed stream once the task has stopped by
+	// sending up to this many of the last lines of the other log type, such
+	// as stdout when streaming stderr, in a final frame with the "task
+	// exited" file event. It requires following a task's logs.
+	TailOtherOnExit int
+
+	// StopOnTaskExit ends a followed stream once the task has stopped, after
+	// streaming the logs it wrote up to then. It requires following a task's
+	// logs and cannot be combined with TailOtherOnExit.
+	StopOnTaskExit bool
+
+	// StripANSI removes ANSI escape sequences, such as color codes, from the
+	// streamed logs.
+	StripANSI bool
+
+	// MaxLinesPerSecond limits the rate at which log lines are streamed.
+	// Lines in excess of the limit are delayed until the next second unless
+	// DropExcessLines is set.
+	MaxLinesPerSecond int
+
+	// DropExcessLines drops lines in excess of MaxLinesPerSecond rather than
+	// delaying them. The number of dropped lines is reported on the next
+	// streamed frame.
+	DropExcessLines bool
+
+	// LineAligned ensures every frame ends on a line boundary, except for
+	// lines longer than a frame and the remainder of the file at EOF.
+	LineAligned bool
+
+	// WholeLinesOnly holds back a trailing partial line when the end of the
+	// logs is reached while following them, until its newline is written or
+	// the stream ends, so that every frame ends on a line boundary except for
+	// lines longer than a frame. It requires Follow.
+	WholeLinesOnly bool
+
+	// EmitStatEvery interleaves a frame with a snapshot of the newest log
+	// file, holding its path, rotation index and size, among the streamed
+	// frames at the given interval, so that clients can show the growth of
+	// the logs without polling. It requires Follow and cannot be combined
+	// with PlainText. Zero disables the snapshots.
+	EmitStatEvery time.Duration
+
+	// MaxFramesPerSecond limits the number of frames streamed per second.
+	// Frames in excess of the limit are coalesced into fewer, larger frames
+	// rather than dropping any data.
+	MaxFramesPerSecond int
+
+	// IncludeExitInfo ends a stream that is not followed with a frame holding
+	// the exit code, OOM killed flag and finish time of the task, if it has
+	// stopped by the time the stream completes.
+	IncludeExitInfo bool
+
+	// Dedup collapses runs of consecutive identical lines into a single line
+	// suffixed with the number of repetitions, such as "line (x42)". It is
+	// ignored for plain text streams.
+	Dedup bool
+
+	// CollapseBlankLines collapses runs of consecutive blank lines, including
+	// lines containing only whitespace, into a single empty line.
+	// DropBlankLines drops them entirely instead. Both are ignored for plain
+	// text streams.
+	CollapseBlankLines bool
+	DropBlankLines     bool
+
+	// DetectLevel annotates streamed frames with the log level of their
+	// lines, one of "trace", "debug", "info", "warn" or "error", or "none" if
+	// no level is detected.
+	DetectLevel bool
+
+	// LevelPatterns optionally replaces the regular expression used to
+	// detect a log level, keyed by level. It requires DetectLevel or
+	// JumpToFirstError.
+	LevelPatterns map[string]string
+
+	// MinLevel drops lines with a detected level below it. Lines without a
+	// detected level are always streamed. It requires DetectLevel.
+	MinLevel string
+
+	// MaxLineBytes is the longest partial line that is held back while
+	// waiting for its end by the options that process logs line by line.
+	// Longer partial lines are streamed as is. Zero uses a default of 1MiB.
+	MaxLineBytes int
+
+	// StartAfterMatch skips the logs up to and including the first line
+	// containing the string, such as to hide startup output. Following
+	// streams wait for the line to be written. It cannot be combined with
+	// StartAfterRegex.
+	StartAfterMatch string
+
+	// StartAfterRegex is like StartAfterMatch but skips the logs up to and
+	// including the first line matching the regular expression.
+	StartAfterRegex string
+
+	// JumpToFirstError skips the logs before the first line detected as the
+	// "error" level, as for DetectLevel and using LevelPatterns if set, and
+	// streams the logs from that line on. Following streams wait for an
+	// error line to be written. It cannot be combined with StartAfterMatch
+	// or StartAfterRegex.
+	JumpToFirstError bool
+
+	// LineNumbers prefixes each streamed line with its line number. Lines are
+	// numbered from the first line of the oldest log file, continuing across
+	// rotated log files. It requires streaming from the start of the logs
+	// and cannot be combined with Dedup.
+	LineNumbers bool
+
+	// LineRanges sets the numbers of the first and last lines of the data of
+	// each frame, numbered as for LineNumbers, so that clients can map
+	// positions in the streamed logs to line numbers without counting lines.
+	// It has the requirements of LineNumbers and cannot be combined with
+	// PlainText, DetectLevel, MaxLinesPerSecond or starting after a match.
+	LineRanges bool
+
+	// Sequenced numbers the streamed frames, other than heartbeats, with
+	// consecutive sequence numbers starting at one so that clients can detect
+	// missing or reordered frames. Lines dropped by rate limiting are not a
+	// gap in the sequence but are reported by DroppedLines. It is ignored for
+	// plain text streams.
+	Sequenced bool
+
+	// WaitForStart retries briefly when the allocation's directory or its
+	// log directory is not available yet, as they may not be while the
+	// allocation is starting, rather than failing immediately. Unknown
+	// allocations are not retried.
+	WaitForStart bool
+
+	// Encoding is the encoding of the frames streamed as payloads, either
+	// "json", the default, or "msgpack". It is ignored for plain text
+	// streams.
+	Encoding string
+
 	structs.QueryOptions
 }
 
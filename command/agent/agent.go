@@ -595,6 +595,12 @@ func convertClientConfig(agentConfig *Config) (*clientconfig.Config, error) {
 	conf.MaxDynamicPort = agentConfig.Client.MaxDynamicPort
 	conf.MinDynamicPort = agentConfig.Client.MinDynamicPort
 	conf.DisableRemoteExec = agentConfig.Client.DisableRemoteExec
+	conf.FSSensitivePaths = agentConfig.Client.FSSensitivePaths
+	conf.FSReadAheadBuffers = agentConfig.Client.FSReadAheadBuffers
+	conf.FSLogTailCacheBytes = agentConfig.Client.FSLogTailCacheBytes
+	conf.FSStreamCacheBytes = agentConfig.Client.FSStreamCacheBytes
+	conf.FSStreamCacheTTL = agentConfig.Client.FSStreamCacheTTL
+	conf.FSStreamACLCheckInterval = agentConfig.Client.FSStreamACLCheckInterval
 	if agentConfig.Client.TemplateConfig.FunctionBlacklist != nil {
 		conf.TemplateConfig.FunctionDenylist = agentConfig.Client.TemplateConfig.FunctionBlacklist
 	} else {
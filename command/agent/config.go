@@ -277,6 +277,34 @@ type ClientConfig struct {
 	// DisableRemoteExec disables remote exec targeting tasks on this client
 	DisableRemoteExec bool `hcl:"disable_remote_exec"`
 
+	// FSSensitivePaths are glob patterns of paths within allocation
+	// directories that can only be accessed through the filesystem API by
+	// tokens that are also allowed to exec into the allocation.
+	FSSensitivePaths []string `hcl:"fs_sensitive_paths"`
+
+	// FSReadAheadBuffers is the number of frame sized buffers read ahead of
+	// the stream when streaming files. Zero disables reading ahead.
+	FSReadAheadBuffers int `hcl:"fs_read_ahead_buffers"`
+
+	// FSLogTailCacheBytes is the number of bytes from the end of recently
+	// streamed log files held in memory to serve streams attaching to the
+	// end of the logs. Zero disables caching.
+	FSLogTailCacheBytes int `hcl:"fs_log_tail_cache_bytes"`
+
+	// FSStreamCacheBytes is the total size of the copies of streamed files
+	// cached on disk for streams requesting caching. Zero disables caching.
+	FSStreamCacheBytes int `hcl:"fs_stream_cache_bytes"`
+
+	// FSStreamCacheTTL is how long a cached copy of a streamed file is
+	// served for.
+	FSStreamCacheTTL    time.Duration
+	FSStreamCacheTTLHCL string `hcl:"fs_stream_cache_ttl" json:"-"`
+
+	// FSStreamACLCheckInterval is how often the token of a file or log
+	// stream is checked again while streaming.
+	FSStreamACLCheckInterval    time.Duration
+	FSStreamACLCheckIntervalHCL string `hcl:"fs_stream_acl_check_interval" json:"-"`
+
 	// TemplateConfig includes configuration for template rendering
 	TemplateConfig *ClientTemplateConfig `hcl:"template"`
 
@@ -1706,6 +1734,36 @@ func (a *ClientConfig) Merge(b *ClientConfig) *ClientConfig {
 		result.DisableRemoteExec = b.DisableRemoteExec
 	}
 
+	if len(b.FSSensitivePaths) != 0 {
+		result.FSSensitivePaths = helper.CopySliceString(b.FSSensitivePaths)
+	}
+
+	if b.FSReadAheadBuffers != 0 {
+		result.FSReadAheadBuffers = b.FSReadAheadBuffers
+	}
+
+	if b.FSLogTailCacheBytes != 0 {
+		result.FSLogTailCacheBytes = b.FSLogTailCacheBytes
+	}
+
+	if b.FSStreamCacheBytes != 0 {
+		result.FSStreamCacheBytes = b.FSStreamCacheBytes
+	}
+
+	if b.FSStreamCacheTTL != 0 {
+		result.FSStreamCacheTTL = b.FSStreamCacheTTL
+	}
+	if b.FSStreamCacheTTLHCL != "" {
+		result.FSStreamCacheTTLHCL = b.FSStreamCacheTTLHCL
+	}
+
+	if b.FSStreamACLCheckInterval != 0 {
+		result.FSStreamACLCheckInterval = b.FSStreamACLCheckInterval
+	}
+	if b.FSStreamACLCheckIntervalHCL != "" {
+		result.FSStreamACLCheckIntervalHCL = b.FSStreamACLCheckIntervalHCL
+	}
+
 	if b.TemplateConfig != nil {
 		result.TemplateConfig = b.TemplateConfig
 	}
@@ -50,6 +50,8 @@ func ParseConfigFile(path string) (*Config, error) {
 	// convert strings to time.Durations
 	tds := []td{
 		{"gc_interval", &c.Client.GCInterval, &c.Client.GCIntervalHCL},
+		{"fs_stream_cache_ttl", &c.Client.FSStreamCacheTTL, &c.Client.FSStreamCacheTTLHCL},
+		{"fs_stream_acl_check_interval", &c.Client.FSStreamACLCheckInterval, &c.Client.FSStreamACLCheckIntervalHCL},
 		{"acl.token_ttl", &c.ACL.TokenTTL, &c.ACL.TokenTTLHCL},
 		{"acl.policy_ttl", &c.ACL.PolicyTTL, &c.ACL.PolicyTTLHCL},
 		{"client.server_join.retry_interval", &c.Client.ServerJoin.RetryInterval, &c.Client.ServerJoin.RetryIntervalHCL},
@@ -1,20 +1,24 @@
 package nomad
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
 	"time"
 
 	metrics "github.com/armon/go-metrics"
 	log "github.com/hashicorp/go-hclog"
+	memdb "github.com/hashicorp/go-memdb"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 
 	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/nomad/acl"
 	"github.com/hashicorp/nomad/helper"
+	"github.com/hashicorp/nomad/nomad/state"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
@@ -28,6 +32,9 @@ type FileSystem struct {
 func (f *FileSystem) register() {
 	f.srv.streamingRpcs.Register("FileSystem.Logs", f.logs)
 	f.srv.streamingRpcs.Register("FileSystem.Stream", f.stream)
+	f.srv.streamingRpcs.Register("FileSystem.WatchDir", f.watchDir)
+	f.srv.streamingRpcs.Register("FileSystem.Grep", f.grep)
+	f.srv.streamingRpcs.Register("FileSystem.LineIndex", f.lineIndex)
 }
 
 // handleStreamResultError is a helper for sending an error with a potential
@@ -95,21 +102,24 @@ func forwardRegionStreamingRpc(fsrv *Server, conn io.ReadWriteCloser,
 	structs.Bridge(conn, srvConn)
 }
 
-// List is used to list the contents of an allocation's directory.
-func (f *FileSystem) List(args *cstructs.FsListRequest, reply *cstructs.FsListResponse) error {
+// forwardAllocRpc is used to make an RPC for the allocation to the client
+// running it, once the token is found to have any of the namespace
+// capabilities. Requests for a different region are forwarded to it.
+func (f *FileSystem) forwardAllocRpc(method, metric, allocID string, q *structs.QueryOptions,
+	args, reply interface{}, capabilities ...string) error {
 	// We only allow stale reads since the only potentially stale information is
 	// the Node registration and the cost is fairly high for adding another hope
 	// in the forwarding chain.
-	args.QueryOptions.AllowStale = true
+	q.AllowStale = true
 
 	// Potentially forward to a different region.
-	if done, err := f.srv.forward("FileSystem.List", args, args, reply); done {
+	if done, err := f.srv.forward(method, q, args, reply); done {
 		return err
 	}
-	defer metrics.MeasureSince([]string{"nomad", "file_system", "list"}, time.Now())
+	defer metrics.MeasureSince([]string{"nomad", "file_system", metric}, time.Now())
 
 	// Verify the arguments.
-	if args.AllocID == "" {
+	if allocID == "" {
 		return errors.New("missing allocation ID")
 	}
 
@@ -119,14 +129,14 @@ func (f *FileSystem) List(args *cstructs.FsListRequest, reply *cstructs.FsListRe
 		return err
 	}
 
-	alloc, err := getAlloc(snap, args.AllocID)
+	alloc, err := getAlloc(snap, allocID)
 	if err != nil {
 		return err
 	}
 
-	// Check namespace filesystem read permissions
-	allowNsOp := acl.NamespaceValidator(acl.NamespaceCapabilityReadFS)
-	aclObj, err := f.srv.ResolveToken(args.AuthToken)
+	// Check namespace permissions
+	allowNsOp := acl.NamespaceValidator(capabilities...)
+	aclObj, err := f.srv.ResolveToken(q.AuthToken)
 	if err != nil {
 		return err
 	} else if !allowNsOp(aclObj, alloc.Namespace) {
@@ -142,63 +152,137 @@ func (f *FileSystem) List(args *cstructs.FsListRequest, reply *cstructs.FsListRe
 	// Get the connection to the client
 	state, ok := f.srv.getNodeConn(alloc.NodeID)
 	if !ok {
-		return findNodeConnAndForward(f.srv, alloc.NodeID, "FileSystem.List", args, reply)
+		return findNodeConnAndForward(f.srv, alloc.NodeID, method, args, reply)
 	}
 
 	// Make the RPC
-	return NodeRpc(state.Session, "FileSystem.List", args, reply)
+	return NodeRpc(state.Session, method, args, reply)
+}
+
+// List is used to list the contents of an allocation's directory.
+func (f *FileSystem) List(args *cstructs.FsListRequest, reply *cstructs.FsListResponse) error {
+	return f.forwardAllocRpc("FileSystem.List", "list", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
 }
 
 // Stat is used to stat a file in the allocation's directory.
 func (f *FileSystem) Stat(args *cstructs.FsStatRequest, reply *cstructs.FsStatResponse) error {
+	return f.forwardAllocRpc("FileSystem.Stat", "stat", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
+}
+
+// Changed is used to check whether a file in the allocation's directory changed
+// since a previous check.
+func (f *FileSystem) Changed(args *cstructs.FsChangedRequest, reply *cstructs.FsChangedResponse) error {
+	return f.forwardAllocRpc("FileSystem.Changed", "changed", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
+}
+
+// Exists is used to check whether a path exists in the allocation's
+// directory.
+func (f *FileSystem) Exists(args *cstructs.FsExistsRequest, reply *cstructs.FsExistsResponse) error {
+	return f.forwardAllocRpc("FileSystem.Exists", "exists", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
+}
+
+// DiskUsage is used to summarize the disk usage of a directory in the
+// allocation's directory.
+func (f *FileSystem) DiskUsage(args *cstructs.FsDiskUsageRequest, reply *cstructs.FsDiskUsageResponse) error {
+	return f.forwardAllocRpc("FileSystem.DiskUsage", "disk_usage", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
+}
+
+// Health is used to check whether a client can serve file system requests.
+func (f *FileSystem) Health(args *structs.NodeSpecificRequest, reply *cstructs.FsHealthResponse) error {
 	// We only allow stale reads since the only potentially stale information is
 	// the Node registration and the cost is fairly high for adding another hope
 	// in the forwarding chain.
 	args.QueryOptions.AllowStale = true
 
 	// Potentially forward to a different region.
-	if done, err := f.srv.forward("FileSystem.Stat", args, args, reply); done {
+	if done, err := f.srv.forward("FileSystem.Health", args, args, reply); done {
 		return err
 	}
-	defer metrics.MeasureSince([]string{"nomad", "file_system", "stat"}, time.Now())
+	defer metrics.MeasureSince([]string{"nomad", "file_system", "health"}, time.Now())
 
-	// Verify the arguments.
-	if args.AllocID == "" {
-		return errors.New("missing allocation ID")
-	}
-
-	// Lookup the allocation
-	snap, err := f.srv.State().Snapshot()
-	if err != nil {
+	// Check node read permissions
+	if aclObj, err := f.srv.ResolveToken(args.AuthToken); err != nil {
 		return err
+	} else if aclObj != nil && !aclObj.AllowNodeRead() {
+		return structs.ErrPermissionDenied
 	}
 
-	alloc, err := getAlloc(snap, args.AllocID)
-	if err != nil {
-		return err
+	// Verify the arguments.
+	if args.NodeID == "" {
+		return errors.New("missing NodeID")
 	}
 
-	// Check filesystem read permissions
-	if aclObj, err := f.srv.ResolveToken(args.AuthToken); err != nil {
+	// Make sure Node is valid and new enough to support RPC
+	snap, err := f.srv.State().Snapshot()
+	if err != nil {
 		return err
-	} else if aclObj != nil && !aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadFS) {
-		return structs.ErrPermissionDenied
 	}
 
-	// Make sure Node is valid and new enough to support RPC
-	_, err = getNodeForRpc(snap, alloc.NodeID)
+	_, err = getNodeForRpc(snap, args.NodeID)
 	if err != nil {
 		return err
 	}
 
 	// Get the connection to the client
-	state, ok := f.srv.getNodeConn(alloc.NodeID)
+	state, ok := f.srv.getNodeConn(args.NodeID)
 	if !ok {
-		return findNodeConnAndForward(f.srv, alloc.NodeID, "FileSystem.Stat", args, reply)
+		return findNodeConnAndForward(f.srv, args.NodeID, "FileSystem.Health", args, reply)
 	}
 
 	// Make the RPC
-	return NodeRpc(state.Session, "FileSystem.Stat", args, reply)
+	return NodeRpc(state.Session, "FileSystem.Health", args, reply)
+}
+
+// Find is used to find the files and directories below a directory in the
+// allocation's directory by name.
+func (f *FileSystem) Find(args *cstructs.FsFindRequest, reply *cstructs.FsFindResponse) error {
+	return f.forwardAllocRpc("FileSystem.Find", "find", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
+}
+
+// Peek is used to read the start and end of a file in the allocation's
+// directory.
+func (f *FileSystem) Peek(args *cstructs.FsPeekRequest, reply *cstructs.FsPeekResponse) error {
+	return f.forwardAllocRpc("FileSystem.Peek", "peek", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
+}
+
+// ReadBackward is used to read the window of a file preceding an offset.
+func (f *FileSystem) ReadBackward(args *cstructs.FsReadBackwardRequest, reply *cstructs.FsReadBackwardResponse) error {
+	return f.forwardAllocRpc("FileSystem.ReadBackward", "read_backward", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
+}
+
+// ReadSet is used to read a small set of related files in the allocation's
+// directory.
+func (f *FileSystem) ReadSet(args *cstructs.FsReadSetRequest, reply *cstructs.FsReadSetResponse) error {
+	return f.forwardAllocRpc("FileSystem.ReadSet", "read_set", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS)
+}
+
+// LogStats is used to retrieve the retention statistics of an allocation's
+// task logs.
+func (f *FileSystem) LogStats(args *cstructs.FsLogStatsRequest, reply *cstructs.FsLogStatsResponse) error {
+	return f.forwardAllocRpc("FileSystem.LogStats", "log_stats", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs)
+}
+
+// LogTypes is used to discover the log types written by an allocation's task.
+func (f *FileSystem) LogTypes(args *cstructs.FsLogTypesRequest, reply *cstructs.FsLogTypesResponse) error {
+	return f.forwardAllocRpc("FileSystem.LogTypes", "log_types", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs)
+}
+
+// AllTasksTail is used to read the last lines of the logs of every task of an
+// allocation.
+func (f *FileSystem) AllTasksTail(args *cstructs.FsAllTasksTailRequest, reply *cstructs.FsAllTasksTailResponse) error {
+	return f.forwardAllocRpc("FileSystem.AllTasksTail", "all_tasks_tail", args.AllocID, &args.QueryOptions,
+		args, reply, acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs)
 }
 
 // stream is is used to stream the contents of file in an allocation's
@@ -320,13 +404,14 @@ func (f *FileSystem) stream(conn io.ReadWriteCloser) {
 	structs.Bridge(conn, clientConn)
 }
 
-// logs is used to access an task's logs for a given allocation
-func (f *FileSystem) logs(conn io.ReadWriteCloser) {
+// watchDir is used to watch a directory of an allocation for newly created
+// entries.
+func (f *FileSystem) watchDir(conn io.ReadWriteCloser) {
 	defer conn.Close()
-	defer metrics.MeasureSince([]string{"nomad", "file_system", "logs"}, time.Now())
+	defer metrics.MeasureSince([]string{"nomad", "file_system", "watch_dir"}, time.Now())
 
 	// Decode the arguments
-	var args cstructs.FsLogsRequest
+	var args cstructs.FsWatchDirRequest
 	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
 	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
 
@@ -337,14 +422,14 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 
 	// Check if we need to forward to a different region
 	if r := args.RequestRegion(); r != f.srv.Region() {
-		forwardRegionStreamingRpc(f.srv, conn, encoder, &args, "FileSystem.Logs",
+		forwardRegionStreamingRpc(f.srv, conn, encoder, &args, "FileSystem.WatchDir",
 			args.AllocID, &args.QueryOptions)
 		return
 	}
 
 	// Verify the arguments.
 	if args.AllocID == "" {
-		handleStreamResultError(structs.ErrMissingAllocID, helper.Int64ToPtr(400), encoder)
+		handleStreamResultError(errors.New("missing AllocID"), helper.Int64ToPtr(400), encoder)
 		return
 	}
 
@@ -365,14 +450,11 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 		return
 	}
 
-	// Check namespace read-logs *or* read-fs permissions.
-	allowNsOp := acl.NamespaceValidator(
-		acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs)
-	aclObj, err := f.srv.ResolveToken(args.AuthToken)
-	if err != nil {
+	// Check namespace read-fs permissions.
+	if aclObj, err := f.srv.ResolveToken(args.AuthToken); err != nil {
 		handleStreamResultError(err, nil, encoder)
 		return
-	} else if !allowNsOp(aclObj, alloc.Namespace) {
+	} else if aclObj != nil && !aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadFS) {
 		handleStreamResultError(structs.ErrPermissionDenied, nil, encoder)
 		return
 	}
@@ -414,7 +496,7 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 		}
 
 		// Get a connection to the server
-		conn, err := f.srv.streamingRpc(srv, "FileSystem.Logs")
+		conn, err := f.srv.streamingRpc(srv, "FileSystem.WatchDir")
 		if err != nil {
 			handleStreamResultError(err, nil, encoder)
 			return
@@ -422,7 +504,7 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 
 		clientConn = conn
 	} else {
-		stream, err := NodeStreamingRpc(state.Session, "FileSystem.Logs")
+		stream, err := NodeStreamingRpc(state.Session, "FileSystem.WatchDir")
 		if err != nil {
 			handleStreamResultError(err, nil, encoder)
 			return
@@ -440,3 +522,514 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 
 	structs.Bridge(conn, clientConn)
 }
+
+// grep is used to search a file of an allocation for lines matching a
+// pattern.
+func (f *FileSystem) grep(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	defer metrics.MeasureSince([]string{"nomad", "file_system", "grep"}, time.Now())
+
+	// Decode the arguments
+	var args cstructs.FsGrepRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&args); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	// Check if we need to forward to a different region
+	if r := args.RequestRegion(); r != f.srv.Region() {
+		forwardRegionStreamingRpc(f.srv, conn, encoder, &args, "FileSystem.Grep",
+			args.AllocID, &args.QueryOptions)
+		return
+	}
+
+	// Verify the arguments.
+	if args.AllocID == "" {
+		handleStreamResultError(errors.New("missing AllocID"), helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	// Retrieve the allocation
+	snap, err := f.srv.State().Snapshot()
+	if err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	alloc, err := getAlloc(snap, args.AllocID)
+	if structs.IsErrUnknownAllocation(err) {
+		handleStreamResultError(structs.NewErrUnknownAllocation(args.AllocID), helper.Int64ToPtr(404), encoder)
+		return
+	}
+	if err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	// Check namespace read-fs permissions.
+	if aclObj, err := f.srv.ResolveToken(args.AuthToken); err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	} else if aclObj != nil && !aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadFS) {
+		handleStreamResultError(structs.ErrPermissionDenied, nil, encoder)
+		return
+	}
+
+	// Get the connection to the client either by forwarding to another server
+	// or creating a direct stream
+	clientConn, code, err := f.nodeStreamingConn(snap, alloc.NodeID, "FileSystem.Grep")
+	if err != nil {
+		handleStreamResultError(err, code, encoder)
+		return
+	}
+	defer clientConn.Close()
+
+	// Send the request.
+	outEncoder := codec.NewEncoder(clientConn, structs.MsgpackHandle)
+	if err := outEncoder.Encode(args); err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	structs.Bridge(conn, clientConn)
+}
+
+// lineIndex is used to index the byte offsets of the lines of a file of an
+// allocation.
+func (f *FileSystem) lineIndex(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	defer metrics.MeasureSince([]string{"nomad", "file_system", "line_index"}, time.Now())
+
+	// Decode the arguments
+	var args cstructs.FsLineIndexRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&args); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	// Check if we need to forward to a different region
+	if r := args.RequestRegion(); r != f.srv.Region() {
+		forwardRegionStreamingRpc(f.srv, conn, encoder, &args, "FileSystem.LineIndex",
+			args.AllocID, &args.QueryOptions)
+		return
+	}
+
+	// Verify the arguments.
+	if args.AllocID == "" {
+		handleStreamResultError(errors.New("missing AllocID"), helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	// Retrieve the allocation
+	snap, err := f.srv.State().Snapshot()
+	if err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	alloc, err := getAlloc(snap, args.AllocID)
+	if structs.IsErrUnknownAllocation(err) {
+		handleStreamResultError(structs.NewErrUnknownAllocation(args.AllocID), helper.Int64ToPtr(404), encoder)
+		return
+	}
+	if err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	// Check namespace read-fs permissions.
+	if aclObj, err := f.srv.ResolveToken(args.AuthToken); err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	} else if aclObj != nil && !aclObj.AllowNsOp(alloc.Namespace, acl.NamespaceCapabilityReadFS) {
+		handleStreamResultError(structs.ErrPermissionDenied, nil, encoder)
+		return
+	}
+
+	// Get the connection to the client either by forwarding to another server
+	// or creating a direct stream
+	clientConn, code, err := f.nodeStreamingConn(snap, alloc.NodeID, "FileSystem.LineIndex")
+	if err != nil {
+		handleStreamResultError(err, code, encoder)
+		return
+	}
+	defer clientConn.Close()
+
+	// Send the request.
+	outEncoder := codec.NewEncoder(clientConn, structs.MsgpackHandle)
+	if err := outEncoder.Encode(args); err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	structs.Bridge(conn, clientConn)
+}
+
+// logs is used to access an task's logs for a given allocation
+func (f *FileSystem) logs(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	defer metrics.MeasureSince([]string{"nomad", "file_system", "logs"}, time.Now())
+
+	// Decode the arguments
+	var args cstructs.FsLogsRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&args); err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	// Streams by job are resolved to an allocation separately
+	if args.AllocID == "" && args.JobID != "" {
+		f.logsForJob(conn, encoder, args)
+		return
+	}
+
+	// Check if we need to forward to a different region
+	if r := args.RequestRegion(); r != f.srv.Region() {
+		forwardRegionStreamingRpc(f.srv, conn, encoder, &args, "FileSystem.Logs",
+			args.AllocID, &args.QueryOptions)
+		return
+	}
+
+	// Verify the arguments.
+	if args.AllocID == "" {
+		handleStreamResultError(structs.ErrMissingAllocID, helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	// Retrieve the allocation
+	snap, err := f.srv.State().Snapshot()
+	if err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	alloc, err := getAlloc(snap, args.AllocID)
+	if structs.IsErrUnknownAllocation(err) {
+		handleStreamResultError(structs.NewErrUnknownAllocation(args.AllocID), helper.Int64ToPtr(404), encoder)
+		return
+	}
+	if err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	// Check namespace read-logs *or* read-fs permissions.
+	allowNsOp := acl.NamespaceValidator(
+		acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs)
+	aclObj, err := f.srv.ResolveToken(args.AuthToken)
+	if err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	} else if !allowNsOp(aclObj, alloc.Namespace) {
+		handleStreamResultError(structs.ErrPermissionDenied, nil, encoder)
+		return
+	}
+
+	// Get the connection to the client either by forwarding to another server
+	// or creating a direct stream
+	clientConn, code, err := f.nodeStreamingConn(snap, alloc.NodeID, "FileSystem.Logs")
+	if err != nil {
+		handleStreamResultError(err, code, encoder)
+		return
+	}
+	defer clientConn.Close()
+
+	// Send the request.
+	outEncoder := codec.NewEncoder(clientConn, structs.MsgpackHandle)
+	if err := outEncoder.Encode(args); err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	}
+
+	structs.Bridge(conn, clientConn)
+}
+
+// nodeStreamingConn returns a connection for the streaming RPC to the node,
+// either by forwarding to the server connected to it or creating a direct
+// stream. On error the HTTP status code to return is included when known.
+func (f *FileSystem) nodeStreamingConn(snap *state.StateSnapshot, nodeID, method string) (net.Conn, *int64, error) {
+	// Make sure Node is valid and new enough to support RPC
+	node, err := snap.NodeByID(nil, nodeID)
+	if err != nil {
+		return nil, helper.Int64ToPtr(500), err
+	}
+
+	if node == nil {
+		return nil, helper.Int64ToPtr(400), fmt.Errorf("Unknown node %q", nodeID)
+	}
+
+	if err := nodeSupportsRpc(node); err != nil {
+		return nil, helper.Int64ToPtr(400), err
+	}
+
+	nodeConn, ok := f.srv.getNodeConn(nodeID)
+	if ok {
+		stream, err := NodeStreamingRpc(nodeConn.Session, method)
+		return stream, nil, err
+	}
+
+	// Determine the Server that has a connection to the node.
+	srv, err := f.srv.serverWithNodeConn(nodeID, f.srv.Region())
+	if err != nil {
+		var code *int64
+		if structs.IsErrNoNodeConn(err) {
+			code = helper.Int64ToPtr(404)
+		}
+		return nil, code, err
+	}
+
+	// Get a connection to the server
+	conn, err := f.srv.streamingRpc(srv, method)
+	return conn, nil, err
+}
+
+// logsForJob streams the logs of a task from the job's most recent allocation
+// running it. When following, the stream switches to the start of the logs of
+// the replacement allocation once the current allocation stops.
+func (f *FileSystem) logsForJob(conn io.ReadWriteCloser, encoder *codec.Encoder, args cstructs.FsLogsRequest) {
+	// Check if we need to forward to a different region. The allocation is
+	// resolved by a server in the region.
+	if r := args.RequestRegion(); r != f.srv.Region() {
+		srv, err := f.srv.findRegionServer(r)
+		if err != nil {
+			handleStreamResultError(err, nil, encoder)
+			return
+		}
+
+		srvConn, err := f.srv.streamingRpc(srv, "FileSystem.Logs")
+		if err != nil {
+			handleStreamResultError(err, nil, encoder)
+			return
+		}
+		defer srvConn.Close()
+
+		outEncoder := codec.NewEncoder(srvConn, structs.MsgpackHandle)
+		if err := outEncoder.Encode(args); err != nil {
+			handleStreamResultError(err, nil, encoder)
+			return
+		}
+
+		structs.Bridge(conn, srvConn)
+		return
+	}
+
+	if args.Task == "" {
+		handleStreamResultError(errors.New("missing task name"), helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	// Check namespace read-logs *or* read-fs permissions.
+	allowNsOp := acl.NamespaceValidator(
+		acl.NamespaceCapabilityReadFS, acl.NamespaceCapabilityReadLogs)
+	aclObj, err := f.srv.ResolveToken(args.AuthToken)
+	if err != nil {
+		handleStreamResultError(err, nil, encoder)
+		return
+	} else if !allowNsOp(aclObj, args.RequestNamespace()) {
+		handleStreamResultError(structs.ErrPermissionDenied, nil, encoder)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Detect the remote side closing
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		cancel()
+	}()
+
+	alloc, err := f.waitForTaskAlloc(ctx, &args, nil)
+	if err != nil {
+		handleStreamResultError(err, helper.Int64ToPtr(404), encoder)
+		return
+	}
+
+	for alloc != nil {
+		args.AllocID = alloc.ID
+
+		var next <-chan *structs.Allocation
+		if args.Follow {
+			next = f.watchTaskAllocReplaced(ctx, &args, alloc)
+		}
+
+		replacement, err := f.streamAllocLogs(ctx, encoder, args, next)
+		if err != nil {
+			handleStreamResultError(err, nil, encoder)
+			return
+		}
+
+		// Replacement allocations are streamed from the start
+		alloc = replacement
+		args.Origin = "start"
+		args.Offset = 0
+	}
+}
+
+// streamAllocLogs relays the logs stream of the allocation set in the request
+// to the encoder. It returns when the stream ends, the context is cancelled or
+// a replacement allocation is received on next, in which case the
+// replacement is returned.
+func (f *FileSystem) streamAllocLogs(ctx context.Context, encoder *codec.Encoder,
+	args cstructs.FsLogsRequest, next <-chan *structs.Allocation) (*structs.Allocation, error) {
+
+	snap, err := f.srv.State().Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	alloc, err := getAlloc(snap, args.AllocID)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConn, _, err := f.nodeStreamingConn(snap, alloc.NodeID, "FileSystem.Logs")
+	if err != nil {
+		return nil, err
+	}
+	defer clientConn.Close()
+
+	// Send the request.
+	outEncoder := codec.NewEncoder(clientConn, structs.MsgpackHandle)
+	if err := outEncoder.Encode(args); err != nil {
+		return nil, err
+	}
+
+	// Relay whole messages so the stream can be switched between them
+	msgCh := make(chan *cstructs.StreamErrWrapper)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		decoder := codec.NewDecoder(clientConn, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				return
+			}
+
+			select {
+			case msgCh <- &msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-msgCh:
+			if err := encoder.Encode(msg); err != nil {
+				return nil, err
+			}
+		case <-doneCh:
+			if next != nil {
+				// Keep waiting for a replacement when following
+				select {
+				case alloc := <-next:
+					return alloc, nil
+				case <-ctx.Done():
+					return nil, nil
+				}
+			}
+			return nil, nil
+		case alloc := <-next:
+			return alloc, nil
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// watchTaskAllocReplaced returns a channel that receives the allocation
+// replacing the given allocation once it has stopped.
+func (f *FileSystem) watchTaskAllocReplaced(ctx context.Context, args *cstructs.FsLogsRequest,
+	alloc *structs.Allocation) <-chan *structs.Allocation {
+
+	next := make(chan *structs.Allocation, 1)
+	go func() {
+		replacement, err := f.waitForTaskAlloc(ctx, args, alloc)
+		if err == nil && replacement != nil {
+			next <- replacement
+		}
+	}()
+	return next
+}
+
+// waitForTaskAlloc returns the job's most recent allocation for the task in
+// the request, preferring running allocations. If prev is set it blocks until
+// prev has stopped and a newer running allocation exists, returning nil if the
+// context is cancelled first.
+func (f *FileSystem) waitForTaskAlloc(ctx context.Context, args *cstructs.FsLogsRequest,
+	prev *structs.Allocation) (*structs.Allocation, error) {
+
+	for {
+		ws := memdb.NewWatchSet()
+		store := f.srv.State()
+		allocs, err := store.AllocsByJob(ws, args.RequestNamespace(), args.JobID, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if prev == nil {
+			alloc := latestTaskAlloc(allocs, args.TaskGroup, args.Task, 0)
+			if alloc == nil {
+				return nil, fmt.Errorf("no allocations of job %q found for task %q", args.JobID, args.Task)
+			}
+			return alloc, nil
+		}
+
+		current, err := store.AllocByID(ws, prev.ID)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil || current.TerminalStatus() {
+			alloc := latestTaskAlloc(allocs, args.TaskGroup, args.Task, prev.CreateIndex)
+			if alloc != nil && alloc.ClientStatus == structs.AllocClientStatusRunning {
+				return alloc, nil
+			}
+		}
+
+		if err := ws.WatchCtx(ctx); err != nil {
+			return nil, nil
+		}
+	}
+}
+
+// latestTaskAlloc returns the allocation created after the index that runs the
+// task, optionally limited to a task group. Running allocations are preferred
+// over the most recent allocation otherwise.
+func latestTaskAlloc(allocs []*structs.Allocation, group, task string, after uint64) *structs.Allocation {
+	var latest, running *structs.Allocation
+	for _, alloc := range allocs {
+		if alloc.CreateIndex <= after || (group != "" && alloc.TaskGroup != group) {
+			continue
+		}
+
+		tg := alloc.Job.LookupTaskGroup(alloc.TaskGroup)
+		if tg == nil || tg.LookupTask(task) == nil {
+			continue
+		}
+
+		if latest == nil || alloc.CreateIndex > latest.CreateIndex {
+			latest = alloc
+		}
+		if alloc.ClientStatus == structs.AllocClientStatusRunning &&
+			(running == nil || alloc.CreateIndex > running.CreateIndex) {
+			running = alloc
+		}
+	}
+
+	if running != nil {
+		return running
+	}
+	return latest
+}
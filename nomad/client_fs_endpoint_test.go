@@ -542,6 +542,844 @@ func TestClientFS_Stat_Remote(t *testing.T) {
 	require.NotNil(resp.Info)
 }
 
+func TestClientFS_Exists_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsExistsRequest{
+		Path:         "alloc/logs/web.stdout.0",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsExistsResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.Exists", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsExistsResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.Exists", req, &resp2)
+	require.Nil(err)
+	require.True(resp2.Exists)
+	require.False(resp2.IsDir)
+
+	// A missing path is not an error
+	req.Path = "alloc/logs/missing"
+	var resp3 cstructs.FsExistsResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.Exists", req, &resp3)
+	require.Nil(err)
+	require.False(resp3.Exists)
+}
+
+func TestClientFS_Peek_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsPeekRequest{
+		Path:         "alloc/logs/web.stdout.0",
+		HeadBytes:    2,
+		TailBytes:    2,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsPeekResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.Peek", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsPeekResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.Peek", req, &resp2)
+	require.Nil(err)
+	require.Equal("he", string(resp2.Head))
+	require.Equal("lo", string(resp2.Tail))
+	require.EqualValues(1, resp2.ElidedBytes)
+}
+
+func TestClientFS_ReadBackward_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello\nworld\n",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsReadBackwardRequest{
+		Path:         "alloc/logs/web.stdout.0",
+		Offset:       12,
+		WindowBytes:  8,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsReadBackwardResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.ReadBackward", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsReadBackwardResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.ReadBackward", req, &resp2)
+	require.Nil(err)
+	require.Equal("world\n", string(resp2.Data))
+	require.EqualValues(6, resp2.Offset)
+}
+
+func TestClientFS_ReadSet_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsReadSetRequest{
+		Paths:        []string{"alloc/logs/web.stdout.0", "alloc/logs/web.stderr.0"},
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsReadSetResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.ReadSet", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsReadSetResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.ReadSet", req, &resp2)
+	require.Nil(err)
+	require.True(resp2.Consistent)
+	require.Len(resp2.Files, 2)
+	require.Equal("hello", string(resp2.Files[0].Contents))
+	require.EqualValues(5, resp2.Files[0].Info.Size)
+	require.Empty(resp2.Files[1].Contents)
+}
+
+func TestClientFS_DiskUsage_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsDiskUsageRequest{
+		Path:         "alloc/logs",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsDiskUsageResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.DiskUsage", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsDiskUsageResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.DiskUsage", req, &resp2)
+	require.Nil(err)
+	require.GreaterOrEqual(resp2.Total.Files, int64(2))
+	require.GreaterOrEqual(resp2.Total.Bytes, int64(len("hello")))
+}
+
+func TestClientFS_Health_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Make the request without having a node-id
+	req := &structs.NodeSpecificRequest{
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsHealthResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.Health", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the node id
+	req.NodeID = c.NodeID()
+	var resp2 cstructs.FsHealthResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.Health", req, &resp2)
+	require.Nil(err)
+	require.True(resp2.Healthy)
+}
+
+func TestClientFS_Find_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsFindRequest{
+		Root:         "alloc/logs",
+		NamePattern:  "web.*",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsFindResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.Find", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsFindResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.Find", req, &resp2)
+	require.Nil(err)
+	require.Contains(resp2.Paths, "alloc/logs/web.stdout.0")
+	require.Contains(resp2.Paths, "alloc/logs/web.stderr.0")
+}
+
+func TestClientFS_LogStats_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsLogStatsRequest{
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsLogStatsResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.LogStats", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsLogStatsResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.LogStats", req, &resp2)
+	require.Nil(err)
+	require.Len(resp2.Stats, 2)
+
+	stdout := resp2.Stats[0]
+	require.Equal("web", stdout.Task)
+	require.Equal("stdout", stdout.LogType)
+	require.Equal(1, stdout.Files)
+	require.EqualValues(5, stdout.TotalBytes)
+	require.Equal("stderr", resp2.Stats[1].LogType)
+	require.Zero(resp2.Stats[1].TotalBytes)
+}
+
+func TestClientFS_LogTypes_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsLogTypesRequest{
+		Task:         "web",
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsLogTypesResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.LogTypes", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsLogTypesResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.LogTypes", req, &resp2)
+	require.Nil(err)
+	require.Equal([]string{"stderr", "stdout"}, resp2.LogTypes)
+}
+
+func TestClientFS_AllTasksTail_Local(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanupC := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanupC()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "2s",
+			"stdout_string": "hello",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	// Wait for the client to run the allocation
+	testutil.WaitForResult(func() (bool, error) {
+		alloc, err := state.AllocByID(nil, a.ID)
+		if err != nil {
+			return false, err
+		}
+		if alloc == nil {
+			return false, fmt.Errorf("unknown alloc")
+		}
+		if alloc.ClientStatus != structs.AllocClientStatusComplete {
+			return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+		}
+
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("Alloc on node %q not finished: %v", c.NodeID(), err)
+	})
+
+	// Make the request without having a node-id
+	req := &cstructs.FsAllTasksTailRequest{
+		LogType:      "stdout",
+		Lines:        10,
+		QueryOptions: structs.QueryOptions{Region: "global"},
+	}
+
+	// Fetch the response
+	var resp cstructs.FsAllTasksTailResponse
+	err := msgpackrpc.CallWithCodec(codec, "FileSystem.AllTasksTail", req, &resp)
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	// Fetch the response setting the alloc id
+	req.AllocID = a.ID
+	var resp2 cstructs.FsAllTasksTailResponse
+	err = msgpackrpc.CallWithCodec(codec, "FileSystem.AllTasksTail", req, &resp2)
+	require.Nil(err)
+	require.Len(resp2.Tails, 1)
+	require.Equal("web", resp2.Tails[0].Task)
+	require.Equal("hello", string(resp2.Tails[0].Data))
+}
+
 func TestClientFS_Streaming_NoAlloc(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -1830,6 +2668,162 @@ OUTER:
 	}
 }
 
+func TestClientFS_Logs_Job_Follow_Replaced(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Start a server and client
+	s, cleanupS := TestServer(t, nil)
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	c, cleanup := client.TestClient(t, func(c *config.Config) {
+		c.Servers = []string{s.config.RPCAddr.String()}
+	})
+	defer cleanup()
+
+	// Force an allocation onto the node
+	a := mock.Alloc()
+	a.Job.Type = structs.JobTypeBatch
+	a.NodeID = c.NodeID()
+	a.Job.TaskGroups[0].Count = 1
+	a.Job.TaskGroups[0].Tasks[0] = &structs.Task{
+		Name:   "web",
+		Driver: "mock_driver",
+		Config: map[string]interface{}{
+			"run_for":       "20s",
+			"stdout_string": "first",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 256,
+		},
+	}
+
+	// Wait for the client to connect
+	testutil.WaitForResult(func() (bool, error) {
+		nodes := s.connectedNodes()
+		return len(nodes) == 1, nil
+	}, func(err error) {
+		t.Fatalf("should have a clients")
+	})
+
+	// Upsert the allocation
+	state := s.State()
+	require.Nil(state.UpsertJob(structs.MsgTypeTestSetup, 999, a.Job))
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1003, []*structs.Allocation{a}))
+
+	waitForRunning := func(allocID string) {
+		testutil.WaitForResult(func() (bool, error) {
+			alloc, err := state.AllocByID(nil, allocID)
+			if err != nil {
+				return false, err
+			}
+			if alloc == nil {
+				return false, fmt.Errorf("unknown alloc")
+			}
+			if alloc.ClientStatus != structs.AllocClientStatusRunning {
+				return false, fmt.Errorf("alloc client status: %v", alloc.ClientStatus)
+			}
+
+			return true, nil
+		}, func(err error) {
+			t.Fatalf("Alloc on node %q not running: %v", c.NodeID(), err)
+		})
+	}
+	waitForRunning(a.ID)
+
+	// Make the request by job rather than allocation
+	req := &cstructs.FsLogsRequest{
+		JobID:     a.JobID,
+		TaskGroup: a.TaskGroup,
+		Task:      "web",
+		LogType:   "stdout",
+		Origin:    "start",
+		PlainText: true,
+		Follow:    true,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: a.Namespace,
+		},
+	}
+
+	// Get the handler
+	handler, err := s.StreamingRpcHandler("FileSystem.Logs")
+	require.Nil(err)
+
+	// Create a pipe
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	errCh := make(chan error)
+	streamMsg := make(chan *cstructs.StreamErrWrapper)
+
+	// Start the handler
+	go handler(p2)
+
+	// Start the decoder
+	go func() {
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			var msg cstructs.StreamErrWrapper
+			if err := decoder.Decode(&msg); err != nil {
+				if err == io.EOF || strings.Contains(err.Error(), "closed") {
+					return
+				}
+				errCh <- fmt.Errorf("error decoding: %v", err)
+			}
+
+			streamMsg <- &msg
+		}
+	}()
+
+	// Send the request
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.Nil(encoder.Encode(req))
+
+	receive := func(expected string) {
+		timeout := time.After(20 * time.Second)
+		received := ""
+		for {
+			select {
+			case <-timeout:
+				t.Fatalf("timeout waiting for %q, received %q", expected, received)
+			case err := <-errCh:
+				t.Fatal(err)
+			case msg := <-streamMsg:
+				if msg.Error != nil {
+					t.Fatalf("Got error: %v", msg.Error.Error())
+				}
+
+				// Add the payload
+				received += string(msg.Payload)
+				if strings.Contains(received, expected) {
+					return
+				}
+			}
+		}
+	}
+	receive("first")
+
+	// Replace the allocation mid stream
+	a2 := a.Copy()
+	a2.ID = uuid.Generate()
+	a2.Name = structs.AllocName(a.JobID, a.TaskGroup, 1)
+	a2.ClientStatus = structs.AllocClientStatusPending
+	a2.TaskStates = nil
+	a2.Job.TaskGroups[0].Tasks[0].Config["stdout_string"] = "second"
+
+	stopped := a.Copy()
+	stopped.DesiredStatus = structs.AllocDesiredStatusStop
+	require.Nil(state.UpsertAllocs(structs.MsgTypeTestSetup, 1004, []*structs.Allocation{stopped, a2}))
+
+	waitForRunning(a2.ID)
+	receive("second")
+}
+
 func TestClientFS_Logs_Remote_Server(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -2123,3 +3117,31 @@ OUTER:
 		}
 	}
 }
+
+func TestClientFS_latestTaskAlloc(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	newAlloc := func(index uint64, status string) *structs.Allocation {
+		a := mock.Alloc()
+		a.CreateIndex = index
+		a.ClientStatus = status
+		return a
+	}
+
+	old := newAlloc(10, structs.AllocClientStatusRunning)
+	failed := newAlloc(20, structs.AllocClientStatusFailed)
+	other := newAlloc(30, structs.AllocClientStatusRunning)
+	other.TaskGroup = "other"
+	allocs := []*structs.Allocation{old, failed, other}
+
+	// Running allocations are preferred
+	require.Equal(old, latestTaskAlloc(allocs, "web", "web", 0))
+
+	// Otherwise the most recent allocation is used
+	require.Equal(failed, latestTaskAlloc(allocs, "web", "web", 10))
+
+	// Unknown tasks and groups match nothing
+	require.Nil(latestTaskAlloc(allocs, "web", "unknown", 0))
+	require.Nil(latestTaskAlloc(allocs, "unknown", "web", 0))
+}
@@ -1,16 +1,22 @@
 package nomad
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/go-msgpack/codec"
 
 	"github.com/hashicorp/nomad/acl"
+	"github.com/hashicorp/nomad/helper"
 	"github.com/hashicorp/nomad/nomad/state"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -21,6 +27,17 @@ const (
 	//
 	// Does not apply to fuzzy searching.
 	truncateLimit = 20
+
+	// maxSearchSummaries is the maximum number of objects that can be
+	// summarized in a single request.
+	maxSearchSummaries = 1000
+
+	// segmentScanLimit is the number of jobs scanned when matching a prefix
+	// against the segments of job IDs, unless the configured query limit is
+	// higher. Every job scanned is compared with the prefix, so the cost of
+	// such searches grows with the number of jobs rather than the number of
+	// matches.
+	segmentScanLimit = 10000
 )
 
 var (
@@ -45,55 +62,178 @@ type Search struct {
 	logger hclog.Logger
 }
 
+func (s *Search) register() {
+	s.srv.streamingRpcs.Register("Search.PrefixSearchStream", s.prefixSearchStream)
+}
+
 // getPrefixMatches extracts matches for an iterator, and returns a list of ids for
-// these matches.
-func (s *Search) getPrefixMatches(iter memdb.ResultIterator, prefix string) ([]string, bool) {
+// these matches. The modify index and status of each match are recorded in
+// indexes and statuses if they are not nil.
+func (s *Search) getPrefixMatches(iter memdb.ResultIterator, prefix string,
+	indexes map[string]uint64, statuses map[string]string) ([]string, bool) {
 	var matches []string
+	truncated, _ := s.eachPrefixMatch(iter, prefix, func(id string, raw interface{}) error {
+		matches = append(matches, id)
+		if indexes != nil {
+			indexes[id] = getModifyIndex(raw)
+		}
+		if status, ok := getMatchStatus(raw); ok && statuses != nil {
+			statuses[id] = status
+		}
+		return nil
+	})
+	return matches, truncated
+}
 
+// eachPrefixMatch calls fn with each of the matches of an iterator, in the
+// order they are returned, stopping early if fn returns an error. It returns
+// whether the matches were truncated.
+func (s *Search) eachPrefixMatch(iter memdb.ResultIterator, prefix string, fn func(id string, raw interface{}) error) (bool, error) {
 	for i := 0; i < truncateLimit; i++ {
 		raw := iter.Next()
 		if raw == nil {
 			break
 		}
 
-		var id string
-		switch t := raw.(type) {
-		case *structs.Job:
-			id = t.ID
-		case *structs.Evaluation:
-			id = t.ID
-		case *structs.Allocation:
-			id = t.ID
-		case *structs.Node:
-			id = t.ID
-		case *structs.Deployment:
-			id = t.ID
-		case *structs.CSIPlugin:
-			id = t.ID
-		case *structs.CSIVolume:
-			id = t.ID
-		case *structs.ScalingPolicy:
-			id = t.ID
-		case *structs.Namespace:
-			id = t.Name
-		default:
-			matchID, ok := getEnterpriseMatch(raw)
-			if !ok {
-				s.logger.Error("unexpected type for resources context", "type", fmt.Sprintf("%T", t))
-				continue
-			}
+		id, ok := s.getMatchID(raw)
+		if !ok {
+			continue
+		}
 
-			id = matchID
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+
+		if err := fn(id, raw); err != nil {
+			return false, err
+		}
+	}
+
+	return iter.Next() != nil, nil
+}
+
+// getRecentPrefixMatches extracts matches for an iterator like
+// getPrefixMatches, but orders them by most recently modified first. Because
+// the iterator is in ID order, up to the configured query limit of objects are
+// scanned before the matches are sorted and truncated.
+func (s *Search) getRecentPrefixMatches(iter memdb.ResultIterator, prefix string,
+	indexes map[string]uint64, statuses map[string]string) ([]string, bool) {
+	type recentMatch struct {
+		id    string
+		index uint64
+		raw   interface{}
+	}
+
+	limitQuery := truncateLimit
+	if sc := s.srv.config.SearchConfig; sc != nil && sc.LimitQuery > limitQuery {
+		limitQuery = sc.LimitQuery
+	}
+
+	var recent []recentMatch
+	for i := 0; i < limitQuery; i++ {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+
+		id, ok := s.getMatchID(raw)
+		if !ok {
+			continue
 		}
 
 		if !strings.HasPrefix(id, prefix) {
 			continue
 		}
 
-		matches = append(matches, id)
+		recent = append(recent, recentMatch{id: id, index: getModifyIndex(raw), raw: raw})
+	}
+	truncated := iter.Next() != nil
+
+	sort.SliceStable(recent, func(a, b int) bool {
+		return recent[a].index > recent[b].index
+	})
+
+	if len(recent) > truncateLimit {
+		recent = recent[:truncateLimit]
+		truncated = true
 	}
 
-	return matches, iter.Next() != nil
+	matches := make([]string, 0, len(recent))
+	for _, match := range recent {
+		matches = append(matches, match.id)
+		if indexes != nil {
+			indexes[match.id] = match.index
+		}
+		if status, ok := getMatchStatus(match.raw); ok && statuses != nil {
+			statuses[match.id] = status
+		}
+	}
+
+	return matches, truncated
+}
+
+// getMatchID returns the ID used for prefix matching of an object returned by
+// a resource iterator. Objects of new contexts are matched by implementing the
+// state.IDGetter interface.
+func (s *Search) getMatchID(raw interface{}) (string, bool) {
+	if getter, ok := raw.(state.IDGetter); ok {
+		return getter.GetID(), true
+	}
+
+	matchID, ok := getEnterpriseMatch(raw)
+	if !ok {
+		s.logger.Error("unexpected type for resources context", "type", fmt.Sprintf("%T", raw))
+		return "", false
+	}
+
+	return matchID, true
+}
+
+// getModifyIndex returns the modify index of an object returned by a resource
+// iterator, or zero if the object does not track one.
+func getModifyIndex(raw interface{}) uint64 {
+	switch t := raw.(type) {
+	case *structs.Job:
+		return t.ModifyIndex
+	case *structs.Evaluation:
+		return t.ModifyIndex
+	case *structs.Allocation:
+		return t.ModifyIndex
+	case *structs.Node:
+		return t.ModifyIndex
+	case *structs.Deployment:
+		return t.ModifyIndex
+	case *structs.CSIPlugin:
+		return t.ModifyIndex
+	case *structs.CSIVolume:
+		return t.ModifyIndex
+	case *structs.ScalingPolicy:
+		return t.ModifyIndex
+	case *structs.Namespace:
+		return t.ModifyIndex
+	default:
+		return 0
+	}
+}
+
+// getMatchStatus returns the status of an object returned by a resource
+// iterator: the status of jobs, nodes, evaluations and deployments, and the
+// client status of allocations. Objects of other contexts have no status.
+func getMatchStatus(raw interface{}) (string, bool) {
+	switch t := raw.(type) {
+	case *structs.Job:
+		return t.Status, true
+	case *structs.Allocation:
+		return t.ClientStatus, true
+	case *structs.Node:
+		return t.Status, true
+	case *structs.Evaluation:
+		return t.Status, true
+	case *structs.Deployment:
+		return t.Status, true
+	default:
+		return "", false
+	}
 }
 
 func (s *Search) getFuzzyMatches(iter memdb.ResultIterator, text string) (map[structs.Context][]structs.FuzzyMatch, map[structs.Context]bool) {
@@ -472,6 +612,27 @@ func nsCapFilter(aclObj *acl.ACL) memdb.FilterFunc {
 	}
 }
 
+// qualifiedSearchPrefix splits a prefix qualified with an existing namespace,
+// such as "default:example", into the namespace and the prefix to search it
+// for. Other prefixes are searched for in the namespace of the request, so
+// that IDs containing a colon, such as "web:api", can still be found when no
+// namespace is named like the part before the colon.
+func qualifiedSearchPrefix(state *state.StateStore, namespace, prefix string) (string, string, bool, error) {
+	i := strings.IndexByte(prefix, ':')
+	if i < 0 || !structs.ValidNamespaceName(prefix[:i]) {
+		return namespace, prefix, false, nil
+	}
+
+	ns, err := state.NamespaceByName(nil, prefix[:i])
+	if err != nil {
+		return "", "", false, err
+	}
+	if ns == nil {
+		return namespace, prefix, false, nil
+	}
+	return prefix[:i], prefix[i+1:], true, nil
+}
+
 // If the length of a prefix is odd, return a subset to the last even character
 // This only applies to UUIDs, jobs are excluded
 func roundUUIDDownIfOdd(prefix string, context structs.Context) string {
@@ -526,41 +687,122 @@ func (s *Search) PrefixSearch(args *structs.SearchRequest, reply *structs.Search
 		return err
 	}
 
-	namespace := args.RequestNamespace()
+	// A prefix qualified with a namespace searches that namespace
+	namespace, prefix, qualified, err := qualifiedSearchPrefix(s.srv.fsm.State(), args.RequestNamespace(), args.Prefix)
+	if err != nil {
+		return err
+	}
+	args.Prefix = prefix
+
+	context, err := normalizeContext(args.Context)
+	if err != nil {
+		return err
+	}
+	args.Context = context
+
+	if err := validateSearchFilter(args.Filter); err != nil {
+		return err
+	}
+	if args.NodeStatus != "" && !structs.ValidNodeStatus(args.NodeStatus) {
+		return fmt.Errorf("invalid node status %q", args.NodeStatus)
+	}
 
-	// Require either node:read or namespace:read-job
-	if !sufficientSearchPerms(aclObj, namespace, args.Context) {
+	// Require either node:read or namespace:read-job. A namespace named in
+	// the prefix that may not be searched has no matches rather than an
+	// error confirming that it exists.
+	denied := !sufficientSearchPerms(aclObj, namespace, args.Context)
+	if denied && !qualified {
 		return structs.ErrPermissionDenied
 	}
 
-	reply.Matches = make(map[structs.Context][]string)
-	reply.Truncations = make(map[structs.Context]bool)
+	excluded := excludedIDs(args.ExcludeIDs)
 
-	// Setup the blocking query
+	// Setup the blocking query. Only the tables of the searched contexts are
+	// watched, through the prefix iterators, so changes to other tables or
+	// to objects not matching the prefix do not unblock it.
 	opts := blockingOptions{
 		queryMeta: &reply.QueryMeta,
-		queryOpts: &structs.QueryOptions{},
+		queryOpts: &args.QueryOptions,
 		run: func(ws memdb.WatchSet, state *state.StateStore) error {
 
+			// Reset the matches as the query may be run multiple times
+			reply.Matches = make(map[structs.Context][]string)
+			reply.Truncations = make(map[structs.Context]bool)
+			if args.Highlight {
+				reply.Highlights = make(map[structs.Context][]structs.SearchHighlight)
+			}
+			if args.IncludeIndexes {
+				reply.Indexes = make(map[structs.Context]map[string]uint64)
+			}
+			if args.IncludeStatus {
+				reply.Statuses = make(map[structs.Context]map[string]string)
+			}
+
 			iters := make(map[structs.Context]memdb.ResultIterator)
-			contexts := filteredSearchContexts(aclObj, namespace, args.Context)
+			segments := make(map[structs.Context]*segmentIterator)
+			var contexts []structs.Context
+			if !denied {
+				contexts = filteredSearchContexts(aclObj, namespace, args.Context)
+			}
 
 			for _, ctx := range contexts {
-				iter, err := getResourceIter(ctx, aclObj, namespace, roundUUIDDownIfOdd(args.Prefix, args.Context), ws, state)
+				segmented := segmentSearch(ctx, args.Separator)
+				prefix := roundUUIDDownIfOdd(args.Prefix, args.Context)
+				if segmented {
+					prefix = ""
+				}
+
+				iter, err := getResourceIter(ctx, aclObj, namespace, prefix, ws, state)
 				if err != nil {
 					if !s.silenceError(err) {
 						return err
 					}
-				} else {
-					iters[ctx] = iter
+					continue
+				}
+				if segmented {
+					segments[ctx] = s.newSegmentIterator(iter, args.Prefix, args.Separator)
+					iter = segments[ctx]
 				}
+				iters[ctx] = s.filterExcluded(filterNodes(filterTerminal(iter, args.Filter), args.NodeStatus, args.OnlyEligible), excluded)
 			}
 
 			// Return matches for the given prefix
 			for k, v := range iters {
-				res, isTrunc := s.getPrefixMatches(v, args.Prefix)
+				var res []string
+				var isTrunc bool
+				var indexes map[string]uint64
+				if args.IncludeIndexes {
+					indexes = make(map[string]uint64)
+					reply.Indexes[k] = indexes
+				}
+				var statuses map[string]string
+				if args.IncludeStatus {
+					statuses = make(map[string]string)
+					reply.Statuses[k] = statuses
+				}
+				// The IDs of jobs searched by segment were matched by the
+				// iterator
+				prefix := args.Prefix
+				segment := segments[k]
+				if segment != nil {
+					prefix = ""
+				}
+
+				if args.SortByRecent {
+					res, isTrunc = s.getRecentPrefixMatches(v, prefix, indexes, statuses)
+				} else {
+					res, isTrunc = s.getPrefixMatches(v, prefix, indexes, statuses)
+				}
 				reply.Matches[k] = res
-				reply.Truncations[k] = isTrunc
+				reply.Truncations[k] = isTrunc || segment.limited()
+
+				if args.Highlight {
+					highlights := make([]structs.SearchHighlight, 0, len(res))
+					for _, id := range res {
+						highlights = append(highlights, searchHighlight(id, args.Prefix, segment))
+					}
+					reply.Highlights[k] = highlights
+				}
 			}
 
 			// Set the index for the context. If the context has been specified, it
@@ -582,6 +824,330 @@ func (s *Search) PrefixSearch(args *structs.SearchRequest, reply *structs.Search
 	return s.srv.blockingRPC(&opts)
 }
 
+// Summaries is used to return compact summaries of objects of a context by
+// ID, so that the matches of a prefix search can be listed without fetching
+// each object. Objects the token may not read are omitted.
+func (s *Search) Summaries(args *structs.SearchSummariesRequest, reply *structs.SearchSummariesResponse) error {
+	if done, err := s.srv.forward("Search.Summaries", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"nomad", "search", "summaries"}, time.Now())
+
+	aclObj, err := s.srv.ResolveToken(args.AuthToken)
+	if err != nil {
+		return err
+	}
+
+	context, err := normalizeContext(args.Context)
+	if err != nil {
+		return err
+	}
+	switch context {
+	case structs.Jobs, structs.Allocs, structs.Nodes, structs.Evals, structs.Deployments:
+	default:
+		return fmt.Errorf("summaries are only available for the %s, %s, %s, %s and %s contexts; got %q",
+			structs.Jobs, structs.Allocs, structs.Nodes, structs.Evals, structs.Deployments, args.Context)
+	}
+	if len(args.IDs) > maxSearchSummaries {
+		return fmt.Errorf("at most %d objects can be summarized; got %d", maxSearchSummaries, len(args.IDs))
+	}
+
+	namespace := args.RequestNamespace()
+
+	// Setup the blocking query
+	opts := blockingOptions{
+		queryMeta: &reply.QueryMeta,
+		queryOpts: &args.QueryOptions,
+		run: func(ws memdb.WatchSet, state *state.StateStore) error {
+			reply.Summaries = make([]*structs.SearchSummary, 0, len(args.IDs))
+			for _, id := range args.IDs {
+				summary, err := searchSummary(ws, state, aclObj, context, namespace, id)
+				if err != nil {
+					return err
+				}
+				if summary != nil {
+					reply.Summaries = append(reply.Summaries, summary)
+				}
+			}
+
+			index, err := state.Index(contextToIndex(context))
+			if err != nil {
+				return err
+			}
+			reply.Index = index
+
+			s.srv.setQueryMeta(&reply.QueryMeta)
+			return nil
+		}}
+	return s.srv.blockingRPC(&opts)
+}
+
+// searchSummary returns the summary of the object of the context with the
+// given ID, or nil if it does not exist or the ACL may not read it.
+func searchSummary(ws memdb.WatchSet, state *state.StateStore, aclObj *acl.ACL,
+	context structs.Context, namespace, id string) (*structs.SearchSummary, error) {
+
+	var raw interface{}
+	summary := &structs.SearchSummary{ID: id}
+	switch context {
+	case structs.Jobs:
+		job, err := state.JobByID(ws, namespace, id)
+		if err != nil || job == nil {
+			return nil, err
+		}
+		raw, summary.Name, summary.Namespace = job, job.Name, job.Namespace
+	case structs.Allocs:
+		alloc, err := state.AllocByID(ws, id)
+		if err != nil || alloc == nil {
+			return nil, err
+		}
+		raw, summary.Name, summary.Namespace = alloc, alloc.Name, alloc.Namespace
+	case structs.Evals:
+		eval, err := state.EvalByID(ws, id)
+		if err != nil || eval == nil {
+			return nil, err
+		}
+		raw, summary.Namespace = eval, eval.Namespace
+	case structs.Deployments:
+		deployment, err := state.DeploymentByID(ws, id)
+		if err != nil || deployment == nil {
+			return nil, err
+		}
+		raw, summary.Namespace = deployment, deployment.Namespace
+	case structs.Nodes:
+		node, err := state.NodeByID(ws, id)
+		if err != nil || node == nil {
+			return nil, err
+		}
+		if aclObj != nil && !aclObj.AllowNodeRead() {
+			return nil, nil
+		}
+		raw, summary.Name = node, node.Name
+	default:
+		return nil, nil
+	}
+
+	// Objects in namespaces require reading the namespace's jobs
+	if summary.Namespace != "" && aclObj != nil &&
+		!aclObj.AllowNsOp(summary.Namespace, acl.NamespaceCapabilityReadJob) {
+		return nil, nil
+	}
+
+	summary.Status, _ = getMatchStatus(raw)
+	summary.ModifyIndex = getModifyIndex(raw)
+	return summary, nil
+}
+
+// prefixSearchStream is a streaming variant of PrefixSearch that sends each
+// match as soon as it is found rather than once the search completes, so
+// autocompletion can show the first matches of large prefixes immediately.
+// The matches of each context are capped as for PrefixSearch and the search
+// stops if the remote side closes the connection.
+func (s *Search) prefixSearchStream(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	defer metrics.MeasureSince([]string{"nomad", "search", "prefix_search_stream"}, time.Now())
+
+	var args structs.SearchRequest
+	decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+	encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+
+	if err := decoder.Decode(&args); err != nil {
+		handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	// Forward to the appropriate region
+	if args.Region != s.srv.config.Region {
+		if err := s.forwardStreamingRPC(args.Region, "Search.PrefixSearchStream", args, conn); err != nil {
+			handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+		}
+		return
+	}
+
+	aclObj, err := s.srv.ResolveToken(args.AuthToken)
+	if err != nil {
+		handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	// A prefix qualified with a namespace searches that namespace
+	namespace, prefix, qualified, err := qualifiedSearchPrefix(s.srv.fsm.State(), args.RequestNamespace(), args.Prefix)
+	if err != nil {
+		handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+	args.Prefix = prefix
+
+	normalized, err := normalizeContext(args.Context)
+	if err != nil {
+		handleSearchStreamError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	args.Context = normalized
+
+	if err := validateSearchFilter(args.Filter); err != nil {
+		handleSearchStreamError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+	if args.NodeStatus != "" && !structs.ValidNodeStatus(args.NodeStatus) {
+		handleSearchStreamError(fmt.Errorf("invalid node status %q", args.NodeStatus), helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	// Require either node:read or namespace:read-job. As for PrefixSearch, a
+	// namespace named in the prefix that may not be searched has no matches.
+	denied := !sufficientSearchPerms(aclObj, namespace, args.Context)
+	if denied && !qualified {
+		handleSearchStreamError(structs.ErrPermissionDenied, helper.Int64ToPtr(403), encoder)
+		return
+	}
+
+	snap, err := s.srv.State().Snapshot()
+	if err != nil {
+		handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+		return
+	}
+
+	excluded := excludedIDs(args.ExcludeIDs)
+
+	// Stop searching once the remote side closes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		cancel()
+	}()
+
+	send := func(resp *structs.SearchStreamResponse) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+		encoder.Reset(conn)
+		return nil
+	}
+
+	done := &structs.SearchStreamResponse{
+		Done:        true,
+		Truncations: make(map[structs.Context]bool),
+	}
+
+	var contexts []structs.Context
+	if !denied {
+		contexts = filteredSearchContexts(aclObj, namespace, args.Context)
+	}
+	for _, c := range contexts {
+		// The IDs of jobs searched by segment are matched by the iterator
+		prefix := roundUUIDDownIfOdd(args.Prefix, args.Context)
+		matchPrefix := args.Prefix
+		segmented := segmentSearch(c, args.Separator)
+		if segmented {
+			prefix, matchPrefix = "", ""
+		}
+
+		iter, err := getResourceIter(c, aclObj, namespace, prefix, nil, &snap.StateStore)
+		if err != nil {
+			if !s.silenceError(err) {
+				handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+				return
+			}
+			continue
+		}
+		var segment *segmentIterator
+		if segmented {
+			segment = s.newSegmentIterator(iter, args.Prefix, args.Separator)
+			iter = segment
+		}
+		iter = s.filterExcluded(filterNodes(filterTerminal(iter, args.Filter), args.NodeStatus, args.OnlyEligible), excluded)
+
+		emit := func(id string, index uint64) error {
+			match := &structs.SearchStreamMatch{Context: c, ID: id}
+			if args.Highlight {
+				highlight := searchHighlight(id, args.Prefix, segment)
+				match.Highlight = &highlight
+			}
+			if args.IncludeIndexes {
+				match.ModifyIndex = index
+			}
+			return send(&structs.SearchStreamResponse{Match: match})
+		}
+
+		// Matches ordered by recency can only be sent once all are known
+		var truncated bool
+		if args.SortByRecent {
+			var matches []string
+			indexes := make(map[string]uint64)
+			matches, truncated = s.getRecentPrefixMatches(iter, matchPrefix, indexes, nil)
+			for _, id := range matches {
+				if err = emit(id, indexes[id]); err != nil {
+					break
+				}
+			}
+		} else {
+			truncated, err = s.eachPrefixMatch(iter, matchPrefix, func(id string, raw interface{}) error {
+				return emit(id, getModifyIndex(raw))
+			})
+		}
+		if err != nil {
+			handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+			return
+		}
+		done.Truncations[c] = truncated || segment.limited()
+	}
+
+	for _, c := range contexts {
+		index, err := snap.Index(contextToIndex(c))
+		if err != nil {
+			handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+			return
+		}
+		if index > done.Index {
+			done.Index = index
+		}
+	}
+
+	if err := send(done); err != nil {
+		handleSearchStreamError(err, helper.Int64ToPtr(500), encoder)
+	}
+}
+
+func (s *Search) forwardStreamingRPC(region string, method string, args interface{}, in io.ReadWriteCloser) error {
+	server, err := s.srv.findRegionServer(region)
+	if err != nil {
+		return err
+	}
+
+	srvConn, err := s.srv.streamingRpc(server, method)
+	if err != nil {
+		return err
+	}
+	defer srvConn.Close()
+
+	outEncoder := codec.NewEncoder(srvConn, structs.MsgpackHandle)
+	if err := outEncoder.Encode(args); err != nil {
+		return err
+	}
+
+	structs.Bridge(in, srvConn)
+	return nil
+}
+
+// handleSearchStreamError is a helper for sending an error with a potential
+// error code on a search stream. The transmission of the error is ignored if
+// the error has been generated by the closing of the underlying transport.
+func handleSearchStreamError(err error, code *int64, encoder *codec.Encoder) {
+	// Nothing to do as the conn is closed
+	if err == io.EOF || err == context.Canceled || strings.Contains(err.Error(), "closed") {
+		return
+	}
+
+	encoder.Encode(&structs.SearchStreamResponse{
+		Error: structs.NewRpcError(err, code),
+	})
+}
+
 // FuzzySearch is used to list fuzzy or prefix matches for a given text argument and Context.
 // If the Context is "all", all searchable contexts are searched. If ACLs are enabled,
 // results are limited to policies of the provided ACL token.
@@ -632,16 +1198,17 @@ func (s *Search) FuzzySearch(args *structs.FuzzySearchRequest, reply *structs.Fu
 	// for case-insensitive searching, lower-case the search term once and reuse
 	text := strings.ToLower(args.Text)
 
-	// accumulate fuzzy search results and any truncations
-	reply.Matches = make(map[structs.Context][]structs.FuzzyMatch)
-	reply.Truncations = make(map[structs.Context]bool)
-
 	// Setup the blocking query
 	opts := blockingOptions{
 		queryMeta: &reply.QueryMeta,
-		queryOpts: new(structs.QueryOptions),
+		queryOpts: &args.QueryOptions,
 		run: func(ws memdb.WatchSet, state *state.StateStore) error {
 
+			// accumulate fuzzy search results and any truncations, resetting
+			// them as the query may be run multiple times
+			reply.Matches = make(map[structs.Context][]structs.FuzzyMatch)
+			reply.Truncations = make(map[structs.Context]bool)
+
 			fuzzyIters := make(map[structs.Context]memdb.ResultIterator)
 			prefixIters := make(map[structs.Context]memdb.ResultIterator)
 
@@ -681,7 +1248,7 @@ func (s *Search) FuzzySearch(args *structs.FuzzySearchRequest, reply *structs.Fu
 
 			// Set prefix matches of the given text
 			for ctx, iter := range prefixIters {
-				res, isTrunc := s.getPrefixMatches(iter, args.Text)
+				res, isTrunc := s.getPrefixMatches(iter, args.Text, nil, nil)
 				matches := make([]structs.FuzzyMatch, 0, len(res))
 				for _, result := range res {
 					matches = append(matches, structs.FuzzyMatch{ID: result})
@@ -711,13 +1278,15 @@ func (s *Search) FuzzySearch(args *structs.FuzzySearchRequest, reply *structs.Fu
 			// Set the index for the context. If the context has been specified,
 			// it will be used as the index of the response. Otherwise, the maximum
 			// index from all the resources will be used.
-			for _, ctx := range fuzzyContexts {
-				index, err := state.Index(contextToIndex(ctx))
-				if err != nil {
-					return err
-				}
-				if index > reply.Index {
-					reply.Index = index
+			for _, contexts := range [][]structs.Context{prefixContexts, fuzzyContexts} {
+				for _, ctx := range contexts {
+					index, err := state.Index(contextToIndex(ctx))
+					if err != nil {
+						return err
+					}
+					if index > reply.Index {
+						reply.Index = index
+					}
 				}
 			}
 
@@ -742,6 +1311,259 @@ func expandContext(context structs.Context) []structs.Context {
 	}
 }
 
+// matchHighlight returns the position of the first case-insensitive
+// occurrence of text within id, as byte offsets into id. Case folding may
+// change the length of characters, so the length returned is that of the
+// matched portion of id rather than of text.
+func matchHighlight(id, text string) (structs.SearchHighlight, bool) {
+	if text == "" {
+		return structs.SearchHighlight{}, true
+	}
+
+	for offset := range id {
+		if n, ok := foldPrefixLen(id[offset:], text); ok {
+			return structs.SearchHighlight{Offset: offset, Length: n}, true
+		}
+	}
+
+	return structs.SearchHighlight{}, false
+}
+
+// foldPrefixLen returns the number of bytes of s matching prefix under
+// Unicode case folding, and whether s starts with prefix.
+func foldPrefixLen(s, prefix string) (int, bool) {
+	n := 0
+	for _, r := range prefix {
+		if n >= len(s) {
+			return 0, false
+		}
+
+		_, size := utf8.DecodeRuneInString(s[n:])
+		if !strings.EqualFold(s[n:n+size], string(r)) {
+			return 0, false
+		}
+		n += size
+	}
+	return n, true
+}
+
+// segmentSearch returns whether the context is searched by matching the prefix
+// against the segments of IDs split by the separator, which is only done for
+// jobs.
+func segmentSearch(context structs.Context, sep string) bool {
+	return sep != "" && context == structs.Jobs
+}
+
+// segmentMatch returns the byte offset of the first segment of id, split by
+// sep, that starts with prefix, and whether there is one.
+func segmentMatch(id, prefix, sep string) (int, bool) {
+	offset := 0
+	for {
+		if strings.HasPrefix(id[offset:], prefix) {
+			return offset, true
+		}
+
+		i := strings.Index(id[offset:], sep)
+		if i < 0 {
+			return 0, false
+		}
+		offset += i + len(sep)
+	}
+}
+
+// searchHighlight returns the position of the prefix matched by id, which is
+// that of its matched segment if it was matched by segment.
+func searchHighlight(id, prefix string, segment *segmentIterator) structs.SearchHighlight {
+	if segment != nil {
+		if offset, ok := segmentMatch(id, prefix, segment.sep); ok {
+			return structs.SearchHighlight{Offset: offset, Length: len(prefix)}
+		}
+	}
+
+	highlight, _ := matchHighlight(id, prefix)
+	return highlight
+}
+
+// segmentIterator filters the objects of an iterator to those with an ID
+// having a segment that starts with the prefix. As every object must be
+// compared, at most limit objects are scanned.
+type segmentIterator struct {
+	s      *Search
+	iter   memdb.ResultIterator
+	prefix string
+	sep    string
+
+	limit   int
+	scanned int
+
+	// stopped is set once the scan reached the limit, and truncated if
+	// objects were left unscanned
+	stopped   bool
+	truncated bool
+}
+
+// newSegmentIterator returns an iterator matching the prefix against the
+// segments of the IDs of iter split by sep.
+func (s *Search) newSegmentIterator(iter memdb.ResultIterator, prefix, sep string) *segmentIterator {
+	limit := segmentScanLimit
+	if sc := s.srv.config.SearchConfig; sc != nil && sc.LimitQuery > limit {
+		limit = sc.LimitQuery
+	}
+
+	return &segmentIterator{
+		s:      s,
+		iter:   iter,
+		prefix: prefix,
+		sep:    sep,
+		limit:  limit,
+	}
+}
+
+func (it *segmentIterator) WatchCh() <-chan struct{} {
+	return it.iter.WatchCh()
+}
+
+func (it *segmentIterator) Next() interface{} {
+	for !it.stopped {
+		if it.scanned == it.limit {
+			it.stopped = true
+			it.truncated = it.iter.Next() != nil
+			break
+		}
+
+		raw := it.iter.Next()
+		if raw == nil {
+			break
+		}
+		it.scanned++
+
+		id, ok := it.s.getMatchID(raw)
+		if !ok {
+			continue
+		}
+		if _, ok := segmentMatch(id, it.prefix, it.sep); ok {
+			return raw
+		}
+	}
+
+	return nil
+}
+
+// limited returns whether the scan stopped with objects left unscanned. It is
+// false for a nil iterator so that it can be called for every context.
+func (it *segmentIterator) limited() bool {
+	return it != nil && it.truncated
+}
+
+// validateSearchFilter returns an error if the filter is not a known
+// SearchFilter.
+func validateSearchFilter(filter structs.SearchFilter) error {
+	switch filter {
+	case "", structs.SearchExcludeTerminal, structs.SearchOnlyTerminal:
+		return nil
+	default:
+		return fmt.Errorf("filter must be one of %q or %q; got %q",
+			structs.SearchExcludeTerminal, structs.SearchOnlyTerminal, filter)
+	}
+}
+
+// filterTerminal wraps the iterator to apply the search filter to terminal
+// allocations and evaluations. Matches are truncated after filtering since
+// the filtered objects are never returned by the iterator.
+func filterTerminal(iter memdb.ResultIterator, filter structs.SearchFilter) memdb.ResultIterator {
+	if filter == "" {
+		return iter
+	}
+
+	return memdb.NewFilterIterator(iter, func(raw interface{}) bool {
+		var terminal bool
+		switch t := raw.(type) {
+		case *structs.Allocation:
+			terminal = t.TerminalStatus()
+		case *structs.Evaluation:
+			terminal = t.TerminalStatus()
+		default:
+			return false
+		}
+
+		// Returning true removes the object from the iterator
+		if filter == structs.SearchOnlyTerminal {
+			return !terminal
+		}
+		return terminal
+	})
+}
+
+// filterNodes wraps the iterator to only include nodes with the given status,
+// if set, and nodes eligible for scheduling if onlyEligible is set. Like
+// filterTerminal, matches are truncated after filtering.
+func filterNodes(iter memdb.ResultIterator, status string, onlyEligible bool) memdb.ResultIterator {
+	if status == "" && !onlyEligible {
+		return iter
+	}
+
+	return memdb.NewFilterIterator(iter, func(raw interface{}) bool {
+		node, ok := raw.(*structs.Node)
+		if !ok {
+			return false
+		}
+
+		// Returning true removes the node from the iterator
+		if status != "" && node.Status != status {
+			return true
+		}
+		return onlyEligible && node.SchedulingEligibility != structs.NodeSchedulingEligible
+	})
+}
+
+// excludedIDs returns the set of the given IDs, or nil if there are none.
+func excludedIDs(ids []string) map[string]struct{} {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	excluded := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		excluded[id] = struct{}{}
+	}
+	return excluded
+}
+
+// filterExcluded wraps the iterator to skip objects with an excluded ID. As
+// with filterTerminal, excluded objects do not count towards the truncation
+// limit, so excluding the matches already seen returns the next ones.
+func (s *Search) filterExcluded(iter memdb.ResultIterator, excluded map[string]struct{}) memdb.ResultIterator {
+	if len(excluded) == 0 {
+		return iter
+	}
+
+	return memdb.NewFilterIterator(iter, func(raw interface{}) bool {
+		id, ok := s.getMatchID(raw)
+		if !ok {
+			return false
+		}
+
+		// Returning true removes the object from the iterator
+		_, skip := excluded[id]
+		return skip
+	})
+}
+
+// normalizeContext trims and lowercases the requested context and returns an
+// error listing the supported contexts if it is not one of them.
+func normalizeContext(context structs.Context) (structs.Context, error) {
+	c := structs.Context(strings.ToLower(strings.TrimSpace(string(context))))
+	if c == structs.All {
+		return c, nil
+	}
+	for _, valid := range allContexts {
+		if c == valid {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("context must be one of %v or 'all' for all contexts; got %q", allContexts, context)
+}
+
 // sufficientFuzzySearchPerms returns true if the searched namespace is the wildcard
 // namespace, indicating we should bypass the preflight ACL checks otherwise performed
 // by sufficientSearchPerms. This is to support fuzzy searching multiple namespaces
@@ -2,12 +2,17 @@ package nomad
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/go-msgpack/codec"
 	msgpackrpc "github.com/hashicorp/net-rpc-msgpackrpc"
 	"github.com/hashicorp/nomad/acl"
+	"github.com/hashicorp/nomad/helper/testlog"
 	"github.com/hashicorp/nomad/helper/uuid"
 	"github.com/hashicorp/nomad/nomad/mock"
 	"github.com/hashicorp/nomad/nomad/state"
@@ -69,6 +74,44 @@ func TestSearch_PrefixSearch_Job(t *testing.T) {
 	require.Equal(t, uint64(jobIndex), resp.Index)
 }
 
+func TestSearch_PrefixSearch_NormalizeContext(t *testing.T) {
+	t.Parallel()
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	job := registerMockJob(s, t, prefix, 0)
+
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: " Jobs ",
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: job.Namespace,
+		},
+	}
+
+	var resp structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	require.Len(t, resp.Matches[structs.Jobs], 1)
+	require.Equal(t, job.ID, resp.Matches[structs.Jobs][0])
+
+	// An unknown context lists the supported ones
+	req.Context = "bogus"
+	err := msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `got "bogus"`)
+	for _, c := range allContexts {
+		require.Contains(t, err.Error(), string(c))
+	}
+}
+
 func TestSearch_PrefixSearch_ACL(t *testing.T) {
 	t.Parallel()
 
@@ -209,22 +252,827 @@ func TestSearch_PrefixSearch_All_JobWithHyphen(t *testing.T) {
 		},
 	}
 
-	// req.Prefix = "example-te": 9
-	for i := 1; i < len(prefix); i++ {
-		req.Prefix = prefix[:i]
-		var resp structs.SearchResponse
-		require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
-		require.Equal(t, 1, len(resp.Matches[structs.Jobs]))
-		require.Equal(t, job.ID, resp.Matches[structs.Jobs][0])
-		require.EqualValues(t, jobIndex, resp.Index)
+	// req.Prefix = "example-te": 9
+	for i := 1; i < len(prefix); i++ {
+		req.Prefix = prefix[:i]
+		var resp structs.SearchResponse
+		require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+		require.Equal(t, 1, len(resp.Matches[structs.Jobs]))
+		require.Equal(t, job.ID, resp.Matches[structs.Jobs][0])
+		require.EqualValues(t, jobIndex, resp.Index)
+	}
+}
+
+func TestSearch_PrefixSearch_All_LongJob(t *testing.T) {
+	t.Parallel()
+
+	prefix := strings.Repeat("a", 100)
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	// Register a job and an allocation
+	job := registerMockJob(s, t, prefix, 0)
+	alloc := mockAlloc()
+	alloc.JobID = job.ID
+	summary := mock.JobSummary(alloc.JobID)
+	fsmState := s.fsm.State()
+
+	require.NoError(t, fsmState.UpsertJobSummary(999, summary))
+	require.NoError(t, fsmState.UpsertAllocs(structs.MsgTypeTestSetup, 1000, []*structs.Allocation{alloc}))
+
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: structs.All,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: job.Namespace,
+		},
+	}
+
+	var resp structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+
+	require.Len(t, resp.Matches[structs.Jobs], 1)
+	require.Equal(t, job.ID, resp.Matches[structs.Jobs][0])
+	require.EqualValues(t, jobIndex, resp.Index)
+}
+
+// truncate should limit results to 20
+func TestSearch_PrefixSearch_Truncate(t *testing.T) {
+	t.Parallel()
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	for counter := 0; counter < 25; counter++ {
+		registerMockJob(s, t, prefix, counter)
+	}
+
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: structs.Jobs,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: "default",
+		},
+	}
+
+	var resp structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+
+	require.Len(t, resp.Matches[structs.Jobs], 20)
+	require.True(t, resp.Truncations[structs.Jobs])
+	require.Equal(t, uint64(jobIndex), resp.Index)
+}
+
+func TestSearch_PrefixSearch_ExcludeIDs(t *testing.T) {
+	t.Parallel()
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	for counter := 0; counter < 25; counter++ {
+		registerMockJob(s, t, prefix, counter)
+	}
+
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: structs.Jobs,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: "default",
+		},
+	}
+
+	var first structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &first))
+	require.Len(t, first.Matches[structs.Jobs], 20)
+	require.True(t, first.Truncations[structs.Jobs])
+
+	// Excluding the first page returns the remaining matches
+	req.ExcludeIDs = first.Matches[structs.Jobs]
+	var next structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &next))
+	require.Len(t, next.Matches[structs.Jobs], 5)
+	require.False(t, next.Truncations[structs.Jobs])
+	for _, id := range next.Matches[structs.Jobs] {
+		require.NotContains(t, first.Matches[structs.Jobs], id)
+	}
+}
+
+func TestSearch_Summaries(t *testing.T) {
+	t.Parallel()
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	var jobs []*structs.Job
+	for counter := 0; counter < 3; counter++ {
+		jobs = append(jobs, registerMockJob(s, t, prefix, counter))
+	}
+
+	// Resolve the prefix
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: structs.Jobs,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: structs.DefaultNamespace,
+		},
+	}
+	var resp structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	require.Len(t, resp.Matches[structs.Jobs], 3)
+
+	// Summarize the matches in one request, omitting unknown IDs
+	summariesReq := &structs.SearchSummariesRequest{
+		Context:      structs.Jobs,
+		IDs:          append(resp.Matches[structs.Jobs], "unknown"),
+		QueryOptions: req.QueryOptions,
+	}
+	var summaries structs.SearchSummariesResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.Summaries", summariesReq, &summaries))
+	require.Equal(t, uint64(jobIndex), summaries.Index)
+	require.Len(t, summaries.Summaries, 3)
+	for i, summary := range summaries.Summaries {
+		stored, err := s.fsm.State().JobByID(nil, structs.DefaultNamespace, jobs[i].ID)
+		require.NoError(t, err)
+		require.Equal(t, &structs.SearchSummary{
+			ID:          stored.ID,
+			Name:        stored.Name,
+			Namespace:   stored.Namespace,
+			Status:      stored.Status,
+			ModifyIndex: stored.ModifyIndex,
+		}, summary)
+	}
+
+	// Contexts without summaries are rejected
+	summariesReq.Context = structs.Volumes
+	err := msgpackrpc.CallWithCodec(codec, "Search.Summaries", summariesReq, &summaries)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "summaries are only available")
+}
+
+func TestSearch_Summaries_ACL(t *testing.T) {
+	t.Parallel()
+
+	s, root, cleanupS := TestACLServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+	fsmState := s.fsm.State()
+
+	ns := mock.Namespace()
+	require.NoError(t, fsmState.UpsertNamespaces(500, []*structs.Namespace{ns}))
+
+	// One allocation in the default namespace and one in the other
+	alloc := mockAlloc()
+	other := mockAlloc()
+	other.Namespace = ns.Name
+	other.Job.Namespace = ns.Name
+	summary := mock.JobSummary(alloc.JobID)
+	require.NoError(t, fsmState.UpsertJobSummary(999, summary))
+	otherSummary := mock.JobSummary(other.JobID)
+	otherSummary.Namespace = ns.Name
+	require.NoError(t, fsmState.UpsertJobSummary(999, otherSummary))
+	require.NoError(t, fsmState.UpsertAllocs(structs.MsgTypeTestSetup, 1000, []*structs.Allocation{alloc, other}))
+
+	node := mock.Node()
+	require.NoError(t, fsmState.UpsertNode(structs.MsgTypeTestSetup, 1001, node))
+
+	token := mock.CreatePolicyAndToken(t, fsmState, 1003, "test-valid",
+		mock.NamespacePolicy(structs.DefaultNamespace, "", []string{acl.NamespaceCapabilityReadJob}))
+
+	cases := []struct {
+		Name     string
+		Token    string
+		Context  structs.Context
+		IDs      []string
+		Expected []string
+	}{
+		{
+			Name:    "no token",
+			Context: structs.Allocs,
+			IDs:     []string{alloc.ID, other.ID},
+		},
+		{
+			Name:     "namespace token",
+			Token:    token.SecretID,
+			Context:  structs.Allocs,
+			IDs:      []string{alloc.ID, other.ID},
+			Expected: []string{alloc.ID},
+		},
+		{
+			Name:    "namespace token nodes",
+			Token:   token.SecretID,
+			Context: structs.Nodes,
+			IDs:     []string{node.ID},
+		},
+		{
+			Name:     "root token",
+			Token:    root.SecretID,
+			Context:  structs.Allocs,
+			IDs:      []string{alloc.ID, other.ID},
+			Expected: []string{alloc.ID, other.ID},
+		},
+		{
+			Name:     "root token nodes",
+			Token:    root.SecretID,
+			Context:  structs.Nodes,
+			IDs:      []string{node.ID},
+			Expected: []string{node.ID},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := &structs.SearchSummariesRequest{
+				Context: tc.Context,
+				IDs:     tc.IDs,
+				QueryOptions: structs.QueryOptions{
+					Region:    "global",
+					AuthToken: tc.Token,
+				},
+			}
+			var resp structs.SearchSummariesResponse
+			require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.Summaries", req, &resp))
+
+			var ids []string
+			for _, summary := range resp.Summaries {
+				ids = append(ids, summary.ID)
+			}
+			require.Equal(t, tc.Expected, ids)
+		})
+	}
+}
+
+func TestSearch_PrefixSearch_SortByRecent(t *testing.T) {
+	t.Parallel()
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+	fsmState := s.fsm.State()
+
+	// Register jobs in ID order, then modify the first job again so it is the
+	// most recently touched despite having the lowest ID
+	var jobs []*structs.Job
+	for counter := 0; counter < 3; counter++ {
+		job := mock.Job()
+		job.ID = prefix + strconv.Itoa(counter)
+		require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, uint64(jobIndex+counter), job))
+		jobs = append(jobs, job)
+	}
+	updated := jobs[0].Copy()
+	updated.Priority = 90
+	require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, jobIndex+10, updated))
+
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: structs.Jobs,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: "default",
+		},
+	}
+
+	// Without sorting the matches are in ID order
+	var resp structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	require.Equal(t, []string{jobs[0].ID, jobs[1].ID, jobs[2].ID}, resp.Matches[structs.Jobs])
+
+	// Sorting orders by most recently modified first
+	req.SortByRecent = true
+	var sorted structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &sorted))
+	require.Equal(t, []string{jobs[0].ID, jobs[2].ID, jobs[1].ID}, sorted.Matches[structs.Jobs])
+	require.False(t, sorted.Truncations[structs.Jobs])
+}
+
+func TestSearch_PrefixSearch_SortByRecent_Truncate(t *testing.T) {
+	t.Parallel()
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+		c.SearchConfig.LimitQuery = 50
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+	fsmState := s.fsm.State()
+
+	// The job with the highest ID is the most recently modified, and would be
+	// truncated away without sorting. The query limit allows scanning past the
+	// truncation limit before sorting.
+	for counter := 0; counter < 25; counter++ {
+		job := mock.Job()
+		job.ID = fmt.Sprintf("%s%02d", prefix, counter)
+		require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, uint64(jobIndex+counter), job))
+	}
+
+	req := &structs.SearchRequest{
+		Prefix:       prefix,
+		Context:      structs.Jobs,
+		SortByRecent: true,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: "default",
+		},
+	}
+
+	var resp structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	require.Len(t, resp.Matches[structs.Jobs], 20)
+	require.Equal(t, prefix+"24", resp.Matches[structs.Jobs][0])
+	require.True(t, resp.Truncations[structs.Jobs])
+}
+
+func TestSearch_PrefixSearch_AllWithJob(t *testing.T) {
+	t.Parallel()
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	job := registerMockJob(s, t, prefix, 0)
+	eval1 := mock.Eval()
+	eval1.ID = job.ID
+	require.NoError(t, s.fsm.State().UpsertEvals(structs.MsgTypeTestSetup, 2000, []*structs.Evaluation{eval1}))
+
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: structs.All,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: job.Namespace,
+		},
+	}
+
+	var resp structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+
+	require.Len(t, resp.Matches[structs.Jobs], 1)
+	require.Equal(t, job.ID, resp.Matches[structs.Jobs][0])
+	require.Len(t, resp.Matches[structs.Evals], 1)
+	require.Equal(t, eval1.ID, resp.Matches[structs.Evals][0])
+}
+
+func TestSearch_PrefixSearch_Evals(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	eval1 := mock.Eval()
+	require.NoError(t, s.fsm.State().UpsertEvals(structs.MsgTypeTestSetup, 2000, []*structs.Evaluation{eval1}))
+
+	prefix := eval1.ID[:len(eval1.ID)-2]
+
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: structs.Evals,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: eval1.Namespace,
+		},
+	}
+
+	var resp structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+
+	require.Len(t, resp.Matches[structs.Evals], 1)
+	require.Equal(t, eval1.ID, resp.Matches[structs.Evals][0])
+	require.False(t, resp.Truncations[structs.Evals])
+	require.Equal(t, uint64(2000), resp.Index)
+}
+
+func TestSearch_PrefixSearch_Filter(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb897"
+	fsmState := s.fsm.State()
+
+	// Create more terminal allocations than are returned before truncation
+	// and a single running one
+	running := mockAlloc()
+	running.ID = prefix + "00"
+	allocs := []*structs.Allocation{running}
+	for i := 1; i <= truncateLimit+5; i++ {
+		alloc := mockAlloc()
+		alloc.ID = fmt.Sprintf("%s%02d", prefix, i)
+		alloc.ClientStatus = structs.AllocClientStatusComplete
+		allocs = append(allocs, alloc)
+	}
+	require.NoError(t, fsmState.UpsertJobSummary(999, mock.JobSummary(running.JobID)))
+	require.NoError(t, fsmState.UpsertAllocs(structs.MsgTypeTestSetup, 1000, allocs))
+
+	pending := mock.Eval()
+	pending.ID = prefix + "00"
+	complete := mock.Eval()
+	complete.ID = prefix + "01"
+	complete.Status = structs.EvalStatusComplete
+	require.NoError(t, fsmState.UpsertEvals(structs.MsgTypeTestSetup, 1001, []*structs.Evaluation{pending, complete}))
+
+	search := func(filter structs.SearchFilter) (*structs.SearchResponse, error) {
+		req := &structs.SearchRequest{
+			Prefix:  prefix,
+			Context: structs.All,
+			Filter:  filter,
+			QueryOptions: structs.QueryOptions{
+				Region:    "global",
+				Namespace: structs.DefaultNamespace,
+			},
+		}
+
+		var resp structs.SearchResponse
+		err := msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp)
+		return &resp, err
+	}
+
+	// Without a filter the terminal allocations truncate the matches
+	resp, err := search("")
+	require.NoError(t, err)
+	require.Len(t, resp.Matches[structs.Allocs], truncateLimit)
+	require.True(t, resp.Truncations[structs.Allocs])
+	require.Len(t, resp.Matches[structs.Evals], 2)
+
+	// Excluding terminal objects is not truncated
+	resp, err = search(structs.SearchExcludeTerminal)
+	require.NoError(t, err)
+	require.Equal(t, []string{running.ID}, resp.Matches[structs.Allocs])
+	require.False(t, resp.Truncations[structs.Allocs])
+	require.Equal(t, []string{pending.ID}, resp.Matches[structs.Evals])
+
+	// Only including terminal objects
+	resp, err = search(structs.SearchOnlyTerminal)
+	require.NoError(t, err)
+	require.Len(t, resp.Matches[structs.Allocs], truncateLimit)
+	require.NotContains(t, resp.Matches[structs.Allocs], running.ID)
+	require.True(t, resp.Truncations[structs.Allocs])
+	require.Equal(t, []string{complete.ID}, resp.Matches[structs.Evals])
+
+	// Unknown filters are rejected
+	_, err = search("bogus")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `got "bogus"`)
+}
+
+func TestSearch_PrefixSearch_NodeFilter(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb897"
+	fsmState := s.fsm.State()
+
+	// Create more down nodes than are returned before truncation, a ready
+	// node and a ready but ineligible node
+	ready := mock.Node()
+	ready.ID = prefix + "00"
+	ineligible := mock.Node()
+	ineligible.ID = prefix + "01"
+	ineligible.SchedulingEligibility = structs.NodeSchedulingIneligible
+	index := uint64(1000)
+	for _, node := range []*structs.Node{ready, ineligible} {
+		index++
+		require.NoError(t, fsmState.UpsertNode(structs.MsgTypeTestSetup, index, node))
+	}
+	for i := 2; i < truncateLimit+5; i++ {
+		node := mock.Node()
+		node.ID = fmt.Sprintf("%s%02d", prefix, i)
+		node.Status = structs.NodeStatusDown
+		index++
+		require.NoError(t, fsmState.UpsertNode(structs.MsgTypeTestSetup, index, node))
+	}
+
+	search := func(status string, onlyEligible bool) (*structs.SearchResponse, error) {
+		req := &structs.SearchRequest{
+			Prefix:       prefix,
+			Context:      structs.Nodes,
+			NodeStatus:   status,
+			OnlyEligible: onlyEligible,
+			QueryOptions: structs.QueryOptions{
+				Region: "global",
+			},
+		}
+
+		var resp structs.SearchResponse
+		err := msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp)
+		return &resp, err
+	}
+
+	// Without a filter the down nodes truncate the matches
+	resp, err := search("", false)
+	require.NoError(t, err)
+	require.Len(t, resp.Matches[structs.Nodes], truncateLimit)
+	require.True(t, resp.Truncations[structs.Nodes])
+
+	// Filtering by status excludes the down nodes and is not truncated
+	resp, err = search(structs.NodeStatusReady, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{ready.ID, ineligible.ID}, resp.Matches[structs.Nodes])
+	require.False(t, resp.Truncations[structs.Nodes])
+
+	// Filtering by eligibility also excludes the ineligible node
+	resp, err = search(structs.NodeStatusReady, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{ready.ID}, resp.Matches[structs.Nodes])
+	require.False(t, resp.Truncations[structs.Nodes])
+
+	// Unknown statuses are rejected
+	_, err = search("bogus", false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid node status "bogus"`)
+}
+
+func TestSearch_PrefixSearch_Blocking(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	prefix := "aaaaaaaa-e8f7-fd38"
+	search := func(context structs.Context, minIndex uint64, maxTime time.Duration) (*structs.SearchResponse, error) {
+		req := &structs.SearchRequest{
+			Prefix:  prefix,
+			Context: context,
+			QueryOptions: structs.QueryOptions{
+				Region:        "global",
+				Namespace:     structs.DefaultNamespace,
+				MinQueryIndex: minIndex,
+				MaxQueryTime:  maxTime,
+			},
+		}
+
+		var resp structs.SearchResponse
+		err := msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp)
+		return &resp, err
+	}
+
+	resp, err := search(structs.All, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, resp.Matches[structs.Jobs])
+	index := resp.Index
+
+	// Registering a matching job unblocks a query of all contexts
+	job := mock.Job()
+	job.ID = prefix + "-job"
+	time.AfterFunc(100*time.Millisecond, func() {
+		require.NoError(t, s.fsm.State().UpsertJob(structs.MsgTypeTestSetup, index+1000, job))
+	})
+
+	start := time.Now()
+	resp, err = search(structs.All, index, 5*time.Second)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, []string{job.ID}, resp.Matches[structs.Jobs])
+	require.Equal(t, index+1000, resp.Index)
+	index = resp.Index
+
+	// Changes to tables of other contexts do not unblock a query
+	time.AfterFunc(100*time.Millisecond, func() {
+		require.NoError(t, s.fsm.State().UpsertNode(structs.MsgTypeTestSetup, index+1000, mock.Node()))
+	})
+
+	start = time.Now()
+	resp, err = search(structs.Jobs, index, 500*time.Millisecond)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	require.Equal(t, index, resp.Index)
+	require.Equal(t, []string{job.ID}, resp.Matches[structs.Jobs])
+}
+
+func TestSearch_PrefixSearch_Separator(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+
+	for _, id := range []string{"team/service/env", "team/service/prod", "other/services-old", "team/web/env", "serviceless"} {
+		job := mock.Job()
+		job.ID = id
+		registerJob(s, t, job)
+	}
+
+	search := func(prefix, sep string) *structs.SearchResponse {
+		req := &structs.SearchRequest{
+			Prefix:    prefix,
+			Context:   structs.Jobs,
+			Separator: sep,
+			Highlight: true,
+			QueryOptions: structs.QueryOptions{
+				Region:    "global",
+				Namespace: structs.DefaultNamespace,
+			},
+		}
+
+		var resp structs.SearchResponse
+		require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+		return &resp
+	}
+
+	// Interior segments are matched with a separator
+	resp := search("service", "/")
+	require.Equal(t, []string{"other/services-old", "serviceless", "team/service/env", "team/service/prod"}, resp.Matches[structs.Jobs])
+	require.Equal(t, []structs.SearchHighlight{
+		{Offset: 6, Length: 7},
+		{Offset: 0, Length: 7},
+		{Offset: 5, Length: 7},
+		{Offset: 5, Length: 7},
+	}, resp.Highlights[structs.Jobs])
+	require.False(t, resp.Truncations[structs.Jobs])
+
+	resp = search("env", "/")
+	require.Equal(t, []string{"team/service/env", "team/web/env"}, resp.Matches[structs.Jobs])
+
+	resp = search("service/p", "/")
+	require.Equal(t, []string{"team/service/prod"}, resp.Matches[structs.Jobs])
+
+	// Only the start of IDs is matched otherwise
+	resp = search("service", "")
+	require.Equal(t, []string{"serviceless"}, resp.Matches[structs.Jobs])
+}
+
+func TestSearch_segmentIterator_Limit(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	for _, id := range []string{"a/match", "b/other", "c/match", "d/match"} {
+		job := mock.Job()
+		job.ID = id
+		registerJob(s, t, job)
+	}
+
+	matches := func(limit int) ([]string, bool) {
+		iter, err := s.fsm.State().JobsByIDPrefix(nil, structs.DefaultNamespace, "")
+		require.NoError(t, err)
+
+		search := &Search{srv: s}
+		segments := search.newSegmentIterator(iter, "match", "/")
+		segments.limit = limit
+
+		var ids []string
+		for raw := segments.Next(); raw != nil; raw = segments.Next() {
+			ids = append(ids, raw.(*structs.Job).ID)
+		}
+		return ids, segments.limited()
+	}
+
+	// The scan stops at the limit, marking the matches as truncated
+	ids, limited := matches(3)
+	require.Equal(t, []string{"a/match", "c/match"}, ids)
+	require.True(t, limited)
+
+	ids, limited = matches(4)
+	require.Equal(t, []string{"a/match", "c/match", "d/match"}, ids)
+	require.False(t, limited)
+}
+
+func TestSearch_PrefixSearchStream(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	testutil.WaitForLeader(t, s.RPC)
+
+	// Register more jobs than are returned before truncation, and an
+	// evaluation matching the same prefix
+	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb897"
+	var expected []*structs.SearchStreamMatch
+	for i := 0; i < truncateLimit+5; i++ {
+		job := mock.Job()
+		job.ID = fmt.Sprintf("%s%02d", prefix, i)
+		registerJob(s, t, job)
+		if i < truncateLimit {
+			expected = append(expected, &structs.SearchStreamMatch{Context: structs.Jobs, ID: job.ID})
+		}
+	}
+
+	eval := mock.Eval()
+	eval.ID = prefix + "00"
+	require.NoError(t, s.fsm.State().UpsertEvals(structs.MsgTypeTestSetup, 2000, []*structs.Evaluation{eval}))
+	expected = append(expected, &structs.SearchStreamMatch{Context: structs.Evals, ID: eval.ID})
+
+	req := &structs.SearchRequest{
+		Prefix:  prefix,
+		Context: structs.All,
+		QueryOptions: structs.QueryOptions{
+			Region:    "global",
+			Namespace: structs.DefaultNamespace,
+		},
+	}
+
+	handler, err := s.StreamingRpcHandler("Search.PrefixSearchStream")
+	require.NoError(t, err)
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	go handler(p2)
+
+	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+	require.NoError(t, encoder.Encode(req))
+
+	// Drain the stream until it is done
+	decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+	var matches []*structs.SearchStreamMatch
+	var done structs.SearchStreamResponse
+	for {
+		var msg structs.SearchStreamResponse
+		require.NoError(t, decoder.Decode(&msg))
+		require.Nil(t, msg.Error)
+
+		if msg.Done {
+			done = msg
+			break
+		}
+		require.NotNil(t, msg.Match)
+		matches = append(matches, msg.Match)
 	}
+
+	require.Equal(t, expected, matches)
+	require.True(t, done.Truncations[structs.Jobs])
+	require.False(t, done.Truncations[structs.Evals])
+	require.Equal(t, uint64(2000), done.Index)
+
+	// The stream closes after the last message
+	var msg structs.SearchStreamResponse
+	require.Equal(t, io.EOF, decoder.Decode(&msg))
 }
 
-func TestSearch_PrefixSearch_All_LongJob(t *testing.T) {
+func TestSearch_PrefixSearch_Highlight(t *testing.T) {
 	t.Parallel()
 
-	prefix := strings.Repeat("a", 100)
-
 	s, cleanupS := TestServer(t, func(c *Config) {
 		c.NumSchedulers = 0
 	})
@@ -232,35 +1080,33 @@ func TestSearch_PrefixSearch_All_LongJob(t *testing.T) {
 	codec := rpcClient(t, s)
 	testutil.WaitForLeader(t, s.RPC)
 
-	// Register a job and an allocation
-	job := registerMockJob(s, t, prefix, 0)
-	alloc := mockAlloc()
-	alloc.JobID = job.ID
-	summary := mock.JobSummary(alloc.JobID)
-	fsmState := s.fsm.State()
-
-	require.NoError(t, fsmState.UpsertJobSummary(999, summary))
-	require.NoError(t, fsmState.UpsertAllocs(structs.MsgTypeTestSetup, 1000, []*structs.Allocation{alloc}))
+	job := mock.Job()
+	job.ID = "example-job"
+	registerJob(s, t, job)
 
 	req := &structs.SearchRequest{
-		Prefix:  prefix,
-		Context: structs.All,
+		Prefix:    "exam",
+		Context:   structs.Jobs,
+		Highlight: true,
 		QueryOptions: structs.QueryOptions{
 			Region:    "global",
-			Namespace: job.Namespace,
+			Namespace: structs.DefaultNamespace,
 		},
 	}
 
 	var resp structs.SearchResponse
 	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	require.Equal(t, []string{job.ID}, resp.Matches[structs.Jobs])
+	require.Equal(t, []structs.SearchHighlight{{Offset: 0, Length: 4}}, resp.Highlights[structs.Jobs])
 
-	require.Len(t, resp.Matches[structs.Jobs], 1)
-	require.Equal(t, job.ID, resp.Matches[structs.Jobs][0])
-	require.EqualValues(t, jobIndex, resp.Index)
+	// Highlights are omitted unless requested
+	req.Highlight = false
+	resp = structs.SearchResponse{}
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	require.Nil(t, resp.Highlights)
 }
 
-// truncate should limit results to 20
-func TestSearch_PrefixSearch_Truncate(t *testing.T) {
+func TestSearch_PrefixSearch_IncludeIndexes(t *testing.T) {
 	t.Parallel()
 
 	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
@@ -271,29 +1117,60 @@ func TestSearch_PrefixSearch_Truncate(t *testing.T) {
 	defer cleanupS()
 	codec := rpcClient(t, s)
 	testutil.WaitForLeader(t, s.RPC)
+	fsmState := s.fsm.State()
 
-	for counter := 0; counter < 25; counter++ {
-		registerMockJob(s, t, prefix, counter)
-	}
+	for counter := 0; counter < 3; counter++ {
+		job := mock.Job()
+		job.ID = prefix + strconv.Itoa(counter)
+		require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, uint64(jobIndex+counter), job))
+	}
+	eval := mock.Eval()
+	eval.ID = prefix + "0"
+	require.NoError(t, fsmState.UpsertEvals(structs.MsgTypeTestSetup, jobIndex+10, []*structs.Evaluation{eval}))
+
+	// The expected indexes are those of the stored objects
+	expected := make(map[structs.Context]map[string]uint64)
+	expected[structs.Jobs] = make(map[string]uint64)
+	for counter := 0; counter < 3; counter++ {
+		job, err := fsmState.JobByID(nil, structs.DefaultNamespace, prefix+strconv.Itoa(counter))
+		require.NoError(t, err)
+		expected[structs.Jobs][job.ID] = job.ModifyIndex
+	}
+	stored, err := fsmState.EvalByID(nil, eval.ID)
+	require.NoError(t, err)
+	expected[structs.Evals] = map[string]uint64{stored.ID: stored.ModifyIndex}
 
 	req := &structs.SearchRequest{
-		Prefix:  prefix,
-		Context: structs.Jobs,
+		Prefix:         prefix,
+		Context:        structs.All,
+		IncludeIndexes: true,
 		QueryOptions: structs.QueryOptions{
 			Region:    "global",
-			Namespace: "default",
+			Namespace: structs.DefaultNamespace,
 		},
 	}
 
 	var resp structs.SearchResponse
 	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
-
-	require.Len(t, resp.Matches[structs.Jobs], 20)
-	require.True(t, resp.Truncations[structs.Jobs])
-	require.Equal(t, uint64(jobIndex), resp.Index)
+	require.Len(t, resp.Matches[structs.Jobs], 3)
+	require.Equal(t, expected[structs.Jobs], resp.Indexes[structs.Jobs])
+	require.Equal(t, expected[structs.Evals], resp.Indexes[structs.Evals])
+
+	// Matches sorted by recency return the same indexes
+	req.SortByRecent = true
+	var sorted structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &sorted))
+	require.Equal(t, expected[structs.Jobs], sorted.Indexes[structs.Jobs])
+	require.Equal(t, expected[structs.Evals], sorted.Indexes[structs.Evals])
+
+	// Indexes are omitted unless requested
+	req.IncludeIndexes = false
+	resp = structs.SearchResponse{}
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	require.Nil(t, resp.Indexes)
 }
 
-func TestSearch_PrefixSearch_AllWithJob(t *testing.T) {
+func TestSearch_PrefixSearch_IncludeStatus(t *testing.T) {
 	t.Parallel()
 
 	prefix := "aaaaaaaa-e8f7-fd38-c855-ab94ceb8970"
@@ -301,65 +1178,226 @@ func TestSearch_PrefixSearch_AllWithJob(t *testing.T) {
 	s, cleanupS := TestServer(t, func(c *Config) {
 		c.NumSchedulers = 0
 	})
-
 	defer cleanupS()
 	codec := rpcClient(t, s)
 	testutil.WaitForLeader(t, s.RPC)
+	fsmState := s.fsm.State()
 
-	job := registerMockJob(s, t, prefix, 0)
-	eval1 := mock.Eval()
-	eval1.ID = job.ID
-	require.NoError(t, s.fsm.State().UpsertEvals(structs.MsgTypeTestSetup, 2000, []*structs.Evaluation{eval1}))
+	job := mock.Job()
+	job.ID = prefix + "0"
+	require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, jobIndex, job))
+
+	alloc := mock.Alloc()
+	alloc.ID = prefix + "1"
+	alloc.ClientStatus = structs.AllocClientStatusFailed
+	require.NoError(t, fsmState.UpsertJobSummary(jobIndex+1, mock.JobSummary(alloc.JobID)))
+	require.NoError(t, fsmState.UpsertAllocs(structs.MsgTypeTestSetup, jobIndex+2, []*structs.Allocation{alloc}))
+
+	node := mock.Node()
+	node.ID = prefix + "2"
+	node.Status = structs.NodeStatusDown
+	require.NoError(t, fsmState.UpsertNode(structs.MsgTypeTestSetup, jobIndex+3, node))
+
+	eval := mock.Eval()
+	eval.ID = prefix + "3"
+	eval.Status = structs.EvalStatusBlocked
+	require.NoError(t, fsmState.UpsertEvals(structs.MsgTypeTestSetup, jobIndex+4, []*structs.Evaluation{eval}))
+
+	deployment := mock.Deployment()
+	deployment.ID = prefix + "4"
+	deployment.Status = structs.DeploymentStatusPaused
+	require.NoError(t, fsmState.UpsertDeployment(jobIndex+5, deployment))
+
+	storedJob, err := fsmState.JobByID(nil, job.Namespace, job.ID)
+	require.NoError(t, err)
 
 	req := &structs.SearchRequest{
-		Prefix:  prefix,
-		Context: structs.All,
+		Prefix:        prefix,
+		Context:       structs.All,
+		IncludeStatus: true,
 		QueryOptions: structs.QueryOptions{
 			Region:    "global",
-			Namespace: job.Namespace,
+			Namespace: structs.DefaultNamespace,
 		},
 	}
 
+	// Each context returns the status of its objects
+	expected := map[structs.Context]map[string]string{
+		structs.Jobs:        {job.ID: storedJob.Status},
+		structs.Allocs:      {alloc.ID: structs.AllocClientStatusFailed},
+		structs.Nodes:       {node.ID: structs.NodeStatusDown},
+		structs.Evals:       {eval.ID: structs.EvalStatusBlocked},
+		structs.Deployments: {deployment.ID: structs.DeploymentStatusPaused},
+	}
+
 	var resp structs.SearchResponse
 	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	for ctx, statuses := range expected {
+		require.Equal(t, statuses, resp.Statuses[ctx], "context %s", ctx)
+	}
+	require.Empty(t, resp.Statuses[structs.Namespaces])
 
-	require.Len(t, resp.Matches[structs.Jobs], 1)
-	require.Equal(t, job.ID, resp.Matches[structs.Jobs][0])
-	require.Len(t, resp.Matches[structs.Evals], 1)
-	require.Equal(t, eval1.ID, resp.Matches[structs.Evals][0])
+	// Matches sorted by recency return the same statuses
+	req.SortByRecent = true
+	var sorted structs.SearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &sorted))
+	for ctx, statuses := range expected {
+		require.Equal(t, statuses, sorted.Statuses[ctx], "context %s", ctx)
+	}
+
+	// Statuses are omitted unless requested
+	req.IncludeStatus = false
+	resp = structs.SearchResponse{}
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
+	require.Nil(t, resp.Statuses)
 }
 
-func TestSearch_PrefixSearch_Evals(t *testing.T) {
+func TestSearch_getMatchID(t *testing.T) {
 	t.Parallel()
 
-	s, cleanupS := TestServer(t, func(c *Config) {
-		c.NumSchedulers = 0
-	})
+	job := mock.Job()
+	eval := mock.Eval()
+	alloc := mock.Alloc()
+	node := mock.Node()
+	deployment := mock.Deployment()
+	plugin := mock.CSIPlugin()
+	volume := mock.CSIVolume(plugin)
+	policy := mock.ScalingPolicy()
+	ns := mock.Namespace()
+
+	cases := []struct {
+		Context  structs.Context
+		Object   interface{}
+		Expected string
+	}{
+		{structs.Jobs, job, job.ID},
+		{structs.Evals, eval, eval.ID},
+		{structs.Allocs, alloc, alloc.ID},
+		{structs.Nodes, node, node.ID},
+		{structs.Deployments, deployment, deployment.ID},
+		{structs.Plugins, plugin, plugin.ID},
+		{structs.Volumes, volume, volume.ID},
+		{structs.ScalingPolicies, policy, policy.ID},
+		{structs.Namespaces, ns, ns.Name},
+	}
+
+	s := &Search{logger: testlog.HCLogger(t)}
+	for _, c := range cases {
+		t.Run(string(c.Context), func(t *testing.T) {
+			id, ok := s.getMatchID(c.Object)
+			require.True(t, ok)
+			require.Equal(t, c.Expected, id)
+		})
+	}
+
+	// Objects that cannot be matched are skipped
+	_, ok := s.getMatchID(&structs.ACLToken{})
+	require.False(t, ok)
+}
+
+func TestSearch_matchHighlight(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Name     string
+		ID       string
+		Text     string
+		Expected structs.SearchHighlight
+		Match    bool
+	}{
+		{
+			Name:     "prefix",
+			ID:       "example-job",
+			Text:     "exam",
+			Expected: structs.SearchHighlight{Offset: 0, Length: 4},
+			Match:    true,
+		},
+		{
+			Name:     "case insensitive prefix",
+			ID:       "Example-Job",
+			Text:     "eXAMple",
+			Expected: structs.SearchHighlight{Offset: 0, Length: 7},
+			Match:    true,
+		},
+		{
+			Name:     "case insensitive substring",
+			ID:       "example-job",
+			Text:     "JOB",
+			Expected: structs.SearchHighlight{Offset: 8, Length: 3},
+			Match:    true,
+		},
+		{
+			Name:     "multibyte before match",
+			ID:       "größe-Cache",
+			Text:     "cache",
+			Expected: structs.SearchHighlight{Offset: 8, Length: 5},
+			Match:    true,
+		},
+		{
+			// The long s folds to "s" but is two bytes long
+			Name:     "folding changes length",
+			ID:       "maſter",
+			Text:     "MAS",
+			Expected: structs.SearchHighlight{Offset: 0, Length: 4},
+			Match:    true,
+		},
+		{
+			Name:  "no match",
+			ID:    "example-job",
+			Text:  "cache",
+			Match: false,
+		},
+		{
+			Name:  "text longer than id",
+			ID:    "job",
+			Text:  "jobs",
+			Match: false,
+		},
+		{
+			Name:  "empty text",
+			ID:    "job",
+			Text:  "",
+			Match: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			highlight, ok := matchHighlight(tc.ID, tc.Text)
+			require.Equal(t, tc.Match, ok)
+			require.Equal(t, tc.Expected, highlight)
+		})
+	}
+}
+
+func TestSearch_PrefixSearchStream_InvalidContext(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, nil)
 	defer cleanupS()
-	codec := rpcClient(t, s)
 	testutil.WaitForLeader(t, s.RPC)
 
-	eval1 := mock.Eval()
-	require.NoError(t, s.fsm.State().UpsertEvals(structs.MsgTypeTestSetup, 2000, []*structs.Evaluation{eval1}))
+	handler, err := s.StreamingRpcHandler("Search.PrefixSearchStream")
+	require.NoError(t, err)
 
-	prefix := eval1.ID[:len(eval1.ID)-2]
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	go handler(p2)
 
 	req := &structs.SearchRequest{
-		Prefix:  prefix,
-		Context: structs.Evals,
-		QueryOptions: structs.QueryOptions{
-			Region:    "global",
-			Namespace: eval1.Namespace,
-		},
+		Prefix:       "foo",
+		Context:      "bogus",
+		QueryOptions: structs.QueryOptions{Region: "global"},
 	}
+	require.NoError(t, codec.NewEncoder(p1, structs.MsgpackHandle).Encode(req))
 
-	var resp structs.SearchResponse
-	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp))
-
-	require.Len(t, resp.Matches[structs.Evals], 1)
-	require.Equal(t, eval1.ID, resp.Matches[structs.Evals][0])
-	require.False(t, resp.Truncations[structs.Evals])
-	require.Equal(t, uint64(2000), resp.Index)
+	var msg structs.SearchStreamResponse
+	require.NoError(t, codec.NewDecoder(p1, structs.MsgpackHandle).Decode(&msg))
+	require.NotNil(t, msg.Error)
+	require.EqualValues(t, 400, *msg.Error.Code)
+	require.Contains(t, msg.Error.Error(), "context must be one of")
 }
 
 func TestSearch_PrefixSearch_Allocation(t *testing.T) {
@@ -786,6 +1824,95 @@ func TestSearch_PrefixSearch_Namespace(t *testing.T) {
 	require.Equal(t, uint64(2000), resp.Index)
 }
 
+func TestSearch_PrefixSearch_QualifiedNamespace(t *testing.T) {
+	t.Parallel()
+
+	s, root, cleanup := TestACLServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanup()
+
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+	fsmState := s.fsm.State()
+
+	ns := mock.Namespace()
+	require.NoError(t, fsmState.UpsertNamespaces(500, []*structs.Namespace{ns}))
+
+	job1 := mock.Job()
+	job1.ID = "example-default"
+	require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, 502, job1))
+
+	job2 := mock.Job()
+	job2.ID = "example-other"
+	job2.Namespace = ns.Name
+	require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, 504, job2))
+
+	search := func(prefix, namespace, token string) (*structs.SearchResponse, error) {
+		req := &structs.SearchRequest{
+			Prefix:  prefix,
+			Context: structs.Jobs,
+			QueryOptions: structs.QueryOptions{
+				Region:    "global",
+				Namespace: namespace,
+				AuthToken: token,
+			},
+		}
+
+		var resp structs.SearchResponse
+		err := msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp)
+		return &resp, err
+	}
+
+	// Unqualified prefixes search the namespace of the request
+	resp, err := search("example", structs.DefaultNamespace, root.SecretID)
+	require.NoError(t, err)
+	require.Equal(t, []string{job1.ID}, resp.Matches[structs.Jobs])
+
+	// Qualified prefixes search the namespace they name
+	resp, err = search(ns.Name+":example", structs.DefaultNamespace, root.SecretID)
+	require.NoError(t, err)
+	require.Equal(t, []string{job2.ID}, resp.Matches[structs.Jobs])
+
+	resp, err = search("default:example", ns.Name, root.SecretID)
+	require.NoError(t, err)
+	require.Equal(t, []string{job1.ID}, resp.Matches[structs.Jobs])
+
+	// Prefixes that do not start with a namespace name are unqualified
+	resp, err = search("*:example", structs.DefaultNamespace, root.SecretID)
+	require.NoError(t, err)
+	require.Empty(t, resp.Matches[structs.Jobs])
+
+	// IDs containing a colon are found when no namespace is named like the
+	// part before it
+	job3 := mock.Job()
+	job3.ID = "web:api"
+	require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, 506, job3))
+
+	resp, err = search("web:a", structs.DefaultNamespace, root.SecretID)
+	require.NoError(t, err)
+	require.Equal(t, []string{job3.ID}, resp.Matches[structs.Jobs])
+
+	// A namespace the token may not search has no matches, while the
+	// namespace of the request must still be allowed and is searched when
+	// the named namespace does not exist
+	token := mock.CreatePolicyAndToken(t, fsmState, 1001, "default-only",
+		mock.NamespacePolicy(structs.DefaultNamespace, "", []string{acl.NamespaceCapabilityReadJob}))
+
+	resp, err = search("default:example", structs.DefaultNamespace, token.SecretID)
+	require.NoError(t, err)
+	require.Equal(t, []string{job1.ID}, resp.Matches[structs.Jobs])
+
+	for _, prefix := range []string{ns.Name + ":example", "missing:example"} {
+		resp, err = search(prefix, structs.DefaultNamespace, token.SecretID)
+		require.NoError(t, err)
+		require.Empty(t, resp.Matches[structs.Jobs])
+	}
+
+	_, err = search("example", ns.Name, token.SecretID)
+	require.EqualError(t, err, structs.ErrPermissionDenied.Error())
+}
+
 func TestSearch_PrefixSearch_Namespace_ACL(t *testing.T) {
 	t.Parallel()
 
@@ -1112,6 +2239,153 @@ func TestSearch_FuzzySearch_ShortText(t *testing.T) {
 		"fuzzy search query must be at least 5 characters, got 3")
 }
 
+func TestSearch_FuzzySearch_Blocking(t *testing.T) {
+	t.Parallel()
+
+	s, cleanupS := TestServer(t, func(c *Config) {
+		c.NumSchedulers = 0
+	})
+	defer cleanupS()
+	codec := rpcClient(t, s)
+	testutil.WaitForLeader(t, s.RPC)
+	fsmState := s.fsm.State()
+
+	job := mock.Job()
+	job.Name = "my-job"
+	registerJob(s, t, job)
+
+	search := func(minIndex uint64, maxTime time.Duration) (*structs.FuzzySearchResponse, error) {
+		req := &structs.FuzzySearchRequest{
+			Text:    "job",
+			Context: structs.Jobs,
+			QueryOptions: structs.QueryOptions{
+				Region:        "global",
+				Namespace:     structs.DefaultNamespace,
+				MinQueryIndex: minIndex,
+				MaxQueryTime:  maxTime,
+			},
+		}
+
+		var resp structs.FuzzySearchResponse
+		err := msgpackrpc.CallWithCodec(codec, "Search.FuzzySearch", req, &resp)
+		return &resp, err
+	}
+
+	resp, err := search(0, 0)
+	require.NoError(t, err)
+	require.Len(t, resp.Matches[structs.Jobs], 1)
+	index := resp.Index
+
+	// A query with the current index blocks until the index advances past it
+	other := mock.Job()
+	other.Name = "other-job"
+	time.AfterFunc(200*time.Millisecond, func() {
+		require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, index+1000, other))
+	})
+
+	start := time.Now()
+	resp, err = search(index, 5*time.Second)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, index+1000, resp.Index)
+	require.Len(t, resp.Matches[structs.Jobs], 2)
+
+	// A query with a later index than the current one blocks until its max
+	// query time
+	start = time.Now()
+	resp, err = search(index+1000, 300*time.Millisecond)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	require.Equal(t, index+1000, resp.Index)
+	require.Len(t, resp.Matches[structs.Jobs], 2)
+}
+
+func TestSearch_AllowStale(t *testing.T) {
+	t.Parallel()
+
+	s1, cleanupS1 := TestServer(t, func(c *Config) {
+		c.BootstrapExpect = 2
+		c.NumSchedulers = 0
+	})
+	defer cleanupS1()
+	s2, cleanupS2 := TestServer(t, func(c *Config) {
+		c.BootstrapExpect = 2
+		c.NumSchedulers = 0
+	})
+	defer cleanupS2()
+
+	TestJoin(t, s1, s2)
+	testutil.WaitForLeader(t, s1.RPC)
+	testutil.WaitForLeader(t, s2.RPC)
+
+	nonLeader := s1
+	if s1.IsLeader() {
+		nonLeader = s2
+	}
+	codec := rpcClient(t, nonLeader)
+
+	// Write jobs directly to the state of the non-leader, so they are only
+	// matched by queries it runs itself
+	prefix := "aaaaaaaa-e8f7-fd38"
+	ns := mock.Namespace()
+	job := mock.Job()
+	job.ID = prefix + "-job"
+	job.Name = "stale-job"
+	other := mock.Job()
+	other.ID = prefix + "-other"
+	other.Namespace = ns.Name
+	fsmState := nonLeader.fsm.State()
+	require.NoError(t, fsmState.UpsertNamespaces(1000, []*structs.Namespace{ns}))
+	require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, 1001, job))
+	require.NoError(t, fsmState.UpsertJob(structs.MsgTypeTestSetup, 1002, other))
+
+	search := func(namespace string, stale bool) (*structs.SearchResponse, error) {
+		req := &structs.SearchRequest{
+			Prefix:  prefix,
+			Context: structs.Jobs,
+			QueryOptions: structs.QueryOptions{
+				Region:     "global",
+				Namespace:  namespace,
+				AllowStale: stale,
+			},
+		}
+
+		var resp structs.SearchResponse
+		err := msgpackrpc.CallWithCodec(codec, "Search.PrefixSearch", req, &resp)
+		return &resp, err
+	}
+
+	// Stale queries run on the non-leader, within the requested namespace
+	resp, err := search(structs.DefaultNamespace, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{job.ID}, resp.Matches[structs.Jobs])
+
+	resp, err = search(ns.Name, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{other.ID}, resp.Matches[structs.Jobs])
+
+	// Other queries are forwarded to the leader
+	resp, err = search(structs.DefaultNamespace, false)
+	require.NoError(t, err)
+	require.Empty(t, resp.Matches[structs.Jobs])
+
+	// Fuzzy searches also run on the non-leader when stale
+	fuzzy := &structs.FuzzySearchRequest{
+		Text:    "stale",
+		Context: structs.Jobs,
+		QueryOptions: structs.QueryOptions{
+			Region:     "global",
+			Namespace:  structs.DefaultNamespace,
+			AllowStale: true,
+		},
+	}
+	var fuzzyResp structs.FuzzySearchResponse
+	require.NoError(t, msgpackrpc.CallWithCodec(codec, "Search.FuzzySearch", fuzzy, &fuzzyResp))
+	require.Len(t, fuzzyResp.Matches[structs.Jobs], 1)
+	require.Equal(t, job.Name, fuzzyResp.Matches[structs.Jobs][0].ID)
+}
+
 func TestSearch_FuzzySearch_TruncateLimitQuery(t *testing.T) {
 	t.Parallel()
 
@@ -291,6 +291,14 @@ type CSIVolume struct {
 	ModifyIndex uint64
 }
 
+// GetID implements the IDGetter interface, required for search
+func (v *CSIVolume) GetID() string {
+	if v == nil {
+		return ""
+	}
+	return v.ID
+}
+
 // CSIVolListStub is partial representation of a CSI Volume for inclusion in lists
 type CSIVolListStub struct {
 	ID                  string
@@ -936,6 +944,14 @@ type CSIPlugin struct {
 	ModifyIndex uint64
 }
 
+// GetID implements the IDGetter interface, required for search
+func (p *CSIPlugin) GetID() string {
+	if p == nil {
+		return ""
+	}
+	return p.ID
+}
+
 // NewCSIPlugin creates the plugin struct. No side-effects
 func NewCSIPlugin(id string, index uint64) *CSIPlugin {
 	out := &CSIPlugin{
@@ -30,14 +30,27 @@ const (
 	All Context = "all"
 )
 
+// SearchFilter filters the allocations and evaluations matched by a prefix
+// search by whether they are terminal, and so eligible for garbage collection.
+type SearchFilter string
+
+const (
+	// SearchExcludeTerminal excludes terminal allocations and evaluations.
+	SearchExcludeTerminal SearchFilter = "exclude-terminal"
+
+	// SearchOnlyTerminal only includes terminal allocations and evaluations.
+	SearchOnlyTerminal SearchFilter = "only-terminal"
+)
+
 // SearchConfig is used in servers to configure search API options.
 type SearchConfig struct {
 	// FuzzyEnabled toggles whether the FuzzySearch API is enabled. If not
 	// enabled, requests to /v1/search/fuzzy will reply with a 404 response code.
 	FuzzyEnabled bool `hcl:"fuzzy_enabled"`
 
-	// LimitQuery limits the number of objects searched in the FuzzySearch API.
-	// The results are indicated as truncated if the limit is reached.
+	// LimitQuery limits the number of objects searched in the FuzzySearch API,
+	// and in the PrefixSearch API when sorting matches by recency. The results
+	// are indicated as truncated if the limit is reached.
 	//
 	// Lowering this value can reduce resource consumption of Nomad server when
 	// the FuzzySearch API is enabled.
@@ -68,15 +81,41 @@ type SearchResponse struct {
 	// been truncated
 	Truncations map[Context]bool
 
+	// Highlights holds the matched portion of each match, in the same order
+	// as Matches, when requested.
+	Highlights map[Context][]SearchHighlight
+
+	// Indexes holds the modify index of each match by ID, when requested.
+	// Objects that do not track a modify index have an index of zero.
+	Indexes map[Context]map[string]uint64
+
+	// Statuses holds the status of each match by ID, when requested. Only
+	// jobs, allocations, nodes, evaluations and deployments have a status,
+	// which is the client status for allocations.
+	Statuses map[Context]map[string]string
+
 	QueryMeta
 }
 
+// SearchHighlight is the position of the matched portion of a match, as byte
+// offsets into its ID.
+type SearchHighlight struct {
+	// Offset is the byte offset at which the matched portion starts
+	Offset int
+
+	// Length is the length of the matched portion in bytes
+	Length int
+}
+
 // SearchRequest is used to parameterize a request, and returns a
 // list of matches made up of jobs, allocations, evaluations, and/or nodes,
 // along with whether or not the information returned is truncated.
 type SearchRequest struct {
 	// Prefix is what ids are matched to. I.e, if the given prefix were
-	// "a", potential matches might be "abcd" or "aabb"
+	// "a", potential matches might be "abcd" or "aabb". A prefix qualified
+	// with a namespace, such as "default:abcd", searches that namespace in
+	// place of the namespace of the request, and has no matches if the
+	// namespace may not be searched.
 	Prefix string
 
 	// Context is the type that can be matched against. A context can be a job,
@@ -84,9 +123,132 @@ type SearchRequest struct {
 	// matched)
 	Context Context
 
+	// SortByRecent orders the matches of each context by most recently
+	// modified first, rather than by ID.
+	SortByRecent bool
+
+	// Filter optionally excludes terminal allocations and evaluations from
+	// the matches, or only includes them. Other contexts are not filtered.
+	Filter SearchFilter
+
+	// NodeStatus optionally only includes nodes with the given status in the
+	// node matches.
+	NodeStatus string
+
+	// OnlyEligible optionally only includes nodes that are eligible for
+	// scheduling in the node matches.
+	OnlyEligible bool
+
+	// Highlight returns the position of the matched portion of each match.
+	Highlight bool
+
+	// IncludeIndexes returns the modify index of each match, so that clients
+	// caching objects can check whether their copies are stale without
+	// fetching them.
+	IncludeIndexes bool
+
+	// IncludeStatus returns the status of each match, so that clients such
+	// as autocompletion can show it without fetching each match.
+	IncludeStatus bool
+
+	// ExcludeIDs are IDs that are never matched, such as those already shown
+	// to the user. They do not count towards truncation, so excluding the
+	// matches of a truncated response returns the next ones.
+	ExcludeIDs []string
+
+	// Separator matches the prefix against every segment of job IDs split
+	// by it, rather than only against the start of the IDs, so that with a
+	// separator of "/" the prefix "service" matches "team/service/env".
+	// Because the ID prefix index cannot be used, the jobs of the namespace
+	// are scanned, up to a bounded number, and the job matches are marked
+	// as truncated if the scan stops early. Other contexts are still matched
+	// by ID prefix.
+	Separator string
+
 	QueryOptions
 }
 
+// SearchStreamMatch is a single match streamed by Search.PrefixSearchStream.
+type SearchStreamMatch struct {
+	// Context is the type of the matched object
+	Context Context
+
+	// ID is the matched ID
+	ID string
+
+	// Highlight is the position of the matched portion of the ID, when
+	// requested.
+	Highlight *SearchHighlight
+
+	// ModifyIndex is the modify index of the matched object, when requested.
+	ModifyIndex uint64
+}
+
+// SearchStreamResponse is a message of a prefix search stream. Each message
+// holds either a single match, an error, or marks the end of the stream once
+// every context has been searched.
+type SearchStreamResponse struct {
+	// Match is the next match, in the order of the contexts searched and then
+	// of the matches of each context.
+	Match *SearchStreamMatch
+
+	// Done is set on the last message of a successful stream, which holds the
+	// truncations and index of the search.
+	Done bool
+
+	// Truncations indicates whether the matches for a particular Context have
+	// been truncated
+	Truncations map[Context]bool
+
+	// Index is the maximum index of the searched contexts
+	Index uint64
+
+	// Error is set if the search failed
+	Error *RpcError
+}
+
+// SearchSummariesRequest is used to summarize objects of a context by ID, such
+// as the matches of a prefix search, in a single request.
+type SearchSummariesRequest struct {
+	// Context is the type of the objects, which must be jobs, allocations,
+	// nodes, evaluations or deployments.
+	Context Context
+
+	// IDs are the IDs of the objects to summarize. Jobs are looked up in the
+	// namespace of the request.
+	IDs []string
+
+	QueryOptions
+}
+
+// SearchSummary is a compact summary of an object for list views.
+type SearchSummary struct {
+	ID string
+
+	// Name is the name of jobs, allocations and nodes, and is empty for
+	// evaluations and deployments.
+	Name string
+
+	// Namespace is the namespace of the object, and is empty for nodes.
+	Namespace string
+
+	// Status is the status of the object, which is the client status for
+	// allocations.
+	Status string
+
+	ModifyIndex uint64
+}
+
+// SearchSummariesResponse is used to return the summaries of objects.
+type SearchSummariesResponse struct {
+	// Summaries are the summaries of the objects in the order of the
+	// requested IDs. Objects that do not exist or may not be read are
+	// omitted.
+	Summaries []*SearchSummary
+
+	QueryMeta
+}
+
 // FuzzyMatch is used to describe the ID of an object which may be a machine
 // readable UUID or a human readable Name. If the object is a component of a Job,
 // the Scope is a list of IDs starting from Namespace down to the parent object of
@@ -1961,6 +1961,14 @@ type Node struct {
 	ModifyIndex uint64
 }
 
+// GetID implements the IDGetter interface, required for search
+func (n *Node) GetID() string {
+	if n == nil {
+		return ""
+	}
+	return n.ID
+}
+
 // Sanitize returns a copy of the Node omitting confidential fields
 // It only returns a copy if the Node contains the confidential fields
 func (n *Node) Sanitize() *Node {
@@ -4164,6 +4172,14 @@ type Job struct {
 	JobModifyIndex uint64
 }
 
+// GetID implements the IDGetter interface, required for search
+func (j *Job) GetID() string {
+	if j == nil {
+		return ""
+	}
+	return j.ID
+}
+
 // NamespacedID returns the namespaced id useful for logging
 func (j *Job) NamespacedID() NamespacedID {
 	return NamespacedID{
@@ -4953,11 +4969,25 @@ type Namespace struct {
 	ModifyIndex uint64
 }
 
+// GetID implements the IDGetter interface, required for search. Namespaces
+// are identified by their name.
+func (n *Namespace) GetID() string {
+	if n == nil {
+		return ""
+	}
+	return n.Name
+}
+
+// ValidNamespaceName returns whether name is a valid name for a namespace.
+func ValidNamespaceName(name string) bool {
+	return validNamespaceName.MatchString(name)
+}
+
 func (n *Namespace) Validate() error {
 	var mErr multierror.Error
 
 	// Validate the name and description
-	if !validNamespaceName.MatchString(n.Name) {
+	if !ValidNamespaceName(n.Name) {
 		err := fmt.Errorf("invalid name %q. Must match regex %s", n.Name, validNamespaceName)
 		mErr.Errors = append(mErr.Errors, err)
 	}
@@ -5494,6 +5524,14 @@ type ScalingPolicy struct {
 	ModifyIndex uint64
 }
 
+// GetID implements the IDGetter interface, required for search
+func (p *ScalingPolicy) GetID() string {
+	if p == nil {
+		return ""
+	}
+	return p.ID
+}
+
 // JobKey returns a key that is unique to a job-scoped target, useful as a map
 // key. This uses the policy type, plus target (group and task).
 func (p *ScalingPolicy) JobKey() string {
@@ -9353,6 +9391,14 @@ type Allocation struct {
 	ModifyTime int64
 }
 
+// GetID implements the IDGetter interface, required for search
+func (a *Allocation) GetID() string {
+	if a == nil {
+		return ""
+	}
+	return a.ID
+}
+
 // ConsulNamespace returns the Consul namespace of the task group associated
 // with this allocation.
 func (a *Allocation) ConsulNamespace() string {
@@ -583,6 +583,24 @@ type ExecTaskStreamingRawDriver interface {
 		stream ExecTaskStream) error
 }
 
+// TaskLogsDriver is an optional interface for drivers that keep the logs of
+// their tasks outside of the log files in the alloc dir, such as in a journal.
+//
+// It is not part of the driver plugin protocol, so only drivers running in the
+// client's process, such as internal drivers, can provide it. Nomad client
+// streams the logs of tasks of such drivers through it; the logs of tasks of
+// external driver plugins are always read from the log files.
+type TaskLogsDriver interface {
+	// TaskLogs returns a reader of the logs of the given type of a task,
+	// starting at the given byte offset into them. Reading at the end of the
+	// logs returns io.EOF, after which logs written later may still be read.
+	TaskLogs(allocID, taskName, logType string, offset int64) (io.ReadCloser, error)
+
+	// TaskLogsSize returns the size in bytes of the logs of the given type
+	// of a task.
+	TaskLogsSize(allocID, taskName, logType string) (int64, error)
+}
+
 // ExecTaskStream represents a stream of exec streaming messages,
 // and is a handle to get stdin and tty size and send back
 // stdout/stderr and exit operations.